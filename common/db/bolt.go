@@ -0,0 +1,616 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const watchBuffer = 256
+
+var (
+	valuesBucket  = []byte("values")
+	indexesBucket = []byte("indexes")
+	metaBucket    = []byte("meta")
+)
+
+// Bolt is an embedded single node Store. The database file is locked by the process and
+// Watch events don't leave it, so all the services using it have to run within that process.
+type Bolt struct {
+	DB *bolt.DB
+	L  *zap.Logger
+
+	watchLock *sync.RWMutex
+	watchers  map[*boltWatcher]bool
+
+	locksLock *sync.Mutex
+	locks     map[string]chan struct{}
+}
+
+type boltWatcher struct {
+	prefix string
+	c      chan *Event
+}
+
+func NewBolt(path string, l *zap.Logger) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{valuesBucket, indexesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{
+		DB:        db,
+		L:         l,
+		watchLock: &sync.RWMutex{},
+		watchers:  map[*boltWatcher]bool{},
+		locksLock: &sync.Mutex{},
+		locks:     map[string]chan struct{}{},
+	}, nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+func lookupMember(value string, id string) []byte {
+	return []byte(value + "\x00" + id)
+}
+
+// bucket returns nested bucket by path or nil if it doesn't exist.
+func bucket(tx *bolt.Tx, path ...[]byte) *bolt.Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+
+		b = b.Bucket(name)
+	}
+
+	return b
+}
+
+func createBucket(tx *bolt.Tx, path ...[]byte) (*bolt.Bucket, error) {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		var err error
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func indexPath(prefix string, kind string, field string) [][]byte {
+	return [][]byte{indexesBucket, []byte(prefix), []byte(kind + ":" + field)}
+}
+
+func boltItem(b *bolt.Bucket, id string) (*Item, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	raw := b.Get([]byte(id))
+	if raw == nil {
+		return nil, nil
+	}
+
+	version, err := decodeVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Item{ID: id, Value: copyBytes(raw), Version: version}, nil
+}
+
+func (b *Bolt) Get(ctx context.Context, prefix string, id string) (*Item, error) {
+	var item *Item
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		item, err = boltItem(bucket(tx, valuesBucket, []byte(prefix)), id)
+		return err
+	})
+
+	return item, err
+}
+
+func (b *Bolt) Scan(ctx context.Context, prefix string, handler func(item *Item) bool) error {
+	return b.DB.View(func(tx *bolt.Tx) error {
+		values := bucket(tx, valuesBucket, []byte(prefix))
+		if values == nil {
+			return nil
+		}
+
+		c := values.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			item, err := boltItem(values, string(k))
+			if err != nil {
+				b.L.Error(
+					"Failed to read value",
+					zap.Error(err),
+					zap.String("prefix", prefix),
+					zap.String("id", string(k)),
+				)
+				continue
+			}
+
+			if !handler(item) {
+				return nil
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *Bolt) List(ctx context.Context, coll *Collection, query *RawQuery) (string, error) {
+	if !coll.hasSort(query.SortBy) {
+		return "", ErrUnknownSort
+	}
+
+	limit := pageLimit(query.Limit)
+	last, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return "", err
+	}
+
+	next := ""
+	err = b.DB.View(func(tx *bolt.Tx) error {
+		idx := bucket(tx, indexPath(coll.Prefix, "sort", query.SortBy)...)
+		values := bucket(tx, valuesBucket, []byte(coll.Prefix))
+		if idx == nil || values == nil {
+			return nil
+		}
+
+		c := idx.Cursor()
+		var k []byte
+
+		if query.Desc {
+			if last == "" {
+				k, _ = c.Last()
+			} else if k, _ = c.Seek([]byte(last)); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		} else {
+			if last == "" {
+				k, _ = c.First()
+			} else if k, _ = c.Seek([]byte(last)); k != nil && string(k) == last {
+				k, _ = c.Next()
+			}
+		}
+
+		accepted := 0
+		for k != nil {
+			member := string(k)
+			item, err := boltItem(values, memberID(member))
+			if err == nil && item != nil && query.Accept(item) {
+				accepted++
+				if accepted == limit {
+					next = encodeCursor(member)
+					return nil
+				}
+			}
+
+			if query.Desc {
+				k, _ = c.Prev()
+			} else {
+				k, _ = c.Next()
+			}
+		}
+
+		return nil
+	})
+
+	return next, err
+}
+
+func (b *Bolt) GetUnique(ctx context.Context, coll *Collection, field string, value string) (*Item, error) {
+	var item *Item
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		idx := bucket(tx, indexPath(coll.Prefix, "unique", field)...)
+		if idx == nil {
+			return nil
+		}
+
+		id := idx.Get([]byte(value))
+		if id == nil {
+			return nil
+		}
+
+		var err error
+		item, err = boltItem(bucket(tx, valuesBucket, []byte(coll.Prefix)), string(id))
+		return err
+	})
+
+	return item, err
+}
+
+func (b *Bolt) GetLookup(ctx context.Context, coll *Collection, field string, value string) ([]*Item, error) {
+	res := []*Item{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		idx := bucket(tx, indexPath(coll.Prefix, "lookup", field)...)
+		values := bucket(tx, valuesBucket, []byte(coll.Prefix))
+		if idx == nil || values == nil {
+			return nil
+		}
+
+		prefix := lookupMember(value, "")
+		c := idx.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			item, err := boltItem(values, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+
+			if item != nil {
+				res = append(res, item)
+			}
+		}
+
+		return nil
+	})
+
+	return res, err
+}
+
+func writeBoltIndexes(tx *bolt.Tx, prefix string, id string, prev *Entries, next *Entries) error {
+	for field, key := range prev.Sort {
+		if next.Sort[field] == key {
+			continue
+		}
+
+		idx, err := createBucket(tx, indexPath(prefix, "sort", field)...)
+		if err != nil {
+			return err
+		}
+
+		if err := idx.Delete([]byte(sortMember(key, id))); err != nil {
+			return err
+		}
+	}
+
+	for field, key := range next.Sort {
+		idx, err := createBucket(tx, indexPath(prefix, "sort", field)...)
+		if err != nil {
+			return err
+		}
+
+		if err := idx.Put([]byte(sortMember(key, id)), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	for field, v := range prev.Unique {
+		if next.Unique[field] == v {
+			continue
+		}
+
+		idx, err := createBucket(tx, indexPath(prefix, "unique", field)...)
+		if err != nil {
+			return err
+		}
+
+		if err := idx.Delete([]byte(v)); err != nil {
+			return err
+		}
+	}
+
+	for field, v := range next.Unique {
+		idx, err := createBucket(tx, indexPath(prefix, "unique", field)...)
+		if err != nil {
+			return err
+		}
+
+		if err := idx.Put([]byte(v), []byte(id)); err != nil {
+			return err
+		}
+	}
+
+	for field, v := range prev.Lookup {
+		if next.Lookup[field] == v {
+			continue
+		}
+
+		idx, err := createBucket(tx, indexPath(prefix, "lookup", field)...)
+		if err != nil {
+			return err
+		}
+
+		if err := idx.Delete(lookupMember(v, id)); err != nil {
+			return err
+		}
+	}
+
+	for field, v := range next.Lookup {
+		idx, err := createBucket(tx, indexPath(prefix, "lookup", field)...)
+		if err != nil {
+			return err
+		}
+
+		if err := idx.Put(lookupMember(v, id), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bolt) Set(ctx context.Context, coll *Collection, id string, value []byte, expected int64) (int64, error) {
+	next, err := coll.entries(id, value)
+	if err != nil {
+		return NoVersion, err
+	}
+
+	var version int64
+	var obj []byte
+	err = b.DB.Update(func(tx *bolt.Tx) error {
+		values, err := createBucket(tx, valuesBucket, []byte(coll.Prefix))
+		if err != nil {
+			return err
+		}
+
+		prevItem, err := boltItem(values, id)
+		if err != nil {
+			return err
+		}
+
+		prev := &Entries{}
+		version = NoVersion
+		if prevItem != nil {
+			version = prevItem.Version
+			if prev, err = coll.entries(id, prevItem.Value); err != nil {
+				return err
+			}
+		}
+
+		if err := checkVersion(id, prevItem != nil, version, expected); err != nil {
+			return err
+		}
+
+		for field, v := range next.Unique {
+			idx := bucket(tx, indexPath(coll.Prefix, "unique", field)...)
+			if idx == nil {
+				continue
+			}
+
+			if owner := idx.Get([]byte(v)); owner != nil && string(owner) != id {
+				return &ConflictError{Field: field, Value: v, ID: string(owner)}
+			}
+		}
+
+		version++
+		if obj, err = encodeVersioned(value, version); err != nil {
+			return err
+		}
+
+		if err := values.Put([]byte(id), obj); err != nil {
+			return err
+		}
+
+		return writeBoltIndexes(tx, coll.Prefix, id, prev, next)
+	})
+
+	if err != nil {
+		return NoVersion, err
+	}
+
+	b.publish(coll.Prefix, &Event{Type: EventSet, ID: id, Value: obj})
+
+	return version, nil
+}
+
+func (b *Bolt) Delete(ctx context.Context, coll *Collection, id string, expected int64) error {
+	deleted := false
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		values := bucket(tx, valuesBucket, []byte(coll.Prefix))
+		prevItem, err := boltItem(values, id)
+		if err != nil {
+			return err
+		}
+
+		if err := checkDelete(prevItem, expected); err != nil || prevItem == nil {
+			return err
+		}
+
+		prev, err := coll.entries(id, prevItem.Value)
+		if err != nil {
+			return err
+		}
+
+		if err := values.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		deleted = true
+		return writeBoltIndexes(tx, coll.Prefix, id, prev, &Entries{})
+	})
+
+	if err == nil && deleted {
+		b.publish(coll.Prefix, &Event{Type: EventDel, ID: id})
+	}
+
+	return err
+}
+
+func (b *Bolt) Reindex(ctx context.Context, coll *Collection) error {
+	versionKey := []byte("index:" + coll.Prefix)
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if string(meta.Get(versionKey)) == indexVersion {
+			return nil
+		}
+
+		b.L.Info("Rebuilding indexes", zap.String("prefix", coll.Prefix))
+
+		indexes := tx.Bucket(indexesBucket)
+		if indexes.Bucket([]byte(coll.Prefix)) != nil {
+			if err := indexes.DeleteBucket([]byte(coll.Prefix)); err != nil {
+				return err
+			}
+		}
+
+		values := bucket(tx, valuesBucket, []byte(coll.Prefix))
+		if values != nil {
+			owners := map[string]map[string]string{}
+			for _, field := range coll.Unique {
+				owners[field] = map[string]string{}
+			}
+
+			err := values.ForEach(func(k, v []byte) error {
+				id := string(k)
+				e, err := coll.entries(id, v)
+				if err != nil {
+					b.L.Error(
+						"Failed to index value",
+						zap.Error(err),
+						zap.String("prefix", coll.Prefix),
+						zap.String("id", id),
+					)
+					return nil
+				}
+
+				for field, uv := range e.Unique {
+					if owner, ok := owners[field][uv]; ok {
+						b.L.Warn(
+							"Unique constraint is violated by stored values",
+							zap.String("prefix", coll.Prefix),
+							zap.String("field", field),
+							zap.String("value", uv),
+							zap.String("owner", owner),
+							zap.String("id", id),
+						)
+						delete(e.Unique, field)
+						continue
+					}
+
+					owners[field][uv] = id
+				}
+
+				return writeBoltIndexes(tx, coll.Prefix, id, &Entries{}, e)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return meta.Put(versionKey, []byte(indexVersion))
+	})
+}
+
+func (b *Bolt) publish(prefix string, event *Event) {
+	b.watchLock.Lock()
+	defer b.watchLock.Unlock()
+
+	for w := range b.watchers {
+		if w.prefix != prefix {
+			continue
+		}
+
+		// Writers hold the lock, so a watcher lagging behind is closed instead of blocking
+		// every write, it has missed the event and has to start over
+		select {
+		case w.c <- event:
+		default:
+			b.L.Warn(
+				"Closed lagging watcher",
+				zap.String("prefix", prefix),
+				zap.String("id", event.ID),
+			)
+
+			delete(b.watchers, w)
+			close(w.c)
+		}
+	}
+}
+
+// Watch buffers up to watchBuffer events, the channel is closed once an event is published
+// while the buffer is full.
+func (b *Bolt) Watch(ctx context.Context, prefix string) (<-chan *Event, error) {
+	w := &boltWatcher{prefix: prefix, c: make(chan *Event, watchBuffer)}
+
+	b.watchLock.Lock()
+	b.watchers[w] = true
+	b.watchLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.watchLock.Lock()
+		defer b.watchLock.Unlock()
+
+		// Might be closed for lagging already
+		if b.watchers[w] {
+			delete(b.watchers, w)
+			close(w.c)
+		}
+	}()
+
+	return w.c, nil
+}
+
+// Lock is process local, ttl is ignored since the holder can't be gone without the process.
+func (b *Bolt) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	b.locksLock.Lock()
+	lock, ok := b.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		b.locks[name] = lock
+	}
+	b.locksLock.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrLockTimeout
+	}
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { <-lock })
+	}, nil
+}
+
+func (b *Bolt) Meta(ctx context.Context, key string, init string) (string, error) {
+	res := init
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if val := meta.Get([]byte(key)); val != nil {
+			res = string(val)
+			return nil
+		}
+
+		return meta.Put([]byte(key), []byte(init))
+	})
+
+	return res, err
+}
+
+func (b *Bolt) Close() error {
+	return b.DB.Close()
+}
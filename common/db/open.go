@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-redis/redis/v8"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/util"
+)
+
+const (
+	BackendRedis = "redis"
+	BackendBolt  = "bolt"
+)
+
+// Backend returns the backend configured by STORE_BACKEND env var.
+func Backend() string {
+	return util.GetStrVarDefault("STORE_BACKEND", BackendRedis)
+}
+
+// Open connects to the Store configured by STORE_BACKEND env var:
+// 'redis' (default) uses REDIS_ENDPOINT, 'bolt' uses BOLT_PATH file. Bolt can't be
+// shared between processes, see Bolt.
+func Open(l *zap.Logger) (Store, error) {
+	switch backend := Backend(); backend {
+	case BackendRedis:
+		return NewRedis(util.GetStrVar("REDIS_ENDPOINT"), l)
+	case BackendBolt:
+		return NewBolt(util.GetStrVar("BOLT_PATH"), l)
+	default:
+		return nil, fmt.Errorf("unknown store backend: %s", backend)
+	}
+}
+
+// IsUnavailable tells whether the error is caused by the store being unreachable rather
+// than by the operation itself, so the operation may succeed once retried.
+func IsUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, redis.ErrClosed) ||
+		errors.Is(err, bolt.ErrDatabaseNotOpen) ||
+		errors.Is(err, bolt.ErrTimeout)
+}
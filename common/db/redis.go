@@ -2,15 +2,23 @@ package db
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/util"
 )
 
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
 type Redis struct {
 	Client *redis.Client
 	L      *zap.Logger
@@ -38,183 +46,574 @@ func NewRedis(endpoint string, l *zap.Logger) (*Redis, error) {
 	return nil, errors.New("failed to connect to redis")
 }
 
-func scanValues[T any](ctx context.Context, prefix string, handler func(x *T) bool) func(r *Redis) error {
-	return func(r *Redis) error {
-		var cursor uint64
-		traversed := map[string]bool{}
+func sortIndexKey(prefix string, field string) string {
+	return "idx:" + prefix + ":sort:" + field
+}
 
-		for {
-			var keys []string
-			var err error
+func uniqueIndexKey(prefix string, field string) string {
+	return "idx:" + prefix + ":unique:" + field
+}
 
-			keys, cursor, err = r.Client.Scan(ctx, cursor, prefix+":*", 0).Result()
+func lookupIndexKey(prefix string, field string, value string) string {
+	return "idx:" + prefix + ":lookup:" + field + ":" + value
+}
 
-			if err != nil {
-				r.L.Error(
-					"Failed to scan redis",
-					zap.Error(err),
-				)
-				return err
-			}
+func indexVersionKey(prefix string) string {
+	return "idx:" + prefix + ":version"
+}
 
-			for _, key := range keys {
-				if traversed[key] {
-					continue
-				}
+func readItem(ctx context.Context, c redis.Cmdable, key string, id string) (*Item, error) {
+	raw, err := c.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
 
-				traversed[key] = true
-				val, err := getValueByKey[T](ctx, key)(r)
-				if err != nil {
-					continue
-				}
+	if err != nil {
+		return nil, err
+	}
 
-				if !handler(val) {
-					return nil
-				}
+	version, err := decodeVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Item{ID: id, Value: raw, Version: version}, nil
+}
+
+func (r *Redis) Get(ctx context.Context, prefix string, id string) (*Item, error) {
+	item, err := readItem(ctx, r.Client, prefix+":"+id, id)
+	if err != nil {
+		r.L.Error(
+			"Failed to get value by key",
+			zap.Error(err),
+			zap.String("key", prefix+":"+id),
+		)
+	}
+
+	return item, err
+}
+
+func (r *Redis) Scan(ctx context.Context, prefix string, handler func(item *Item) bool) error {
+	var cursor uint64
+	traversed := map[string]bool{}
+
+	for {
+		var keys []string
+		var err error
+
+		keys, cursor, err = r.Client.Scan(ctx, cursor, prefix+":*", 0).Result()
+
+		if err != nil {
+			r.L.Error(
+				"Failed to scan redis",
+				zap.Error(err),
+			)
+			return err
+		}
+
+		for _, key := range keys {
+			if traversed[key] {
+				continue
+			}
+
+			traversed[key] = true
+			item, err := readItem(ctx, r.Client, key, strings.TrimPrefix(key, prefix+":"))
+			if err != nil || item == nil {
+				continue
 			}
 
-			if cursor == 0 {
+			if !handler(item) {
 				return nil
 			}
 		}
+
+		if cursor == 0 {
+			return nil
+		}
 	}
 }
 
-func GetValues[T any](ctx context.Context, prefix string) func(r *Redis) ([]*T, error) {
-	return func(r *Redis) ([]*T, error) {
-		res := []*T{}
+func (r *Redis) List(ctx context.Context, coll *Collection, query *RawQuery) (string, error) {
+	if !coll.hasSort(query.SortBy) {
+		return "", ErrUnknownSort
+	}
 
-		err := scanValues(ctx, prefix, func(val *T) bool {
-			res = append(res, val)
-			return true
-		})(r)
+	limit := pageLimit(query.Limit)
+	last, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return "", err
+	}
+
+	idxKey := sortIndexKey(coll.Prefix, query.SortBy)
+	accepted := 0
+
+	for {
+		rng := &redis.ZRangeBy{Min: "-", Max: "+", Count: int64(limit)}
+		var members []string
+
+		if query.Desc {
+			if last != "" {
+				rng.Max = "(" + last
+			}
+			members, err = r.Client.ZRevRangeByLex(ctx, idxKey, rng).Result()
+		} else {
+			if last != "" {
+				rng.Min = "(" + last
+			}
+			members, err = r.Client.ZRangeByLex(ctx, idxKey, rng).Result()
+		}
+
+		if err != nil {
+			r.L.Error(
+				"Failed to read index",
+				zap.Error(err),
+				zap.String("key", idxKey),
+			)
+			return "", err
+		}
+
+		if len(members) == 0 {
+			return "", nil
+		}
+
+		keys := make([]string, 0, len(members))
+		for _, member := range members {
+			keys = append(keys, coll.Prefix+":"+memberID(member))
+		}
+
+		values, err := r.Client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return "", err
+		}
+
+		for i, raw := range values {
+			last = members[i]
+
+			str, ok := raw.(string)
+			if !ok {
+				// Index might be ahead of a concurrent delete
+				continue
+			}
+
+			version, err := decodeVersion([]byte(str))
+			if err != nil {
+				continue
+			}
+
+			if !query.Accept(&Item{ID: memberID(last), Value: []byte(str), Version: version}) {
+				continue
+			}
+
+			accepted++
+			if accepted == limit {
+				return encodeCursor(last), nil
+			}
+		}
+
+		if len(members) < limit {
+			return "", nil
+		}
+	}
+}
+
+func (r *Redis) GetUnique(ctx context.Context, coll *Collection, field string, value string) (*Item, error) {
+	id, err := r.Client.HGet(ctx, uniqueIndexKey(coll.Prefix, field), value).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Get(ctx, coll.Prefix, id)
+}
+
+func (r *Redis) GetLookup(ctx context.Context, coll *Collection, field string, value string) ([]*Item, error) {
+	ids, err := r.Client.SMembers(ctx, lookupIndexKey(coll.Prefix, field, value)).Result()
+	if err != nil {
+		return nil, err
+	}
 
+	res := []*Item{}
+	for _, id := range ids {
+		item, err := r.Get(ctx, coll.Prefix, id)
 		if err != nil {
 			return nil, err
 		}
 
-		return res, nil
+		if item != nil {
+			res = append(res, item)
+		}
+	}
+
+	return res, nil
+}
+
+// retryTx runs the optimistic transaction until it doesn't race with other writers.
+func (r *Redis) retryTx(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < maxTxRetries; i++ {
+		err := r.Client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
 	}
+
+	return ErrTooManyRetries
 }
 
-func getValueByKey[T any](ctx context.Context, key string) func(r *Redis) (*T, error) {
-	return func(r *Redis) (*T, error) {
-		rawVal, err := r.Client.Get(ctx, key).Result()
+func writeIndexes(ctx context.Context, p redis.Pipeliner, prefix string, id string, prev *Entries, next *Entries) {
+	for field, key := range prev.Sort {
+		if next.Sort[field] != key {
+			p.ZRem(ctx, sortIndexKey(prefix, field), sortMember(key, id))
+		}
+	}
+	for field, key := range next.Sort {
+		p.ZAdd(ctx, sortIndexKey(prefix, field), &redis.Z{Member: sortMember(key, id)})
+	}
+
+	for field, v := range prev.Unique {
+		if next.Unique[field] != v {
+			p.HDel(ctx, uniqueIndexKey(prefix, field), v)
+		}
+	}
+	for field, v := range next.Unique {
+		p.HSet(ctx, uniqueIndexKey(prefix, field), v, id)
+	}
+
+	for field, v := range prev.Lookup {
+		if next.Lookup[field] != v {
+			p.SRem(ctx, lookupIndexKey(prefix, field, v), id)
+		}
+	}
+	for field, v := range next.Lookup {
+		p.SAdd(ctx, lookupIndexKey(prefix, field, v), id)
+	}
+}
+
+func (r *Redis) Set(ctx context.Context, coll *Collection, id string, value []byte, expected int64) (int64, error) {
+	key := coll.Prefix + ":" + id
+
+	next, err := coll.entries(id, value)
+	if err != nil {
+		return NoVersion, err
+	}
+
+	watch := []string{key}
+	for field := range next.Unique {
+		watch = append(watch, uniqueIndexKey(coll.Prefix, field))
+	}
+
+	var version int64
+	err = r.retryTx(ctx, func(tx *redis.Tx) error {
+		prevItem, err := readItem(ctx, tx, key, id)
 		if err != nil {
-			if err == redis.Nil {
-				return nil, nil
+			return err
+		}
+
+		prev := &Entries{}
+		if prevItem != nil {
+			version = prevItem.Version
+			if prev, err = coll.entries(id, prevItem.Value); err != nil {
+				return err
 			}
+		} else {
+			version = NoVersion
+		}
 
-			r.L.Error(
-				"Failed to get value by key",
-				zap.Error(err),
-				zap.String("key", key),
-			)
-			return nil, err
+		if err := checkVersion(id, prevItem != nil, version, expected); err != nil {
+			return err
 		}
 
-		var val T
+		for field, v := range next.Unique {
+			owner, err := tx.HGet(ctx, uniqueIndexKey(coll.Prefix, field), v).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
 
-		if err := json.Unmarshal([]byte(rawVal), &val); err != nil {
-			r.L.Error(
-				"Failed to parse redis value",
-				zap.Error(err),
-				zap.String("key", key),
-				zap.String("value", rawVal),
-			)
-			return nil, err
+			if err == nil && owner != id {
+				return &ConflictError{Field: field, Value: v, ID: owner}
+			}
 		}
 
-		return &val, err
+		version++
+		obj, err := encodeVersioned(value, version)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, key, obj, 0)
+			writeIndexes(ctx, p, coll.Prefix, id, prev, next)
+
+			return nil
+		})
+
+		return err
+	}, watch...)
+
+	if err != nil {
+		return NoVersion, err
 	}
-}
 
-func GetValue[T any](ctx context.Context, prefix string, id string) func(r *Redis) (*T, error) {
-	return getValueByKey[T](ctx, prefix+":"+id)
+	return version, nil
 }
 
-func SetValue(ctx context.Context, key string, val interface{}) func(r *Redis) error {
-	return func(r *Redis) error {
-		obj, err := json.Marshal(val)
+func (r *Redis) Delete(ctx context.Context, coll *Collection, id string, expected int64) error {
+	key := coll.Prefix + ":" + id
+
+	return r.retryTx(ctx, func(tx *redis.Tx) error {
+		prevItem, err := readItem(ctx, tx, key, id)
 		if err != nil {
 			return err
 		}
 
-		status := r.Client.Set(ctx, key, string(obj), 0)
-		if err := status.Err(); err != nil {
+		if err := checkDelete(prevItem, expected); err != nil || prevItem == nil {
 			return err
 		}
 
-		return nil
+		prev, err := coll.entries(id, prevItem.Value)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Del(ctx, key)
+			writeIndexes(ctx, p, coll.Prefix, id, prev, &Entries{})
+
+			return nil
+		})
+
+		return err
+	}, key)
+}
+
+func (r *Redis) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var cursor uint64
+	res := []string{}
+
+	for {
+		keys, next, err := r.Client.Scan(ctx, cursor, pattern, 0).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, keys...)
+		cursor = next
+
+		if cursor == 0 {
+			return res, nil
+		}
 	}
 }
 
-func FindValue[T any](ctx context.Context, prefix string, predicate func(x *T) bool) func(r *Redis) (*T, error) {
-	return func(r *Redis) (*T, error) {
-		var res *T
-		err := scanValues(ctx, prefix, func(val *T) bool {
-			if predicate(val) {
-				res = val
-				return false
-			}
+func (r *Redis) Reindex(ctx context.Context, coll *Collection) error {
+	version, err := r.Client.Get(ctx, indexVersionKey(coll.Prefix)).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if version == indexVersion {
+		return nil
+	}
 
+	r.L.Info("Rebuilding indexes", zap.String("prefix", coll.Prefix))
+
+	stale, err := r.scanKeys(ctx, "idx:"+coll.Prefix+":lookup:*")
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]*Entries{}
+	err = r.Scan(ctx, coll.Prefix, func(item *Item) bool {
+		e, err := coll.entries(item.ID, item.Value)
+		if err != nil {
+			r.L.Error(
+				"Failed to index value",
+				zap.Error(err),
+				zap.String("prefix", coll.Prefix),
+				zap.String("id", item.ID),
+			)
 			return true
-		})(r)
+		}
 
-		return res, err
+		entries[item.ID] = e
+		return true
+	})
+	if err != nil {
+		return err
 	}
-}
 
-type SetNotification[T any] struct {
-	Value *T
-}
+	owners := map[string]map[string]string{}
+	for _, field := range coll.Unique {
+		owners[field] = map[string]string{}
+	}
+
+	for id, e := range entries {
+		for field, v := range e.Unique {
+			if owner, ok := owners[field][v]; ok {
+				r.L.Warn(
+					"Unique constraint is violated by stored values",
+					zap.String("prefix", coll.Prefix),
+					zap.String("field", field),
+					zap.String("value", v),
+					zap.String("owner", owner),
+					zap.String("id", id),
+				)
+				delete(e.Unique, field)
+				continue
+			}
 
-type DelNotification struct {
-	Key string
+			owners[field][v] = id
+		}
+	}
+
+	_, err = r.Client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, field := range coll.Sort {
+			p.Del(ctx, sortIndexKey(coll.Prefix, field))
+		}
+
+		for _, field := range coll.Unique {
+			p.Del(ctx, uniqueIndexKey(coll.Prefix, field))
+		}
+
+		if len(stale) > 0 {
+			p.Del(ctx, stale...)
+		}
+
+		for id, e := range entries {
+			writeIndexes(ctx, p, coll.Prefix, id, &Entries{}, e)
+		}
+
+		p.Set(ctx, indexVersionKey(coll.Prefix), indexVersion, 0)
+
+		return nil
+	})
+
+	return err
 }
 
-func Subscribe[T any](ctx context.Context, prefix string) func(r *Redis) <-chan interface{} {
-	return func(r *Redis) <-chan interface{} {
-		topic := "__keyspace@0__:" + prefix + "*"
-		r.L.Info("Subscribe to topic", zap.String("topic", topic))
-		pubsub := r.Client.PSubscribe(ctx, topic)
-		notificationsC := make(chan interface{})
+// Watch relies on keyspace notifications, so redis has to be started with 'notify-keyspace-events KA'.
+func (r *Redis) Watch(ctx context.Context, prefix string) (<-chan *Event, error) {
+	topic := "__keyspace@0__:" + prefix + ":*"
+	r.L.Info("Subscribe to topic", zap.String("topic", topic))
+	pubsub := r.Client.PSubscribe(ctx, topic)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
 
-		go func() {
-			defer close(notificationsC)
-			r.L.Info("Wait for notifications")
+	eventsC := make(chan *Event)
 
-			for msg := range pubsub.Channel() {
-				r.L.Info("New notification", zap.String("channel", msg.Channel))
-				tSlice := strings.SplitN(msg.Channel, ":", 2)
-				if len(tSlice) < 2 {
-					r.L.Error(
-						"Unexpected notification",
-						zap.String("msg", msg.Channel),
-					)
-					continue
-				}
+	go func() {
+		defer close(eventsC)
+		defer pubsub.Close()
 
-				t := msg.Payload
-				if t == "del" {
-					notificationsC <- &DelNotification{msg.Payload}
-					continue
-				}
+		msgC := pubsub.Channel()
+		for {
+			var msg *redis.Message
+			select {
+			case msg = <-msgC:
+			case <-ctx.Done():
+				return
+			}
+
+			if msg == nil {
+				return
+			}
+
+			r.L.Info("New notification", zap.String("channel", msg.Channel))
+			tSlice := strings.SplitN(msg.Channel, ":", 2)
+			if len(tSlice) < 2 {
+				r.L.Error(
+					"Unexpected notification",
+					zap.String("msg", msg.Channel),
+				)
+				continue
+			}
 
-				val, err := getValueByKey[T](ctx, tSlice[1])(r)
+			key := tSlice[1]
+			id := strings.TrimPrefix(key, prefix+":")
+			event := &Event{Type: EventSet, ID: id}
+
+			switch msg.Payload {
+			case "del", "expired", "evicted":
+				event.Type = EventDel
+			case "set":
+				item, err := readItem(ctx, r.Client, key, id)
 				if err != nil {
 					r.L.Error(
 						"Failed to get redis value",
 						zap.Error(err),
-						zap.String("key", msg.Payload),
+						zap.String("key", key),
 					)
 					continue
 				}
 
-				notificationsC <- &SetNotification[T]{val}
+				// Removed right after the update
+				if item == nil {
+					continue
+				}
+
+				event.Value = item.Value
+			default:
+				continue
 			}
-		}()
 
-		return notificationsC
+			select {
+			case eventsC <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return eventsC, nil
+}
+
+func (r *Redis) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	key := "lock:" + name
+	token := util.UUID()
+
+	for {
+		ok, err := r.Client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			break
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ErrLockTimeout
+		}
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := unlockScript.Run(ctx, r.Client, []string{key}, token).Err(); err != nil {
+			r.L.Error(
+				"Failed to release lock",
+				zap.Error(err),
+				zap.String("lock", name),
+			)
+		}
+	}, nil
+}
+
+func (r *Redis) Meta(ctx context.Context, key string, init string) (string, error) {
+	if err := r.Client.SetNX(ctx, key, init, 0).Err(); err != nil {
+		return "", err
 	}
+
+	return r.Client.Get(ctx, key).Result()
+}
+
+func (r *Redis) Close() error {
+	return r.Client.Close()
 }
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+
+	// Bump to force indexes rebuild on the next start.
+	indexVersion = "2"
+
+	maxTxRetries = 16
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+var ErrUnknownSort = errors.New("unknown sort field")
+var ErrConflict = errors.New("conflict")
+var ErrTooManyRetries = errors.New("transaction is retried too many times")
+
+type ConflictError struct {
+	Field string
+	Value string
+	ID    string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s '%s' is already taken by %s", e.Field, e.Value, e.ID)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// SortKey maps a value onto a string which orders lexicographically the same way
+// values have to be ordered. Use NumKey for numeric fields.
+type SortKey[T any] func(x *T) string
+
+// FieldKey extracts an indexed field value, empty values are not indexed.
+type FieldKey[T any] func(x *T) string
+
+// Schema describes how values stored under Prefix are indexed.
+type Schema[T any] struct {
+	Prefix string
+	ID     func(x *T) string
+	Sort   map[string]SortKey[T]
+	// Unique fields point to exactly one value, writes violating it fail with ConflictError.
+	Unique map[string]FieldKey[T]
+	// Lookup fields point to a set of values sharing the field value.
+	Lookup map[string]FieldKey[T]
+
+	once sync.Once
+	coll *Collection
+}
+
+func (s *Schema[T]) entries(val *T) *Entries {
+	res := &Entries{
+		Sort:   map[string]string{},
+		Unique: map[string]string{},
+		Lookup: map[string]string{},
+	}
+
+	for field, key := range s.Sort {
+		res.Sort[field] = key(val)
+	}
+
+	for field, key := range s.Unique {
+		if v := key(val); v != "" {
+			res.Unique[field] = v
+		}
+	}
+
+	for field, key := range s.Lookup {
+		if v := key(val); v != "" {
+			res.Lookup[field] = v
+		}
+	}
+
+	return res
+}
+
+// lookup picks the first of the query lookup fields, by name, which the schema indexes.
+func (s *Schema[T]) lookup(query map[string]string) (string, string, bool) {
+	fields := make([]string, 0, len(query))
+	for field, value := range query {
+		if _, ok := s.Lookup[field]; ok && value != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	if len(fields) == 0 {
+		return "", "", false
+	}
+
+	sort.Strings(fields)
+	return fields[0], query[fields[0]], true
+}
+
+func (s *Schema[T]) collection() *Collection {
+	s.once.Do(func() {
+		s.coll = &Collection{
+			Prefix: s.Prefix,
+			Index: func(id string, raw []byte) (*Entries, error) {
+				var val T
+				if err := json.Unmarshal(raw, &val); err != nil {
+					return nil, err
+				}
+
+				return s.entries(&val), nil
+			},
+		}
+
+		for field := range s.Sort {
+			s.coll.Sort = append(s.coll.Sort, field)
+		}
+
+		for field := range s.Unique {
+			s.coll.Unique = append(s.coll.Unique, field)
+		}
+
+		for field := range s.Lookup {
+			s.coll.Lookup = append(s.coll.Lookup, field)
+		}
+	})
+
+	return s.coll
+}
+
+// Collection returns the untyped schema to write raw values with, e.g. when they're restored.
+func (s *Schema[T]) Collection() *Collection {
+	return s.collection()
+}
+
+func NumKey(v int64) string {
+	return fmt.Sprintf("%020d", v)
+}
+
+func (c *Collection) hasSort(field string) bool {
+	for _, f := range c.Sort {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// entries returns index entries of a raw value, empty ones for a missing value.
+func (c *Collection) entries(id string, raw []byte) (*Entries, error) {
+	if raw == nil {
+		return &Entries{}, nil
+	}
+
+	return c.Index(id, raw)
+}
+
+func sortMember(key string, id string) string {
+	return key + "\x00" + id
+}
+
+func memberID(member string) string {
+	for i := len(member) - 1; i >= 0; i-- {
+		if member[i] == 0 {
+			return member[i+1:]
+		}
+	}
+
+	return member
+}
+
+func encodeCursor(member string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(member))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+
+	return string(raw), nil
+}
+
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+
+	return limit
+}
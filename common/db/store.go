@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrLockTimeout = errors.New("failed to acquire lock")
+
+// Item is a raw stored value.
+type Item struct {
+	ID      string
+	Value   []byte
+	Version int64
+}
+
+type EventType string
+
+const (
+	EventSet EventType = "set"
+	EventDel EventType = "del"
+)
+
+// Event notifies about a value change, Value is empty for deletes.
+type Event struct {
+	Type  EventType
+	ID    string
+	Value []byte
+}
+
+// Entries are index entries of a single value.
+type Entries struct {
+	Sort   map[string]string
+	Unique map[string]string
+	Lookup map[string]string
+}
+
+// Collection is an untyped Schema, see Schema.collection.
+type Collection struct {
+	Prefix string
+	Sort   []string
+	Unique []string
+	Lookup []string
+	Index  func(id string, raw []byte) (*Entries, error)
+}
+
+type RawQuery struct {
+	SortBy string
+	Desc   bool
+	Cursor string
+	Limit  int
+	// Accept decides whether the item makes it into the page.
+	Accept func(item *Item) bool
+}
+
+// Store keeps JSON values grouped by prefix. Every write bumps value resource version
+// and updates value indexes atomically.
+type Store interface {
+	// Get returns nil if there is no such value.
+	Get(ctx context.Context, prefix string, id string) (*Item, error)
+	// Scan walks over all values with the prefix until handler returns false.
+	Scan(ctx context.Context, prefix string, handler func(item *Item) bool) error
+	// List walks over values in the sort index order and returns the cursor of the next page.
+	List(ctx context.Context, coll *Collection, query *RawQuery) (string, error)
+	GetUnique(ctx context.Context, coll *Collection, field string, value string) (*Item, error)
+	GetLookup(ctx context.Context, coll *Collection, field string, value string) ([]*Item, error)
+	// Set writes the value if its stored version equals to expected one and returns the new version.
+	// Use AnyVersion to skip the check and NoVersion to only create.
+	Set(ctx context.Context, coll *Collection, id string, value []byte, expected int64) (int64, error)
+	// Delete removes the value if its stored version equals to expected one. Use AnyVersion
+	// to skip the check, a missing value isn't an error then.
+	Delete(ctx context.Context, coll *Collection, id string, expected int64) error
+	// Reindex rebuilds collection indexes if their layout is outdated.
+	Reindex(ctx context.Context, coll *Collection) error
+	// Watch streams changes of values with the prefix until ctx is done. The channel is also
+	// closed if the watcher can't keep up or the connection is lost, changes might be missed
+	// then, so values have to be listed again.
+	Watch(ctx context.Context, prefix string) (<-chan *Event, error)
+	// Lock blocks until the named lock is acquired or ctx is done. Lock is released
+	// automatically after ttl in case its holder has gone.
+	Lock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error)
+	// Meta returns a plain installation wide setting, initializing it with init value if it's missing.
+	Meta(ctx context.Context, key string, init string) (string, error)
+	Close() error
+}
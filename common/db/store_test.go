@@ -0,0 +1,346 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/util"
+)
+
+type testValue struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Group string `json:"group"`
+	Rank  int64  `json:"rank"`
+}
+
+func testSchema() *Schema[testValue] {
+	return &Schema[testValue]{
+		// Values of every run live under their own prefix, so a shared redis stays usable
+		Prefix: "test-" + util.UUID(),
+		ID:     func(x *testValue) string { return x.Id },
+		Sort: map[string]SortKey[testValue]{
+			"rank": func(x *testValue) string { return NumKey(x.Rank) },
+		},
+		Unique: map[string]FieldKey[testValue]{
+			"name": func(x *testValue) string { return x.Name },
+		},
+		Lookup: map[string]FieldKey[testValue]{
+			"group": func(x *testValue) string { return x.Group },
+		},
+	}
+}
+
+// testStores returns the backends to run the tests against. Redis is tested only if
+// TEST_REDIS_ENDPOINT points to a server started with 'notify-keyspace-events KA'.
+func testStores(t *testing.T) map[string]Store {
+	stores := map[string]Store{}
+
+	b, err := NewBolt(filepath.Join(t.TempDir(), "store.db"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	stores[BackendBolt] = b
+
+	if endpoint := os.Getenv("TEST_REDIS_ENDPOINT"); endpoint != "" {
+		r, err := NewRedis(endpoint, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+		stores[BackendRedis] = r
+	}
+
+	return stores
+}
+
+func forEachStore(t *testing.T, test func(t *testing.T, s Store, schema *Schema[testValue])) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			schema := testSchema()
+			if err := Reindex(context.Background(), schema)(s); err != nil {
+				t.Fatal(err)
+			}
+
+			test(t, s, schema)
+		})
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, schema *Schema[testValue]) {
+		ctx := context.Background()
+		val := &testValue{Id: "a", Name: "a"}
+
+		if err := CreateIndexedValue(ctx, schema, val)(s); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := CreateIndexedValue(ctx, schema, val)(s); !errors.Is(err, ErrConflict) {
+			t.Fatalf("second create: expected conflict, got %v", err)
+		}
+
+		version, err := UpdateIndexedValue(ctx, schema, val, FirstVersion)(s)
+		if err != nil || version != FirstVersion+1 {
+			t.Fatalf("update: expected version %d, got %d, %v", FirstVersion+1, version, err)
+		}
+
+		if _, err := UpdateIndexedValue(ctx, schema, val, FirstVersion)(s); !errors.Is(err, ErrStaleVersion) {
+			t.Fatalf("stale update: expected stale version, got %v", err)
+		}
+
+		got, version, err := GetVersionedValue[testValue](ctx, schema.Prefix, "a")(s)
+		if err != nil || got == nil || version != FirstVersion+1 {
+			t.Fatalf("get: expected version %d, got %v, %d, %v", FirstVersion+1, got, version, err)
+		}
+
+		if err := DelVersionedValue(ctx, schema, "a", FirstVersion)(s); !errors.Is(err, ErrStaleVersion) {
+			t.Fatalf("stale delete: expected stale version, got %v", err)
+		}
+
+		if err := DelVersionedValue(ctx, schema, "a", FirstVersion+1)(s); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := GetValue[testValue](ctx, schema.Prefix, "a")(s); err != nil || got != nil {
+			t.Fatalf("get deleted: expected nil, got %v, %v", got, err)
+		}
+
+		if err := DelVersionedValue(ctx, schema, "a", FirstVersion+1)(s); !errors.Is(err, ErrStaleVersion) {
+			t.Fatalf("delete of missing: expected stale version, got %v", err)
+		}
+
+		if err := DelIndexedValue(ctx, schema, "a")(s); err != nil {
+			t.Fatalf("delete of missing with any version: %v", err)
+		}
+	})
+}
+
+func TestStoreIndexes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, schema *Schema[testValue]) {
+		ctx := context.Background()
+		for _, val := range []*testValue{{Id: "a", Name: "x", Group: "g"}, {Id: "b", Name: "y", Group: "g"}} {
+			if err := CreateIndexedValue(ctx, schema, val)(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		taken := &testValue{Id: "c", Name: "x"}
+		if err := CreateIndexedValue(ctx, schema, taken)(s); !errors.Is(err, ErrConflict) {
+			t.Fatalf("taken name: expected conflict, got %v", err)
+		}
+
+		got, err := GetValueByUnique(ctx, schema, "name", "x")(s)
+		if err != nil || got == nil || got.Id != "a" {
+			t.Fatalf("unique: expected a, got %v, %v", got, err)
+		}
+
+		// Renaming frees the old name and moves the value out of the group
+		if err := SetIndexedValue(ctx, schema, &testValue{Id: "a", Name: "z"})(s); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := GetValueByUnique(ctx, schema, "name", "x")(s); err != nil || got != nil {
+			t.Fatalf("freed name: expected nil, got %v, %v", got, err)
+		}
+
+		group, err := GetValuesByLookup(ctx, schema, "group", "g")(s)
+		if err != nil || len(group) != 1 || group[0].Id != "b" {
+			t.Fatalf("lookup: expected [b], got %v, %v", group, err)
+		}
+
+		if err := DelIndexedValue(ctx, schema, "b")(s); err != nil {
+			t.Fatal(err)
+		}
+
+		if group, err := GetValuesByLookup(ctx, schema, "group", "g")(s); err != nil || len(group) != 0 {
+			t.Fatalf("lookup of deleted: expected none, got %v, %v", group, err)
+		}
+	})
+}
+
+func TestStoreList(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, schema *Schema[testValue]) {
+		ctx := context.Background()
+		for i := 0; i < 7; i++ {
+			val := &testValue{Id: fmt.Sprint("id", i), Name: fmt.Sprint("name", i), Group: fmt.Sprint("g", i%2), Rank: int64(10 - i)}
+			if err := CreateIndexedValue(ctx, schema, val)(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list := func(query *Query[testValue]) []string {
+			ids := []string{}
+			for {
+				page, err := ListValues(ctx, schema, query)(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, val := range page.Items {
+					ids = append(ids, val.Id)
+				}
+
+				if page.Next == "" {
+					return ids
+				}
+
+				query.Cursor = page.Next
+			}
+		}
+
+		cases := []struct {
+			name     string
+			query    *Query[testValue]
+			expected string
+		}{
+			{"asc", &Query[testValue]{SortBy: "rank", Limit: 3}, "[id6 id5 id4 id3 id2 id1 id0]"},
+			{"desc", &Query[testValue]{SortBy: "rank", Desc: true, Limit: 3}, "[id0 id1 id2 id3 id4 id5 id6]"},
+			{
+				"filter",
+				&Query[testValue]{SortBy: "rank", Limit: 2, Filter: func(x *testValue) bool { return x.Group == "g1" }},
+				"[id5 id3 id1]",
+			},
+			{"lookup", &Query[testValue]{SortBy: "rank", Limit: 2, Lookup: map[string]string{"group": "g0"}}, "[id6 id4 id2 id0]"},
+			{
+				"lookup desc",
+				&Query[testValue]{SortBy: "rank", Desc: true, Limit: 2, Lookup: map[string]string{"group": "g0"}},
+				"[id0 id2 id4 id6]",
+			},
+		}
+
+		for _, c := range cases {
+			if ids := fmt.Sprint(list(c.query)); ids != c.expected {
+				t.Errorf("%s: expected %s, got %s", c.name, c.expected, ids)
+			}
+		}
+
+		if _, err := ListValues(ctx, schema, &Query[testValue]{SortBy: "missing"})(s); !errors.Is(err, ErrUnknownSort) {
+			t.Errorf("unknown sort: expected ErrUnknownSort, got %v", err)
+		}
+	})
+}
+
+func TestStoreWatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, schema *Schema[testValue]) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events, err := s.Watch(ctx, schema.Prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := SetIndexedValue(ctx, schema, &testValue{Id: "a", Name: "a"})(s); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := DelIndexedValue(ctx, schema, "a")(s); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []EventType{EventSet, EventDel} {
+			select {
+			case event := <-events:
+				if event.Type != expected || event.ID != "a" {
+					t.Fatalf("expected %s of a, got %s of %s", expected, event.Type, event.ID)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %s event", expected)
+			}
+		}
+	})
+}
+
+func TestStoreLockAndMeta(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, schema *Schema[testValue]) {
+		ctx := context.Background()
+		name := schema.Prefix + "-lock"
+
+		unlock, err := s.Lock(ctx, name, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		if _, err := s.Lock(timeout, name, time.Minute); !errors.Is(err, ErrLockTimeout) {
+			t.Fatalf("held lock: expected ErrLockTimeout, got %v", err)
+		}
+
+		unlock()
+		unlock, err = s.Lock(ctx, name, time.Minute)
+		if err != nil {
+			t.Fatalf("released lock: %v", err)
+		}
+		unlock()
+
+		key := schema.Prefix + "-meta"
+		for _, init := range []string{"first", "second"} {
+			if val, err := s.Meta(ctx, key, init); err != nil || val != "first" {
+				t.Fatalf("meta: expected first, got %s, %v", val, err)
+			}
+		}
+	})
+}
+
+func TestBoltLaggingWatcher(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "store.db"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	schema := testSchema()
+	events, err := b.Watch(ctx, schema.Prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the events, writes must go on once the buffer is full
+	done := make(chan error)
+	go func() {
+		for i := 0; i < watchBuffer+10; i++ {
+			if err := SetIndexedValue(ctx, schema, &testValue{Id: fmt.Sprint(i)})(b); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes are blocked by the watcher")
+	}
+
+	// Buffered events are delivered, then the channel is closed since the rest are missed
+	received := 0
+	for range events {
+		received++
+	}
+
+	if received != watchBuffer {
+		t.Fatalf("expected %d events before the channel is closed, got %d", watchBuffer, received)
+	}
+
+	// Cancelling the closed watcher doesn't close it again
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,367 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+type Query[T any] struct {
+	SortBy string
+	Desc   bool
+	Cursor string
+	Limit  int
+	Filter func(x *T) bool
+	// Lookup restricts the page to values having the lookup field values, they are read
+	// through the lookup index instead of scanning the whole sort index.
+	Lookup map[string]string
+}
+
+type Page[T any] struct {
+	Items []*T
+	Next  string
+}
+
+type SetNotification[T any] struct {
+	Value *T
+}
+
+type DelNotification struct {
+	Key string
+}
+
+func decodeItem[T any](item *Item) (*T, error) {
+	if item == nil {
+		return nil, nil
+	}
+
+	var val T
+	if err := json.Unmarshal(item.Value, &val); err != nil {
+		return nil, fmt.Errorf("failed to parse value %s: %w", item.ID, err)
+	}
+
+	return &val, nil
+}
+
+func GetValue[T any](ctx context.Context, prefix string, id string) func(s Store) (*T, error) {
+	return func(s Store) (*T, error) {
+		val, _, err := GetVersionedValue[T](ctx, prefix, id)(s)
+		return val, err
+	}
+}
+
+// GetVersionedValue returns the value together with its resource version.
+func GetVersionedValue[T any](ctx context.Context, prefix string, id string) func(s Store) (*T, int64, error) {
+	return func(s Store) (*T, int64, error) {
+		item, err := s.Get(ctx, prefix, id)
+		if err != nil || item == nil {
+			return nil, NoVersion, err
+		}
+
+		val, err := decodeItem[T](item)
+		if err != nil {
+			return nil, NoVersion, err
+		}
+
+		return val, item.Version, nil
+	}
+}
+
+func GetValues[T any](ctx context.Context, prefix string) func(s Store) ([]*T, error) {
+	return func(s Store) ([]*T, error) {
+		res := []*T{}
+
+		err := s.Scan(ctx, prefix, func(item *Item) bool {
+			if val, err := decodeItem[T](item); err == nil {
+				res = append(res, val)
+			}
+
+			return true
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+}
+
+func FindValue[T any](ctx context.Context, prefix string, predicate func(x *T) bool) func(s Store) (*T, error) {
+	return func(s Store) (*T, error) {
+		var res *T
+		err := s.Scan(ctx, prefix, func(item *Item) bool {
+			val, err := decodeItem[T](item)
+			if err != nil {
+				return true
+			}
+
+			if predicate(val) {
+				res = val
+				return false
+			}
+
+			return true
+		})
+
+		return res, err
+	}
+}
+
+// ListValues returns a single page of values ordered by one of the schema sort keys.
+// Cursor is an opaque string returned as Page.Next by the previous call.
+func ListValues[T any](ctx context.Context, schema *Schema[T], query *Query[T]) func(s Store) (*Page[T], error) {
+	return func(s Store) (*Page[T], error) {
+		if field, value, ok := schema.lookup(query.Lookup); ok {
+			return listLookup(ctx, schema, query, field, value)(s)
+		}
+
+		page := &Page[T]{Items: []*T{}}
+
+		next, err := s.List(ctx, schema.collection(), &RawQuery{
+			SortBy: query.SortBy,
+			Desc:   query.Desc,
+			Cursor: query.Cursor,
+			Limit:  query.Limit,
+			Accept: func(item *Item) bool {
+				val, err := decodeItem[T](item)
+				if err != nil {
+					return false
+				}
+
+				if query.Filter != nil && !query.Filter(val) {
+					return false
+				}
+
+				page.Items = append(page.Items, val)
+				return true
+			},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		page.Next = next
+
+		return page, nil
+	}
+}
+
+// listLookup is ListValues reading the members of the lookup index, which are expected to be
+// few, and ordering them in memory. Cursors are the same as the ones of the sort index.
+func listLookup[T any](ctx context.Context, schema *Schema[T], query *Query[T], field string, value string) func(s Store) (*Page[T], error) {
+	return func(s Store) (*Page[T], error) {
+		sortKey, ok := schema.Sort[query.SortBy]
+		if !ok {
+			return nil, ErrUnknownSort
+		}
+
+		last, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		vals, err := GetValuesByLookup(ctx, schema, field, value)(s)
+		if err != nil {
+			return nil, err
+		}
+
+		type member struct {
+			key string
+			val *T
+		}
+
+		members := make([]*member, 0, len(vals))
+		for _, val := range vals {
+			if query.Filter != nil && !query.Filter(val) {
+				continue
+			}
+
+			key := sortMember(sortKey(val), schema.ID(val))
+			if last != "" && (query.Desc && key >= last || !query.Desc && key <= last) {
+				continue
+			}
+
+			members = append(members, &member{key: key, val: val})
+		}
+
+		sort.Slice(members, func(i, j int) bool {
+			if query.Desc {
+				return members[i].key > members[j].key
+			}
+
+			return members[i].key < members[j].key
+		})
+
+		page := &Page[T]{Items: []*T{}}
+		limit := pageLimit(query.Limit)
+		for i, m := range members {
+			if i == limit {
+				page.Next = encodeCursor(members[i-1].key)
+				break
+			}
+
+			page.Items = append(page.Items, m.val)
+		}
+
+		return page, nil
+	}
+}
+
+// UpdateIndexedValue writes the value only if its stored resource version equals to version.
+// It returns the new resource version.
+func UpdateIndexedValue[T any](ctx context.Context, schema *Schema[T], val *T, version int64) func(s Store) (int64, error) {
+	return func(s Store) (int64, error) {
+		obj, err := json.Marshal(val)
+		if err != nil {
+			return NoVersion, err
+		}
+
+		return s.Set(ctx, schema.collection(), schema.ID(val), obj, version)
+	}
+}
+
+// SetIndexedValue stores the value regardless of its resource version and updates its indexes
+// in a single transaction.
+func SetIndexedValue[T any](ctx context.Context, schema *Schema[T], val *T) func(s Store) error {
+	return func(s Store) error {
+		_, err := UpdateIndexedValue(ctx, schema, val, AnyVersion)(s)
+		return err
+	}
+}
+
+// CreateIndexedValue is SetIndexedValue which fails with ConflictError if the value already exists.
+func CreateIndexedValue[T any](ctx context.Context, schema *Schema[T], val *T) func(s Store) error {
+	return func(s Store) error {
+		_, err := UpdateIndexedValue(ctx, schema, val, NoVersion)(s)
+		return err
+	}
+}
+
+// ModifyIndexedValue applies mutate to the latest stored value and writes it back with
+// compare-and-set, re-reading and re-applying the mutation if the value was changed meanwhile.
+// Nil value is returned if there is no value with such id.
+func ModifyIndexedValue[T any](ctx context.Context, schema *Schema[T], id string, mutate func(x *T) error) func(s Store) (*T, int64, error) {
+	return func(s Store) (*T, int64, error) {
+		for i := 0; i < maxTxRetries; i++ {
+			val, version, err := GetVersionedValue[T](ctx, schema.Prefix, id)(s)
+			if err != nil || val == nil {
+				return nil, NoVersion, err
+			}
+
+			if err := mutate(val); err != nil {
+				return nil, NoVersion, err
+			}
+
+			version, err = UpdateIndexedValue(ctx, schema, val, version)(s)
+			if errors.Is(err, ErrStaleVersion) {
+				continue
+			}
+
+			if err != nil {
+				return nil, NoVersion, err
+			}
+
+			return val, version, nil
+		}
+
+		return nil, NoVersion, ErrTooManyRetries
+	}
+}
+
+// DelIndexedValue removes the value together with its index entries.
+func DelIndexedValue[T any](ctx context.Context, schema *Schema[T], id string) func(s Store) error {
+	return DelVersionedValue(ctx, schema, id, AnyVersion)
+}
+
+// DelVersionedValue removes the value together with its index entries if its resource
+// version is still the expected one.
+func DelVersionedValue[T any](ctx context.Context, schema *Schema[T], id string, expected int64) func(s Store) error {
+	return func(s Store) error {
+		return s.Delete(ctx, schema.collection(), id, expected)
+	}
+}
+
+// GetValueByUnique returns the value owning the unique field value.
+func GetValueByUnique[T any](ctx context.Context, schema *Schema[T], field string, value string) func(s Store) (*T, error) {
+	return func(s Store) (*T, error) {
+		item, err := s.GetUnique(ctx, schema.collection(), field, value)
+		if err != nil {
+			return nil, err
+		}
+
+		return decodeItem[T](item)
+	}
+}
+
+// GetValuesByLookup returns all values having the lookup field value.
+func GetValuesByLookup[T any](ctx context.Context, schema *Schema[T], field string, value string) func(s Store) ([]*T, error) {
+	return func(s Store) ([]*T, error) {
+		items, err := s.GetLookup(ctx, schema.collection(), field, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res := make([]*T, 0, len(items))
+		for _, item := range items {
+			val, err := decodeItem[T](item)
+			if err != nil {
+				return nil, err
+			}
+
+			res = append(res, val)
+		}
+
+		return res, nil
+	}
+}
+
+// Reindex rebuilds indexes of the schema unless they are already up to date.
+func Reindex[T any](ctx context.Context, schema *Schema[T]) func(s Store) error {
+	return func(s Store) error {
+		return s.Reindex(ctx, schema.collection())
+	}
+}
+
+// Subscribe streams SetNotification and DelNotification of values with the prefix, the channel
+// is closed along with the one of Store.Watch.
+func Subscribe[T any](ctx context.Context, prefix string) func(s Store) (<-chan interface{}, error) {
+	return func(s Store) (<-chan interface{}, error) {
+		events, err := s.Watch(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		notificationsC := make(chan interface{})
+
+		go func() {
+			defer close(notificationsC)
+
+			for event := range events {
+				var notification interface{}
+
+				if event.Type == EventDel {
+					notification = &DelNotification{event.ID}
+				} else {
+					val, err := decodeItem[T](&Item{ID: event.ID, Value: event.Value})
+					if err != nil || val == nil {
+						continue
+					}
+
+					notification = &SetNotification[T]{val}
+				}
+
+				select {
+				case notificationsC <- notification:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		return notificationsC, nil
+	}
+}
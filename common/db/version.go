@@ -0,0 +1,107 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// AnyVersion skips the resource version check on write.
+	AnyVersion int64 = -1
+	// NoVersion expects the value to be absent on write.
+	NoVersion int64 = 0
+	// FirstVersion is the resource version of a just created value.
+	FirstVersion int64 = 1
+)
+
+var ErrStaleVersion = errors.New("stale resource version")
+
+type VersionError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("resource version %d is expected, actual is %d", e.Expected, e.Actual)
+}
+
+func (e *VersionError) Unwrap() error {
+	return ErrStaleVersion
+}
+
+type versionEnvelope struct {
+	ResourceVersion int64 `json:"resource_version"`
+}
+
+// encodeVersioned stores resource version along with the value fields,
+// so readers unaware of versions still see a plain value.
+func encodeVersioned(obj []byte, version int64) ([]byte, error) {
+	if len(obj) < 2 || obj[0] != '{' {
+		return nil, fmt.Errorf("only objects can be versioned: %s", string(obj))
+	}
+
+	head := fmt.Sprintf(`{"resource_version":%d`, version)
+	if len(obj) == 2 {
+		return []byte(head + "}"), nil
+	}
+
+	return append([]byte(head+","), obj[1:]...), nil
+}
+
+func decodeVersion(raw []byte) (int64, error) {
+	var envelope versionEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return NoVersion, err
+	}
+
+	// Values written before versioning was introduced
+	if envelope.ResourceVersion == NoVersion {
+		return FirstVersion, nil
+	}
+
+	return envelope.ResourceVersion, nil
+}
+
+// checkVersion validates expected version against the stored one.
+func checkVersion(id string, exists bool, actual int64, expected int64) error {
+	if expected == NoVersion && exists {
+		return &ConflictError{Field: "id", Value: id, ID: id}
+	}
+
+	if expected != AnyVersion && expected != actual {
+		return &VersionError{Expected: expected, Actual: actual}
+	}
+
+	return nil
+}
+
+// checkDelete checks the version of the value about to be deleted, nil item is a missing one.
+func checkDelete(item *Item, expected int64) error {
+	if expected == AnyVersion {
+		return nil
+	}
+
+	if item == nil {
+		return &VersionError{Expected: expected, Actual: NoVersion}
+	}
+
+	return checkVersion(item.ID, true, item.Version, expected)
+}
+
+// Unversioned returns the value without the resource version stored along with its fields,
+// so it can be written again as a plain value.
+func Unversioned(raw []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	if _, ok := fields["resource_version"]; !ok {
+		return raw, nil
+	}
+
+	delete(fields, "resource_version")
+
+	return json.Marshal(fields)
+}
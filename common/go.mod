@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/google/uuid v1.4.0
+	go.etcd.io/bbolt v1.3.8
 	go.uber.org/zap v1.26.0
 )
 
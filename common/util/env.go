@@ -29,3 +29,20 @@ func GetIntVar(name string) int {
 
 	return v
 }
+
+func GetStrVarDefault(name string, d string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		return d
+	}
+
+	return v
+}
+
+func GetIntVarDefault(name string, d int) int {
+	if os.Getenv(name) == "" {
+		return d
+	}
+
+	return GetIntVar(name)
+}
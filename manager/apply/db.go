@@ -0,0 +1,55 @@
+package apply
+
+import (
+	"context"
+	"time"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+var ownedSchema = &db.Schema[model.Owned]{
+	Prefix: "owned",
+	ID:     func(x *model.Owned) string { return ownedID(x.Kind, x.Name) },
+	Lookup: map[string]db.FieldKey[model.Owned]{
+		"manifest": func(x *model.Owned) string { return x.Manifest },
+	},
+}
+
+func ownedID(kind string, name string) string {
+	return kind + "/" + name
+}
+
+func Reindex(ctx context.Context) error {
+	return db.Reindex(ctx, ownedSchema)(store.Client)
+}
+
+func Collections() []*db.Collection {
+	return []*db.Collection{ownedSchema.Collection()}
+}
+
+// LockManifest keeps the manifest from being applied concurrently.
+func LockManifest(ctx context.Context, manifest string) (func(), error) {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return store.Client.Lock(lctx, "apply:"+manifest, 30*time.Minute)
+}
+
+// GetOwned returns nil if the resource isn't owned by any manifest.
+func GetOwned(ctx context.Context, kind string, name string) (*model.Owned, error) {
+	return db.GetValue[model.Owned](ctx, "owned", ownedID(kind, name))(store.Client)
+}
+
+func GetManifestOwned(ctx context.Context, manifest string) ([]*model.Owned, error) {
+	return db.GetValuesByLookup(ctx, ownedSchema, "manifest", manifest)(store.Client)
+}
+
+func SetOwned(ctx context.Context, owned *model.Owned) error {
+	return db.SetIndexedValue(ctx, ownedSchema, owned)(store.Client)
+}
+
+func DelOwned(ctx context.Context, kind string, name string) error {
+	return db.DelIndexedValue(ctx, ownedSchema, ownedID(kind, name))(store.Client)
+}
@@ -0,0 +1,609 @@
+package apply
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/onpremless/go-client"
+	"github.com/samber/lo"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/endpoint"
+	"github.com/onpremless/opless/manager/lambda"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/upload"
+)
+
+type ApplyService interface {
+	// Apply plans changes bringing the current state to the manifest and runs them unless
+	// it's a dry run. Resources owned by the manifest which are missing from it are deleted
+	// if prune is set. Existing resources no manifest owns fail unless adopt is set, they're
+	// taken over then. Failures are reported per resource.
+	Apply(ctx context.Context, manifest *model.Manifest, dryRun bool, prune bool, adopt bool) (*model.Plan, error)
+}
+
+type service struct {
+	lambdaSvc   lambda.LambdaService
+	endpointSvc endpoint.EndpointService
+	uploadSvc   upload.UploadService
+}
+
+func CreateApplyService(lambdaSvc lambda.LambdaService, endpointSvc endpoint.EndpointService, uploadSvc upload.UploadService) ApplyService {
+	return &service{
+		lambdaSvc:   lambdaSvc,
+		endpointSvc: endpointSvc,
+		uploadSvc:   uploadSvc,
+	}
+}
+
+// step is a planned change along with the spec it brings the resource to.
+type step struct {
+	item *model.PlanItem
+	// spec is recorded as applied once the step succeeds, nil for deletes
+	spec map[string]any
+	run  func(ctx context.Context) error
+}
+
+func fail(st *step, err error) *step {
+	st.item.Status = model.ApplyFailed
+	st.item.Error = err.Error()
+	return st
+}
+
+func (s service) Apply(ctx context.Context, manifest *model.Manifest, dryRun bool, prune bool, adopt bool) (*model.Plan, error) {
+	unlock, err := LockManifest(ctx, manifest.Name)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s is being applied: %w", manifest.Name, err)
+	}
+	defer unlock()
+
+	// Resources are created in dependency order and deleted in the reverse one
+	steps := []*step{}
+	for _, spec := range manifest.Runtimes {
+		steps = append(steps, s.planRuntime(ctx, manifest.Name, spec, adopt))
+	}
+
+	for _, spec := range manifest.Lambdas {
+		steps = append(steps, s.planLambda(ctx, manifest.Name, spec, adopt))
+	}
+
+	for _, spec := range manifest.Endpoints {
+		steps = append(steps, s.planEndpoint(ctx, manifest.Name, spec, adopt))
+	}
+
+	if prune {
+		deletes, err := s.planPrune(ctx, manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, deletes...)
+	}
+
+	plan := &model.Plan{Manifest: manifest.Name, DryRun: dryRun, Items: make([]*model.PlanItem, 0, len(steps))}
+	for _, st := range steps {
+		plan.Items = append(plan.Items, st.item)
+		if st.item.Status == model.ApplyFailed {
+			continue
+		}
+
+		if dryRun {
+			st.item.Status = model.ApplyPlanned
+			continue
+		}
+
+		if err := s.run(ctx, manifest.Name, st); err != nil {
+			fail(st, err)
+			continue
+		}
+
+		st.item.Status = model.ApplySucceeded
+	}
+
+	return plan, nil
+}
+
+func (s service) run(ctx context.Context, manifest string, st *step) error {
+	if st.run != nil {
+		if err := st.run(ctx); err != nil {
+			return err
+		}
+	}
+
+	item := st.item
+	switch {
+	case item.Action == model.ActionDelete:
+		return DelOwned(ctx, item.Kind, item.Name)
+	case item.Action == model.ActionNone && !item.Adopt:
+		return nil
+	default:
+		return SetOwned(ctx, &model.Owned{
+			Kind:      item.Kind,
+			Name:      item.Name,
+			Manifest:  manifest,
+			Spec:      st.spec,
+			AppliedAt: time.Now().UnixMilli(),
+		})
+	}
+}
+
+// owned returns the ownership of the resource, it fails if another manifest owns it.
+func owned(ctx context.Context, manifest string, item *model.PlanItem) (*model.Owned, error) {
+	owned, err := GetOwned(ctx, item.Kind, item.Name)
+	if err != nil || owned == nil {
+		return nil, err
+	}
+
+	item.Owner = owned.Manifest
+	if owned.Manifest != manifest {
+		return nil, fmt.Errorf("%s %s is owned by manifest %s", item.Kind, item.Name, owned.Manifest)
+	}
+
+	return owned, nil
+}
+
+// adopting marks the existing resource no manifest owns to be taken over by the manifest,
+// it fails unless adopt is set.
+func adopting(item *model.PlanItem, prev *model.Owned, adopt bool) error {
+	if prev != nil {
+		return nil
+	}
+
+	if !adopt {
+		return fmt.Errorf("%s %s exists and isn't owned by a manifest, apply with adopt to take it over", item.Kind, item.Name)
+	}
+
+	item.Adopt = true
+	return nil
+}
+
+// checksum identifies the upload content. Presigned uploads have no checksum, so they're
+// identified by id and always considered changed.
+func (s service) checksum(ctx context.Context, id string) (string, error) {
+	upload, err := s.uploadSvc.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	if upload == nil {
+		return "", fmt.Errorf("upload is not found or expired: %s", id)
+	}
+
+	if upload.Checksum == "" {
+		return "upload:" + id, nil
+	}
+
+	return upload.Checksum, nil
+}
+
+func specMap(spec any) (map[string]any, error) {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]any{}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func action(item *model.PlanItem) {
+	if len(item.Changes) == 0 {
+		item.Action = model.ActionNone
+	} else {
+		item.Action = model.ActionUpdate
+	}
+}
+
+func orEmpty(params *model.BuildParams) *model.BuildParams {
+	if params == nil {
+		return &model.BuildParams{}
+	}
+
+	return params
+}
+
+func sameParams(a *model.BuildParams, b *model.BuildParams) bool {
+	a, b = orEmpty(a), orEmpty(b)
+	return a.Target == b.Target && a.Platform == b.Platform && maps.Equal(a.Args, b.Args) && maps.Equal(a.Labels, b.Labels)
+}
+
+func (s service) planRuntime(ctx context.Context, manifest string, spec *model.RuntimeSpec, adopt bool) *step {
+	st := &step{item: &model.PlanItem{Kind: model.KindRuntime, Name: spec.Name}}
+
+	checksum, err := s.checksum(ctx, spec.Dockerfile)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	if st.spec, err = specMap(spec); err != nil {
+		return fail(st, err)
+	}
+	st.spec["dockerfile"] = checksum
+
+	prev, err := owned(ctx, manifest, st.item)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	runtime, err := lambda.GetRuntimeByName(ctx, spec.Name)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	if runtime == nil {
+		st.item.Action = model.ActionCreate
+		st.run = func(ctx context.Context) error {
+			_, _, err := s.lambdaSvc.BootstrapRuntime(ctx, &api.CreateRuntime{Name: spec.Name, Dockerfile: spec.Dockerfile}, spec.Build)
+			return err
+		}
+
+		return st
+	}
+
+	if err := adopting(st.item, prev, adopt); err != nil {
+		return fail(st, err)
+	}
+
+	latest, err := lambda.GetLatestRuntimeVersion(ctx, runtime.Id)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	// Upload checksum and version digest are both sha256 of the Dockerfile
+	if latest == nil || latest.Digest != checksum {
+		st.item.Changes = append(st.item.Changes, "dockerfile")
+	}
+
+	if latest == nil || !sameParams(&latest.Params, spec.Build) {
+		st.item.Changes = append(st.item.Changes, "build")
+	}
+
+	action(st.item)
+	if st.item.Action == model.ActionUpdate {
+		st.run = func(ctx context.Context) error {
+			req := &model.CreateRuntimeVersion{Dockerfile: spec.Dockerfile, Build: orEmpty(spec.Build)}
+			_, _, err := s.lambdaSvc.CreateRuntimeVersion(ctx, runtime.Id, req)
+			return err
+		}
+	}
+
+	return st
+}
+
+func (s service) planLambda(ctx context.Context, manifest string, spec *model.LambdaSpec, adopt bool) *step {
+	st := &step{item: &model.PlanItem{Kind: model.KindLambda, Name: spec.Name}}
+
+	var err error
+	if st.spec, err = specMap(spec); err != nil {
+		return fail(st, err)
+	}
+
+	if spec.Archive != "" {
+		if st.spec["archive"], err = s.checksum(ctx, spec.Archive); err != nil {
+			return fail(st, err)
+		}
+	}
+
+	// Credentials aren't kept in the spec, only whether they change
+	if spec.Image != nil && spec.Image.Auth != nil {
+		raw, err := json.Marshal(spec.Image.Auth)
+		if err != nil {
+			return fail(st, err)
+		}
+
+		hash := sha256.Sum256(raw)
+		st.spec["image"].(map[string]any)["auth"] = "sha256:" + hex.EncodeToString(hash[:])
+	}
+
+	prev, err := owned(ctx, manifest, st.item)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	l, err := lambda.GetLambda(ctx, spec.Name)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	if l == nil {
+		st.item.Action = model.ActionCreate
+		st.run = func(ctx context.Context) error {
+			return s.createLambda(ctx, spec)
+		}
+
+		return st
+	}
+
+	if err := adopting(st.item, prev, adopt); err != nil {
+		return fail(st, err)
+	}
+
+	if spec.Image != nil && l.Runtime != "" {
+		return fail(st, fmt.Errorf("lambda is built from a runtime, it has to be deleted to run a pre-built image"))
+	}
+
+	if spec.Image == nil && l.Runtime == "" {
+		return fail(st, fmt.Errorf("lambda runs a pre-built image, it has to be deleted to be built from a runtime"))
+	}
+
+	if l.LambdaType != spec.Type {
+		st.item.Changes = append(st.item.Changes, "type")
+	}
+
+	if spec.Image != nil {
+		changed, err := imageChanged(ctx, l, spec, prev, st.spec)
+		if err != nil {
+			return fail(st, err)
+		}
+
+		if changed {
+			st.item.Changes = append(st.item.Changes, "image")
+		}
+	} else {
+		changes, err := codeChanges(ctx, l, spec, prev, st.spec)
+		if err != nil {
+			return fail(st, err)
+		}
+
+		st.item.Changes = append(st.item.Changes, changes...)
+	}
+
+	action(st.item)
+	if st.item.Action == model.ActionUpdate {
+		st.run = func(ctx context.Context) error {
+			return s.updateLambda(ctx, spec, st.item.Changes)
+		}
+	}
+
+	return st
+}
+
+// imageChanged compares the image the lambda runs, credentials are compared with the last applied spec.
+func imageChanged(ctx context.Context, l *api.Lambda, spec *model.LambdaSpec, prev *model.Owned, desired map[string]any) (bool, error) {
+	image, err := lambda.GetLambdaImage(ctx, l.Id)
+	if err != nil {
+		return false, err
+	}
+
+	if image == nil || image.Ref != spec.Image.Ref || image.Platform != spec.Image.Platform {
+		return true, nil
+	}
+
+	return prev != nil && !reflect.DeepEqual(prev.Spec["image"], desired["image"]), nil
+}
+
+// codeChanges compares the runtime and build params of the lambda. The code can't be compared
+// with the archive, so it's considered changed unless the last applied archive is the same one.
+func codeChanges(ctx context.Context, l *api.Lambda, spec *model.LambdaSpec, prev *model.Owned, desired map[string]any) ([]string, error) {
+	changes := []string{}
+
+	runtime, err := lambda.GetRuntimeByName(ctx, spec.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	if runtime == nil || runtime.Id != l.Runtime {
+		changes = append(changes, "runtime")
+	}
+
+	if prev == nil || prev.Spec["archive"] != desired["archive"] {
+		changes = append(changes, "archive")
+	}
+
+	overrides, err := lambda.GetLambdaBuildParams(ctx, l.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !sameParams(overrides, spec.Build) {
+		changes = append(changes, "build")
+	}
+
+	return changes, nil
+}
+
+func (s service) createLambda(ctx context.Context, spec *model.LambdaSpec) error {
+	if spec.Image != nil {
+		_, err := s.lambdaSvc.RegisterImage(ctx, &api.CreateLambda{Name: spec.Name, LambdaType: spec.Type}, spec.Image)
+		return err
+	}
+
+	runtime, err := lambda.GetRuntimeByName(ctx, spec.Runtime)
+	if err != nil {
+		return err
+	}
+
+	if runtime == nil {
+		return fmt.Errorf("runtime is not found: %s", spec.Runtime)
+	}
+
+	cLambda := &api.CreateLambda{Name: spec.Name, Runtime: runtime.Id, Archive: spec.Archive, LambdaType: spec.Type}
+	_, err = s.lambdaSvc.BootstrapLambda(ctx, cLambda, spec.Build)
+	return err
+}
+
+func (s service) updateLambda(ctx context.Context, spec *model.LambdaSpec, changes []string) error {
+	req := &model.UpdateLambda{}
+	for _, change := range changes {
+		switch change {
+		case "type":
+			req.LambdaType = spec.Type
+		case "archive":
+			req.Archive = spec.Archive
+		case "build":
+			req.Build = orEmpty(spec.Build)
+		case "image":
+			req.Image = spec.Image
+		case "runtime":
+			// Runtime might be created by the same apply
+			runtime, err := lambda.GetRuntimeByName(ctx, spec.Runtime)
+			if err != nil {
+				return err
+			}
+
+			if runtime == nil {
+				return fmt.Errorf("runtime is not found: %s", spec.Runtime)
+			}
+
+			req.Runtime = runtime.Id
+		}
+	}
+
+	_, err := s.lambdaSvc.UpdateLambda(ctx, spec.Name, req)
+	return err
+}
+
+func (s service) planEndpoint(ctx context.Context, manifest string, spec *model.EndpointSpec, adopt bool) *step {
+	st := &step{item: &model.PlanItem{Kind: model.KindEndpoint, Name: spec.Path}}
+
+	var err error
+	if st.spec, err = specMap(spec); err != nil {
+		return fail(st, err)
+	}
+
+	prev, err := owned(ctx, manifest, st.item)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	e, err := endpoint.GetEndpointByPath(ctx, spec.Path)
+	if err != nil {
+		return fail(st, err)
+	}
+
+	req := &api.CreateEndpoint{Name: spec.Name, Path: spec.Path, Lambda: spec.Lambda}
+	if e == nil {
+		st.item.Action = model.ActionCreate
+		st.run = func(ctx context.Context) error {
+			_, err := s.endpointSvc.Create(ctx, req)
+			return err
+		}
+
+		return st
+	}
+
+	if err := adopting(st.item, prev, adopt); err != nil {
+		return fail(st, err)
+	}
+
+	if e.Name != spec.Name {
+		st.item.Changes = append(st.item.Changes, "name")
+	}
+
+	if e.Lambda != spec.Lambda {
+		st.item.Changes = append(st.item.Changes, "lambda")
+	}
+
+	action(st.item)
+	if st.item.Action == model.ActionUpdate {
+		st.run = func(ctx context.Context) error {
+			_, _, err := s.endpointSvc.Update(ctx, e.Id, req, db.AnyVersion)
+			return err
+		}
+	}
+
+	return st
+}
+
+var kindOrder = map[string]int{model.KindEndpoint: 0, model.KindLambda: 1, model.KindRuntime: 2}
+
+// planPrune deletes resources owned by the manifest which are missing from it, dependents go first.
+func (s service) planPrune(ctx context.Context, manifest *model.Manifest) ([]*step, error) {
+	desired := map[string]bool{}
+	for _, spec := range manifest.Runtimes {
+		desired[ownedID(model.KindRuntime, spec.Name)] = true
+	}
+
+	for _, spec := range manifest.Lambdas {
+		desired[ownedID(model.KindLambda, spec.Name)] = true
+	}
+
+	for _, spec := range manifest.Endpoints {
+		desired[ownedID(model.KindEndpoint, spec.Path)] = true
+	}
+
+	owned, err := GetManifestOwned(ctx, manifest.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	owned = lo.Filter(owned, func(o *model.Owned, _ int) bool { return !desired[ownedID(o.Kind, o.Name)] })
+	sort.Slice(owned, func(i, j int) bool {
+		if owned[i].Kind != owned[j].Kind {
+			return kindOrder[owned[i].Kind] < kindOrder[owned[j].Kind]
+		}
+
+		return owned[i].Name < owned[j].Name
+	})
+
+	steps := make([]*step, 0, len(owned))
+	for _, o := range owned {
+		o := o
+		steps = append(steps, &step{
+			item: &model.PlanItem{Kind: o.Kind, Name: o.Name, Action: model.ActionDelete, Owner: o.Manifest},
+			run: func(ctx context.Context) error {
+				return s.delete(ctx, o)
+			},
+		})
+	}
+
+	return steps, nil
+}
+
+// delete removes the resource, the one which is already gone is only disowned.
+func (s service) delete(ctx context.Context, o *model.Owned) error {
+	switch o.Kind {
+	case model.KindEndpoint:
+		e, err := endpoint.GetEndpointByPath(ctx, o.Name)
+		if err != nil || e == nil {
+			return err
+		}
+
+		return s.endpointSvc.Delete(ctx, e.Id, db.AnyVersion)
+	case model.KindLambda:
+		l, err := lambda.GetLambda(ctx, o.Name)
+		if err != nil || l == nil {
+			return err
+		}
+
+		// Endpoints are created under the same lock, so none appears until the lambda is gone
+		unlock, err := lambda.LockRefs(ctx, model.KindLambda, l.Id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		endpoints, err := endpoint.GetLambdaEndpoints(ctx, l.Id)
+		if err != nil {
+			return err
+		}
+
+		if len(endpoints) > 0 {
+			paths := lo.Map(endpoints, func(e *api.Endpoint, _ int) string { return e.Path })
+			return fmt.Errorf("lambda is used by endpoints: %s", strings.Join(paths, ", "))
+		}
+
+		return s.lambdaSvc.DeleteLambda(ctx, l.Id)
+	case model.KindRuntime:
+		runtime, err := lambda.GetRuntimeByName(ctx, o.Name)
+		if err != nil || runtime == nil {
+			return err
+		}
+
+		return s.lambdaSvc.DeleteRuntime(ctx, runtime.Id)
+	default:
+		return fmt.Errorf("unknown kind: %s", o.Kind)
+	}
+}
@@ -0,0 +1,44 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidArchive = errors.New("invalid archive")
+
+type Reason string
+
+const (
+	ReasonUnsupportedType Reason = "unsupported_type"
+	ReasonCorrupt         Reason = "corrupt"
+	ReasonArchiveTooLarge Reason = "archive_too_large"
+	ReasonTooLarge        Reason = "too_large"
+	ReasonTooManyFiles    Reason = "too_many_files"
+	ReasonTooDeep         Reason = "too_deep"
+	ReasonInvalidPath     Reason = "invalid_path"
+	ReasonPathTraversal   Reason = "path_traversal"
+	ReasonLink            Reason = "link"
+	ReasonSpecialFile     Reason = "special_file"
+	ReasonEmpty           Reason = "empty"
+)
+
+// ValidationError describes the first archive entry violating extraction limits.
+type ValidationError struct {
+	Reason Reason `json:"reason"`
+	// Path of the offending entry, empty if the archive itself is rejected
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid archive: %s", e.Detail)
+	}
+
+	return fmt.Sprintf("invalid archive entry '%s': %s", e.Path, e.Detail)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidArchive
+}
@@ -0,0 +1,298 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/klauspost/compress/zip"
+	"github.com/mholt/archiver/v3"
+)
+
+var errBudget = errors.New("extraction size limit is exceeded")
+
+// budget is shared by all files of the archive, so the limit applies to their total size.
+type budget struct {
+	left int64
+}
+
+// budgetReader keeps the read error of the entry, so a broken entry is told apart from
+// a failure of the consumer.
+type budgetReader struct {
+	r      io.Reader
+	b      *budget
+	broken error
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	if r.b.left < 0 {
+		return 0, errBudget
+	}
+
+	n, err := r.r.Read(p)
+	r.b.left -= int64(n)
+	if r.b.left < 0 {
+		return n, errBudget
+	}
+
+	if err != nil && err != io.EOF {
+		r.broken = err
+	}
+
+	return n, err
+}
+
+// archiveReader enforces the archive size limit on the raw stream, exceeded is kept since
+// archive readers don't preserve the errors of the underlying stream.
+type archiveReader struct {
+	r        io.Reader
+	left     int64
+	exceeded bool
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		r.exceeded = true
+		return n, errArchiveTooLarge
+	}
+
+	return n, err
+}
+
+var errArchiveTooLarge = errors.New("archive size limit is exceeded")
+
+// detectSize is the number of leading bytes the archive type is detected by.
+const detectSize = 3072
+
+// Extract validates the archive read from r against limits and calls fn for every regular file
+// of the archive in order, mode is the permission bits of the file. Files are never written to disk, fn has to consume r before returning.
+// Limits are enforced while the archive is streamed and violations are reported with
+// ValidationError as soon as they're encountered.
+func Extract(r io.Reader, limits *Limits, fn func(name string, r io.Reader, size int64, mode os.FileMode) error) error {
+	in := &archiveReader{r: r, left: limits.MaxArchiveSize}
+	tooLarge := &ValidationError{
+		Reason: ReasonArchiveTooLarge,
+		Detail: fmt.Sprintf("archive is larger than %d bytes", limits.MaxArchiveSize),
+	}
+
+	head := bufio.NewReaderSize(in, detectSize)
+	peek, err := head.Peek(detectSize)
+	if in.exceeded {
+		return tooLarge
+	}
+
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	mime, err := detect(peek, limits)
+	if err != nil {
+		return err
+	}
+
+	reader := readers[mime]()
+	if mime == zipType {
+		// Zip needs random access, so the archive is spooled, but never unpacked
+		spool, size, err := spoolArchive(head)
+		if in.exceeded {
+			return tooLarge
+		}
+
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		err = reader.Open(spool, size)
+		if err != nil {
+			return &ValidationError{Reason: ReasonCorrupt, Detail: err.Error()}
+		}
+	} else if err := reader.Open(head, -1); err != nil {
+		return &ValidationError{Reason: ReasonCorrupt, Detail: err.Error()}
+	}
+	defer reader.Close()
+
+	b := &budget{left: limits.MaxSize}
+	files := 0
+	for {
+		f, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if in.exceeded {
+			return tooLarge
+		}
+
+		if err != nil {
+			return &ValidationError{Reason: ReasonCorrupt, Detail: err.Error()}
+		}
+
+		err = check(f, limits, b, &files, fn)
+		f.Close()
+
+		if in.exceeded {
+			return tooLarge
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if files == 0 {
+		return &ValidationError{Reason: ReasonEmpty, Detail: "archive contains no files"}
+	}
+
+	return nil
+}
+
+func spoolArchive(r io.Reader) (*os.File, int64, error) {
+	spool, err := os.CreateTemp("", "opless-archive-")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, 0, err
+	}
+
+	return spool, size, nil
+}
+
+// detect picks the archive type by the leading bytes, the archive type has to be allowed
+// itself or to be based on an allowed one, like jar is based on zip.
+func detect(head []byte, limits *Limits) (string, error) {
+	mime := mimetype.Detect(head)
+	for m := mime; m != nil; m = m.Parent() {
+		for t := range readers {
+			if m.Is(t) && limits.allows(t) {
+				return t, nil
+			}
+		}
+	}
+
+	return "", &ValidationError{
+		Reason: ReasonUnsupportedType,
+		Detail: fmt.Sprintf("'%s' archives are not allowed", mime.String()),
+	}
+}
+
+// entryName returns the full path of the entry, File.Name is only its base name.
+func entryName(f archiver.File) string {
+	switch h := f.Header.(type) {
+	case zip.FileHeader:
+		return h.Name
+	case *tar.Header:
+		return h.Name
+	}
+
+	return f.Name()
+}
+
+func check(f archiver.File, limits *Limits, b *budget, files *int, fn func(name string, r io.Reader, size int64, mode os.FileMode) error) error {
+	name := entryName(f)
+
+	if h, ok := f.Header.(*tar.Header); ok {
+		switch h.Typeflag {
+		case tar.TypeXGlobalHeader:
+			return nil
+		case tar.TypeSymlink, tar.TypeLink:
+			return &ValidationError{Reason: ReasonLink, Path: name, Detail: "links are not allowed"}
+		}
+	}
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		return &ValidationError{Reason: ReasonLink, Path: name, Detail: "links are not allowed"}
+	}
+
+	if f.IsDir() {
+		return nil
+	}
+
+	if !f.Mode().IsRegular() {
+		return &ValidationError{Reason: ReasonSpecialFile, Path: name, Detail: "only regular files are allowed"}
+	}
+
+	clean, err := cleanPath(name, limits)
+	if err != nil {
+		return err
+	}
+
+	*files++
+	if *files > limits.MaxFiles {
+		return &ValidationError{
+			Reason: ReasonTooManyFiles,
+			Path:   name,
+			Detail: fmt.Sprintf("archive contains more than %d files", limits.MaxFiles),
+		}
+	}
+
+	tooLarge := &ValidationError{
+		Reason: ReasonTooLarge,
+		Path:   name,
+		Detail: fmt.Sprintf("files are larger than %d bytes in total", limits.MaxSize),
+	}
+
+	// Declared size might be forged, so it's only a shortcut for honest archives
+	if f.Size() > b.left {
+		return tooLarge
+	}
+
+	// Zip rejects entries larger than declared, which is reported as corruption
+	br := &budgetReader{r: f, b: b}
+	err = fn(clean, br, f.Size(), f.Mode().Perm())
+	if b.left < 0 {
+		return tooLarge
+	}
+
+	if err != nil && br.broken != nil {
+		return &ValidationError{Reason: ReasonCorrupt, Path: name, Detail: br.broken.Error()}
+	}
+
+	return err
+}
+
+// cleanPath returns slash separated path of the entry relative to the archive root.
+func cleanPath(name string, limits *Limits) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") {
+		return "", &ValidationError{Reason: ReasonInvalidPath, Path: name, Detail: "path is malformed"}
+	}
+
+	if strings.HasPrefix(name, "/") {
+		return "", &ValidationError{Reason: ReasonPathTraversal, Path: name, Detail: "absolute paths are not allowed"}
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", &ValidationError{Reason: ReasonPathTraversal, Path: name, Detail: "parent directory references are not allowed"}
+		}
+	}
+
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", &ValidationError{Reason: ReasonInvalidPath, Path: name, Detail: "path is empty"}
+	}
+
+	if depth := strings.Count(clean, "/") + 1; depth > limits.MaxDepth {
+		return "", &ValidationError{
+			Reason: ReasonTooDeep,
+			Path:   name,
+			Detail: fmt.Sprintf("path is deeper than %d levels", limits.MaxDepth),
+		}
+	}
+
+	return clean, nil
+}
@@ -0,0 +1,265 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	name     string
+	body     string
+	typeflag byte
+	mode     os.FileMode
+	// size is the declared size of a zip entry, the body length if it's 0
+	size uint64
+}
+
+func tarArchive(t *testing.T, entries ...entry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: e.typeflag}
+		switch e.typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = "target"
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.body))
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries ...entry) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		hdr.SetMode(0o644)
+		if e.mode != 0 {
+			hdr.SetMode(e.mode)
+		}
+
+		var w io.Writer
+		var err error
+		if e.size != 0 {
+			// Stored raw, so the header keeps the forged size
+			hdr.Method = zip.Store
+			hdr.CompressedSize64 = uint64(len(e.body))
+			hdr.UncompressedSize64 = e.size
+			w, err = zw.CreateRaw(hdr)
+		} else {
+			w, err = zw.CreateHeader(hdr)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func testLimits() *Limits {
+	return &Limits{
+		MaxArchiveSize: 1 << 20,
+		MaxSize:        1 << 10,
+		MaxFiles:       3,
+		MaxDepth:       3,
+		AllowedTypes:   []string{zipType, "application/x-tar"},
+	}
+}
+
+func TestExtract(t *testing.T) {
+	file := func(name string) entry { return entry{name: name, body: "x", typeflag: tar.TypeReg} }
+	bomb := strings.Repeat("0", 1<<20)
+
+	cases := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		limits  func(l *Limits)
+		reason  Reason
+		files   []string
+	}{
+		{
+			name: "tar",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, entry{name: "dir/", typeflag: tar.TypeDir}, file("dir/a"), file("./b"))
+			},
+			files: []string{"dir/a", "b"},
+		},
+		{
+			name:    "zip",
+			archive: func(t *testing.T) []byte { return zipArchive(t, file("dir/a"), file("b")) },
+			files:   []string{"dir/a", "b"},
+		},
+		{
+			name:    "type isn't allowed",
+			archive: func(t *testing.T) []byte { return zipArchive(t, file("a")) },
+			limits:  func(l *Limits) { l.AllowedTypes = []string{"application/x-tar"} },
+			reason:  ReasonUnsupportedType,
+		},
+		{
+			name:    "not an archive",
+			archive: func(t *testing.T) []byte { return []byte("plain text") },
+			reason:  ReasonUnsupportedType,
+		},
+		{
+			name: "truncated zip",
+			archive: func(t *testing.T) []byte {
+				z := zipArchive(t, file("a"))
+				return z[:len(z)-30]
+			},
+			reason: ReasonCorrupt,
+		},
+		{
+			name:    "archive is too large",
+			archive: func(t *testing.T) []byte { return tarArchive(t, file("a")) },
+			limits:  func(l *Limits) { l.MaxArchiveSize = 1024 },
+			reason:  ReasonArchiveTooLarge,
+		},
+		{
+			name:    "zip bomb",
+			archive: func(t *testing.T) []byte { return zipArchive(t, entry{name: "bomb", body: bomb}) },
+			reason:  ReasonTooLarge,
+		},
+		{
+			name: "files exceed the budget together",
+			archive: func(t *testing.T) []byte {
+				half := strings.Repeat("0", 600)
+				return tarArchive(t, entry{name: "a", body: half, typeflag: tar.TypeReg}, entry{name: "b", body: half, typeflag: tar.TypeReg})
+			},
+			reason: ReasonTooLarge,
+		},
+		{
+			// Declared size passes the budget shortcut, but zip refuses to read past it
+			name: "forged size",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, entry{name: "forged", body: strings.Repeat("0", 4096), size: 1})
+			},
+			reason: ReasonCorrupt,
+		},
+		{
+			name: "truncated tar",
+			archive: func(t *testing.T) []byte {
+				return tarArchive(t, entry{name: "a", body: strings.Repeat("0", 1000), typeflag: tar.TypeReg})[:1024]
+			},
+			reason: ReasonCorrupt,
+		},
+		{
+			name:    "too many files",
+			archive: func(t *testing.T) []byte { return tarArchive(t, file("a"), file("b"), file("c"), file("d")) },
+			reason:  ReasonTooManyFiles,
+		},
+		{
+			name:    "too deep",
+			archive: func(t *testing.T) []byte { return zipArchive(t, file("a/b/c/d")) },
+			reason:  ReasonTooDeep,
+		},
+		{
+			name:    "backslash",
+			archive: func(t *testing.T) []byte { return zipArchive(t, file("a\\b")) },
+			reason:  ReasonInvalidPath,
+		},
+		{
+			name:    "parent reference",
+			archive: func(t *testing.T) []byte { return tarArchive(t, file("a/../../b")) },
+			reason:  ReasonPathTraversal,
+		},
+		{
+			name:    "zip parent reference",
+			archive: func(t *testing.T) []byte { return zipArchive(t, file("../b")) },
+			reason:  ReasonPathTraversal,
+		},
+		{
+			name:    "absolute path",
+			archive: func(t *testing.T) []byte { return tarArchive(t, file("/etc/passwd")) },
+			reason:  ReasonPathTraversal,
+		},
+		{
+			name:    "symlink",
+			archive: func(t *testing.T) []byte { return tarArchive(t, entry{name: "a", typeflag: tar.TypeSymlink}) },
+			reason:  ReasonLink,
+		},
+		{
+			name:    "hardlink",
+			archive: func(t *testing.T) []byte { return tarArchive(t, entry{name: "a", typeflag: tar.TypeLink}) },
+			reason:  ReasonLink,
+		},
+		{
+			name: "zip symlink",
+			archive: func(t *testing.T) []byte {
+				return zipArchive(t, entry{name: "a", body: "target", mode: os.ModeSymlink | 0o777})
+			},
+			reason: ReasonLink,
+		},
+		{
+			name:    "fifo",
+			archive: func(t *testing.T) []byte { return tarArchive(t, entry{name: "a", typeflag: tar.TypeFifo}) },
+			reason:  ReasonSpecialFile,
+		},
+		{
+			name:    "no files",
+			archive: func(t *testing.T) []byte { return tarArchive(t, entry{name: "dir/", typeflag: tar.TypeDir}) },
+			reason:  ReasonEmpty,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			limits := testLimits()
+			if c.limits != nil {
+				c.limits(limits)
+			}
+
+			files := []string{}
+			err := Extract(bytes.NewReader(c.archive(t)), limits, func(name string, r io.Reader, size int64, mode os.FileMode) error {
+				files = append(files, name)
+				_, err := io.Copy(io.Discard, r)
+				return err
+			})
+
+			if c.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if strings.Join(files, ",") != strings.Join(c.files, ",") {
+					t.Fatalf("expected files %v, got %v", c.files, files)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Reason != c.reason {
+				t.Fatalf("expected %s, got %v", c.reason, err)
+			}
+		})
+	}
+}
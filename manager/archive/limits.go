@@ -0,0 +1,69 @@
+package archive
+
+import (
+	"strings"
+
+	"github.com/mholt/archiver/v3"
+
+	cutil "github.com/onpremless/opless/common/util"
+)
+
+const zipType = "application/zip"
+
+// readers maps supported archive MIME types onto archive readers, compressed
+// streams are expected to contain a tarball. Only zip isn't read as a stream.
+var readers = map[string]func() archiver.Reader{
+	zipType:               func() archiver.Reader { return archiver.NewZip() },
+	"application/x-tar":   func() archiver.Reader { return archiver.NewTar() },
+	"application/gzip":    func() archiver.Reader { return archiver.NewTarGz() },
+	"application/x-bzip2": func() archiver.Reader { return archiver.NewTarBz2() },
+	"application/x-xz":    func() archiver.Reader { return archiver.NewTarXz() },
+	"application/zstd":    func() archiver.Reader { return archiver.NewTarZstd() },
+}
+
+type Limits struct {
+	// MaxArchiveSize limits size of the archive itself
+	MaxArchiveSize int64
+	// MaxSize limits total uncompressed size of all files
+	MaxSize  int64
+	MaxFiles int
+	// MaxDepth limits number of path segments of a file, including its name
+	MaxDepth int
+	// AllowedTypes are archive MIME types accepted for extraction
+	AllowedTypes []string
+}
+
+// LimitsFromEnv reads ARCHIVE_MAX_SIZE, EXTRACT_MAX_SIZE (both in bytes), EXTRACT_MAX_FILES,
+// EXTRACT_MAX_DEPTH and comma separated ARCHIVE_TYPES env vars, defaults apply to missing ones.
+func LimitsFromEnv() *Limits {
+	types := []string{}
+	for _, t := range strings.Split(cutil.GetStrVarDefault("ARCHIVE_TYPES", ""), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+
+	if len(types) == 0 {
+		for t := range readers {
+			types = append(types, t)
+		}
+	}
+
+	return &Limits{
+		MaxArchiveSize: int64(cutil.GetIntVarDefault("ARCHIVE_MAX_SIZE", 128<<20)),
+		MaxSize:        int64(cutil.GetIntVarDefault("EXTRACT_MAX_SIZE", 512<<20)),
+		MaxFiles:       cutil.GetIntVarDefault("EXTRACT_MAX_FILES", 10000),
+		MaxDepth:       cutil.GetIntVarDefault("EXTRACT_MAX_DEPTH", 32),
+		AllowedTypes:   types,
+	}
+}
+
+func (l *Limits) allows(mime string) bool {
+	for _, t := range l.AllowedTypes {
+		if t == mime {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	cutil "github.com/onpremless/opless/common/util"
+)
+
+const (
+	TmpBucket     = "lambda-tmp"
+	LambdaBucket  = "lambda"
+	RuntimeBucket = "runtime"
+
+	BackendMinio = "minio"
+	BackendLocal = "local"
+)
+
+var Buckets = []string{TmpBucket, LambdaBucket, RuntimeBucket}
+
+var ErrNotFound = errors.New("artifact is not found")
+
+type Object struct {
+	Key      string
+	Size     int64
+	ModTime  time.Time
+	Metadata map[string]string
+}
+
+// Store keeps lambda code, uploads and runtime Dockerfiles in a fixed set of buckets.
+// Metadata keys are case insensitive and always returned lower cased.
+type Store interface {
+	// Put stores the object, size is -1 if it's unknown.
+	Put(ctx context.Context, bucket string, key string, r io.Reader, size int64, metadata map[string]string) error
+	// Get returns ErrNotFound if there is no such object.
+	Get(ctx context.Context, bucket string, key string) (io.ReadCloser, error)
+	// Stat returns ErrNotFound if there is no such object.
+	Stat(ctx context.Context, bucket string, key string) (*Object, error)
+	// Copy replaces destination object metadata if it's not nil.
+	Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, metadata map[string]string) error
+	Remove(ctx context.Context, bucket string, key string) error
+	// Walk calls fn for every object under the prefix, metadata is not populated.
+	Walk(ctx context.Context, bucket string, prefix string, fn func(obj *Object) error) error
+}
+
+// Presigner is implemented by stores clients can upload objects to directly.
+type Presigner interface {
+	// PresignPost returns URL and form fields an object of up to maxSize bytes can be uploaded
+	// with in a multipart POST request until expiry elapses. The store rejects larger objects.
+	PresignPost(ctx context.Context, bucket string, key string, maxSize int64, expiry time.Duration) (string, map[string]string, error)
+}
+
+var Client Store
+
+// Init opens the Store configured by ARTIFACT_BACKEND env var: 'minio' (default)
+// uses MINIO_* variables, 'local' keeps files under ARTIFACT_PATH directory.
+// Optional MINIO_PUBLIC_ENDPOINT is the endpoint presigned URLs point to.
+func Init(ctx context.Context) error {
+	var err error
+
+	switch backend := cutil.GetStrVarDefault("ARTIFACT_BACKEND", BackendMinio); backend {
+	case BackendMinio:
+		Client, err = NewMinio(
+			ctx,
+			cutil.GetStrVar("MINIO_ENDPOINT"),
+			cutil.GetStrVarDefault("MINIO_PUBLIC_ENDPOINT", ""),
+			cutil.GetStrVar("MINIO_ACCESS_KEY"),
+			cutil.GetStrVar("MINIO_SECRET_KEY"),
+		)
+	case BackendLocal:
+		Client, err = NewLocal(cutil.GetStrVar("ARTIFACT_PATH"))
+	default:
+		err = fmt.Errorf("unknown artifact backend: %s", backend)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to open artifact store: %w", err)
+	}
+
+	return nil
+}
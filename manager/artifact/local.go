@@ -0,0 +1,276 @@
+package artifact
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	localMetaDir = ".meta"
+	localTmpDir  = ".tmp"
+)
+
+// Local keeps objects as plain files under <root>/<bucket>/<key>,
+// metadata lives next to them under <root>/.meta.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	for _, dir := range append([]string{localMetaDir, localTmpDir}, Buckets...) {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Local{root: root}, nil
+}
+
+func cleanKey(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != key {
+		return "", fmt.Errorf("invalid artifact key: %s", key)
+	}
+
+	return clean, nil
+}
+
+func (l *Local) paths(bucket string, key string) (string, string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	data := filepath.Join(l.root, bucket, filepath.FromSlash(key))
+	meta := filepath.Join(l.root, localMetaDir, bucket, filepath.FromSlash(key)+".json")
+
+	return data, meta, nil
+}
+
+func wrapFsErr(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// writeFile writes the file atomically, readers never see it partially written.
+func (l *Local) writeFile(dst string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(l.root, localTmpDir), "artifact-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (l *Local) writeMeta(metaPath string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		err := os.Remove(metaPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	raw, err := json.Marshal(lowerKeys(metadata))
+	if err != nil {
+		return err
+	}
+
+	return l.writeFile(metaPath, strings.NewReader(string(raw)))
+}
+
+func (l *Local) readMeta(metaPath string) (map[string]string, error) {
+	res := map[string]string{}
+
+	raw, err := os.ReadFile(metaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return res, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (l *Local) Put(ctx context.Context, bucket string, key string, r io.Reader, size int64, metadata map[string]string) error {
+	dataPath, metaPath, err := l.paths(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	if err := l.writeMeta(metaPath, metadata); err != nil {
+		return err
+	}
+
+	return l.writeFile(dataPath, r)
+}
+
+func (l *Local) Get(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	dataPath, _, err := l.paths(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return nil, wrapFsErr(err)
+	}
+
+	return file, nil
+}
+
+func (l *Local) Stat(ctx context.Context, bucket string, key string) (*Object, error) {
+	dataPath, metaPath, err := l.paths(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return nil, wrapFsErr(err)
+	}
+
+	metadata, err := l.readMeta(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{Key: key, Size: info.Size(), ModTime: info.ModTime(), Metadata: metadata}, nil
+}
+
+func (l *Local) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, metadata map[string]string) error {
+	src, err := l.Stat(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+
+	if metadata == nil {
+		metadata = src.Metadata
+	}
+
+	r, err := l.Get(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return l.Put(ctx, dstBucket, dstKey, r, src.Size, metadata)
+}
+
+func (l *Local) Remove(ctx context.Context, bucket string, key string) error {
+	dataPath, metaPath, err := l.paths(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{dataPath, metaPath} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	l.removeEmptyDirs(filepath.Dir(dataPath), filepath.Join(l.root, bucket))
+	l.removeEmptyDirs(filepath.Dir(metaPath), filepath.Join(l.root, localMetaDir, bucket))
+
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to root while they are empty,
+// so key prefixes don't outlive their objects like in object storages.
+func (l *Local) removeEmptyDirs(dir string, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		// Fails on non-empty directory
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (l *Local) Walk(ctx context.Context, bucket string, prefix string, fn func(obj *Object) error) error {
+	bucketDir := filepath.Join(l.root, bucket)
+
+	// Don't walk the whole bucket when prefix points into a directory
+	start := bucketDir
+	if dir := path.Dir(prefix); strings.Contains(prefix, "/") && dir != "." {
+		start = filepath.Join(bucketDir, filepath.FromSlash(dir))
+	}
+
+	// Nothing is stored under the prefix yet
+	if _, err := os.Stat(start); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	// Objects and directories removed while they're walked are skipped
+	return filepath.WalkDir(start, func(file string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(bucketDir, file)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return fn(&Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
@@ -0,0 +1,212 @@
+package artifact
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/manager/logger"
+)
+
+// MinIO might still be starting along with the manager
+const minioStartTimeout = time.Minute
+
+// Presigning with a known region doesn't require a bucket location request,
+// which the public endpoint might not be reachable for from the manager.
+const minioRegion = "us-east-1"
+
+type Minio struct {
+	Client *minio.Client
+	// presigner signs URLs for the endpoint clients outside of the cluster use
+	presigner *minio.Client
+}
+
+// NewMinio connects to MinIO at endpoint, presigned URLs point to publicEndpoint
+// ('[https://]host[:port]') if it's not empty.
+func NewMinio(ctx context.Context, endpoint string, publicEndpoint string, accessKeyID string, secretAccessKey string) (*Minio, error) {
+	creds := credentials.NewStaticV4(accessKeyID, secretAccessKey, "")
+
+	client, err := minio.New(endpoint, &minio.Options{Creds: creds})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Minio{Client: client, presigner: client}
+
+	if publicEndpoint != "" {
+		host, secure := strings.CutPrefix(publicEndpoint, "https://")
+		host = strings.TrimPrefix(host, "http://")
+
+		m.presigner, err = minio.New(host, &minio.Options{
+			Creds:  creds,
+			Secure: secure,
+			Region: minioRegion,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, minioStartTimeout)
+	defer cancel()
+
+	for {
+		_, err := client.BucketExists(wctx, LambdaBucket)
+		if err == nil {
+			break
+		}
+
+		logger.L.Warn("MinIO is not ready yet", zap.Error(err))
+
+		select {
+		case <-time.After(time.Second):
+		case <-wctx.Done():
+			return nil, err
+		}
+	}
+
+	for _, bucket := range Buckets {
+		if err := m.createBucketIfNecessary(ctx, bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Minio) createBucketIfNecessary(ctx context.Context, bucket string) error {
+	exists, errBucketExists := m.Client.BucketExists(ctx, bucket)
+	if errBucketExists != nil {
+		return errBucketExists
+	}
+
+	if exists {
+		return nil
+	}
+
+	return m.Client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{})
+}
+
+func wrapMinioErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func lowerKeys(metadata map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range metadata {
+		res[strings.ToLower(k)] = v
+	}
+
+	return res
+}
+
+func (m *Minio) Put(ctx context.Context, bucket string, key string, r io.Reader, size int64, metadata map[string]string) error {
+	_, err := m.Client.PutObject(ctx, bucket, key, r, size, minio.PutObjectOptions{UserMetadata: metadata})
+	return err
+}
+
+func (m *Minio) PresignPost(ctx context.Context, bucket string, key string, maxSize int64, expiry time.Duration) (string, map[string]string, error) {
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(bucket); err != nil {
+		return "", nil, err
+	}
+
+	if err := policy.SetKey(key); err != nil {
+		return "", nil, err
+	}
+
+	if err := policy.SetExpires(time.Now().UTC().Add(expiry)); err != nil {
+		return "", nil, err
+	}
+
+	if err := policy.SetContentLengthRange(0, maxSize); err != nil {
+		return "", nil, err
+	}
+
+	u, fields, err := m.presigner.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return u.String(), fields, nil
+}
+
+func (m *Minio) Get(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	obj, err := m.Client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapMinioErr(err)
+	}
+
+	// Object is fetched lazily, so make sure it exists
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, wrapMinioErr(err)
+	}
+
+	return obj, nil
+}
+
+func (m *Minio) Stat(ctx context.Context, bucket string, key string) (*Object, error) {
+	info, err := m.Client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, wrapMinioErr(err)
+	}
+
+	return &Object{
+		Key:      info.Key,
+		Size:     info.Size,
+		ModTime:  info.LastModified,
+		Metadata: lowerKeys(info.UserMetadata),
+	}, nil
+}
+
+func (m *Minio) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string, metadata map[string]string) error {
+	_, err := m.Client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket:          dstBucket,
+		Object:          dstKey,
+		UserMetadata:    metadata,
+		ReplaceMetadata: metadata != nil,
+	}, minio.CopySrcOptions{Bucket: srcBucket, Object: srcKey})
+
+	return wrapMinioErr(err)
+}
+
+func (m *Minio) Remove(ctx context.Context, bucket string, key string) error {
+	return m.Client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (m *Minio) Walk(ctx context.Context, bucket string, prefix string, fn func(obj *Object) error) error {
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objectCh := m.Client.ListObjects(lctx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+
+	for object := range objectCh {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		if err := fn(&Object{Key: object.Key, Size: object.Size, ModTime: object.LastModified}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
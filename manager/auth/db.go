@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+var tokenSchema = &db.Schema[model.StoredToken]{
+	Prefix: "token",
+	ID:     func(x *model.StoredToken) string { return x.Id },
+	Sort: map[string]db.SortKey[model.StoredToken]{
+		"created_at": func(x *model.StoredToken) string { return db.NumKey(x.CreatedAt) },
+		"name":       func(x *model.StoredToken) string { return x.Name },
+	},
+	Unique: map[string]db.FieldKey[model.StoredToken]{
+		"name": func(x *model.StoredToken) string { return x.Name },
+	},
+}
+
+func Reindex(ctx context.Context) error {
+	return db.Reindex(ctx, tokenSchema)(store.Client)
+}
+
+func GetToken(ctx context.Context, id string) (*model.StoredToken, error) {
+	return db.GetValue[model.StoredToken](ctx, "token", id)(store.Client)
+}
+
+func ListTokens(ctx context.Context, query *db.Query[model.StoredToken]) (*db.Page[model.StoredToken], error) {
+	return db.ListValues(ctx, tokenSchema, query)(store.Client)
+}
+
+func CreateToken(ctx context.Context, token *model.StoredToken) error {
+	return db.CreateIndexedValue(ctx, tokenSchema, token)(store.Client)
+}
+
+func DelToken(ctx context.Context, id string) error {
+	return db.DelIndexedValue(ctx, tokenSchema, id)(store.Client)
+}
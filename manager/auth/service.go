@@ -0,0 +1,166 @@
+// Package auth keeps API tokens. A token is '<prefix><id>_<secret>', only the SHA-256 of the
+// secret is stored: secrets are random 256 bit values, so a slow hash would only add latency
+// to every request. Tokens are not backed up, restoring a backup keeps the existing ones.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/onpremless/opless/common/db"
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+const (
+	tokenPrefix = "opl_"
+	// BootstrapName is the name of the admin token created on the first start
+	BootstrapName = "bootstrap"
+)
+
+var errInvalidToken = errs.New(errs.Unauthorized, "token is invalid, expired or revoked")
+
+type AuthService interface {
+	Create(ctx context.Context, req *model.CreateToken) (*model.CreatedToken, error)
+	List(ctx context.Context, query *db.Query[model.StoredToken]) (*db.Page[model.Token], error)
+	Revoke(ctx context.Context, id string) error
+	// Authenticate returns the token the bearer token belongs to, the error is Unauthorized
+	// if it's not a valid token.
+	Authenticate(ctx context.Context, bearer string) (*model.Token, error)
+	// Bootstrap creates the admin token unless there are tokens already, in which case nil
+	// is returned. Revoking every token and restarting the manager creates a new one.
+	Bootstrap(ctx context.Context) (*model.CreatedToken, error)
+}
+
+type service struct{}
+
+func CreateAuthService() AuthService {
+	return &service{}
+}
+
+func (s *service) Create(ctx context.Context, req *model.CreateToken) (*model.CreatedToken, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	token := &model.StoredToken{
+		Token: model.Token{
+			Id:        cutil.UUID(),
+			Name:      req.Name,
+			Scopes:    req.Scopes,
+			CreatedAt: now.UnixMilli(),
+		},
+		Hash: hash(secret),
+	}
+
+	if req.TTL > 0 {
+		token.ExpiresAt = now.Add(time.Duration(req.TTL) * time.Second).UnixMilli()
+	}
+
+	if err := CreateToken(ctx, token); err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			return nil, errs.New(errs.Conflict, "token already exists: %w", err)
+		}
+
+		return nil, err
+	}
+
+	return &model.CreatedToken{Token: token.Token, Secret: tokenPrefix + token.Id + "_" + secret}, nil
+}
+
+func (s *service) List(ctx context.Context, query *db.Query[model.StoredToken]) (*db.Page[model.Token], error) {
+	page, err := ListTokens(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := &db.Page[model.Token]{Items: make([]*model.Token, 0, len(page.Items)), Next: page.Next}
+	for _, token := range page.Items {
+		token := token.Token
+		tokens.Items = append(tokens.Items, &token)
+	}
+
+	return tokens, nil
+}
+
+func (s *service) Revoke(ctx context.Context, id string) error {
+	token, err := GetToken(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if token == nil {
+		return errs.New(errs.NotFound, "token is not found: %s", id)
+	}
+
+	return DelToken(ctx, id)
+}
+
+func (s *service) Authenticate(ctx context.Context, bearer string) (*model.Token, error) {
+	rest, ok := strings.CutPrefix(bearer, tokenPrefix)
+	if !ok {
+		return nil, errInvalidToken
+	}
+
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, errInvalidToken
+	}
+
+	token, err := GetToken(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil || subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash(secret))) != 1 {
+		return nil, errInvalidToken
+	}
+
+	if token.ExpiresAt != 0 && token.ExpiresAt <= time.Now().UnixMilli() {
+		return nil, errInvalidToken
+	}
+
+	return &token.Token, nil
+}
+
+func (s *service) Bootstrap(ctx context.Context) (*model.CreatedToken, error) {
+	page, err := ListTokens(ctx, &db.Query[model.StoredToken]{SortBy: "created_at", Limit: 1})
+	if err != nil || len(page.Items) > 0 {
+		return nil, err
+	}
+
+	token, err := s.Create(ctx, &model.CreateToken{Name: BootstrapName, Scopes: []string{model.ScopeAdmin}})
+	// Another manager sharing the store has just created it
+	if errors.Is(err, db.ErrConflict) {
+		return nil, nil
+	}
+
+	return token, err
+}
+
+// Grants tells whether the scopes allow an operation requiring the scope.
+func Grants(scopes []string, required string) bool {
+	if slices.Contains(scopes, model.ScopeAdmin) || slices.Contains(scopes, required) {
+		return true
+	}
+
+	resource, access, _ := strings.Cut(required, ":")
+	return access == "read" && slices.Contains(scopes, resource+":write")
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
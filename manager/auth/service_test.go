@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+func testStore(t *testing.T) {
+	b, err := db.NewBolt(filepath.Join(t.TempDir(), "store.db"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := store.Client
+	store.Client = b
+	t.Cleanup(func() {
+		store.Client = prev
+		b.Close()
+	})
+
+	if err := Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrants(t *testing.T) {
+	cases := []struct {
+		name     string
+		scopes   []string
+		required string
+		granted  bool
+	}{
+		{"same scope", []string{model.ScopeLambdaRead}, model.ScopeLambdaRead, true},
+		{"write implies read", []string{model.ScopeLambdaWrite}, model.ScopeLambdaRead, true},
+		{"read doesn't imply write", []string{model.ScopeLambdaRead}, model.ScopeLambdaWrite, false},
+		{"write of another resource", []string{model.ScopeEndpointWrite}, model.ScopeLambdaRead, false},
+		{"admin grants read", []string{model.ScopeAdmin}, model.ScopeRuntimeRead, true},
+		{"admin grants write", []string{model.ScopeAdmin}, model.ScopeUploadWrite, true},
+		{"admin grants admin", []string{model.ScopeAdmin}, model.ScopeAdmin, true},
+		{"write doesn't grant admin", []string{model.ScopeLambdaWrite}, model.ScopeAdmin, false},
+		{"no scopes", nil, model.ScopeLambdaRead, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if granted := Grants(c.scopes, c.required); granted != c.granted {
+				t.Fatalf("expected %v, got %v", c.granted, granted)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	testStore(t)
+	ctx := context.Background()
+	s := CreateAuthService()
+
+	created, err := s.Create(ctx, &model.CreateToken{Name: "valid", Scopes: []string{model.ScopeLambdaRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := &model.StoredToken{
+		Token: model.Token{Id: "expired", Name: "expired", ExpiresAt: time.Now().Add(-time.Minute).UnixMilli()},
+		Hash:  hash("secret"),
+	}
+	if err := CreateToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := s.Create(ctx, &model.CreateToken{Name: "revoked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Revoke(ctx, revoked.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		bearer string
+		valid  bool
+	}{
+		{"valid", created.Secret, true},
+		{"expired", tokenPrefix + "expired_secret", false},
+		{"tampered secret", created.Secret + "x", false},
+		{"tampered id", tokenPrefix + "x" + created.Secret[len(tokenPrefix):], false},
+		{"revoked", revoked.Secret, false},
+		{"no prefix", created.Secret[len(tokenPrefix):], false},
+		{"no secret", tokenPrefix + created.Id, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			token, err := s.Authenticate(ctx, c.bearer)
+			if c.valid {
+				if err != nil || token == nil || token.Id != created.Id {
+					t.Fatalf("expected token %s, got %v, %v", created.Id, token, err)
+				}
+				return
+			}
+
+			if errs.KindOf(err) != errs.Unauthorized {
+				t.Fatalf("expected unauthorized, got %v, %v", token, err)
+			}
+		})
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	testStore(t)
+	ctx := context.Background()
+	s := CreateAuthService()
+
+	created, err := s.Bootstrap(ctx)
+	if err != nil || created == nil {
+		t.Fatalf("first bootstrap: expected a token, got %v, %v", created, err)
+	}
+
+	if created.Name != BootstrapName || !Grants(created.Scopes, model.ScopeAdmin) {
+		t.Fatalf("first bootstrap: expected an admin token, got %v", created.Token)
+	}
+
+	if _, err := s.Authenticate(ctx, created.Secret); err != nil {
+		t.Fatalf("bootstrap token doesn't authenticate: %v", err)
+	}
+
+	if again, err := s.Bootstrap(ctx); err != nil || again != nil {
+		t.Fatalf("second bootstrap: expected nothing, got %v, %v", again, err)
+	}
+
+	// Revoking every token lets the next start create a new one
+	if err := s.Revoke(ctx, created.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if again, err := s.Bootstrap(ctx); err != nil || again == nil || again.Id == created.Id {
+		t.Fatalf("bootstrap after revoke: expected a new token, got %v, %v", again, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/onpremless/opless/manager/auth"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/openapi"
+)
+
+const tokenKey = "token"
+
+// authorize requires a bearer token granting the scope of the operation. The scopes come
+// from the OpenAPI operations, which the contract test keeps in line with the routes, so a
+// route can't be registered without deciding who may call it. A matched route without an
+// operation is refused, unknown routes and routes scoped by their handlers only require a
+// valid token.
+func authorize(authSvc auth.AuthService, operations []*openapi.Operation) gin.HandlerFunc {
+	scopes := map[string]*openapi.Operation{}
+	for _, op := range operations {
+		scopes[op.Method+" "+op.Path] = op
+	}
+
+	return func(c *gin.Context) {
+		op := scopes[c.Request.Method+" "+c.FullPath()]
+		if op == nil && c.FullPath() != "" {
+			writeError(c, errs.New(errs.Internal, "operation %s %s isn't declared", c.Request.Method, c.FullPath()))
+			return
+		}
+
+		if op != nil && op.Public {
+			c.Next()
+			return
+		}
+
+		bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			writeError(c, errs.New(errs.Unauthorized, "bearer token is required"))
+			return
+		}
+
+		token, err := authSvc.Authenticate(c, strings.TrimSpace(bearer))
+		if err != nil {
+			if errs.KindOf(err) == errs.Unauthorized {
+				c.Header("WWW-Authenticate", "Bearer")
+			}
+
+			writeError(c, err)
+			return
+		}
+
+		c.Set(tokenKey, token)
+		if op != nil && op.ScopedBy == "" && !granted(c, op.Scope) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// granted responds with Forbidden unless the token of the request grants the scope.
+func granted(c *gin.Context, scope string) bool {
+	token := c.MustGet(tokenKey).(*model.Token)
+	if !auth.Grants(token.Scopes, scope) {
+		writeError(c, errs.New(errs.Forbidden, "token doesn't grant the '%s' scope", scope))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/onpremless/opless/manager/auth"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/openapi"
+)
+
+type stubAuth struct {
+	auth.AuthService
+}
+
+func (stubAuth) Authenticate(ctx context.Context, bearer string) (*model.Token, error) {
+	if bearer != "reader" {
+		return nil, errs.New(errs.Unauthorized, "token is invalid")
+	}
+
+	return &model.Token{Id: "reader", Scopes: []string{model.ScopeLambdaRead}}, nil
+}
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ops := []*openapi.Operation{
+		{Method: http.MethodGet, Path: "/public", Public: true},
+		{Method: http.MethodGet, Path: "/read", Scope: model.ScopeLambdaRead},
+		{Method: http.MethodGet, Path: "/write", Scope: model.ScopeLambdaWrite},
+	}
+
+	r := gin.New()
+	r.Use(authorize(stubAuth{}, ops))
+	for _, path := range []string{"/public", "/read", "/write", "/undeclared"} {
+		r.GET(path, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+
+	cases := []struct {
+		path   string
+		bearer string
+		status int
+	}{
+		{"/public", "", http.StatusOK},
+		{"/read", "", http.StatusUnauthorized},
+		{"/read", "forged", http.StatusUnauthorized},
+		{"/read", "reader", http.StatusOK},
+		{"/write", "reader", http.StatusForbidden},
+		{"/undeclared", "reader", http.StatusInternalServerError},
+		{"/unknown", "reader", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path+" "+c.bearer, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.path, nil)
+			if c.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+c.bearer)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != c.status {
+				t.Fatalf("expected %d, got %d: %s", c.status, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,580 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/apply"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/code"
+	"github.com/onpremless/opless/manager/endpoint"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/lambda"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+// Archive layout is a gzipped tar stream of the manifest, records of every collection as
+// records/<prefix>.jsonl and artifacts as artifacts/<bucket>/<key>. The manager keeps
+// serving meanwhile, so it's not a point in time snapshot: collections are read one by one
+// and objects removed while they're walked, like migrated legacy code, are skipped.
+const (
+	manifestName = "backup.json"
+	recordsDir   = "records/"
+	artifactsDir = "artifacts/"
+	// metaPrefix prefixes PAX records keeping artifact metadata
+	metaPrefix = "OPLESS.meta."
+)
+
+const maxManifestSize = 1 << 20
+
+// Uploads are transient, so the tmp bucket isn't backed up.
+var buckets = []string{artifact.LambdaBucket, artifact.RuntimeBucket}
+
+var ErrNotEmpty = errs.New(errs.Conflict, "installation has lambdas, endpoints or runtimes, restore requires an empty one")
+
+type BackupService interface {
+	// Backup writes the archive of all records, lambda code and runtime Dockerfiles. Nothing
+	// is written until the lock is taken and the records are read.
+	Backup(ctx context.Context, w io.Writer) error
+	// Restore replaces records and adds artifacts of the archive. The installation must have
+	// neither lambdas, endpoints nor runtimes besides catalog ones, ErrNotEmpty is returned
+	// otherwise. Restored lambdas are stopped, ones which were running are reported. Registry
+	// credentials aren't backed up, image sources of lambdas pulled from private registries
+	// have to be set again.
+	Restore(ctx context.Context, r io.Reader) (*model.RestoreReport, error)
+	// Start builds and starts the lambdas one by one.
+	Start(ctx context.Context, lambdas []string) []*model.StartResult
+}
+
+type service struct {
+	lambdaSvc lambda.LambdaService
+}
+
+func CreateBackupService(lambdaSvc lambda.LambdaService) BackupService {
+	return &service{
+		lambdaSvc: lambdaSvc,
+	}
+}
+
+// collections returns all collections which are backed up by prefix.
+func collections() map[string]*db.Collection {
+	res := map[string]*db.Collection{}
+	for _, colls := range [][]*db.Collection{lambda.Collections(), endpoint.Collections(), code.Collections(), apply.Collections()} {
+		for _, coll := range colls {
+			res[coll.Prefix] = coll
+		}
+	}
+
+	return res
+}
+
+// record is a line of a records file.
+type record struct {
+	ID    string          `json:"id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// lock keeps backups and restores from running concurrently.
+func lock(ctx context.Context) (func(), error) {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	unlock, err := store.Client.Lock(lctx, "backup", time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("another backup or restore is in progress: %w", err)
+	}
+
+	return unlock, nil
+}
+
+func (s service) Backup(ctx context.Context, w io.Writer) error {
+	unlock, err := lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	colls := collections()
+	prefixes := make([]string, 0, len(colls))
+	for prefix := range colls {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	manifest := &model.Backup{
+		Format:    model.BackupFormat,
+		OPlessID:  store.OPlessID,
+		CreatedAt: time.Now().UnixMilli(),
+		Records:   map[string]int{},
+	}
+
+	records := map[string][]byte{}
+	for _, prefix := range prefixes {
+		raw, n, err := readRecords(ctx, prefix)
+		if err != nil {
+			return err
+		}
+
+		records[prefix] = raw
+		manifest.Records[prefix] = n
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	modTime := time.UnixMilli(manifest.CreatedAt)
+
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(tw, manifestName, raw, modTime); err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		if err := writeFile(tw, recordsDir+prefix+".jsonl", records[prefix], modTime); err != nil {
+			return err
+		}
+	}
+
+	for _, bucket := range buckets {
+		err := artifact.Client.Walk(ctx, bucket, "", func(obj *artifact.Object) error {
+			return writeObject(ctx, tw, bucket, obj)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+func readRecords(ctx context.Context, prefix string) ([]byte, int, error) {
+	recs, err := scanRecords(ctx, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return buf.Bytes(), len(recs), nil
+}
+
+// scanRecords returns all records of the collection without resource versions, which are
+// assigned again when the records are written.
+func scanRecords(ctx context.Context, prefix string) ([]*record, error) {
+	recs := []*record{}
+
+	var valueErr error
+	err := store.Client.Scan(ctx, prefix, func(item *db.Item) bool {
+		var value []byte
+		value, valueErr = db.Unversioned(item.Value)
+		recs = append(recs, &record{ID: item.ID, Value: value})
+		return valueErr == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if valueErr != nil {
+		return nil, valueErr
+	}
+
+	return recs, nil
+}
+
+func writeFile(tw *tar.Writer, name string, raw []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(raw)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(raw)
+	return err
+}
+
+func writeObject(ctx context.Context, tw *tar.Writer, bucket string, obj *artifact.Object) error {
+	// Walk doesn't populate metadata
+	stat, err := artifact.Client.Stat(ctx, bucket, obj.Key)
+	if errors.Is(err, artifact.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:       artifactsDir + bucket + "/" + obj.Key,
+		Mode:       0644,
+		Size:       stat.Size,
+		ModTime:    stat.ModTime,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{},
+	}
+
+	for k, v := range stat.Metadata {
+		hdr.PAXRecords[metaPrefix+k] = v
+	}
+
+	r, err := artifact.Client.Get(ctx, bucket, obj.Key)
+	if errors.Is(err, artifact.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, r, stat.Size)
+	return err
+}
+
+func (s service) Restore(ctx context.Context, r io.Reader) (*model.RestoreReport, error) {
+	unlock, err := lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errs.New(errs.Validation, "invalid backup: %w", err)
+	}
+
+	tr := tar.NewReader(gr)
+
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	colls := collections()
+	for prefix := range manifest.Records {
+		if colls[prefix] == nil {
+			return nil, errs.New(errs.Validation, "backup has unknown records: %s", prefix)
+		}
+	}
+
+	if err := checkEmpty(ctx); err != nil {
+		return nil, err
+	}
+
+	report := &model.RestoreReport{Records: map[string]int{}, Objects: map[string]int{}, Running: []string{}}
+
+	// Records are written once the whole archive is read, so a broken archive leaves the
+	// store as it was. Artifacts only ever add keys, the ones of a failed restore are unused.
+	staged := map[string][]*record{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, errs.New(errs.Validation, "invalid backup: %w", err)
+		}
+
+		if name, ok := strings.CutPrefix(hdr.Name, recordsDir); ok {
+			prefix := strings.TrimSuffix(name, ".jsonl")
+			if colls[prefix] == nil {
+				return nil, errs.New(errs.Validation, "backup has unknown records: %s", prefix)
+			}
+
+			recs, err := stageRecords(prefix, tr, report)
+			if err != nil {
+				return nil, errs.New(errs.Validation, "invalid %s records: %w", prefix, err)
+			}
+
+			staged[prefix] = recs
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(hdr.Name, artifactsDir); ok {
+			bucket, key, _ := strings.Cut(name, "/")
+			if !isBackedUp(bucket) || key == "" {
+				return nil, errs.New(errs.Validation, "unexpected backup entry: %s", hdr.Name)
+			}
+
+			if err := restoreObject(ctx, bucket, key, hdr, tr); err != nil {
+				return nil, fmt.Errorf("failed to restore %s: %w", hdr.Name, err)
+			}
+
+			report.Objects[bucket]++
+			continue
+		}
+
+		return nil, errs.New(errs.Validation, "unexpected backup entry: %s", hdr.Name)
+	}
+
+	if err := replaceRecords(ctx, colls, staged); err != nil {
+		return nil, err
+	}
+
+	// Backups made before runtimes were versioned have their Dockerfiles only
+	if err := lambda.MigrateLegacyRuntimes(ctx); err != nil {
+		return nil, err
+	}
+
+	for prefix, recs := range staged {
+		report.Records[prefix] = len(recs)
+	}
+
+	return report, nil
+}
+
+func readManifest(tr *tar.Reader) (*model.Backup, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errs.New(errs.Validation, "invalid backup: %w", err)
+	}
+
+	if hdr.Name != manifestName {
+		return nil, errs.New(errs.Validation, "backup must start with %s, got %s", manifestName, hdr.Name)
+	}
+
+	if hdr.Size > maxManifestSize {
+		return nil, errs.New(errs.Validation, "%s is larger than %d bytes", manifestName, maxManifestSize)
+	}
+
+	manifest := &model.Backup{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, errs.New(errs.Validation, "invalid %s: %w", manifestName, err)
+	}
+
+	if manifest.Format != model.BackupFormat {
+		return nil, errs.New(errs.Validation, "unsupported backup format %d, expected %d", manifest.Format, model.BackupFormat)
+	}
+
+	return manifest, nil
+}
+
+// checkEmpty allows runtimes seeded from the catalog, they're replaced by restored ones.
+func checkEmpty(ctx context.Context) error {
+	lambdas, err := lambda.GetLambdas(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := endpoint.GetEndpoints(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(lambdas) > 0 || len(endpoints) > 0 {
+		return ErrNotEmpty
+	}
+
+	runtimes, err := lambda.GetRuntimes(ctx)
+	if err != nil {
+		return err
+	}
+
+	builtins, err := lambda.GetBuiltinRuntimes(ctx)
+	if err != nil {
+		return err
+	}
+
+	seeded := map[string]bool{}
+	for _, builtin := range builtins {
+		seeded[builtin.Id] = true
+	}
+
+	for _, runtime := range runtimes {
+		if !seeded[runtime.Id] {
+			return ErrNotEmpty
+		}
+	}
+
+	return nil
+}
+
+func isBackedUp(bucket string) bool {
+	for _, b := range buckets {
+		if b == bucket {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stageRecords reads records of the collection, values are stripped of resource versions
+// kept by archives made before they were left out.
+func stageRecords(prefix string, r io.Reader, report *model.RestoreReport) ([]*record, error) {
+	recs := []*record{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		rec := &record{}
+		err := dec.Decode(rec)
+		if errors.Is(err, io.EOF) {
+			return recs, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rec.ID == "" {
+			return nil, errors.New("record has no id")
+		}
+
+		if rec.Value, err = db.Unversioned(rec.Value); err != nil {
+			return nil, err
+		}
+
+		if prefix == "lambda" {
+			if rec.Value, err = stopLambda(rec.Value, report); err != nil {
+				return nil, err
+			}
+		}
+
+		recs = append(recs, rec)
+	}
+}
+
+// replaceRecords replaces records of the staged collections. If a write fails, previous
+// records of the collections are written back, so the store isn't left half restored.
+func replaceRecords(ctx context.Context, colls map[string]*db.Collection, staged map[string][]*record) error {
+	prefixes := make([]string, 0, len(staged))
+	for prefix := range staged {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	previous := map[string][]*record{}
+	for _, prefix := range prefixes {
+		recs, err := scanRecords(ctx, prefix)
+		if err != nil {
+			return err
+		}
+
+		previous[prefix] = recs
+	}
+
+	for i, prefix := range prefixes {
+		err := writeRecords(ctx, colls[prefix], staged[prefix])
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("failed to restore %s records: %w", prefix, err)
+
+		// The restore might fail because ctx is done, the rollback must not
+		rctx := context.WithoutCancel(ctx)
+		for _, prefix := range prefixes[:i+1] {
+			if rerr := writeRecords(rctx, colls[prefix], previous[prefix]); rerr != nil {
+				return errors.Join(err, fmt.Errorf("failed to roll back %s records: %w", prefix, rerr))
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// writeRecords replaces all records of the collection with the given ones.
+func writeRecords(ctx context.Context, coll *db.Collection, recs []*record) error {
+	ids := []string{}
+	err := store.Client.Scan(ctx, coll.Prefix, func(item *db.Item) bool {
+		ids = append(ids, item.ID)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := store.Client.Delete(ctx, coll, id, db.AnyVersion); err != nil {
+			return err
+		}
+	}
+
+	for _, rec := range recs {
+		if _, err := store.Client.Set(ctx, coll, rec.ID, rec.Value, db.AnyVersion); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stopLambda drops container state, containers of the backed up installation don't exist here.
+func stopLambda(raw []byte, report *model.RestoreReport) ([]byte, error) {
+	l := &api.Lambda{}
+	if err := json.Unmarshal(raw, l); err != nil {
+		return nil, err
+	}
+
+	if l.Docker.ContainerId != nil {
+		report.Running = append(report.Running, l.Id)
+	}
+
+	l.Docker = api.Docker{}
+
+	return json.Marshal(l)
+}
+
+func restoreObject(ctx context.Context, bucket string, key string, hdr *tar.Header, r io.Reader) error {
+	var metadata map[string]string
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, metaPrefix); ok {
+			if metadata == nil {
+				metadata = map[string]string{}
+			}
+
+			metadata[name] = v
+		}
+	}
+
+	return artifact.Client.Put(ctx, bucket, key, r, hdr.Size, metadata)
+}
+
+func (s service) Start(ctx context.Context, lambdas []string) []*model.StartResult {
+	res := make([]*model.StartResult, 0, len(lambdas))
+	for _, id := range lambdas {
+		result := &model.StartResult{Lambda: id}
+		if err := s.lambdaSvc.Start(ctx, id, db.AnyVersion); err != nil {
+			result.Error = err.Error()
+		}
+
+		res = append(res, result)
+	}
+
+	return res
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/onpremless/opless/manager/model"
+)
+
+// bindCreate binds the JSON creation request along with its optional build params.
+func bindCreate(c *gin.Context, req any) (*model.BuildParams, error) {
+	if err := c.ShouldBindBodyWith(req, binding.JSON); err != nil {
+		return nil, err
+	}
+
+	build := &model.BuildRequest{}
+	if err := c.ShouldBindBodyWith(build, binding.JSON); err != nil {
+		return nil, err
+	}
+
+	if build.Build == nil {
+		return nil, nil
+	}
+
+	if err := model.ValidateBuildParams(build.Build); err != nil {
+		return nil, err
+	}
+
+	return build.Build, nil
+}
+
+// bindImage binds the optional pre-built image of the lambda creation request.
+func bindImage(c *gin.Context) (*model.ImageSource, error) {
+	req := &model.ImageRequest{}
+	if err := c.ShouldBindBodyWith(req, binding.JSON); err != nil {
+		return nil, err
+	}
+
+	return req.Image, nil
+}
@@ -0,0 +1,438 @@
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/onpremless/go-client"
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/docker"
+	"github.com/onpremless/opless/manager/endpoint"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/lambda"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+// Bundle layout: the manifest comes first, so the import checks conflicts before loading
+// the image, followed by the 'docker save' output with entries prefixed by imageDir.
+const (
+	manifestName = "bundle.json"
+	imageDir     = "image/"
+)
+
+const (
+	maxManifestSize = 1 << 20
+	// maxRenames is the number of '<name>-<n>' names tried on conflict
+	maxRenames = 100
+)
+
+var ErrNotBuilt = errors.New("lambda has no image, start it to build one")
+
+type BundleService interface {
+	// Manifest describes the lambda export, nil is returned if there is no such lambda.
+	// ErrNotBuilt is returned if the image of the lambda isn't on the host.
+	Manifest(ctx context.Context, id string) (*model.LambdaBundle, error)
+	// Export writes the bundle of the manifest and the lambda image.
+	Export(ctx context.Context, bundle *model.LambdaBundle, w io.Writer) error
+	// Import loads the image from the bundle and recreates the lambda as one running it
+	// along with its endpoints. Conflicts are db.ConflictError unless opts rename the lambda.
+	Import(ctx context.Context, r io.Reader, opts *model.ImportOptions) (*model.ImportResult, error)
+}
+
+type service struct {
+	dockerSvc   docker.DockerService
+	lambdaSvc   lambda.LambdaService
+	endpointSvc endpoint.EndpointService
+}
+
+func CreateBundleService(lambdaSvc lambda.LambdaService, endpointSvc endpoint.EndpointService) (BundleService, error) {
+	dockerSvc, err := docker.NewDockerService(store.OPlessID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &service{
+		dockerSvc:   dockerSvc,
+		lambdaSvc:   lambdaSvc,
+		endpointSvc: endpointSvc,
+	}, nil
+}
+
+func (s service) Manifest(ctx context.Context, id string) (*model.LambdaBundle, error) {
+	l, err := lambda.GetLambda(ctx, id)
+	if err != nil || l == nil {
+		return nil, err
+	}
+
+	build, err := lambda.GetLambdaBuild(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if build == nil || build.ImageId == "" {
+		return nil, ErrNotBuilt
+	}
+
+	imageID, err := s.dockerSvc.ImageID(ctx, build.ImageId)
+	if err != nil {
+		return nil, err
+	}
+
+	if imageID == "" {
+		return nil, ErrNotBuilt
+	}
+
+	bundle := &model.LambdaBundle{
+		Format:     model.BundleFormat,
+		Lambda:     l,
+		Build:      build,
+		ExportedAt: time.Now().UnixMilli(),
+	}
+
+	// Container state makes no sense on another host
+	bundle.Lambda.Docker = api.Docker{}
+
+	if l.Runtime == "" {
+		bundle.Image, err = lambda.GetLambdaImage(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := runtimeManifest(ctx, bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	bundle.Endpoints, err = endpoint.GetLambdaEndpoints(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+func runtimeManifest(ctx context.Context, bundle *model.LambdaBundle) error {
+	var err error
+	bundle.Runtime, err = lambda.GetRuntime(ctx, bundle.Lambda.Runtime)
+	if err != nil {
+		return err
+	}
+
+	if bundle.Build.RuntimeVersion != 0 {
+		bundle.RuntimeVersion, err = lambda.GetRuntimeVersion(ctx, bundle.Lambda.Runtime, bundle.Build.RuntimeVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	bundle.BuildParams, err = lambda.GetLambdaBuildParams(ctx, bundle.Lambda.Id)
+	return err
+}
+
+func (s service) Export(ctx context.Context, bundle *model.LambdaBundle, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	manifest, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: time.UnixMilli(bundle.ExportedAt),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	// Saved by id, so the image is loaded exactly as it's built and not the one the tag is moved to
+	saved, err := s.dockerSvc.Save(ctx, []string{bundle.Build.ImageId})
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+
+	tr := tar.NewReader(saved)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = imageDir + hdr.Name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = imageDir + hdr.Linkname
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func (s service) Import(ctx context.Context, r io.Reader, opts *model.ImportOptions) (*model.ImportResult, error) {
+	tr := tar.NewReader(r)
+
+	bundle, err := readManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	name := bundle.Lambda.Name
+	if opts.Name != "" {
+		name = opts.Name
+	}
+
+	res := &model.ImportResult{Endpoints: []*api.Endpoint{}, Skipped: []*model.SkippedEndpoint{}}
+
+	name, res.Renamed, err = freeName(ctx, name, opts.OnConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := s.checkEndpoints(ctx, bundle, opts.OnConflict, res)
+	if err != nil {
+		return nil, err
+	}
+
+	// An image present before the import might be used by other lambdas, so it's kept
+	// if the import fails
+	present, err := s.dockerSvc.ImageID(ctx, bundle.Build.ImageId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.load(ctx, tr); err != nil {
+		return nil, fmt.Errorf("failed to load image: %w", err)
+	}
+
+	imageID, err := s.dockerSvc.ImageID(ctx, bundle.Build.ImageId)
+	if err != nil {
+		return nil, err
+	}
+
+	if imageID == "" {
+		return nil, errs.New(errs.Validation, "bundle has no image %s", bundle.Build.ImageId)
+	}
+
+	now := time.Now().UnixMilli()
+	l := &api.Lambda{
+		Id:         name,
+		Name:       name,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		LambdaType: bundle.Lambda.LambdaType,
+	}
+
+	// The image can't be rebuilt or pulled, so the lambda runs it as a pre-built one
+	image := &model.LambdaImage{
+		Id:       name,
+		Ref:      bundle.Build.Image,
+		Pinned:   imageID,
+		ImageId:  imageID,
+		PulledAt: now,
+		Imported: true,
+	}
+
+	if bundle.Image != nil {
+		image.Ref = bundle.Image.Ref
+	}
+
+	if bundle.Build.Params != nil {
+		image.Platform = bundle.Build.Params.Platform
+	}
+
+	if err := s.lambdaSvc.ImportLambda(ctx, l, image); err != nil {
+		if present == "" {
+			if rerr := s.dockerSvc.RemoveImage(ctx, imageID); rerr != nil {
+				logger.L.Warn("Failed to remove image of failed import", zap.String("image", imageID), zap.Error(rerr))
+			}
+		}
+
+		return nil, err
+	}
+
+	res.Lambda = l
+
+	for _, e := range endpoints {
+		created, err := s.endpointSvc.Create(ctx, &api.CreateEndpoint{Name: e.Name, Path: e.Path, Lambda: name})
+		// Path might be taken after it's checked
+		if err != nil {
+			res.Skipped = append(res.Skipped, &model.SkippedEndpoint{Endpoint: e, Reason: err.Error()})
+			continue
+		}
+
+		res.Endpoints = append(res.Endpoints, created)
+	}
+
+	return res, nil
+}
+
+func readManifest(tr *tar.Reader) (*model.LambdaBundle, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errs.New(errs.Validation, "failed to read bundle: %w", err)
+	}
+
+	if hdr.Name != manifestName {
+		return nil, errs.New(errs.Validation, "bundle must start with %s, got %s", manifestName, hdr.Name)
+	}
+
+	if hdr.Size > maxManifestSize {
+		return nil, errs.New(errs.Validation, "%s is larger than %d bytes", manifestName, maxManifestSize)
+	}
+
+	bundle := &model.LambdaBundle{}
+	if err := json.NewDecoder(tr).Decode(bundle); err != nil {
+		return nil, errs.New(errs.Validation, "invalid %s: %w", manifestName, err)
+	}
+
+	if err := model.ValidateLambdaBundle(bundle); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// freeName returns the name if it's free, otherwise the first free '<name>-<n>' one
+// if conflicts are resolved by renaming.
+func freeName(ctx context.Context, name string, onConflict string) (string, bool, error) {
+	existing, err := lambda.GetLambda(ctx, name)
+	if err != nil {
+		return "", false, err
+	}
+
+	if existing == nil {
+		return name, false, nil
+	}
+
+	if onConflict != model.ConflictRename {
+		return "", false, &db.ConflictError{Field: "name", Value: name, ID: existing.Id}
+	}
+
+	for i := 2; i < maxRenames+2; i++ {
+		candidate := name + "-" + strconv.Itoa(i)
+		existing, err := lambda.GetLambda(ctx, candidate)
+		if err != nil {
+			return "", false, err
+		}
+
+		if existing == nil {
+			return candidate, true, nil
+		}
+	}
+
+	return "", false, errs.New(errs.Conflict, "no free name for lambda '%s' within %d attempts", name, maxRenames)
+}
+
+// checkEndpoints returns exported endpoints to recreate, ones with taken paths are
+// rejected or skipped depending on conflict resolution.
+func (s service) checkEndpoints(ctx context.Context, bundle *model.LambdaBundle, onConflict string, res *model.ImportResult) ([]*api.Endpoint, error) {
+	endpoints := []*api.Endpoint{}
+	for _, e := range bundle.Endpoints {
+		existing, err := endpoint.GetEndpointByPath(ctx, e.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing == nil {
+			endpoints = append(endpoints, e)
+			continue
+		}
+
+		if onConflict != model.ConflictRename {
+			return nil, &db.ConflictError{Field: "path", Value: e.Path, ID: existing.Id}
+		}
+
+		res.Skipped = append(res.Skipped, &model.SkippedEndpoint{
+			Endpoint: e,
+			Reason:   fmt.Sprintf("path is taken by endpoint %s", existing.Id),
+		})
+	}
+
+	return endpoints, nil
+}
+
+// load streams the rest of the bundle to docker as the 'docker save' output it was exported from.
+func (s service) load(ctx context.Context, tr *tar.Reader) error {
+	pr, pw := io.Pipe()
+	unwrapped := make(chan error, 1)
+
+	go func() {
+		err := unwrapImage(tr, pw)
+		pw.CloseWithError(err)
+		unwrapped <- err
+	}()
+
+	err := s.dockerSvc.Load(ctx, pr)
+	// Unblocks the writer if docker has stopped reading
+	pr.CloseWithError(err)
+
+	// Docker fails to load a broken bundle, the cause is reported instead
+	if uerr := <-unwrapped; errs.KindOf(uerr) == errs.Validation {
+		return uerr
+	}
+
+	return err
+}
+
+func unwrapImage(tr *tar.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return errs.New(errs.Validation, "failed to read bundle: %w", err)
+		}
+
+		name, ok := strings.CutPrefix(hdr.Name, imageDir)
+		if !ok || name == "" {
+			return errs.New(errs.Validation, "unexpected bundle entry: %s", hdr.Name)
+		}
+
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = strings.TrimPrefix(hdr.Linkname, imageDir)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/model"
+)
+
+// Runtimes of the catalog follow the platform contract: lambdas listen on Port and
+// answer HealthPath once ready, code is copied into CodeDir.
+const (
+	Port       = 3000
+	HealthPath = "/health"
+	CodeDir    = "/app"
+)
+
+//go:embed runtimes
+var runtimesFS embed.FS
+
+// Runtime is a curated runtime shipped with opless.
+type Runtime struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Path        string             `json:"dockerfile"`
+	Build       *model.BuildParams `json:"build"`
+	Dockerfile  []byte             `json:"-"`
+}
+
+// Digest changes whenever an opless release changes the runtime.
+func (r *Runtime) Digest() string {
+	params, _ := json.Marshal(r.Build)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "dockerfile sha256:%x\n", sha256.Sum256(r.Dockerfile))
+	fmt.Fprintf(hash, "params %s\n", params)
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// Runtimes returns the embedded catalog. Its Dockerfiles are checked by the parser,
+// so a broken catalog fails the startup rather than lambda builds.
+func Runtimes() ([]*Runtime, error) {
+	raw, err := runtimesFS.ReadFile("runtimes/catalog.json")
+	if err != nil {
+		return nil, err
+	}
+
+	runtimes := []*Runtime{}
+	if err := json.Unmarshal(raw, &runtimes); err != nil {
+		return nil, fmt.Errorf("failed to parse runtime catalog: %w", err)
+	}
+
+	for _, runtime := range runtimes {
+		if runtime.Build == nil {
+			runtime.Build = &model.BuildParams{}
+		}
+
+		if err := model.ValidateBuildParams(runtime.Build); err != nil {
+			return nil, fmt.Errorf("runtime %s of catalog: %w", runtime.Name, err)
+		}
+
+		runtime.Dockerfile, err = runtimesFS.ReadFile("runtimes/" + runtime.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := dockerfile.Parse(bytes.NewReader(runtime.Dockerfile)); err != nil {
+			return nil, fmt.Errorf("runtime %s of catalog: %w", runtime.Name, err)
+		}
+	}
+
+	return runtimes, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	api "github.com/onpremless/go-client"
+
+	"github.com/onpremless/opless/manager/errs"
+)
+
+const nextCursorHeader = "X-Next-Cursor"
+
+var errNotFound = errors.New("not found")
+
+// client calls the manager API, responses are decoded into the types the manager uses.
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func newClient(server string, token string) *client {
+	return &client{server: strings.TrimSuffix(server, "/"), token: token, http: &http.Client{}}
+}
+
+// apiError is the error the manager responds with, Body is nil if the response isn't
+// the error envelope.
+type apiError struct {
+	Status int
+	Body   *errs.Body
+}
+
+func (e *apiError) Error() string {
+	if e.Body == nil || e.Body.Error == "" {
+		return fmt.Sprintf("manager responded with %d %s", e.Status, http.StatusText(e.Status))
+	}
+
+	if e.Body.RequestID == "" {
+		return fmt.Sprintf("%s (%d %s)", e.Body.Error, e.Status, e.Body.Code)
+	}
+
+	return fmt.Sprintf("%s (%d %s, request %s)", e.Body.Error, e.Status, e.Body.Code, e.Body.RequestID)
+}
+
+func (c *client) request(ctx context.Context, method string, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errNotFound
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+
+		e := &apiError{Status: res.StatusCode}
+		body := &errs.Body{}
+		if json.NewDecoder(res.Body).Decode(body) == nil {
+			e.Body = body
+		}
+
+		return nil, e
+	}
+
+	return res, nil
+}
+
+// do sends the body as JSON and decodes the response into out, it returns the response
+// headers.
+func (c *client) do(ctx context.Context, method string, path string, body any, out any, header http.Header) (http.Header, error) {
+	var r io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		r = bytes.NewReader(raw)
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.request(ctx, method, path, r, header)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if out == nil || len(raw) == 0 {
+		return res.Header, nil
+	}
+
+	return res.Header, json.Unmarshal(raw, out)
+}
+
+func (c *client) get(ctx context.Context, path string, out any) error {
+	_, err := c.do(ctx, http.MethodGet, path, nil, out, nil)
+	return err
+}
+
+// getOptional is get reporting whether the resource is found instead of errNotFound.
+func (c *client) getOptional(ctx context.Context, path string, out any) (bool, error) {
+	err := c.get(ctx, path, out)
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// list fetches every page of the list route.
+func list[T any](ctx context.Context, c *client, path string, query url.Values) ([]*T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	items := []*T{}
+	for {
+		var page []*T
+		header, err := c.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, &page, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, page...)
+
+		next := header.Get(nextCursorHeader)
+		if next == "" {
+			return items, nil
+		}
+
+		query.Set("cursor", next)
+	}
+}
+
+// upload uploads the content as a file and returns the upload id.
+func (c *client) upload(ctx context.Context, name string, content io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := form.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+
+		if err == nil {
+			err = form.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	res, err := c.request(ctx, http.MethodPost, "/upload", pr, http.Header{"Content-Type": {form.FormDataContentType()}})
+	if err != nil {
+		pr.CloseWithError(err)
+		return "", err
+	}
+	defer res.Body.Close()
+
+	upload := &api.UploadResponse{}
+	if err := json.NewDecoder(res.Body).Decode(upload); err != nil {
+		return "", err
+	}
+
+	return upload.Id, nil
+}
+
+// lambda resolves the lambda by its id or name.
+func (c *client) lambda(ctx context.Context, ref string) (*api.Lambda, error) {
+	lambda := &api.Lambda{}
+	err := c.get(ctx, "/lambda/"+url.PathEscape(ref), lambda)
+	if err == nil {
+		return lambda, nil
+	}
+
+	if !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+
+	lambdas, err := list[api.Lambda](ctx, c, "/lambda", url.Values{"name": {ref}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lambdas) == 0 {
+		return nil, fmt.Errorf("lambda is not found: %s", ref)
+	}
+
+	return lambdas[0], nil
+}
+
+// runtime resolves the runtime by its id or name.
+func (c *client) runtime(ctx context.Context, ref string) (*api.Runtime, error) {
+	runtime := &api.Runtime{}
+	err := c.get(ctx, "/runtime/"+url.PathEscape(ref), runtime)
+	if err == nil {
+		return runtime, nil
+	}
+
+	if !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+
+	runtimes, err := list[api.Runtime](ctx, c, "/runtime", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, runtime := range runtimes {
+		if runtime.Name == ref {
+			return runtime, nil
+		}
+	}
+
+	return nil, fmt.Errorf("runtime is not found: %s", ref)
+}
+
+// endpoint resolves the endpoint by its id or path, it returns the ETag along.
+func (c *client) endpoint(ctx context.Context, ref string) (*api.Endpoint, string, error) {
+	if strings.HasPrefix(ref, "/") {
+		endpoints, err := list[api.Endpoint](ctx, c, "/endpoint", url.Values{"path_prefix": {ref}})
+		if err != nil {
+			return nil, "", err
+		}
+
+		found := false
+		for _, endpoint := range endpoints {
+			if endpoint.Path == ref {
+				ref, found = endpoint.Id, true
+				break
+			}
+		}
+
+		if !found {
+			return nil, "", fmt.Errorf("endpoint is not found: %s", ref)
+		}
+	}
+
+	endpoint := &api.Endpoint{}
+	header, err := c.do(ctx, http.MethodGet, "/endpoint/"+url.PathEscape(ref), nil, endpoint, nil)
+	if errors.Is(err, errNotFound) {
+		return nil, "", fmt.Errorf("endpoint is not found: %s", ref)
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return endpoint, header.Get("ETag"), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+const configEnv = "OPLESSCTL_CONFIG"
+
+// Config keeps named contexts, each one points to a manager.
+type Config struct {
+	Current  string              `yaml:"current,omitempty"`
+	Contexts map[string]*Context `yaml:"contexts,omitempty"`
+}
+
+type Context struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token,omitempty"`
+}
+
+// configPath returns the path of the config file, $OPLESSCTL_CONFIG overrides the default one.
+func configPath() (string, error) {
+	if path := os.Getenv(configEnv); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "oplessctl", "config.yaml"), nil
+}
+
+// loadConfig reads the config file, missing one is an empty config.
+func loadConfig() (*Config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{Contexts: map[string]*Context{}}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	if config.Contexts == nil {
+		config.Contexts = map[string]*Context{}
+	}
+
+	return config, nil
+}
+
+func saveConfig(config *Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	raw, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, raw, 0o600)
+}
+
+// target resolves the manager URL and the API token: the '-server' and '-token' flags, then
+// $OPLESS_SERVER and $OPLESS_TOKEN, then the context chosen by the '-context' flag or the
+// current one. The token of a context isn't sent to a server given explicitly.
+func (o *options) target() (string, string, error) {
+	token := o.token
+	if token == "" {
+		token = os.Getenv("OPLESS_TOKEN")
+	}
+
+	server := o.serverURL
+	if server == "" {
+		server = os.Getenv("OPLESS_SERVER")
+	}
+
+	if server != "" {
+		return server, token, nil
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return "", "", err
+	}
+
+	name := o.context
+	if name == "" {
+		name = config.Current
+	}
+
+	if name == "" {
+		return "", "", errors.New("no context is chosen, run 'oplessctl context set <name> -server <url>' or pass '-server'")
+	}
+
+	ctx := config.Contexts[name]
+	if ctx == nil {
+		return "", "", fmt.Errorf("context is not found: %s", name)
+	}
+
+	if token == "" {
+		token = ctx.Token
+	}
+
+	return ctx.Server, token, nil
+}
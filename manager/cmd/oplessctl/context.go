@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+func contextCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "context list|current|use <name>|set <name> -server <url> [-token <token>]|delete <name>"
+	if len(args) == 0 {
+		return exactArgs(args, 1, usage)
+	}
+
+	sub := args[0]
+	args, err := o.parse(o.flags("context "+sub), args[1:])
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		return listContexts(o, config)
+	case "current":
+		if config.Current == "" {
+			return fmt.Errorf("no context is chosen")
+		}
+
+		fmt.Println(config.Current)
+		return nil
+	case "use":
+		if err := exactArgs(args, 1, "context use <name>"); err != nil {
+			return err
+		}
+
+		if config.Contexts[args[0]] == nil {
+			return fmt.Errorf("context is not found: %s", args[0])
+		}
+
+		config.Current = args[0]
+	case "set":
+		if err := exactArgs(args, 1, "context set <name> -server <url> [-token <token>]"); err != nil {
+			return err
+		}
+
+		if o.serverURL == "" {
+			return fmt.Errorf("'-server' is required")
+		}
+
+		config.Contexts[args[0]] = &Context{Server: o.serverURL, Token: o.token}
+		// The first context becomes the current one
+		if config.Current == "" {
+			config.Current = args[0]
+		}
+	case "delete":
+		if err := exactArgs(args, 1, "context delete <name>"); err != nil {
+			return err
+		}
+
+		if config.Contexts[args[0]] == nil {
+			return fmt.Errorf("context is not found: %s", args[0])
+		}
+
+		delete(config.Contexts, args[0])
+		if config.Current == args[0] {
+			config.Current = ""
+		}
+	default:
+		return exactArgs(nil, 1, usage)
+	}
+
+	return saveConfig(config)
+}
+
+type contextEntry struct {
+	Name    string `json:"name"`
+	Server  string `json:"server"`
+	Current bool   `json:"current"`
+}
+
+func listContexts(o *options, config *Config) error {
+	entries := []*contextEntry{}
+	for name, ctx := range config.Contexts {
+		entries = append(entries, &contextEntry{Name: name, Server: ctx.Server, Current: name == config.Current})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return render(os.Stdout, o.output, entries, func() *table {
+		tbl := &table{header: []string{"CURRENT", "NAME", "SERVER"}}
+		for _, entry := range entries {
+			current := ""
+			if entry.Current {
+				current = "*"
+			}
+
+			tbl.rows = append(tbl.rows, []string{current, entry.Name, entry.Server})
+		}
+
+		return tbl
+	})
+}
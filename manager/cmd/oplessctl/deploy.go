@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+
+	"github.com/onpremless/opless/manager/model"
+)
+
+// keyValues collects repeated 'key=value' flags.
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	return fmt.Sprint(map[string]string(kv))
+}
+
+func (kv keyValues) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected 'key=value': %s", v)
+	}
+
+	kv[key] = value
+	return nil
+}
+
+// deployCommand uploads the lambda directory and applies a manifest of the lambda along
+// with its endpoint, the manifest is named after the lambda unless '-manifest' is set.
+// The lambda is started and the start task is watched unless it's running already, running
+// lambdas are restarted by the apply itself.
+func deployCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "deploy <dir> -name <name> -runtime <runtime> [-path <path>]"
+
+	fset := o.flags("deploy")
+	name := fset.String("name", "", "lambda name, the directory name by default")
+	runtime := fset.String("runtime", "", "runtime name")
+	lambdaType := fset.String("type", "", "ENDPOINT or INTERNAL, ENDPOINT if '-path' is set")
+	path := fset.String("path", "", "path of the lambda endpoint")
+	manifest := fset.String("manifest", "", "manifest owning the lambda, the lambda name by default")
+	target := fset.String("target", "", "build stage of the runtime Dockerfile")
+	noStart := fset.Bool("no-start", false, "don't start the lambda")
+	adopt := fset.Bool("adopt", false, "take over the lambda and the endpoint if no manifest owns them")
+	timeout := fset.Duration("timeout", 10*time.Minute, "time to wait for the lambda to start")
+	buildArgs := keyValues{}
+	fset.Var(buildArgs, "build-arg", "build arg 'key=value', repeatable")
+
+	args, err := o.parse(fset, args)
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 1, usage); err != nil {
+		return err
+	}
+
+	dir := args[0]
+	if *name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+
+		*name = filepath.Base(abs)
+	}
+
+	if *runtime == "" {
+		return errors.New("'-runtime' is required")
+	}
+
+	if *lambdaType == "" {
+		*lambdaType = lo.Ternary(*path != "", "ENDPOINT", "INTERNAL")
+	}
+
+	if *manifest == "" {
+		*manifest = *name
+	}
+
+	spec := &model.LambdaSpec{Name: *name, Runtime: *runtime, Type: *lambdaType}
+	if len(buildArgs) > 0 || *target != "" {
+		spec.Build = &model.BuildParams{Args: buildArgs, Target: *target}
+	}
+
+	m := &model.Manifest{Name: *manifest, Lambdas: []*model.LambdaSpec{spec}}
+	if *path != "" {
+		m.Endpoints = []*model.EndpointSpec{{Name: *name, Path: *path, Lambda: *name}}
+	}
+
+	// The manifest is validated before the directory is uploaded, the placeholder is
+	// replaced by the upload id
+	spec.Archive = "-"
+	if err := model.ValidateManifest(m); err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	if spec.Archive, err = uploadDir(ctx, c, dir); err != nil {
+		return err
+	}
+
+	plan, err := postManifest(ctx, c, m, false, false, *adopt)
+	if err != nil {
+		return err
+	}
+
+	if err := renderPlan(o, plan); err != nil {
+		return err
+	}
+
+	if *noStart {
+		return nil
+	}
+
+	lambda, err := c.lambda(ctx, *name)
+	if err != nil {
+		return err
+	}
+
+	if lambda.Docker.ContainerId != nil {
+		return nil
+	}
+
+	task, err := lambdaTask(ctx, c, lambda.Id, "start")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "starting %s, task %s\n", lambda.Name, task)
+
+	tctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	return watchTask(tctx, o, c, task, time.Second)
+}
+
+// uploadDir uploads the directory as a zip archive, hidden files and directories are skipped.
+func uploadDir(ctx context.Context, c *client, dir string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(zipDir(dir, pw))
+	}()
+	defer pr.Close()
+
+	id, err := c.upload(ctx, filepath.Base(dir)+".zip", pr)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", dir, err)
+	}
+
+	return id, nil
+}
+
+func zipDir(dir string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(entry, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// applyCommand uploads Dockerfiles and archives the manifest refers to by paths relative
+// to it and applies the manifest, like the 'apply' command of the manager does.
+func applyCommand(ctx context.Context, o *options, args []string) error {
+	fset := o.flags("apply")
+	file := fset.String("f", "", "manifest file")
+	dryRun := fset.Bool("dry-run", false, "only print the plan")
+	prune := fset.Bool("prune", false, "delete resources removed from the manifest")
+	adopt := fset.Bool("adopt", false, "take over existing resources no manifest owns")
+
+	args, err := o.parse(fset, args)
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 0, "apply -f <manifest> [-dry-run] [-prune] [-adopt]"); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("'-f' is required")
+	}
+
+	raw, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+
+	m, err := model.ParseManifest(raw)
+	if err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	// Files are uploaded even for a dry run, the plan compares their checksums
+	dir := filepath.Dir(*file)
+	for _, runtime := range m.Runtimes {
+		if runtime.Dockerfile, err = uploadFile(ctx, c, dir, runtime.Dockerfile); err != nil {
+			return err
+		}
+	}
+
+	for _, lambda := range m.Lambdas {
+		if lambda.Archive == "" {
+			continue
+		}
+
+		if lambda.Archive, err = uploadFile(ctx, c, dir, lambda.Archive); err != nil {
+			return err
+		}
+	}
+
+	plan, err := postManifest(ctx, c, m, *dryRun, *prune, *adopt)
+	if err != nil {
+		return err
+	}
+
+	return renderPlan(o, plan)
+}
+
+// uploadFile uploads the file at the path relative to dir, directories are zipped.
+func uploadFile(ctx context.Context, c *client, dir string, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return uploadDir(ctx, c, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	id, err := c.upload(ctx, filepath.Base(path), f)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", path, err)
+	}
+
+	return id, nil
+}
+
+func postManifest(ctx context.Context, c *client, m *model.Manifest, dryRun bool, prune bool, adopt bool) (*model.Plan, error) {
+	query := url.Values{
+		"dry_run": {strconv.FormatBool(dryRun)},
+		"prune":   {strconv.FormatBool(prune)},
+		"adopt":   {strconv.FormatBool(adopt)},
+	}
+
+	plan := &model.Plan{}
+	if _, err := c.do(ctx, http.MethodPost, "/apply?"+query.Encode(), m, plan, nil); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// renderPlan prints the plan and fails if any of its items failed.
+func renderPlan(o *options, plan *model.Plan) error {
+	err := render(os.Stdout, o.output, plan, func() *table {
+		tbl := &table{header: []string{"KIND", "NAME", "ACTION", "CHANGES", "STATUS", "ERROR"}}
+		for _, item := range plan.Items {
+			tbl.rows = append(tbl.rows, []string{
+				item.Kind, item.Name, lo.Ternary(item.Adopt, item.Action+" (ADOPT)", item.Action),
+				orDash(strings.Join(item.Changes, ",")), item.Status, orDash(item.Error),
+			})
+		}
+
+		return tbl
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := lo.CountBy(plan.Items, func(item *model.PlanItem) bool { return item.Status == model.ApplyFailed })
+	if failed > 0 {
+		return fmt.Errorf("%d of %d resources failed", failed, len(plan.Items))
+	}
+
+	return nil
+}
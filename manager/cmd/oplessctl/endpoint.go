@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	api "github.com/onpremless/go-client"
+)
+
+func endpointCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "endpoint create -name <name> -path <path> -lambda <lambda>|update <id or path> [-name] [-path] [-lambda]|delete <id or path>"
+	if len(args) == 0 {
+		return exactArgs(args, 1, usage)
+	}
+
+	sub := args[0]
+	fs := o.flags("endpoint " + sub)
+	name := fs.String("name", "", "endpoint name")
+	path := fs.String("path", "", "endpoint path")
+	lambdaRef := fs.String("lambda", "", "lambda id or name")
+
+	args, err := o.parse(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	// Lambdas are referred to by id in endpoints
+	lambdaID := ""
+	if *lambdaRef != "" {
+		lambda, err := c.lambda(ctx, *lambdaRef)
+		if err != nil {
+			return err
+		}
+
+		lambdaID = lambda.Id
+	}
+
+	switch sub {
+	case "create":
+		if err := exactArgs(args, 0, usage); err != nil {
+			return err
+		}
+
+		if *name == "" || *path == "" || lambdaID == "" {
+			return errors.New("'-name', '-path' and '-lambda' are required")
+		}
+
+		req := &api.CreateEndpoint{Name: *name, Path: *path, Lambda: lambdaID}
+		endpoint := &api.Endpoint{}
+		if _, err := c.do(ctx, http.MethodPost, "/endpoint", req, endpoint, nil); err != nil {
+			return err
+		}
+
+		return renderEndpoint(o, endpoint)
+	case "update":
+		if err := exactArgs(args, 1, usage); err != nil {
+			return err
+		}
+
+		endpoint, etag, err := c.endpoint(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		req := &api.CreateEndpoint{Name: endpoint.Name, Path: endpoint.Path, Lambda: endpoint.Lambda}
+		if *name != "" {
+			req.Name = *name
+		}
+
+		if *path != "" {
+			req.Path = *path
+		}
+
+		if lambdaID != "" {
+			req.Lambda = lambdaID
+		}
+
+		// The endpoint is changed only if nobody changed it since it's read
+		header := http.Header{}
+		if etag != "" {
+			header.Set("If-Match", etag)
+		}
+
+		updated := &api.Endpoint{}
+		if _, err := c.do(ctx, http.MethodPut, "/endpoint/"+url.PathEscape(endpoint.Id), req, updated, header); err != nil {
+			return err
+		}
+
+		return renderEndpoint(o, updated)
+	case "delete":
+		if err := exactArgs(args, 1, usage); err != nil {
+			return err
+		}
+
+		endpoint, _, err := c.endpoint(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		_, err = c.do(ctx, http.MethodDelete, "/endpoint/"+url.PathEscape(endpoint.Id), nil, nil, nil)
+		return err
+	default:
+		return exactArgs(nil, 1, usage)
+	}
+}
+
+func renderEndpoint(o *options, endpoint *api.Endpoint) error {
+	return render(os.Stdout, o.output, endpoint, func() *table {
+		return endpointTable([]*api.Endpoint{endpoint})
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	api "github.com/onpremless/go-client"
+)
+
+func startCommand(ctx context.Context, o *options, args []string) error {
+	return lambdaTaskCommand(ctx, o, "start", args)
+}
+
+func destroyCommand(ctx context.Context, o *options, args []string) error {
+	return lambdaTaskCommand(ctx, o, "destroy", args)
+}
+
+// lambdaTaskCommand runs the action of the lambda, the task is watched if '-wait' is set.
+func lambdaTaskCommand(ctx context.Context, o *options, action string, args []string) error {
+	fs := o.flags(action)
+	wait := fs.Bool("wait", false, "watch the task until it finishes")
+	timeout := fs.Duration("timeout", 10*time.Minute, "time to wait for the task")
+
+	args, err := o.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 1, action+" <lambda> [-wait]"); err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	lambda, err := c.lambda(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	task, err := lambdaTask(ctx, c, lambda.Id, action)
+	if err != nil {
+		return err
+	}
+
+	if !*wait {
+		return render(os.Stdout, o.output, &api.TaskResponse{Task: task}, func() *table {
+			return details("Task", task)
+		})
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	return watchTask(tctx, o, c, task, time.Second)
+}
+
+// lambdaTask starts the action of the lambda and returns the id of its task.
+func lambdaTask(ctx context.Context, c *client, id string, action string) (string, error) {
+	res := &api.TaskResponse{}
+	if _, err := c.do(ctx, http.MethodPost, "/lambda/"+url.PathEscape(id)+"/"+action, nil, res, nil); err != nil {
+		return "", err
+	}
+
+	return res.Task, nil
+}
+
+func logsCommand(ctx context.Context, o *options, args []string) error {
+	fs := o.flags("logs")
+	follow := fs.Bool("f", false, "follow the logs")
+	tail := fs.String("tail", "100", "number of last lines or 'all'")
+
+	args, err := o.parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 1, "logs <lambda> [-f] [-tail <n>]"); err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	lambda, err := c.lambda(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"follow": {strconv.FormatBool(*follow)}, "tail": {*tail}}
+	res, err := c.request(ctx, http.MethodGet, "/lambda/"+url.PathEscape(lambda.Id)+"/logs?"+query.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Interrupting the follow is not an error
+	if _, err := io.Copy(os.Stdout, res.Body); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("logs stream is broken: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// oplessctl is the command line client of the manager API.
+//
+//	oplessctl context list|current|use <name>|set <name> -server <url> [-token <token>]|delete <name>
+//	oplessctl get lambdas|runtimes|endpoints
+//	oplessctl describe lambda|runtime|endpoint <id or name>
+//	oplessctl deploy <dir> -name <name> -runtime <runtime> [-path <path>]
+//	oplessctl apply -f <manifest> [-dry-run] [-prune] [-adopt]
+//	oplessctl start|destroy <lambda> [-wait]
+//	oplessctl logs <lambda> [-f] [-tail <n>]
+//	oplessctl task get|watch <id>
+//	oplessctl endpoint create|update|delete
+//	oplessctl token list|create <name> -scope <scopes> [-ttl <seconds>]|revoke <id>
+//
+// Every command talking to the manager accepts '-context', '-server', '-token' and
+// '-o table|json|yaml'.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+// options are flags shared by commands talking to the manager.
+type options struct {
+	context   string
+	serverURL string
+	token     string
+	output    string
+}
+
+// flags creates the flag set of the command along with the shared flags.
+func (o *options) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&o.context, "context", "", "context to use instead of the current one")
+	fs.StringVar(&o.serverURL, "server", "", "manager URL, overrides the context")
+	fs.StringVar(&o.token, "token", "", "API token, overrides the context")
+	fs.StringVar(&o.output, "o", outputTable, "output format: table, json or yaml")
+
+	return fs
+}
+
+// parse parses the flags, positional arguments may go before them.
+func (o *options) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	return positional, validOutput(o.output)
+}
+
+func (o *options) client() (*client, error) {
+	server, token, err := o.target()
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(server, token), nil
+}
+
+type command func(ctx context.Context, o *options, args []string) error
+
+var commands = map[string]command{
+	"context":  contextCommand,
+	"get":      getCommand,
+	"describe": describeCommand,
+	"deploy":   deployCommand,
+	"apply":    applyCommand,
+	"start":    startCommand,
+	"destroy":  destroyCommand,
+	"logs":     logsCommand,
+	"task":     taskCommand,
+	"endpoint": endpointCommand,
+	"token":    tokenCommand,
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: oplessctl <command> [args], commands: %s\n", strings.Join(names, ", "))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := cmd(ctx, &options{}, os.Args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// exactArgs checks the number of positional arguments.
+func exactArgs(args []string, n int, usage string) error {
+	if len(args) != n {
+		return fmt.Errorf("usage: oplessctl %s", usage)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// table is the tabular form of a resource or a list of them.
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+func validOutput(output string) error {
+	switch output {
+	case outputTable, outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("invalid output format: %s, expected one of table, json, yaml", output)
+	}
+}
+
+// render writes the value in the chosen format, JSON and YAML use the API field names.
+func render(w io.Writer, output string, value any, tbl func() *table) error {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+	case outputYAML:
+		return printYAML(w, value)
+	default:
+		return printTable(w, tbl())
+	}
+}
+
+func printTable(w io.Writer, tbl *table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(tbl.header, "\t"))
+	for _, row := range tbl.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// printYAML goes through JSON, so YAML keeps field names and their order.
+func printYAML(w io.Writer, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal(raw, node); err != nil {
+		return err
+	}
+	blockStyle(node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// blockStyle drops the flow style JSON is parsed with.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// details is the table of a single resource, one field per row.
+func details(fields ...string) *table {
+	tbl := &table{header: []string{"FIELD", "VALUE"}}
+	for i := 0; i+1 < len(fields); i += 2 {
+		tbl.rows = append(tbl.rows, []string{fields[i], fields[i+1]})
+	}
+
+	return tbl
+}
+
+func millis(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+
+	return time.UnixMilli(ms).Local().Format(time.RFC3339)
+}
+
+func micros(us *int64) string {
+	if us == nil {
+		return "-"
+	}
+
+	return time.UnixMicro(*us).Local().Format(time.RFC3339)
+}
+
+func deref(s *string) string {
+	if s == nil || *s == "" {
+		return "-"
+	}
+
+	return *s
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	api "github.com/onpremless/go-client"
+
+	"github.com/onpremless/opless/manager/model"
+)
+
+func getCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "get lambdas|runtimes|endpoints"
+	if len(args) == 0 {
+		return exactArgs(args, 1, usage)
+	}
+
+	kind := args[0]
+	fs := o.flags("get " + kind)
+	query := url.Values{}
+	filter := func(name string, usage string) {
+		fs.Func(name, usage, func(v string) error {
+			query.Set(strings.ReplaceAll(name, "-", "_"), v)
+			return nil
+		})
+	}
+	filter("sort-by", "sort field: created_at, updated_at or name")
+	filter("order", "sort order: asc or desc")
+
+	switch kind {
+	case "lambdas", "lambda":
+		filter("runtime", "runtime id")
+		filter("lambda-type", "ENDPOINT or INTERNAL")
+		filter("status", "docker status")
+		filter("name", "lambda name")
+	case "endpoints", "endpoint":
+		filter("lambda", "lambda id")
+		filter("path-prefix", "path prefix")
+	case "runtimes", "runtime":
+	default:
+		return exactArgs(nil, 1, usage)
+	}
+
+	args, err := o.parse(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 0, usage); err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "lambdas", "lambda":
+		lambdas, err := list[api.Lambda](ctx, c, "/lambda", query)
+		if err != nil {
+			return err
+		}
+
+		return render(os.Stdout, o.output, lambdas, func() *table { return lambdaTable(lambdas) })
+	case "endpoints", "endpoint":
+		endpoints, err := list[api.Endpoint](ctx, c, "/endpoint", query)
+		if err != nil {
+			return err
+		}
+
+		return render(os.Stdout, o.output, endpoints, func() *table { return endpointTable(endpoints) })
+	default:
+		runtimes, err := list[api.Runtime](ctx, c, "/runtime", query)
+		if err != nil {
+			return err
+		}
+
+		return render(os.Stdout, o.output, runtimes, func() *table { return runtimeTable(runtimes) })
+	}
+}
+
+func lambdaTable(lambdas []*api.Lambda) *table {
+	tbl := &table{header: []string{"ID", "NAME", "TYPE", "RUNTIME", "STATUS", "UPDATED"}}
+	for _, l := range lambdas {
+		tbl.rows = append(tbl.rows, []string{l.Id, l.Name, l.LambdaType, orDash(l.Runtime), orDash(l.Docker.Status), millis(l.UpdatedAt)})
+	}
+
+	return tbl
+}
+
+func runtimeTable(runtimes []*api.Runtime) *table {
+	tbl := &table{header: []string{"ID", "NAME", "CREATED", "UPDATED"}}
+	for _, r := range runtimes {
+		tbl.rows = append(tbl.rows, []string{r.Id, r.Name, millis(r.CreatedAt), millis(r.UpdatedAt)})
+	}
+
+	return tbl
+}
+
+func endpointTable(endpoints []*api.Endpoint) *table {
+	tbl := &table{header: []string{"ID", "NAME", "PATH", "LAMBDA", "UPDATED"}}
+	for _, e := range endpoints {
+		tbl.rows = append(tbl.rows, []string{e.Id, e.Name, e.Path, e.Lambda, millis(e.UpdatedAt)})
+	}
+
+	return tbl
+}
+
+// lambdaDescription is the lambda along with its build and endpoints.
+type lambdaDescription struct {
+	Lambda    *api.Lambda        `json:"lambda"`
+	Build     *model.LambdaBuild `json:"build,omitempty"`
+	Image     *model.LambdaImage `json:"image,omitempty"`
+	Endpoints []*api.Endpoint    `json:"endpoints"`
+	Params    *model.BuildParams `json:"build_params,omitempty"`
+}
+
+// runtimeDescription is the runtime along with its versions and lambdas depending on it.
+type runtimeDescription struct {
+	Runtime  *api.Runtime            `json:"runtime"`
+	Versions []*model.RuntimeVersion `json:"versions"`
+	Lambdas  []*model.RuntimeLambda  `json:"lambdas"`
+}
+
+func describeCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "describe lambda|runtime|endpoint <id or name>"
+	args, err := o.parse(o.flags("describe"), args)
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 2, usage); err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "lambda":
+		return describeLambda(ctx, o, c, args[1])
+	case "runtime":
+		return describeRuntime(ctx, o, c, args[1])
+	case "endpoint":
+		endpoint, _, err := c.endpoint(ctx, args[1])
+		if err != nil {
+			return err
+		}
+
+		return render(os.Stdout, o.output, endpoint, func() *table {
+			return details(
+				"Id", endpoint.Id,
+				"Name", endpoint.Name,
+				"Path", endpoint.Path,
+				"Lambda", endpoint.Lambda,
+				"Created", millis(endpoint.CreatedAt),
+				"Updated", millis(endpoint.UpdatedAt),
+			)
+		})
+	default:
+		return exactArgs(nil, 2, usage)
+	}
+}
+
+func describeLambda(ctx context.Context, o *options, c *client, ref string) error {
+	lambda, err := c.lambda(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	desc := &lambdaDescription{Lambda: lambda}
+	path := "/lambda/" + url.PathEscape(lambda.Id)
+
+	// Lambdas which are not built yet have no build, pre-built ones have no build params
+	if lambda.Runtime == "" {
+		image := &model.LambdaImage{}
+		if found, err := c.getOptional(ctx, path+"/image", image); err != nil {
+			return err
+		} else if found {
+			desc.Image = image
+		}
+	} else {
+		build := &model.LambdaBuild{}
+		if found, err := c.getOptional(ctx, path+"/build", build); err != nil {
+			return err
+		} else if found {
+			desc.Build = build
+		}
+
+		params := &model.BuildParams{}
+		if found, err := c.getOptional(ctx, path+"/build-params", params); err != nil {
+			return err
+		} else if found {
+			desc.Params = params
+		}
+	}
+
+	if desc.Endpoints, err = list[api.Endpoint](ctx, c, "/endpoint", url.Values{"lambda": {lambda.Id}}); err != nil {
+		return err
+	}
+
+	return render(os.Stdout, o.output, desc, func() *table {
+		tbl := details(
+			"Id", lambda.Id,
+			"Name", lambda.Name,
+			"Type", lambda.LambdaType,
+			"Runtime", orDash(lambda.Runtime),
+			"Status", orDash(lambda.Docker.Status),
+			"Image", deref(lambda.Docker.Image),
+			"Container", deref(lambda.Docker.Container),
+			"Created", millis(lambda.CreatedAt),
+			"Updated", millis(lambda.UpdatedAt),
+		)
+
+		if desc.Image != nil {
+			tbl.rows = append(tbl.rows, []string{"Source", desc.Image.Ref}, []string{"Pinned", orDash(desc.Image.Pinned)})
+		}
+
+		for _, endpoint := range desc.Endpoints {
+			tbl.rows = append(tbl.rows, []string{"Endpoint", endpoint.Path})
+		}
+
+		return tbl
+	})
+}
+
+func describeRuntime(ctx context.Context, o *options, c *client, ref string) error {
+	runtime, err := c.runtime(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	desc := &runtimeDescription{Runtime: runtime}
+	path := "/runtime/" + url.PathEscape(runtime.Id)
+
+	if _, err := c.getOptional(ctx, path+"/version", &desc.Versions); err != nil {
+		return err
+	}
+
+	if _, err := c.getOptional(ctx, path+"/lambdas", &desc.Lambdas); err != nil {
+		return err
+	}
+
+	return render(os.Stdout, o.output, desc, func() *table {
+		tbl := details(
+			"Id", runtime.Id,
+			"Name", runtime.Name,
+			"Created", millis(runtime.CreatedAt),
+			"Updated", millis(runtime.UpdatedAt),
+		)
+
+		for _, version := range desc.Versions {
+			tbl.rows = append(tbl.rows, []string{"Version", fmt.Sprintf("%d (%s)", version.Version, version.Digest)})
+		}
+
+		for _, l := range desc.Lambdas {
+			tbl.rows = append(tbl.rows, []string{"Lambda", fmt.Sprintf("%s (version %d)", l.Lambda, l.Version)})
+		}
+
+		return tbl
+	})
+}
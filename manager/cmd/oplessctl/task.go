@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/onpremless/opless/manager/task"
+)
+
+func taskCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "task get|watch <id>"
+	if len(args) == 0 {
+		return exactArgs(args, 1, usage)
+	}
+
+	sub := args[0]
+	fs := o.flags("task " + sub)
+	interval := fs.Duration("interval", time.Second, "polling interval of 'watch'")
+	timeout := fs.Duration("timeout", 0, "time to watch the task, unlimited by default")
+
+	args, err := o.parse(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if err := exactArgs(args, 1, usage); err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "get":
+		status, err := getTask(ctx, c, args[0])
+		if err != nil {
+			return err
+		}
+
+		return renderTask(o, args[0], status)
+	case "watch":
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+
+		return watchTask(ctx, o, c, args[0], *interval)
+	default:
+		return exactArgs(nil, 1, usage)
+	}
+}
+
+func getTask(ctx context.Context, c *client, id string) (*task.PreparedStatus, error) {
+	status := &task.PreparedStatus{}
+	if err := c.get(ctx, "/task/"+url.PathEscape(id), status); err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, fmt.Errorf("task is not found: %s", id)
+		}
+
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// watchTask polls the task until it finishes and prints its final status, failed task
+// is reported as an error.
+func watchTask(ctx context.Context, o *options, c *client, id string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status, err := getTask(ctx, c, id)
+		if err != nil {
+			return err
+		}
+
+		if status.Status != task.PENDING {
+			if err := renderTask(o, id, status); err != nil {
+				return err
+			}
+
+			if status.Status == task.FAILED {
+				return fmt.Errorf("task %s failed: %s", id, taskError(status))
+			}
+
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("task %s is still pending: %w", id, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func renderTask(o *options, id string, status *task.PreparedStatus) error {
+	return render(os.Stdout, o.output, status, func() *table {
+		tbl := details(
+			"Task", id,
+			"Status", status.Status,
+			"Started", micros(&status.StartedAt_),
+			"Finished", micros(status.FinishedAt),
+		)
+
+		if status.Status == task.FAILED {
+			tbl.rows = append(tbl.rows, []string{"Error", taskError(status)})
+		}
+
+		return tbl
+	})
+}
+
+// taskError returns the error failed tasks carry in details.
+func taskError(status *task.PreparedStatus) string {
+	if details, ok := status.Details.(map[string]any); ok {
+		if msg, ok := details["error"].(string); ok {
+			return msg
+		}
+	}
+
+	return "unknown error"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/onpremless/opless/manager/model"
+)
+
+func tokenCommand(ctx context.Context, o *options, args []string) error {
+	const usage = "token list|create <name> -scope <scopes> [-ttl <seconds>]|revoke <id>"
+	if len(args) == 0 {
+		return exactArgs(args, 1, usage)
+	}
+
+	sub := args[0]
+	fs := o.flags("token " + sub)
+	scopes := fs.String("scope", "", "comma separated scopes: "+strings.Join(model.Scopes, ", "))
+	ttl := fs.Int64("ttl", 0, "lifetime in seconds, 0 never expires")
+
+	args, err := o.parse(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		if err := exactArgs(args, 0, usage); err != nil {
+			return err
+		}
+
+		tokens, err := list[model.Token](ctx, c, "/token", nil)
+		if err != nil {
+			return err
+		}
+
+		return render(os.Stdout, o.output, tokens, func() *table {
+			return tokenTable(tokens)
+		})
+	case "create":
+		if err := exactArgs(args, 1, usage); err != nil {
+			return err
+		}
+
+		req := &model.CreateToken{Name: args[0], TTL: *ttl}
+		if *scopes != "" {
+			req.Scopes = strings.Split(*scopes, ",")
+		}
+
+		token := &model.CreatedToken{}
+		if _, err := c.do(ctx, http.MethodPost, "/token", req, token, nil); err != nil {
+			return err
+		}
+
+		// The secret is shown once, so the table carries it too
+		return render(os.Stdout, o.output, token, func() *table {
+			tbl := tokenTable([]*model.Token{&token.Token})
+			tbl.header = append(tbl.header, "TOKEN")
+			tbl.rows[0] = append(tbl.rows[0], token.Secret)
+
+			return tbl
+		})
+	case "revoke":
+		if err := exactArgs(args, 1, usage); err != nil {
+			return err
+		}
+
+		_, err := c.do(ctx, http.MethodDelete, "/token/"+url.PathEscape(args[0]), nil, nil, nil)
+		return err
+	default:
+		return exactArgs(nil, 1, usage)
+	}
+}
+
+func tokenTable(tokens []*model.Token) *table {
+	tbl := &table{header: []string{"ID", "NAME", "SCOPES", "EXPIRES", "CREATED"}}
+	for _, token := range tokens {
+		tbl.rows = append(tbl.rows, []string{
+			token.Id, token.Name, strings.Join(token.Scopes, ","), millis(token.ExpiresAt), millis(token.CreatedAt),
+		})
+	}
+
+	return tbl
+}
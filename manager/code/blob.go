@@ -0,0 +1,120 @@
+package code
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"go.uber.org/zap"
+
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/logger"
+)
+
+// Lambda bucket layout: file contents are shared by all lambdas under blobs/, manifests
+// of code versions are kept under manifests/<lambda id>/.
+const (
+	blobsDir     = "blobs/"
+	manifestsDir = "manifests/"
+)
+
+func blobKey(digest string) string {
+	algorithm, hash, _ := strings.Cut(digest, ":")
+	return blobsDir + algorithm + "/" + hash
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// inlineBlobSize is the size up to which blobs are hashed in memory, so they're written
+// once and only if they don't exist yet.
+const inlineBlobSize = 4 << 20
+
+// PutBlob stores the content unless a blob with the same digest already exists.
+// It returns the content digest and size.
+func PutBlob(ctx context.Context, r io.Reader, size int64) (string, int64, error) {
+	if size < 0 || size > inlineBlobSize {
+		return putStaged(ctx, r, size)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(r, inlineBlobSize+1))
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Declared size was wrong, the rest of the content is still in r
+	if len(raw) > inlineBlobSize {
+		return putStaged(ctx, io.MultiReader(bytes.NewReader(raw), r), -1)
+	}
+
+	hash := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+
+	exists, err := blobExists(ctx, digest)
+	if err != nil || exists {
+		return digest, int64(len(raw)), err
+	}
+
+	err = artifact.Client.Put(ctx, artifact.LambdaBucket, blobKey(digest), bytes.NewReader(raw), int64(len(raw)), nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return digest, int64(len(raw)), nil
+}
+
+// putStaged is PutBlob for large contents, they're staged in the tmp bucket since the digest
+// is known only once the content is read, and copied only if the blob doesn't exist.
+func putStaged(ctx context.Context, r io.Reader, size int64) (string, int64, error) {
+	staged := blobsDir + cutil.UUID()
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	err := artifact.Client.Put(ctx, artifact.TmpBucket, staged, io.TeeReader(r, io.MultiWriter(hash, counter)), size, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer func() {
+		if err := artifact.Client.Remove(context.Background(), artifact.TmpBucket, staged); err != nil {
+			logger.L.Error("Failed to remove staged blob", zap.Error(err), zap.String("key", staged))
+		}
+	}()
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	exists, err := blobExists(ctx, digest)
+	if err != nil || exists {
+		return digest, counter.n, err
+	}
+
+	if err := artifact.Client.Copy(ctx, artifact.TmpBucket, staged, artifact.LambdaBucket, blobKey(digest), nil); err != nil {
+		return "", 0, err
+	}
+
+	return digest, counter.n, nil
+}
+
+func blobExists(ctx context.Context, digest string) (bool, error) {
+	_, err := artifact.Client.Stat(ctx, artifact.LambdaBucket, blobKey(digest))
+	if errors.Is(err, artifact.ErrNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func GetBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	return artifact.Client.Get(ctx, artifact.LambdaBucket, blobKey(digest))
+}
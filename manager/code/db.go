@@ -0,0 +1,35 @@
+package code
+
+import (
+	"context"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+var codeSchema = &db.Schema[model.LambdaCode]{
+	Prefix: "lambda-code",
+	ID:     func(x *model.LambdaCode) string { return x.Id },
+}
+
+func Collections() []*db.Collection {
+	return []*db.Collection{codeSchema.Collection()}
+}
+
+func GetLambdaCode(ctx context.Context, id string) (*model.LambdaCode, error) {
+	return db.GetValue[model.LambdaCode](ctx, "lambda-code", id)(store.Client)
+}
+
+func CreateLambdaCode(ctx context.Context, code *model.LambdaCode) error {
+	return db.CreateIndexedValue(ctx, codeSchema, code)(store.Client)
+}
+
+func ModifyLambdaCode(ctx context.Context, id string, mutate func(code *model.LambdaCode) error) (*model.LambdaCode, error) {
+	code, _, err := db.ModifyIndexedValue(ctx, codeSchema, id, mutate)(store.Client)
+	return code, err
+}
+
+func DelLambdaCode(ctx context.Context, id string) error {
+	return db.DelIndexedValue(ctx, codeSchema, id)(store.Client)
+}
@@ -0,0 +1,184 @@
+package code
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+const blobsLockTTL = 30 * time.Minute
+
+// MinSweepGrace bounds the grace period of SweepBlobs. Versions are stored long before
+// blobs younger than a half of it might be swept, so only older ones are checked under
+// the lock.
+const MinSweepGrace = time.Hour
+
+// lockBlobs keeps SweepBlobs from removing blobs a version is being created with.
+func lockBlobs(ctx context.Context) (func(), error) {
+	lctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	unlock, err := store.Client.Lock(lctx, "code-blobs", blobsLockTTL)
+	if err != nil {
+		return nil, fmt.Errorf("code blobs are being swept by another manager: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// staleBlobs fails if a blob of the files is missing and returns files with blobs which
+// are old enough to be swept before the version is stored.
+func staleBlobs(ctx context.Context, files []*model.CodeFile) ([]*model.CodeFile, error) {
+	deadline := time.Now().Add(-MinSweepGrace / 2)
+	stale := []*model.CodeFile{}
+	for _, file := range files {
+		stat, err := artifact.Client.Stat(ctx, artifact.LambdaBucket, blobKey(file.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find blob of %s: %w", file.Path, err)
+		}
+
+		if stat.ModTime.Before(deadline) {
+			stale = append(stale, file)
+		}
+	}
+
+	return stale, nil
+}
+
+// putChecked puts the manifest, blobs of stale files are checked again with blobs locked,
+// so the version doesn't refer to a blob removed meanwhile.
+func putChecked(ctx context.Context, manifest *model.CodeManifest, stale []*model.CodeFile) error {
+	if len(stale) == 0 {
+		return putManifest(ctx, manifest)
+	}
+
+	unlock, err := lockBlobs(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, file := range stale {
+		exists, err := blobExists(ctx, file.Digest)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return fmt.Errorf("blob of %s was swept while the code was stored, store it again", file.Path)
+		}
+	}
+
+	return putManifest(ctx, manifest)
+}
+
+// SweepBlobs removes manifests of deleted lambdas and blobs no other manifest refers to,
+// which are left by deleted lambdas and failed uploads. Objects younger than grace are
+// kept, they might belong to a version being stored. It returns the number of removed
+// objects.
+func SweepBlobs(ctx context.Context, grace time.Duration) (int, error) {
+	if grace < MinSweepGrace {
+		return 0, fmt.Errorf("grace period must be at least %s", MinSweepGrace)
+	}
+
+	unlock, err := lockBlobs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	deadline := time.Now().Add(-grace)
+	referenced, garbage, err := referencedBlobs(ctx, deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	err = artifact.Client.Walk(ctx, artifact.LambdaBucket, blobsDir, func(obj *artifact.Object) error {
+		if !referenced[obj.Key] && obj.ModTime.Before(deadline) {
+			garbage = append(garbage, obj.Key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range garbage {
+		if err := artifact.Client.Remove(ctx, artifact.LambdaBucket, key); err != nil {
+			return i, err
+		}
+
+		logger.L.Info("Removed unreferenced code object", zap.String("key", key))
+	}
+
+	return len(garbage), nil
+}
+
+// referencedBlobs returns keys of the blobs listed by live manifests along with keys of
+// dead ones. Manifests are live while their lambda exists, manifests younger than deadline
+// might belong to a lambda being created.
+func referencedBlobs(ctx context.Context, deadline time.Time) (map[string]bool, []string, error) {
+	manifests := []*artifact.Object{}
+	err := artifact.Client.Walk(ctx, artifact.LambdaBucket, manifestsDir, func(obj *artifact.Object) error {
+		manifests = append(manifests, obj)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	referenced := map[string]bool{}
+	dead := []string{}
+	lambdas := map[string]bool{}
+	for _, obj := range manifests {
+		lambda, _, _ := strings.Cut(strings.TrimPrefix(obj.Key, manifestsDir), "/")
+		exists, ok := lambdas[lambda]
+		if !ok {
+			// Lambda records are read by prefix, the lambda package depends on this one
+			item, err := store.Client.Get(ctx, "lambda", lambda)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			exists = item != nil
+			lambdas[lambda] = exists
+		}
+
+		if !exists && obj.ModTime.Before(deadline) {
+			dead = append(dead, obj.Key)
+			continue
+		}
+
+		r, err := artifact.Client.Get(ctx, artifact.LambdaBucket, obj.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		manifest := &model.CodeManifest{}
+		err = json.NewDecoder(r).Decode(manifest)
+		r.Close()
+
+		// A blob of an unreadable manifest can't be told apart from garbage
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse manifest %s: %w", obj.Key, err)
+		}
+
+		for _, file := range manifest.Files {
+			referenced[blobKey(file.Digest)] = true
+		}
+	}
+
+	return referenced, dead, nil
+}
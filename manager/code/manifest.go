@@ -0,0 +1,311 @@
+package code
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+)
+
+// Concurrently created versions might get the same number, but only one of them becomes
+// current, so digest is a part of the key to never overwrite its manifest.
+func manifestKey(lambda string, version int64, digest string) string {
+	_, hash, _ := strings.Cut(digest, ":")
+	return manifestsDir + lambda + "/" + db.NumKey(version) + "-" + hash
+}
+
+// digestFiles identifies the files list regardless of the lambda and version it belongs to.
+func digestFiles(files []*model.CodeFile) (string, error) {
+	raw, err := json.Marshal(files)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(hash[:]), nil
+}
+
+// CreateVersion stores the manifest of files as the next code version of the lambda
+// and makes it current.
+func CreateVersion(ctx context.Context, lambda string, files []*model.CodeFile) (*model.CodeManifest, error) {
+	sorted := append([]*model.CodeFile{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	digest, err := digestFiles(sorted)
+	if err != nil {
+		return nil, err
+	}
+
+	stale, err := staleBlobs(ctx, sorted)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < maxVersionRetries; i++ {
+		current, err := GetLambdaCode(ctx, lambda)
+		if err != nil {
+			return nil, err
+		}
+
+		version := db.FirstVersion
+		if current != nil {
+			version = current.Version + 1
+		}
+
+		manifest := &model.CodeManifest{
+			Lambda:    lambda,
+			Version:   version,
+			Digest:    digest,
+			Files:     sorted,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+
+		if err := putChecked(ctx, manifest, stale); err != nil {
+			return nil, err
+		}
+
+		err = setCurrent(ctx, current, manifest)
+		// Another version was created meanwhile, so the number is taken
+		if errors.Is(err, db.ErrConflict) || errors.Is(err, errStaleCode) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return manifest, nil
+	}
+
+	return nil, db.ErrTooManyRetries
+}
+
+const maxVersionRetries = 16
+
+var errStaleCode = errors.New("code version is changed")
+
+func setCurrent(ctx context.Context, current *model.LambdaCode, manifest *model.CodeManifest) error {
+	if current == nil {
+		return CreateLambdaCode(ctx, &model.LambdaCode{
+			Id:        manifest.Lambda,
+			Version:   manifest.Version,
+			Digest:    manifest.Digest,
+			UpdatedAt: manifest.CreatedAt,
+		})
+	}
+
+	_, err := ModifyLambdaCode(ctx, manifest.Lambda, func(code *model.LambdaCode) error {
+		if code.Version != current.Version {
+			return errStaleCode
+		}
+
+		code.Version = manifest.Version
+		code.Digest = manifest.Digest
+		code.UpdatedAt = manifest.CreatedAt
+
+		return nil
+	})
+
+	return err
+}
+
+func putManifest(ctx context.Context, manifest *model.CodeManifest) error {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	key := manifestKey(manifest.Lambda, manifest.Version, manifest.Digest)
+	return artifact.Client.Put(ctx, artifact.LambdaBucket, key, bytes.NewReader(raw), int64(len(raw)), nil)
+}
+
+func getManifest(ctx context.Context, code *model.LambdaCode) (*model.CodeManifest, error) {
+	r, err := artifact.Client.Get(ctx, artifact.LambdaBucket, manifestKey(code.Id, code.Version, code.Digest))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest := &model.CodeManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of lambda %s: %w", code.Id, err)
+	}
+
+	return manifest, nil
+}
+
+// GetManifest returns the manifest of the current lambda code version,
+// nil is returned if the lambda has no code.
+func GetManifest(ctx context.Context, lambda string) (*model.CodeManifest, error) {
+	current, err := GetLambdaCode(ctx, lambda)
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		return migrateLegacy(ctx, lambda)
+	}
+
+	return getManifest(ctx, current)
+}
+
+// DeleteCode removes the code version record and manifests of the lambda, their blobs are
+// left to SweepBlobs, other lambdas might share them.
+func DeleteCode(ctx context.Context, lambda string) error {
+	if err := DelLambdaCode(ctx, lambda); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	err := artifact.Client.Walk(ctx, artifact.LambdaBucket, manifestsDir+lambda+"/", func(obj *artifact.Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := artifact.Client.Remove(ctx, artifact.LambdaBucket, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteTar writes the manifest files into the tar, streaming them from blobs.
+// Files with skipped paths are omitted.
+func WriteTar(ctx context.Context, manifest *model.CodeManifest, tw *tar.Writer, skip ...string) error {
+	for _, file := range manifest.Files {
+		if contains(skip, file.Path) {
+			continue
+		}
+
+		if err := writeBlob(ctx, tw, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeBlob(ctx context.Context, tw *tar.Writer, file *model.CodeFile) error {
+	r, err := GetBlob(ctx, file.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to get blob of %s: %w", file.Path, err)
+	}
+	defer r.Close()
+
+	mode := file.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.Path,
+		Mode:     mode,
+		Size:     file.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// FileMode keeps only whether the file is executable, so the code digest doesn't depend on
+// the umask of whoever made the archive.
+func FileMode(mode os.FileMode) int64 {
+	if mode&0111 != 0 {
+		return 0755
+	}
+
+	return 0644
+}
+
+func contains(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// migrateLegacy moves files of lambdas created before code was content addressed
+// from '<lambda id>/' prefix into blobs.
+func migrateLegacy(ctx context.Context, lambda string) (*model.CodeManifest, error) {
+	prefix := lambda + "/"
+	if strings.HasPrefix(prefix, blobsDir) || strings.HasPrefix(prefix, manifestsDir) {
+		return nil, nil
+	}
+
+	objects := []*artifact.Object{}
+	err := artifact.Client.Walk(ctx, artifact.LambdaBucket, prefix, func(obj *artifact.Object) error {
+		objects = append(objects, obj)
+		return nil
+	})
+
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+
+	files := []*model.CodeFile{}
+	for _, obj := range objects {
+		file, err := migrateObject(ctx, obj, strings.TrimPrefix(obj.Key, prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	manifest, err := CreateVersion(ctx, lambda, files)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range objects {
+		if err := artifact.Client.Remove(ctx, artifact.LambdaBucket, obj.Key); err != nil {
+			logger.L.Error("Failed to remove migrated lambda file", zap.Error(err), zap.String("key", obj.Key))
+		}
+	}
+
+	return manifest, nil
+}
+
+func migrateObject(ctx context.Context, obj *artifact.Object, path string) (*model.CodeFile, error) {
+	r, err := artifact.Client.Get(ctx, artifact.LambdaBucket, obj.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	digest, size, err := PutBlob(ctx, r, obj.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.CodeFile{Path: path, Digest: digest, Size: size}, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+
+	"github.com/onpremless/opless/manager/code"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/openapi"
+)
+
+// runCommand runs a maintenance command against the configured store and artifacts
+// instead of serving the API. Containers of lambdas are left as they are, unless the
+// command starts lambdas itself:
+//
+//	backup [-o file]           writes the backup archive, to stdout by default
+//	restore [-i file] [-start] restores the archive, from stdin by default, and optionally
+//	                           builds and starts lambdas which were running when it was made
+//	apply -f file [-dry-run] [-prune] [-adopt]
+//	                           applies the manifest, Dockerfiles and archives are paths
+//	                           relative to it
+//	openapi [-o file]          checks the OpenAPI document against the routes and writes it,
+//	                           to stdout by default
+//	token -name name [-scope scopes] [-ttl seconds]
+//	                           creates an API token, admin unless comma separated scopes are
+//	                           given, for hosts which lost every admin token
+//	sweep-blobs [-grace duration]
+//	                           removes code of deleted lambdas and blobs no code version
+//	                           refers to, which are older than the grace period, 24h by
+//	                           default and 1h at least
+//	prune-images [-grace duration]
+//	                           removes images built by this installation which no lambda
+//	                           refers to, which are older than the grace period, 1h by default
+func runCommand(ctx context.Context, svcs *Services, args []string) error {
+	switch args[0] {
+	case "backup":
+		return backupCommand(ctx, svcs, args[1:])
+	case "restore":
+		return restoreCommand(ctx, svcs, args[1:])
+	case "apply":
+		return applyCommand(ctx, svcs, args[1:])
+	case "openapi":
+		return openapiCommand(svcs, args[1:])
+	case "token":
+		return tokenCommand(ctx, svcs, args[1:])
+	case "sweep-blobs":
+		return sweepBlobsCommand(ctx, args[1:])
+	case "prune-images":
+		return pruneImagesCommand(ctx, svcs, args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func backupCommand(ctx context.Context, svcs *Services, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := flags.String("o", "-", "archive file, '-' is stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return svcs.backupSvc.Backup(ctx, os.Stdout)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	err = svcs.backupSvc.Backup(ctx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	// A partial archive would pass for a backup
+	if err != nil {
+		os.Remove(*output)
+	}
+
+	return err
+}
+
+func restoreCommand(ctx context.Context, svcs *Services, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := flags.String("i", "-", "archive file, '-' is stdin")
+	start := flags.Bool("start", false, "build and start lambdas which were running")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	report, err := svcs.backupSvc.Restore(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	res := map[string]any{"restore": report}
+	if *start {
+		res["started"] = svcs.backupSvc.Start(ctx, report.Running)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(res)
+}
+
+func applyCommand(ctx context.Context, svcs *Services, args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ContinueOnError)
+	file := flags.String("f", "", "manifest file")
+	dryRun := flags.Bool("dry-run", false, "only print the plan")
+	prune := flags.Bool("prune", false, "delete resources removed from the manifest")
+	adopt := flags.Bool("adopt", false, "take over existing resources no manifest owns")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("'-f' is required")
+	}
+
+	raw, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := model.ParseManifest(raw)
+	if err != nil {
+		return err
+	}
+
+	// Files are uploaded even for a dry run, the plan compares their checksums
+	dir := filepath.Dir(*file)
+	for _, runtime := range manifest.Runtimes {
+		if runtime.Dockerfile, err = uploadFile(ctx, svcs, dir, runtime.Dockerfile); err != nil {
+			return err
+		}
+	}
+
+	for _, lambda := range manifest.Lambdas {
+		if lambda.Archive == "" {
+			continue
+		}
+
+		if lambda.Archive, err = uploadFile(ctx, svcs, dir, lambda.Archive); err != nil {
+			return err
+		}
+	}
+
+	plan, err := svcs.applySvc.Apply(ctx, manifest, *dryRun, *prune, *adopt)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(plan); err != nil {
+		return err
+	}
+
+	failed := lo.CountBy(plan.Items, func(item *model.PlanItem) bool { return item.Status == model.ApplyFailed })
+	if failed > 0 {
+		return fmt.Errorf("%d of %d resources failed", failed, len(plan.Items))
+	}
+
+	return nil
+}
+
+func openapiCommand(svcs *Services, args []string) error {
+	flags := flag.NewFlagSet("openapi", flag.ContinueOnError)
+	output := flags.String("o", "-", "document file, '-' is stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := openapi.Check(operations, newRouter(svcs).Routes()); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(openapi.Build(apiInfo, operations))
+}
+
+func tokenCommand(ctx context.Context, svcs *Services, args []string) error {
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	name := flags.String("name", "", "token name")
+	scopes := flags.String("scope", model.ScopeAdmin, "comma separated scopes")
+	ttl := flags.Int64("ttl", 0, "lifetime in seconds, 0 never expires")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	req := &model.CreateToken{Name: *name, Scopes: strings.Split(*scopes, ","), TTL: *ttl}
+	if err := model.ValidateCreateToken(req); err != nil {
+		return err
+	}
+
+	token, err := svcs.authSvc.Create(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(token)
+}
+
+func sweepBlobsCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sweep-blobs", flag.ContinueOnError)
+	grace := flags.Duration("grace", 24*time.Hour, "age of blobs which might belong to a version being stored")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	removed, err := code.SweepBlobs(ctx, *grace)
+	fmt.Printf("%d code objects are removed\n", removed)
+
+	return err
+}
+
+func pruneImagesCommand(ctx context.Context, svcs *Services, args []string) error {
+	flags := flag.NewFlagSet("prune-images", flag.ContinueOnError)
+	grace := flags.Duration("grace", time.Hour, "age of images which might be built for a lambda being started")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	removed, err := svcs.lambdaSvc.PruneImages(ctx, *grace)
+	fmt.Printf("%d images are removed\n", removed)
+
+	return err
+}
+
+// uploadFile uploads the file at the path relative to dir and returns the upload id.
+func uploadFile(ctx context.Context, svcs *Services, dir string, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	upload, err := svcs.uploadSvc.Upload(ctx, f)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", path, err)
+	}
+
+	return upload.Id, nil
+}
@@ -7,18 +7,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strings"
 	"time"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	api "github.com/onpremless/go-client"
 	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/errs"
 	"github.com/onpremless/opless/manager/logger"
-	"github.com/samber/lo"
+	"github.com/onpremless/opless/manager/model"
 	"go.uber.org/zap"
 )
 
@@ -29,13 +32,23 @@ type service struct {
 }
 
 type DockerService interface {
-	Create(ctx context.Context, lambda *api.Lambda, tar io.Reader) (string, error)
+	ImageID(ctx context.Context, image string) (string, error)
+	Build(ctx context.Context, image string, params *model.BuildParams, labels map[string]string, tar io.Reader) (string, error)
+	Pull(ctx context.Context, ref string, platform string, auth *model.RegistryAuth) (string, string, error)
+	Save(ctx context.Context, images []string) (io.ReadCloser, error)
+	Load(ctx context.Context, tar io.Reader) error
 	CreateContainer(ctx context.Context, lambda *api.Lambda) (string, error)
 	Start(ctx context.Context, lambda *api.Lambda) error
 	Stop(ctx context.Context, lambda *api.Lambda) error
 	ListContainers(ctx context.Context) ([]types.Container, error)
 	Inspect(ctx context.Context, id string) (types.ContainerJSON, error)
 	Remove(ctx context.Context, lambda *api.Lambda) error
+	// ListImages lists images built by this installation.
+	ListImages(ctx context.Context) ([]types.ImageSummary, error)
+	// RemoveImage untags the image and removes it if it was the last tag. Images used by
+	// containers or other images are kept and errs.Conflict is returned.
+	RemoveImage(ctx context.Context, image string) error
+	Logs(ctx context.Context, lambda *api.Lambda, follow bool, tail string) (io.ReadCloser, error)
 }
 
 func NewDockerService(id string) (DockerService, error) {
@@ -49,55 +62,80 @@ func NewDockerService(id string) (DockerService, error) {
 }
 
 func (s service) ListContainers(ctx context.Context) ([]types.Container, error) {
-	return s.client.ContainerList(ctx, types.ContainerListOptions{
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
 		Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: "opless=" + s.id}),
 	})
+
+	return containers, classify(err)
 }
 
 func (s service) Inspect(ctx context.Context, id string) (types.ContainerJSON, error) {
-	return s.client.ContainerInspect(ctx, id)
+	info, err := s.client.ContainerInspect(ctx, id)
+	return info, classify(err)
 }
 
-func (s service) Create(ctx context.Context, lambda *api.Lambda, tar io.Reader) (string, error) {
-	if lambda.Docker.Container == nil || lambda.Docker.Image == nil {
-		return "", fmt.Errorf("lambda model is not complete")
+// ImageID returns id of the image, empty string is returned if there is no such image.
+func (s service) ImageID(ctx context.Context, image string) (string, error) {
+	info, _, err := s.client.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return "", nil
 	}
 
-	images, err := s.client.ImageList(
-		ctx,
-		types.ImageListOptions{
-			Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: "opless=" + s.id}),
-		})
 	if err != nil {
-		return "", err
+		return "", classify(err)
 	}
 
-	_, exists := lo.Find(images, func(image types.ImageSummary) bool {
-		return len(image.RepoTags) > 0 && strings.Split(image.RepoTags[0], ":")[0] == *lambda.Docker.Image
-	})
-	if exists {
-		return "", fmt.Errorf("image already exists: %s", *lambda.Docker.Image)
+	return info.ID, nil
+}
+
+// Build builds the image from the tar build context reusing cached layers and returns its id.
+// Labels are added to ones from params.
+func (s service) Build(ctx context.Context, image string, params *model.BuildParams, labels map[string]string, tar io.Reader) (string, error) {
+	buildLabels := map[string]string{}
+	for _, l := range []map[string]string{params.Labels, labels, {"opless": s.id}} {
+		for k, v := range l {
+			buildLabels[k] = v
+		}
+	}
+
+	args := map[string]*string{}
+	for k, v := range params.Args {
+		v := v
+		args[k] = &v
 	}
 
 	out, err := s.client.ImageBuild(ctx, tar, types.ImageBuildOptions{
-		Tags:   []string{*lambda.Docker.Image},
-		Labels: map[string]string{"opless": s.id},
+		Tags:      []string{image},
+		Labels:    buildLabels,
+		BuildArgs: args,
+		Target:    params.Target,
+		Platform:  params.Platform,
+		Remove:    true,
 	})
 	if err != nil {
-		return "", err
+		return "", classify(err)
 	}
 
 	defer out.Body.Close()
 
+	if err := readProgress(out.Body); err != nil {
+		return "", err
+	}
+
+	return s.ImageID(ctx, image)
+}
+
+// readProgress drains JSON progress messages of a build or a pull and returns the errors reported.
+func readProgress(r io.Reader) error {
 	errorMsg := ""
-	scanner := bufio.NewScanner(out.Body)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		e := struct {
 			Err *string `json:"error"`
 		}{}
 
 		if err := json.Unmarshal([]byte(scanner.Text()), &e); err != nil {
-			return "", err
+			return err
 		}
 
 		if e.Err != nil {
@@ -105,11 +143,88 @@ func (s service) Create(ctx context.Context, lambda *api.Lambda, tar io.Reader)
 		}
 	}
 
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Failures reported along the progress are caused by the image or its build context
 	if errorMsg != "" {
-		return "", fmt.Errorf(errorMsg)
+		return errs.New(errs.Validation, "%s", errorMsg)
+	}
+
+	return nil
+}
+
+// Pull pulls the image and returns its id along with the reference pinning it by digest,
+// so the lambda keeps running the same image even if the tag is moved.
+func (s service) Pull(ctx context.Context, ref string, platform string, auth *model.RegistryAuth) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	opts := types.ImagePullOptions{Platform: platform}
+	if auth != nil {
+		opts.RegistryAuth, err = registry.EncodeAuthConfig(registry.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: reference.Domain(named),
+		})
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	out, err := s.client.ImagePull(ctx, named.String(), opts)
+	if errdefs.IsNotFound(err) {
+		return "", "", errs.Field("image.ref", "refers to missing image %s", ref)
+	}
+
+	if err != nil {
+		return "", "", classify(err)
+	}
+	defer out.Close()
+
+	if err := readProgress(out); err != nil {
+		return "", "", err
+	}
+
+	info, _, err := s.client.ImageInspectWithRaw(ctx, named.String())
+	if err != nil {
+		return "", "", classify(err)
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		return info.ID, reference.TrimNamed(canonical).String() + "@" + canonical.Digest().String(), nil
+	}
+
+	// Image might be pushed to several repositories, the digest is the one of the pulled repository
+	for _, repoDigest := range info.RepoDigests {
+		pinned, err := reference.ParseNormalizedNamed(repoDigest)
+		if err == nil && pinned.Name() == named.Name() {
+			return info.ID, pinned.String(), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("image %s has no digest in repository %s", ref, named.Name())
+}
+
+// Save returns the 'docker save' tar stream of the images.
+func (s service) Save(ctx context.Context, images []string) (io.ReadCloser, error) {
+	r, err := s.client.ImageSave(ctx, images)
+	return r, classify(err)
+}
+
+// Load loads images from the 'docker save' tar stream.
+func (s service) Load(ctx context.Context, tar io.Reader) error {
+	res, err := s.client.ImageLoad(ctx, tar, true)
+	if err != nil {
+		return classify(err)
 	}
+	defer res.Body.Close()
 
-	return s.CreateContainer(ctx, lambda)
+	return readProgress(res.Body)
 }
 
 func (s service) CreateContainer(ctx context.Context, lambda *api.Lambda) (string, error) {
@@ -124,7 +239,7 @@ func (s service) CreateContainer(ctx context.Context, lambda *api.Lambda) (strin
 	})
 	if err != nil {
 		creator.rollback()
-		return "", err
+		return "", classify(err)
 	}
 
 	err = creator.setupNetwork(ctx, types.NetworkListOptions{
@@ -136,7 +251,7 @@ func (s service) CreateContainer(ctx context.Context, lambda *api.Lambda) (strin
 
 	if err != nil {
 		creator.rollback()
-		return "", err
+		return "", classify(err)
 	}
 
 	return creator.container.ID, nil
@@ -149,7 +264,7 @@ func (s service) Start(ctx context.Context, lambda *api.Lambda) error {
 
 	info, err := s.client.ContainerInspect(ctx, *lambda.Docker.ContainerId)
 	if err != nil {
-		return err
+		return classify(err)
 	}
 
 	if info.State.Running || info.State.Restarting {
@@ -157,7 +272,7 @@ func (s service) Start(ctx context.Context, lambda *api.Lambda) error {
 	}
 
 	if err := s.client.ContainerStart(ctx, *lambda.Docker.ContainerId, types.ContainerStartOptions{}); err != nil {
-		return err
+		return classify(err)
 	}
 
 	return nil
@@ -170,7 +285,7 @@ func (s service) Stop(ctx context.Context, lambda *api.Lambda) error {
 
 	info, err := s.client.ContainerInspect(ctx, *lambda.Docker.ContainerId)
 	if err != nil {
-		return err
+		return classify(err)
 	}
 
 	if !info.State.Running && !info.State.Restarting {
@@ -178,7 +293,7 @@ func (s service) Stop(ctx context.Context, lambda *api.Lambda) error {
 	}
 
 	if err := s.client.ContainerStop(ctx, *lambda.Docker.ContainerId, container.StopOptions{}); err != nil {
-		return err
+		return classify(err)
 	}
 
 	return nil
@@ -193,17 +308,27 @@ func (s service) Remove(ctx context.Context, lambda *api.Lambda) error {
 		return err
 	}
 
+	// Image is kept, so the lambda is started again without a build unless its content changes
 	if err := s.client.ContainerRemove(ctx, *lambda.Docker.ContainerId, types.ContainerRemoveOptions{}); err != nil {
-		return err
-	}
-
-	if _, err := s.client.ImageRemove(ctx, *lambda.Docker.Image, types.ImageRemoveOptions{}); err != nil {
-		return err
+		return classify(err)
 	}
 
 	return nil
 }
 
+func (s service) ListImages(ctx context.Context) ([]types.ImageSummary, error) {
+	images, err := s.client.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: "opless=" + s.id}),
+	})
+
+	return images, classify(err)
+}
+
+func (s service) RemoveImage(ctx context.Context, image string) error {
+	_, err := s.client.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	return classify(err)
+}
+
 type ContainerCreator struct {
 	client    *client.Client
 	lambda    *api.Lambda
@@ -254,12 +379,40 @@ func (c *ContainerCreator) rollback() {
 			c.container = nil
 		}
 	}
+}
+
+// Logs returns stdout and stderr of the lambda container multiplexed as by 'docker logs'.
+func (s service) Logs(ctx context.Context, lambda *api.Lambda, follow bool, tail string) (io.ReadCloser, error) {
+	if lambda.Docker.ContainerId == nil {
+		return nil, fmt.Errorf("lambda model is not complete")
+	}
+
+	logs, err := s.client.ContainerLogs(ctx, *lambda.Docker.ContainerId, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Follow:     follow,
+		Tail:       tail,
+	})
+
+	return logs, classify(err)
+}
 
-	if _, err := c.client.ImageRemove(ctx, *c.lambda.Docker.Image, types.ImageRemoveOptions{}); err != nil {
-		logger.L.Error(
-			"Failed to remove image",
-			zap.Error(err),
-			zap.String("id", *c.lambda.Docker.Image),
-		)
+// classify gives the kind to errors of the Docker daemon, so an unreachable daemon or
+// a removed container are not reported as internal failures.
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case client.IsErrConnectionFailed(err), errdefs.IsUnavailable(err), errdefs.IsDeadline(err):
+		return errs.New(errs.Unavailable, "docker is unavailable: %w", err)
+	case errdefs.IsNotFound(err):
+		return errs.New(errs.NotFound, "%w", err)
+	case errdefs.IsConflict(err):
+		return errs.New(errs.Conflict, "%w", err)
+	case errdefs.IsInvalidParameter(err), errdefs.IsUnauthorized(err), errdefs.IsForbidden(err):
+		return errs.New(errs.Validation, "%w", err)
+	default:
+		return err
 	}
 }
@@ -0,0 +1,245 @@
+package dockerfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	cutil "github.com/onpremless/opless/common/util"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+const (
+	RuleSyntax            = "syntax"
+	RuleMissingExpose     = "missing-expose"
+	RuleMissingHealth     = "missing-healthcheck"
+	RuleBaseImage         = "base-image"
+	RuleRootUser          = "root-user"
+	RuleBannedInstruction = "banned-instruction"
+)
+
+// Finding is a single problem found in a Dockerfile, Line is 0 if it concerns the whole file.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Rule     string   `json:"rule"`
+	Line     int      `json:"line,omitempty"`
+	Message  string   `json:"message"`
+}
+
+var ErrRejected = errors.New("dockerfile is rejected")
+
+// LintError carries all findings of a Dockerfile having at least one error finding.
+type LintError struct {
+	Findings []*Finding
+}
+
+func (e *LintError) Error() string {
+	for _, f := range e.Findings {
+		if f.Severity == SeverityError {
+			return fmt.Sprintf("dockerfile is rejected: %s", f.Message)
+		}
+	}
+
+	return "dockerfile is rejected"
+}
+
+func (e *LintError) Unwrap() error {
+	return ErrRejected
+}
+
+// Policy is enforced by admins on every runtime Dockerfile.
+type Policy struct {
+	// AllowedBaseImages are path.Match patterns of images stages can be based on, any if empty
+	AllowedBaseImages []string
+	// BannedInstructions are upper cased instruction keywords
+	BannedInstructions []string
+	AllowRootUser      bool
+}
+
+func splitList(s string) []string {
+	res := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+// PolicyFromEnv reads comma separated DOCKERFILE_ALLOWED_BASE_IMAGES and
+// DOCKERFILE_BANNED_INSTRUCTIONS, and DOCKERFILE_ALLOW_ROOT_USER ('true' or 'false') env vars.
+func PolicyFromEnv() *Policy {
+	banned := []string{}
+	for _, cmd := range splitList(cutil.GetStrVarDefault("DOCKERFILE_BANNED_INSTRUCTIONS", "")) {
+		banned = append(banned, strings.ToUpper(cmd))
+	}
+
+	return &Policy{
+		AllowedBaseImages:  splitList(cutil.GetStrVarDefault("DOCKERFILE_ALLOWED_BASE_IMAGES", "")),
+		BannedInstructions: banned,
+		AllowRootUser:      cutil.GetStrVarDefault("DOCKERFILE_ALLOW_ROOT_USER", "false") == "true",
+	}
+}
+
+// Lint parses the Dockerfile and checks it against the policy. It returns LintError
+// if any finding is an error, warnings are returned otherwise.
+func Lint(r io.Reader, policy *Policy) ([]*Finding, error) {
+	instructions, err := Parse(r)
+
+	var syntaxErr *SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return nil, &LintError{Findings: []*Finding{{
+			Severity: SeverityError,
+			Rule:     RuleSyntax,
+			Line:     syntaxErr.Line,
+			Message:  syntaxErr.Msg,
+		}}}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	findings := lint(instructions, policy)
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return nil, &LintError{Findings: findings}
+		}
+	}
+
+	return findings, nil
+}
+
+func lint(instructions []*Instruction, policy *Policy) []*Finding {
+	findings := []*Finding{}
+	stages := map[string]bool{}
+	// Only the final stage ends up in the image
+	var final []*Instruction
+
+	for _, ins := range instructions {
+		findings = append(findings, checkBanned(ins, policy)...)
+
+		// Triggers run in builds of every lambda based on the runtime image, FROM can't
+		// be a trigger, Parse rejects it
+		if trigger := Trigger(ins); trigger != nil {
+			findings = append(findings, checkBanned(trigger, policy)...)
+
+			if trigger.Cmd == "USER" && !policy.AllowRootUser && isRoot(trigger.Args) {
+				findings = append(findings, &Finding{
+					Severity: SeverityError,
+					Rule:     RuleRootUser,
+					Line:     trigger.Line,
+					Message:  "ONBUILD trigger must not switch to root",
+				})
+			}
+		}
+
+		if ins.Cmd != "FROM" {
+			final = append(final, ins)
+			continue
+		}
+
+		// Syntax is already checked by Parse
+		image, stage, _ := ParseFrom(ins.Args)
+		if f := checkBaseImage(ins, image, stages, policy); f != nil {
+			findings = append(findings, f)
+		}
+
+		if stage != "" {
+			stages[stage] = true
+		}
+
+		final = []*Instruction{ins}
+	}
+
+	if !has(final, "EXPOSE") {
+		findings = append(findings, &Finding{
+			Severity: SeverityWarning,
+			Rule:     RuleMissingExpose,
+			Message:  "final stage has no EXPOSE instruction, the lambda port is unknown",
+		})
+	}
+
+	if !has(final, "HEALTHCHECK") {
+		findings = append(findings, &Finding{
+			Severity: SeverityWarning,
+			Rule:     RuleMissingHealth,
+			Message:  "final stage has no HEALTHCHECK instruction",
+		})
+	}
+
+	if user := last(final, "USER"); user != nil && !policy.AllowRootUser && isRoot(user.Args) {
+		findings = append(findings, &Finding{
+			Severity: SeverityError,
+			Rule:     RuleRootUser,
+			Line:     user.Line,
+			Message:  "image must not run as root",
+		})
+	}
+
+	return findings
+}
+
+func checkBanned(ins *Instruction, policy *Policy) []*Finding {
+	findings := []*Finding{}
+	for _, banned := range policy.BannedInstructions {
+		if ins.Cmd == banned {
+			findings = append(findings, &Finding{
+				Severity: SeverityError,
+				Rule:     RuleBannedInstruction,
+				Line:     ins.Line,
+				Message:  fmt.Sprintf("%s instruction is banned", ins.Cmd),
+			})
+		}
+	}
+
+	return findings
+}
+
+func checkBaseImage(ins *Instruction, image string, stages map[string]bool, policy *Policy) *Finding {
+	// Stages are already checked
+	if len(policy.AllowedBaseImages) == 0 || stages[strings.ToLower(image)] || image == "scratch" {
+		return nil
+	}
+
+	for _, pattern := range policy.AllowedBaseImages {
+		if ok, _ := path.Match(pattern, image); ok {
+			return nil
+		}
+	}
+
+	return &Finding{
+		Severity: SeverityError,
+		Rule:     RuleBaseImage,
+		Line:     ins.Line,
+		Message:  fmt.Sprintf("base image '%s' isn't allowed", image),
+	}
+}
+
+func has(instructions []*Instruction, cmd string) bool {
+	return last(instructions, cmd) != nil
+}
+
+func last(instructions []*Instruction, cmd string) *Instruction {
+	for i := len(instructions) - 1; i >= 0; i-- {
+		if instructions[i].Cmd == cmd {
+			return instructions[i]
+		}
+	}
+
+	return nil
+}
+
+func isRoot(user string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(user), ":")
+	return name == "root" || name == "0"
+}
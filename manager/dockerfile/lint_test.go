@@ -0,0 +1,79 @@
+package dockerfile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	policy := &Policy{BannedInstructions: []string{"ADD"}}
+
+	cases := []struct {
+		name       string
+		dockerfile string
+		rule       string
+	}{
+		{
+			name:       "here-string",
+			dockerfile: "FROM alpine\nRUN cat <<< \"x\"\nUSER nobody\n",
+		},
+		{
+			name:       "heredoc",
+			dockerfile: "FROM alpine\nRUN <<EOF\necho x\nEOF\nUSER nobody\n",
+		},
+		{
+			name:       "unterminated heredoc",
+			dockerfile: "FROM alpine\nRUN cat <<EOF\necho x\n",
+			rule:       RuleSyntax,
+		},
+		{
+			name:       "banned instruction",
+			dockerfile: "FROM alpine\nADD . /app\nUSER nobody\n",
+			rule:       RuleBannedInstruction,
+		},
+		{
+			name:       "banned ONBUILD trigger",
+			dockerfile: "FROM alpine\nONBUILD ADD . /app\nUSER nobody\n",
+			rule:       RuleBannedInstruction,
+		},
+		{
+			name:       "root ONBUILD trigger",
+			dockerfile: "FROM alpine\nONBUILD USER root\nUSER nobody\n",
+			rule:       RuleRootUser,
+		},
+		{
+			name:       "FROM ONBUILD trigger",
+			dockerfile: "FROM alpine\nONBUILD FROM alpine\nUSER nobody\n",
+			rule:       RuleSyntax,
+		},
+		{
+			name:       "allowed ONBUILD trigger",
+			dockerfile: "FROM alpine\nONBUILD RUN echo x\nUSER nobody\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Lint(strings.NewReader(c.dockerfile), policy)
+			if c.rule == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var lintErr *LintError
+			if !errors.As(err, &lintErr) {
+				t.Fatalf("expected a lint error, got %v", err)
+			}
+
+			for _, f := range lintErr.Findings {
+				if f.Rule == c.rule && f.Severity == SeverityError {
+					return
+				}
+			}
+			t.Fatalf("expected %s finding, got %v", c.rule, err)
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package dockerfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Instruction is a single Dockerfile instruction with continuation lines joined.
+type Instruction struct {
+	// Cmd is the upper cased instruction keyword
+	Cmd  string
+	Args string
+	// Line is the line number the instruction starts at
+	Line int
+}
+
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var commands = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true, "ENV": true,
+	"EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true, "MAINTAINER": true,
+	"ONBUILD": true, "RUN": true, "SHELL": true, "STOPSIGNAL": true, "USER": true,
+	"VOLUME": true, "WORKDIR": true,
+}
+
+var directiveRegex = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// Runs of '<' are matched whole, so here-strings like '<<< "x"' aren't taken for heredocs
+var heredocRegex = regexp.MustCompile(`(<+)-?\s*["']?([a-zA-Z_][a-zA-Z0-9_]*)["']?`)
+
+// Parse splits the Dockerfile into instructions and checks their syntax
+// the way the builder does before running any of them.
+func Parse(r io.Reader) ([]*Instruction, error) {
+	scanner := bufio.NewScanner(r)
+	escape := '\\'
+	directives := true
+
+	res := []*Instruction{}
+	var current *Instruction
+	var heredocs []string
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(text)
+
+		if len(heredocs) > 0 {
+			current.Args += "\n" + text
+			if strings.TrimLeft(text, "\t") == heredocs[0] {
+				heredocs = heredocs[1:]
+			}
+
+			if len(heredocs) == 0 {
+				current = nil
+			}
+
+			continue
+		}
+
+		// Parser directives are only recognized before any other line
+		if directives {
+			if m := directiveRegex.FindStringSubmatch(trimmed); m != nil {
+				if strings.ToLower(m[1]) == "escape" {
+					if m[2] != "\\" && m[2] != "`" {
+						return nil, &SyntaxError{Line: line, Msg: fmt.Sprintf("invalid escape character '%s'", m[2])}
+					}
+
+					escape = rune(m[2][0])
+				}
+
+				continue
+			}
+
+			directives = false
+		}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		continued := strings.HasSuffix(trimmed, string(escape))
+		if continued {
+			trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, string(escape)))
+		}
+
+		if current == nil {
+			cmd, args, _ := strings.Cut(trimmed, " ")
+			current = &Instruction{Cmd: strings.ToUpper(cmd), Args: strings.TrimSpace(args), Line: line}
+
+			if !commands[current.Cmd] {
+				return nil, &SyntaxError{Line: line, Msg: fmt.Sprintf("unknown instruction '%s'", cmd)}
+			}
+
+			res = append(res, current)
+		} else if trimmed != "" {
+			current.Args = strings.TrimSpace(current.Args + " " + trimmed)
+		}
+
+		if continued {
+			continue
+		}
+
+		if current.Cmd == "RUN" || current.Cmd == "COPY" || current.Cmd == "ADD" {
+			for _, m := range heredocRegex.FindAllStringSubmatch(current.Args, -1) {
+				if m[1] == "<<" {
+					heredocs = append(heredocs, m[2])
+				}
+			}
+		}
+
+		if len(heredocs) == 0 {
+			current = nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(heredocs) > 0 {
+		return nil, &SyntaxError{Line: line, Msg: fmt.Sprintf("unterminated heredoc '%s'", heredocs[0])}
+	}
+
+	if current != nil {
+		return nil, &SyntaxError{Line: current.Line, Msg: "unterminated line continuation"}
+	}
+
+	if err := check(res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+var stageNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+var portRegex = regexp.MustCompile(`^(\d+)(-\d+)?(/(tcp|udp|sctp))?$`)
+
+func check(instructions []*Instruction) error {
+	if len(instructions) == 0 {
+		return &SyntaxError{Line: 1, Msg: "file with no instructions"}
+	}
+
+	from := false
+	for _, ins := range instructions {
+		if ins.Args == "" {
+			return &SyntaxError{Line: ins.Line, Msg: fmt.Sprintf("%s requires at least one argument", ins.Cmd)}
+		}
+
+		if !from && ins.Cmd != "ARG" && ins.Cmd != "FROM" {
+			return &SyntaxError{Line: ins.Line, Msg: fmt.Sprintf("%s is used before the first FROM", ins.Cmd)}
+		}
+
+		var err error
+		switch ins.Cmd {
+		case "FROM":
+			from = true
+			_, _, err = ParseFrom(ins.Args)
+		case "SHELL":
+			var shell []string
+			if json.Unmarshal([]byte(ins.Args), &shell) != nil || len(shell) == 0 {
+				err = fmt.Errorf("SHELL requires a JSON array of strings")
+			}
+		case "EXPOSE":
+			err = checkPorts(ins.Args)
+		case "HEALTHCHECK":
+			err = checkHealthcheck(ins.Args)
+		case "ONBUILD":
+			cmd, _, _ := strings.Cut(ins.Args, " ")
+			cmd = strings.ToUpper(cmd)
+			if !commands[cmd] || cmd == "ONBUILD" || cmd == "FROM" || cmd == "MAINTAINER" {
+				err = fmt.Errorf("'%s' isn't allowed as an ONBUILD trigger", cmd)
+			}
+		}
+
+		if err != nil {
+			return &SyntaxError{Line: ins.Line, Msg: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// ParseFrom returns the image and the stage name of FROM instruction arguments.
+func ParseFrom(args string) (string, string, error) {
+	fields := strings.Fields(args)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		if !strings.HasPrefix(fields[0], "--platform=") {
+			return "", "", fmt.Errorf("unknown FROM flag '%s'", fields[0])
+		}
+
+		fields = fields[1:]
+	}
+
+	switch {
+	case len(fields) == 1:
+		return fields[0], "", nil
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+		if !stageNameRegex.MatchString(fields[2]) {
+			return "", "", fmt.Errorf("invalid stage name '%s'", fields[2])
+		}
+
+		return fields[0], strings.ToLower(fields[2]), nil
+	}
+
+	return "", "", fmt.Errorf("FROM requires either one or three arguments")
+}
+
+func checkPorts(args string) error {
+	for _, port := range strings.Fields(args) {
+		// Ports might come from build args
+		if strings.Contains(port, "$") {
+			continue
+		}
+
+		if !portRegex.MatchString(port) {
+			return fmt.Errorf("invalid port '%s'", port)
+		}
+	}
+
+	return nil
+}
+
+func checkHealthcheck(args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 1 && strings.EqualFold(fields[0], "NONE") {
+		return nil
+	}
+
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "CMD") {
+		return fmt.Errorf("HEALTHCHECK requires either NONE or CMD with a command")
+	}
+
+	return nil
+}
+
+// Trigger returns the instruction an ONBUILD instruction adds to child images, nil is
+// returned for other instructions.
+func Trigger(ins *Instruction) *Instruction {
+	if ins.Cmd != "ONBUILD" {
+		return nil
+	}
+
+	// Syntax is already checked by Parse
+	cmd, args, _ := strings.Cut(ins.Args, " ")
+	return &Instruction{Cmd: strings.ToUpper(cmd), Args: strings.TrimSpace(args), Line: ins.Line}
+}
+
+// UsesContext reports if any stage copies files from the build context. Triggers of
+// ONBUILD instructions don't count, they run in builds of child images.
+func UsesContext(instructions []*Instruction) bool {
+	for _, ins := range instructions {
+		if ins.Cmd != "COPY" && ins.Cmd != "ADD" {
+			continue
+		}
+
+		fromContext := true
+		for _, field := range strings.Fields(ins.Args) {
+			if !strings.HasPrefix(field, "--") {
+				break
+			}
+
+			if strings.HasPrefix(field, "--from=") {
+				fromContext = false
+			}
+		}
+
+		if fromContext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasOnbuild reports if the final stage has ONBUILD triggers.
+func HasOnbuild(instructions []*Instruction) bool {
+	for i := len(instructions) - 1; i >= 0 && instructions[i].Cmd != "FROM"; i-- {
+		if instructions[i].Cmd == "ONBUILD" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,21 +5,69 @@ import (
 
 	api "github.com/onpremless/go-client"
 	"github.com/onpremless/opless/common/db"
-	"github.com/onpremless/opless/manager/redis"
+	"github.com/onpremless/opless/manager/store"
 )
 
+var endpointSchema = &db.Schema[api.Endpoint]{
+	Prefix: "endpoint",
+	ID:     func(x *api.Endpoint) string { return x.Id },
+	Sort: map[string]db.SortKey[api.Endpoint]{
+		"created_at": func(x *api.Endpoint) string { return db.NumKey(x.CreatedAt) },
+		"updated_at": func(x *api.Endpoint) string { return db.NumKey(x.UpdatedAt) },
+		"name":       func(x *api.Endpoint) string { return x.Name },
+	},
+	Unique: map[string]db.FieldKey[api.Endpoint]{
+		"path": func(x *api.Endpoint) string { return x.Path },
+	},
+	Lookup: map[string]db.FieldKey[api.Endpoint]{
+		"lambda": func(x *api.Endpoint) string { return x.Lambda },
+	},
+}
+
+func Reindex(ctx context.Context) error {
+	return db.Reindex(ctx, endpointSchema)(store.Client)
+}
+
+func Collections() []*db.Collection {
+	return []*db.Collection{endpointSchema.Collection()}
+}
+
 func GetEndpoint(ctx context.Context, id string) (*api.Endpoint, error) {
-	return db.GetValue[api.Endpoint](ctx, "endpoint", id)(redis.Client)
+	return db.GetValue[api.Endpoint](ctx, "endpoint", id)(store.Client)
+}
+
+func GetVersionedEndpoint(ctx context.Context, id string) (*api.Endpoint, int64, error) {
+	return db.GetVersionedValue[api.Endpoint](ctx, "endpoint", id)(store.Client)
 }
 
 func GetEndpoints(ctx context.Context) ([]*api.Endpoint, error) {
-	return db.GetValues[api.Endpoint](ctx, "endpoint")(redis.Client)
+	return db.GetValues[api.Endpoint](ctx, "endpoint")(store.Client)
+}
+
+func ListEndpoints(ctx context.Context, query *db.Query[api.Endpoint]) (*db.Page[api.Endpoint], error) {
+	return db.ListValues(ctx, endpointSchema, query)(store.Client)
+}
+
+func GetEndpointByPath(ctx context.Context, path string) (*api.Endpoint, error) {
+	return db.GetValueByUnique(ctx, endpointSchema, "path", path)(store.Client)
+}
+
+func GetLambdaEndpoints(ctx context.Context, lambda string) ([]*api.Endpoint, error) {
+	return db.GetValuesByLookup(ctx, endpointSchema, "lambda", lambda)(store.Client)
+}
+
+func CreateEndpoint(ctx context.Context, endpoint *api.Endpoint) error {
+	return db.CreateIndexedValue(ctx, endpointSchema, endpoint)(store.Client)
+}
+
+func UpdateEndpoint(ctx context.Context, endpoint *api.Endpoint, version int64) (int64, error) {
+	return db.UpdateIndexedValue(ctx, endpointSchema, endpoint, version)(store.Client)
 }
 
 func SetEndpoint(ctx context.Context, endpoint *api.Endpoint) error {
-	return db.SetValue(ctx, "endpoint:"+endpoint.Id, endpoint)(redis.Client)
+	return db.SetIndexedValue(ctx, endpointSchema, endpoint)(store.Client)
 }
 
-func FindEndpoint(ctx context.Context, predicate func(val *api.Endpoint) bool) (*api.Endpoint, error) {
-	return db.FindValue(ctx, "endpoint", predicate)(redis.Client)
+func DelEndpoint(ctx context.Context, id string, version int64) error {
+	return db.DelVersionedValue(ctx, endpointSchema, id, version)(store.Client)
 }
@@ -2,18 +2,23 @@ package endpoint
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
 	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/common/db"
 	"github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/errs"
 	"github.com/onpremless/opless/manager/lambda"
+	"github.com/onpremless/opless/manager/model"
 )
 
 type EndpointService interface {
-	List(ctx context.Context) ([]*api.Endpoint, error)
-	Get(ctx context.Context, id string) (*api.Endpoint, error)
+	List(ctx context.Context, query *db.Query[api.Endpoint]) (*db.Page[api.Endpoint], error)
+	Get(ctx context.Context, id string) (*api.Endpoint, int64, error)
 	Create(ctx context.Context, req *api.CreateEndpoint) (*api.Endpoint, error)
+	Update(ctx context.Context, id string, req *api.CreateEndpoint, version int64) (*api.Endpoint, int64, error)
+	Delete(ctx context.Context, id string, version int64) error
 }
 
 type endpointService struct {
@@ -26,52 +31,124 @@ func CreateEndpointService(lambdaSvc lambda.LambdaService) EndpointService {
 	}
 }
 
-func (s endpointService) List(ctx context.Context) ([]*api.Endpoint, error) {
-	return GetEndpoints(ctx)
+func (s endpointService) List(ctx context.Context, query *db.Query[api.Endpoint]) (*db.Page[api.Endpoint], error) {
+	return ListEndpoints(ctx, query)
 }
 
-func (s endpointService) Get(ctx context.Context, id string) (*api.Endpoint, error) {
-	return GetEndpoint(ctx, id)
+func (s endpointService) Get(ctx context.Context, id string) (*api.Endpoint, int64, error) {
+	return GetVersionedEndpoint(ctx, id)
 }
 
 func (s endpointService) Create(ctx context.Context, req *api.CreateEndpoint) (*api.Endpoint, error) {
-	lambda, err := lambda.GetLambda(ctx, req.Lambda)
+	unlock, err := s.lockLambda(ctx, req.Lambda)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if lambda == nil {
-		return nil, fmt.Errorf("lambda is not found: %s", req.Lambda)
+	now := time.Now().UnixMilli()
+	endpoint := &api.Endpoint{
+		Id:        util.UUID(),
+		Name:      req.Name,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Path:      req.Path,
+		Lambda:    req.Lambda,
 	}
 
-	if lambda.LambdaType != "ENDPOINT" {
-		return nil, fmt.Errorf("lamda is not an endpoint")
+	if err := CreateEndpoint(ctx, endpoint); err != nil {
+		return nil, wrapConflict(err)
 	}
 
-	existingEndpoint, err := FindEndpoint(ctx, func(val *api.Endpoint) bool {
-		return val.Path == req.Path
-	})
+	return endpoint, nil
+}
+
+// Update replaces the endpoint if its resource version is still the given one,
+// db.AnyVersion means the latest version.
+func (s endpointService) Update(ctx context.Context, id string, req *api.CreateEndpoint, version int64) (*api.Endpoint, int64, error) {
+	endpoint, current, err := GetVersionedEndpoint(ctx, id)
 	if err != nil {
-		return nil, err
+		return nil, db.NoVersion, err
 	}
 
-	if existingEndpoint != nil {
-		return nil, fmt.Errorf("endpoint already exists: %s", existingEndpoint.Id)
+	if endpoint == nil {
+		return nil, db.NoVersion, errs.New(errs.NotFound, "endpoint is not found: %s", id)
 	}
 
-	now := time.Now().UnixMilli()
-	endpoint := &api.Endpoint{
-		Id:        util.UUID(),
-		Name:      req.Name,
-		CreatedAt: now,
-		UpdatedAt: now,
-		Path:      req.Path,
-		Lambda:    req.Lambda,
+	if version == db.AnyVersion {
+		version = current
+	}
+
+	if version != current {
+		return nil, db.NoVersion, &db.VersionError{Expected: version, Actual: current}
+	}
+
+	unlock, err := s.lockLambda(ctx, req.Lambda)
+	if err != nil {
+		return nil, db.NoVersion, err
+	}
+	defer unlock()
+
+	endpoint.Name = req.Name
+	endpoint.Path = req.Path
+	endpoint.Lambda = req.Lambda
+	endpoint.UpdatedAt = time.Now().UnixMilli()
+
+	version, err = UpdateEndpoint(ctx, endpoint, version)
+	if err != nil {
+		return nil, db.NoVersion, wrapConflict(err)
+	}
+
+	return endpoint, version, nil
+}
+
+// Delete removes the endpoint if its resource version is still the given one,
+// db.AnyVersion skips the check.
+func (s endpointService) Delete(ctx context.Context, id string, version int64) error {
+	endpoint, err := GetEndpoint(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if endpoint == nil {
+		return errs.New(errs.NotFound, "endpoint is not found: %s", id)
+	}
+
+	// Version is checked by the store along with the delete
+	return DelEndpoint(ctx, id, version)
+}
+
+// lockLambda validates the lambda the endpoint refers to and takes its refs lock, so
+// the lambda isn't deleted until the endpoint is written.
+func (s endpointService) lockLambda(ctx context.Context, id string) (func(), error) {
+	unlock, err := lambda.LockRefs(ctx, model.KindLambda, id)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := SetEndpoint(ctx, endpoint); err != nil {
+	l, err := lambda.GetLambda(ctx, id)
+	if err != nil {
+		unlock()
 		return nil, err
 	}
 
-	return endpoint, nil
+	if l == nil {
+		unlock()
+		return nil, errs.Field("lambda", "refers to missing lambda %s", id)
+	}
+
+	if l.LambdaType != "ENDPOINT" {
+		unlock()
+		return nil, errs.Field("lambda", "refers to lambda %s which is not an endpoint", id)
+	}
+
+	return unlock, nil
+}
+
+func wrapConflict(err error) error {
+	if errors.Is(err, db.ErrConflict) {
+		return errs.New(errs.Conflict, "endpoint already exists: %w", err)
+	}
+
+	return err
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/logger"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID tags the request with the id sent by the client or a generated one. The id is
+// echoed back and carried by error bodies, so a failure can be found in the logs.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !requestIDRegex.MatchString(id) {
+		id = cutil.UUID()
+	}
+
+	c.Set(requestIDHeader, id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// writeError responds with the error envelope, the status is the one of the error kind.
+func writeError(c *gin.Context, err error) {
+	status, body := errs.Response(err, c.GetString(requestIDHeader))
+	if status >= http.StatusInternalServerError {
+		logger.L.Error(
+			"Request failed",
+			zap.Error(err),
+			zap.String("request_id", body.RequestID),
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+		)
+	}
+
+	c.AbortWithStatusJSON(status, body)
+}
+
+// notFound responds that the resource identified by the 'id' path param doesn't exist.
+func notFound(c *gin.Context, resource string) {
+	writeError(c, errs.New(errs.NotFound, "%s is not found: %s", resource, c.Param("id")))
+}
+
+// invalid responds that the request is malformed, the field is pointed at if the body
+// has a value of the wrong type.
+func invalid(c *gin.Context, err error) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		err = &errs.Error{
+			Kind:   errs.Validation,
+			Err:    err,
+			Fields: []*errs.FieldError{{Field: typeErr.Field, Message: "must be " + typeErr.Type.String()}},
+		}
+	}
+
+	writeError(c, errs.Default(errs.Validation, err))
+}
+
+// recovered responds to the request whose handler panicked, the panic is logged by gin.
+func recovered(c *gin.Context, _ any) {
+	writeError(c, errs.New(errs.Internal, "internal server error"))
+}
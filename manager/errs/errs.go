@@ -0,0 +1,145 @@
+// Package errs classifies errors by kind, so the API responds with statuses and codes
+// which don't depend on the wording of the messages. Services return errors of the kind
+// where the cause is known, like a missing lambda, the rest are classified by KindOf.
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/onpremless/opless/common/db"
+)
+
+// Kind is the machine readable code of the error.
+type Kind string
+
+const (
+	Internal           Kind = "INTERNAL"
+	NotFound           Kind = "NOT_FOUND"
+	Conflict           Kind = "CONFLICT"
+	Validation         Kind = "VALIDATION"
+	Unauthorized       Kind = "UNAUTHORIZED"
+	Forbidden          Kind = "FORBIDDEN"
+	Unavailable        Kind = "UNAVAILABLE"
+	PreconditionFailed Kind = "PRECONDITION_FAILED"
+	TooLarge           Kind = "TOO_LARGE"
+	Unsupported        Kind = "UNSUPPORTED"
+)
+
+var statuses = map[Kind]int{
+	Internal:           http.StatusInternalServerError,
+	NotFound:           http.StatusNotFound,
+	Conflict:           http.StatusConflict,
+	Validation:         http.StatusBadRequest,
+	Unauthorized:       http.StatusUnauthorized,
+	Forbidden:          http.StatusForbidden,
+	Unavailable:        http.StatusServiceUnavailable,
+	PreconditionFailed: http.StatusPreconditionFailed,
+	TooLarge:           http.StatusRequestEntityTooLarge,
+	Unsupported:        http.StatusNotImplemented,
+}
+
+// Status is the HTTP status responded with for errors of the kind.
+func (k Kind) Status() int {
+	if status, ok := statuses[k]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// FieldError points at the request field which failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is an error of a known kind, it wraps the cause so errors.Is keeps working.
+type Error struct {
+	Kind   Kind
+	Err    error
+	Fields []*FieldError
+	// Details are kind specific values, like lint findings of a Dockerfile
+	Details map[string]any
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithDetail adds the value to the details of the error.
+func (e *Error) WithDetail(key string, value any) *Error {
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+
+	e.Details[key] = value
+	return e
+}
+
+// New formats the error of the kind, %w wraps the cause like fmt.Errorf does.
+func New(kind Kind, format string, args ...any) *Error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// Field is a validation error of the request field, the message is prefixed by the
+// quoted field name, like "'name' is required".
+func Field(field string, format string, args ...any) *Error {
+	message := fmt.Sprintf(format, args...)
+	return &Error{
+		Kind:   Validation,
+		Err:    fmt.Errorf("'%s' %s", field, message),
+		Fields: []*FieldError{{Field: field, Message: message}},
+	}
+}
+
+// Default gives the kind to the error unless KindOf knows it already, so the handler can
+// tell what a failure of the call means without hiding the kinds services returned.
+func Default(kind Kind, err error) error {
+	if err == nil || classify(err) != "" {
+		return err
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of the error, errors of unknown cause are Internal.
+func KindOf(err error) Kind {
+	if kind := classify(err); kind != "" {
+		return kind
+	}
+
+	return Internal
+}
+
+// As returns the error of the known kind along with the kind it has.
+func As(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return &Error{Kind: KindOf(err), Err: err}
+}
+
+func classify(err error) Kind {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e.Kind
+	case errors.Is(err, db.ErrConflict), errors.Is(err, db.ErrStaleVersion),
+		errors.Is(err, db.ErrLockTimeout), errors.Is(err, db.ErrTooManyRetries):
+		return Conflict
+	case errors.Is(err, db.ErrInvalidCursor), errors.Is(err, db.ErrUnknownSort):
+		return Validation
+	case db.IsUnavailable(err):
+		return Unavailable
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,25 @@
+package errs
+
+// Body is the JSON envelope every error response of the API is sent in.
+type Body struct {
+	// Error is the human readable message
+	Error string `json:"error"`
+	Code  Kind   `json:"code"`
+	// Fields point at the request fields which failed validation
+	Fields  []*FieldError  `json:"fields,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+	// RequestID is the 'X-Request-Id' of the request, it's logged along with internal errors
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Response returns the status and the body of the error response.
+func Response(err error, requestID string) (int, *Body) {
+	e := As(err)
+	return e.Kind.Status(), &Body{
+		Error:     err.Error(),
+		Code:      e.Kind,
+		Fields:    e.Fields,
+		Details:   e.Details,
+		RequestID: requestID,
+	}
+}
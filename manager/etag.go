@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/lambda"
+)
+
+var errInvalidIfMatch = errs.New(errs.Validation, "invalid 'If-Match' header")
+
+func setETag(c *gin.Context, version int64) {
+	c.Header("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// ifMatch returns resource version required by 'If-Match' header, db.AnyVersion if there is no requirement.
+func ifMatch(c *gin.Context) (int64, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return db.AnyVersion, nil
+	}
+
+	tag := strings.TrimPrefix(header, "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return db.AnyVersion, errInvalidIfMatch
+	}
+
+	version, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	if err != nil || version < db.FirstVersion {
+		return db.AnyVersion, errInvalidIfMatch
+	}
+
+	return version, nil
+}
+
+// staleError distinguishes client side precondition failure from a concurrent modification.
+func staleError(expected int64, err error) error {
+	if expected == db.AnyVersion {
+		return &errs.Error{Kind: errs.Conflict, Err: err}
+	}
+
+	return &errs.Error{Kind: errs.PreconditionFailed, Err: err}
+}
+
+// checkLambdaVersion aborts the request if the lambda doesn't match 'If-Match' header and
+// returns the version required by it otherwise. It only fails early, the version has to be
+// checked again along with the change.
+func checkLambdaVersion(c *gin.Context, id string) (int64, bool) {
+	expected, err := ifMatch(c)
+	if err != nil {
+		invalid(c, err)
+		return db.AnyVersion, false
+	}
+
+	if expected == db.AnyVersion {
+		return expected, true
+	}
+
+	_, version, err := lambda.GetVersionedLambda(c, id)
+	if err != nil {
+		writeError(c, err)
+		return db.AnyVersion, false
+	}
+
+	if version != expected {
+		writeError(c, staleError(expected, &db.VersionError{Expected: expected, Actual: version}))
+		return db.AnyVersion, false
+	}
+
+	return expected, true
+}
@@ -0,0 +1,206 @@
+package lambda
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/manager/archive"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/code"
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+// BootstrapLambda stores files of the uploaded archive as blobs and creates the first
+// code version of the lambda listing them.
+func BootstrapLambda(ctx context.Context, id string, lambda *api.CreateLambda, limits *archive.Limits) error {
+	r, err := artifact.Client.Get(ctx, artifact.TmpBucket, lambda.Archive)
+	if errors.Is(err, artifact.ErrNotFound) {
+		return errs.Field("archive", "refers to missing upload %s", lambda.Archive)
+	}
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := []*model.CodeFile{}
+	err = archive.Extract(r, limits, func(name string, f io.Reader, size int64, mode os.FileMode) error {
+		digest, size, err := code.PutBlob(ctx, f, size)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, &model.CodeFile{Path: name, Digest: digest, Size: size, Mode: code.FileMode(mode)})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = code.CreateVersion(ctx, id, files)
+	return err
+}
+
+// Dockerfile is hashed and put into the build context as is, so it's kept in memory.
+const maxDockerfileSize = 1 << 20
+
+// BuildContext is everything a lambda image is built from.
+type BuildContext struct {
+	Manifest   *model.CodeManifest
+	Dockerfile []byte
+	Params     *model.BuildParams
+	// Base is the runtime image the lambda image is built from, nil if the runtime
+	// Dockerfile needs the code and is built along with it
+	Base *BaseImage
+}
+
+// BaseImage is a runtime version built with no code, it's shared by lambdas with equal params.
+type BaseImage struct {
+	Runtime    *model.RuntimeVersion
+	Dockerfile []byte
+	// Params are the lambda build params which affect the runtime image
+	Params *model.BuildParams
+	Image  string
+}
+
+func GetBuildContext(ctx context.Context, lambda string, runtime *model.RuntimeVersion, params *model.BuildParams) (*BuildContext, error) {
+	manifest, err := code.GetManifest(ctx, lambda)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("lambda %s has no code", lambda)
+	}
+
+	raw, err := GetRuntimeDockerfile(ctx, runtime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Dockerfile of runtime %s: %w", runtime.Runtime, err)
+	}
+
+	// Runtimes created before Dockerfiles were linted might not parse
+	instructions, err := dockerfile.Parse(bytes.NewReader(raw))
+	if err != nil || dockerfile.UsesContext(instructions) {
+		return &BuildContext{Manifest: manifest, Dockerfile: raw, Params: params}, nil
+	}
+
+	base := &BaseImage{
+		Runtime:    runtime,
+		Dockerfile: raw,
+		Params:     &model.BuildParams{Args: params.Args, Target: params.Target, Platform: params.Platform},
+	}
+
+	_, hash, _ := strings.Cut(base.Digest(), ":")
+	base.Image = "opless-runtime-" + runtime.Runtime + ":" + hash
+
+	// Code is copied by ONBUILD triggers of the runtime if it has any
+	lambdaDockerfile := "FROM " + base.Image + "\n"
+	if !dockerfile.HasOnbuild(instructions) {
+		lambdaDockerfile += "COPY . .\n"
+	}
+
+	return &BuildContext{
+		Manifest:   manifest,
+		Dockerfile: []byte(lambdaDockerfile),
+		Params:     &model.BuildParams{Platform: params.Platform, Labels: params.Labels},
+		Base:       base,
+	}, nil
+}
+
+// Digest identifies the base image, it changes only if the runtime Dockerfile or
+// the build params change.
+func (b *BaseImage) Digest() string {
+	params, _ := json.Marshal(b.Params)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "dockerfile %s\n", b.Runtime.Digest)
+	fmt.Fprintf(hash, "params %s\n", params)
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// Tar returns the build context of the base image, it has only the Dockerfile.
+func (b *BaseImage) Tar() (io.Reader, error) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	if err := writeDockerfile(tw, b.Dockerfile); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func writeDockerfile(tw *tar.Writer, raw []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "Dockerfile",
+		Mode:     0644,
+		Size:     int64(len(raw)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(raw)
+	return err
+}
+
+// Digest identifies the image built from the context, it changes only if the runtime
+// Dockerfile, the code files or the build params change.
+func (c *BuildContext) Digest() string {
+	dockerfile := sha256.Sum256(c.Dockerfile)
+	// Map keys are marshalled sorted, so equal params always have equal JSON
+	params, _ := json.Marshal(c.Params)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "dockerfile sha256:%x\n", dockerfile)
+	fmt.Fprintf(hash, "code %s\n", c.Manifest.Digest)
+	fmt.Fprintf(hash, "params %s\n", params)
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// Tar streams the build context, code files are read from blobs only as the context is read.
+// The returned reader has to be closed.
+func (c *BuildContext) Tar(ctx context.Context) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(c.writeTar(ctx, pw))
+	}()
+
+	return pr
+}
+
+func (c *BuildContext) writeTar(ctx context.Context, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	if err := writeDockerfile(tw, c.Dockerfile); err != nil {
+		return err
+	}
+
+	// Dockerfile of the context takes precedence over the lambda one
+	if err := code.WriteTar(ctx, c.Manifest, tw, "Dockerfile"); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
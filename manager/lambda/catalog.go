@@ -0,0 +1,126 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	api "github.com/onpremless/go-client"
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/catalog"
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+// SeedCatalog installs catalog runtimes missing in the store and upgrades built-in ones
+// installed by another opless release. Runtimes created by users are never touched, even if
+// their name is taken by the catalog, neither are catalog runtimes the Dockerfile policy
+// rejects. Disabled if RUNTIME_CATALOG env var is 'false'.
+func SeedCatalog(ctx context.Context) error {
+	if cutil.GetStrVarDefault("RUNTIME_CATALOG", "true") == "false" {
+		return nil
+	}
+
+	runtimes, err := catalog.Runtimes()
+	if err != nil {
+		return err
+	}
+
+	// Managers sharing the store start concurrently
+	lctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	unlock, err := store.Client.Lock(lctx, "runtime-catalog", time.Minute)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	policy := dockerfile.PolicyFromEnv()
+	for _, runtime := range runtimes {
+		if err := seedRuntime(ctx, runtime, policy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func seedRuntime(ctx context.Context, cRuntime *catalog.Runtime, policy *dockerfile.Policy) error {
+	builtin, err := GetBuiltinRuntimeByName(ctx, cRuntime.Name)
+	if err != nil {
+		return err
+	}
+
+	runtime, err := GetRuntimeByName(ctx, cRuntime.Name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	digest := cRuntime.Digest()
+	create := runtime == nil
+
+	switch {
+	case runtime == nil:
+		// Built-in record without the runtime is left by an interrupted install
+		id := cutil.UUID()
+		if builtin != nil {
+			id = builtin.Id
+		}
+
+		builtin = &model.BuiltinRuntime{Id: id, Name: cRuntime.Name, InstalledAt: now}
+		runtime = &api.Runtime{Id: id, Name: cRuntime.Name, CreatedAt: now}
+	case builtin == nil || builtin.Id != runtime.Id:
+		logger.L.Warn("Runtime name is taken, built-in runtime is skipped", zap.String("name", cRuntime.Name), zap.String("id", runtime.Id))
+		return nil
+	case builtin.Digest == digest && builtin.Description == cRuntime.Description:
+		return nil
+	}
+
+	builtin.Description = cRuntime.Description
+	if builtin.Digest == digest {
+		return SetBuiltinRuntime(ctx, builtin)
+	}
+
+	if _, err := dockerfile.Lint(bytes.NewReader(cRuntime.Dockerfile), policy); err != nil {
+		logger.L.Warn("Built-in runtime is rejected by the Dockerfile policy, it's skipped", zap.Error(err), zap.String("name", cRuntime.Name))
+		return nil
+	}
+
+	builtin.Digest = digest
+	builtin.UpgradedAt = now
+	runtime.UpdatedAt = now
+
+	// Runtime is created last, so it's not used until everything it's built from is in place
+	if err := installRuntime(ctx, cRuntime, builtin); err != nil {
+		return err
+	}
+
+	if create {
+		err = CreateRuntime(ctx, runtime)
+	} else {
+		err = SetRuntime(ctx, runtime)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	logger.L.Info("Built-in runtime is installed", zap.String("name", runtime.Name), zap.String("id", runtime.Id), zap.String("digest", digest))
+	return nil
+}
+
+// installRuntime adds the catalog Dockerfile and build params as the next runtime version.
+// Lambdas stay pinned to previous versions until the runtime is rolled out.
+func installRuntime(ctx context.Context, cRuntime *catalog.Runtime, builtin *model.BuiltinRuntime) error {
+	if _, err := CreateRuntimeVersion(ctx, builtin.Id, cRuntime.Dockerfile, cRuntime.Build); err != nil {
+		return err
+	}
+
+	return SetBuiltinRuntime(ctx, builtin)
+}
@@ -2,36 +2,402 @@ package lambda
 
 import (
 	"context"
+	"sort"
+	"time"
 
 	api "github.com/onpremless/go-client"
 	"github.com/onpremless/opless/common/db"
-	"github.com/onpremless/opless/manager/redis"
+	"github.com/onpremless/opless/manager/code"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
 )
 
+var lambdaSchema = &db.Schema[api.Lambda]{
+	Prefix: "lambda",
+	ID:     func(x *api.Lambda) string { return x.Id },
+	Sort: map[string]db.SortKey[api.Lambda]{
+		"created_at": func(x *api.Lambda) string { return db.NumKey(x.CreatedAt) },
+		"updated_at": func(x *api.Lambda) string { return db.NumKey(x.UpdatedAt) },
+		"name":       func(x *api.Lambda) string { return x.Name },
+	},
+	Lookup: map[string]db.FieldKey[api.Lambda]{
+		"runtime": func(x *api.Lambda) string { return x.Runtime },
+	},
+}
+
+var runtimeSchema = &db.Schema[api.Runtime]{
+	Prefix: "runtime",
+	ID:     func(x *api.Runtime) string { return x.Id },
+	Sort: map[string]db.SortKey[api.Runtime]{
+		"created_at": func(x *api.Runtime) string { return db.NumKey(x.CreatedAt) },
+		"updated_at": func(x *api.Runtime) string { return db.NumKey(x.UpdatedAt) },
+		"name":       func(x *api.Runtime) string { return x.Name },
+	},
+	Unique: map[string]db.FieldKey[api.Runtime]{
+		"name": func(x *api.Runtime) string { return x.Name },
+	},
+}
+
+var buildSchema = &db.Schema[model.LambdaBuild]{
+	Prefix: "lambda-build",
+	ID:     func(x *model.LambdaBuild) string { return x.Id },
+}
+
+var runtimeVersionSchema = &db.Schema[model.RuntimeVersion]{
+	Prefix: "runtime-version",
+	ID:     func(x *model.RuntimeVersion) string { return runtimeVersionID(x.Runtime, x.Version) },
+	Lookup: map[string]db.FieldKey[model.RuntimeVersion]{
+		"runtime": func(x *model.RuntimeVersion) string { return x.Runtime },
+	},
+}
+
+var lambdaRuntimeSchema = &db.Schema[model.LambdaRuntime]{
+	Prefix: "lambda-runtime",
+	ID:     func(x *model.LambdaRuntime) string { return x.Id },
+}
+
+var runtimeImageSchema = &db.Schema[model.RuntimeImage]{
+	Prefix: "runtime-image",
+	ID:     func(x *model.RuntimeImage) string { return x.Id },
+	Lookup: map[string]db.FieldKey[model.RuntimeImage]{
+		"runtime": func(x *model.RuntimeImage) string { return x.Runtime },
+	},
+}
+
+var lambdaImageSchema = &db.Schema[model.LambdaImage]{
+	Prefix: "lambda-image",
+	ID:     func(x *model.LambdaImage) string { return x.Id },
+}
+
+var lambdaRegistryAuthSchema = &db.Schema[model.LambdaRegistryAuth]{
+	Prefix: "lambda-registry-auth",
+	ID:     func(x *model.LambdaRegistryAuth) string { return x.Id },
+}
+
+var lambdaBuildParamsSchema = &db.Schema[model.LambdaBuildParams]{
+	Prefix: "lambda-build-params",
+	ID:     func(x *model.LambdaBuildParams) string { return x.Id },
+}
+
+var builtinRuntimeSchema = &db.Schema[model.BuiltinRuntime]{
+	Prefix: "runtime-builtin",
+	ID:     func(x *model.BuiltinRuntime) string { return x.Id },
+	Unique: map[string]db.FieldKey[model.BuiltinRuntime]{
+		"name": func(x *model.BuiltinRuntime) string { return x.Name },
+	},
+}
+
+// Lambda build can take a while, lock expires only if a manager has gone.
+const lambdaLockTTL = 30 * time.Minute
+
+// LockLambda serializes lambda processing across managers sharing the store.
+func LockLambda(ctx context.Context, id string) (func(), error) {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return store.Client.Lock(lctx, "lambda:"+id, lambdaLockTTL)
+}
+
+// LockRefs serializes deleting a lambda or a runtime with creating resources referring to
+// it, dependents are checked under it. It's held only while the records are written.
+func LockRefs(ctx context.Context, kind string, id string) (func(), error) {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	unlock, err := store.Client.Lock(lctx, "refs:"+kind+":"+id, time.Minute)
+	if err != nil {
+		return nil, errs.New(errs.Conflict, "%s '%s' is being changed: %w", kind, id, err)
+	}
+
+	return unlock, nil
+}
+
+func Reindex(ctx context.Context) error {
+	if err := db.Reindex(ctx, lambdaSchema)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.Reindex(ctx, runtimeSchema)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.Reindex(ctx, runtimeVersionSchema)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.Reindex(ctx, runtimeImageSchema)(store.Client); err != nil {
+		return err
+	}
+
+	return db.Reindex(ctx, builtinRuntimeSchema)(store.Client)
+}
+
+// Collections are all collections of lambdas and runtimes which are backed up. Registry
+// credentials are left out, so backups carry no secrets.
+func Collections() []*db.Collection {
+	return []*db.Collection{
+		lambdaSchema.Collection(),
+		runtimeSchema.Collection(),
+		buildSchema.Collection(),
+		runtimeVersionSchema.Collection(),
+		lambdaRuntimeSchema.Collection(),
+		runtimeImageSchema.Collection(),
+		lambdaImageSchema.Collection(),
+		lambdaBuildParamsSchema.Collection(),
+		builtinRuntimeSchema.Collection(),
+	}
+}
+
 func GetLambda(ctx context.Context, id string) (*api.Lambda, error) {
-	return db.GetValue[api.Lambda](ctx, "lambda", id)(redis.Client)
+	return db.GetValue[api.Lambda](ctx, "lambda", id)(store.Client)
 }
 
 func GetRuntime(ctx context.Context, id string) (*api.Runtime, error) {
-	return db.GetValue[api.Runtime](ctx, "runtime", id)(redis.Client)
+	return db.GetValue[api.Runtime](ctx, "runtime", id)(store.Client)
+}
+
+func GetVersionedLambda(ctx context.Context, id string) (*api.Lambda, int64, error) {
+	return db.GetVersionedValue[api.Lambda](ctx, "lambda", id)(store.Client)
+}
+
+func GetVersionedRuntime(ctx context.Context, id string) (*api.Runtime, int64, error) {
+	return db.GetVersionedValue[api.Runtime](ctx, "runtime", id)(store.Client)
+}
+
+func GetRuntimeByName(ctx context.Context, name string) (*api.Runtime, error) {
+	return db.GetValueByUnique(ctx, runtimeSchema, "name", name)(store.Client)
+}
+
+func GetRuntimeLambdas(ctx context.Context, runtime string) ([]*api.Lambda, error) {
+	return db.GetValuesByLookup(ctx, lambdaSchema, "runtime", runtime)(store.Client)
 }
 
 func GetLambdas(ctx context.Context) ([]*api.Lambda, error) {
-	return db.GetValues[api.Lambda](ctx, "lambda")(redis.Client)
+	return db.GetValues[api.Lambda](ctx, "lambda")(store.Client)
 }
 
 func GetRuntimes(ctx context.Context) ([]*api.Runtime, error) {
-	return db.GetValues[api.Runtime](ctx, "runtime")(redis.Client)
+	return db.GetValues[api.Runtime](ctx, "runtime")(store.Client)
+}
+
+func ListLambdas(ctx context.Context, query *db.Query[api.Lambda]) (*db.Page[api.Lambda], error) {
+	return db.ListValues(ctx, lambdaSchema, query)(store.Client)
+}
+
+func ListRuntimes(ctx context.Context, query *db.Query[api.Runtime]) (*db.Page[api.Runtime], error) {
+	return db.ListValues(ctx, runtimeSchema, query)(store.Client)
+}
+
+func CreateLambda(ctx context.Context, lambda *api.Lambda) error {
+	return db.CreateIndexedValue(ctx, lambdaSchema, lambda)(store.Client)
+}
+
+func CreateRuntime(ctx context.Context, runtime *api.Runtime) error {
+	return db.CreateIndexedValue(ctx, runtimeSchema, runtime)(store.Client)
 }
 
 func SetLambda(ctx context.Context, lambda *api.Lambda) error {
-	return db.SetValue(ctx, "lambda:"+lambda.Id, lambda)(redis.Client)
+	return db.SetIndexedValue(ctx, lambdaSchema, lambda)(store.Client)
 }
 
 func SetRuntime(ctx context.Context, runtime *api.Runtime) error {
-	return db.SetValue(ctx, "runtime:"+runtime.Id, runtime)(redis.Client)
+	return db.SetIndexedValue(ctx, runtimeSchema, runtime)(store.Client)
+}
+
+func ModifyLambda(ctx context.Context, id string, mutate func(lambda *api.Lambda) error) (*api.Lambda, int64, error) {
+	return db.ModifyIndexedValue(ctx, lambdaSchema, id, mutate)(store.Client)
+}
+
+func ModifyRuntime(ctx context.Context, id string, mutate func(runtime *api.Runtime) error) (*api.Runtime, int64, error) {
+	return db.ModifyIndexedValue(ctx, runtimeSchema, id, mutate)(store.Client)
 }
 
 func FindLambda(ctx context.Context, predicate func(val *api.Lambda) bool) (*api.Lambda, error) {
-	return db.FindValue(ctx, "lambda", predicate)(redis.Client)
+	return db.FindValue(ctx, "lambda", predicate)(store.Client)
+}
+
+func GetLambdaBuild(ctx context.Context, id string) (*model.LambdaBuild, error) {
+	return db.GetValue[model.LambdaBuild](ctx, "lambda-build", id)(store.Client)
+}
+
+func GetLambdaBuilds(ctx context.Context) ([]*model.LambdaBuild, error) {
+	return db.GetValues[model.LambdaBuild](ctx, "lambda-build")(store.Client)
+}
+
+func SetLambdaBuild(ctx context.Context, build *model.LambdaBuild) error {
+	return db.SetIndexedValue(ctx, buildSchema, build)(store.Client)
+}
+
+func runtimeVersionID(runtime string, version int64) string {
+	return runtime + "/" + db.NumKey(version)
+}
+
+func GetRuntimeVersion(ctx context.Context, runtime string, version int64) (*model.RuntimeVersion, error) {
+	return db.GetValue[model.RuntimeVersion](ctx, "runtime-version", runtimeVersionID(runtime, version))(store.Client)
+}
+
+// GetRuntimeVersions returns versions of the runtime ordered from the oldest one.
+func GetRuntimeVersions(ctx context.Context, runtime string) ([]*model.RuntimeVersion, error) {
+	versions, err := db.GetValuesByLookup(ctx, runtimeVersionSchema, "runtime", runtime)(store.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// createRuntimeVersionRecord fails with db.ErrConflict if the version number is taken.
+func delRuntimeVersions(ctx context.Context, runtime string) error {
+	versions, err := GetRuntimeVersions(ctx, runtime)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if err := db.DelIndexedValue(ctx, runtimeVersionSchema, runtimeVersionID(runtime, version.Version))(store.Client); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createRuntimeVersionRecord(ctx context.Context, version *model.RuntimeVersion) error {
+	return db.CreateIndexedValue(ctx, runtimeVersionSchema, version)(store.Client)
+}
+
+func GetLambdaRuntime(ctx context.Context, id string) (*model.LambdaRuntime, error) {
+	return db.GetValue[model.LambdaRuntime](ctx, "lambda-runtime", id)(store.Client)
+}
+
+func SetLambdaRuntime(ctx context.Context, pin *model.LambdaRuntime) error {
+	return db.SetIndexedValue(ctx, lambdaRuntimeSchema, pin)(store.Client)
+}
+
+// GetLambdaBuildParams returns empty params if the lambda has no overrides.
+func GetLambdaBuildParams(ctx context.Context, id string) (*model.BuildParams, error) {
+	params, err := db.GetValue[model.LambdaBuildParams](ctx, "lambda-build-params", id)(store.Client)
+	if err != nil || params == nil {
+		return &model.BuildParams{}, err
+	}
+
+	return &params.BuildParams, nil
+}
+
+func SetLambdaBuildParams(ctx context.Context, id string, params *model.BuildParams) error {
+	return db.SetIndexedValue(ctx, lambdaBuildParamsSchema, &model.LambdaBuildParams{Id: id, BuildParams: *params})(store.Client)
+}
+
+func GetBuiltinRuntimes(ctx context.Context) ([]*model.BuiltinRuntime, error) {
+	return db.GetValues[model.BuiltinRuntime](ctx, "runtime-builtin")(store.Client)
+}
+
+func GetBuiltinRuntimeByName(ctx context.Context, name string) (*model.BuiltinRuntime, error) {
+	return db.GetValueByUnique(ctx, builtinRuntimeSchema, "name", name)(store.Client)
+}
+
+func SetBuiltinRuntime(ctx context.Context, runtime *model.BuiltinRuntime) error {
+	return db.SetIndexedValue(ctx, builtinRuntimeSchema, runtime)(store.Client)
+}
+
+func GetRuntimeImages(ctx context.Context, runtime string) ([]*model.RuntimeImage, error) {
+	return db.GetValuesByLookup(ctx, runtimeImageSchema, "runtime", runtime)(store.Client)
+}
+
+func SetRuntimeImage(ctx context.Context, image *model.RuntimeImage) error {
+	return db.SetIndexedValue(ctx, runtimeImageSchema, image)(store.Client)
+}
+
+func DelRuntimeImage(ctx context.Context, id string) error {
+	return db.DelIndexedValue(ctx, runtimeImageSchema, id)(store.Client)
+}
+
+// GetLambdaImage returns nil if the lambda is built from its code.
+func GetLambdaImage(ctx context.Context, id string) (*model.LambdaImage, error) {
+	return db.GetValue[model.LambdaImage](ctx, "lambda-image", id)(store.Client)
+}
+
+func GetLambdaImages(ctx context.Context) ([]*model.LambdaImage, error) {
+	return db.GetValues[model.LambdaImage](ctx, "lambda-image")(store.Client)
+}
+
+func SetLambdaImage(ctx context.Context, image *model.LambdaImage) error {
+	return db.SetIndexedValue(ctx, lambdaImageSchema, image)(store.Client)
+}
+
+// GetLambdaRegistryAuth returns nil if the lambda image is pulled anonymously.
+func GetLambdaRegistryAuth(ctx context.Context, id string) (*model.RegistryAuth, error) {
+	auth, err := db.GetValue[model.LambdaRegistryAuth](ctx, "lambda-registry-auth", id)(store.Client)
+	if err != nil || auth == nil {
+		return nil, err
+	}
+
+	return openRegistryAuth(id, auth.Sealed)
+}
+
+func SetLambdaRegistryAuth(ctx context.Context, id string, auth *model.RegistryAuth) error {
+	sealed, err := sealRegistryAuth(id, auth)
+	if err != nil {
+		return err
+	}
+
+	return db.SetIndexedValue(ctx, lambdaRegistryAuthSchema, &model.LambdaRegistryAuth{Id: id, Sealed: sealed})(store.Client)
+}
+
+// DelLambda removes the lambda, records kept by its id and its code versions. Blobs of the
+// code are removed by the blob sweep.
+func DelLambda(ctx context.Context, id string) error {
+	// Lambda goes first, so a failure leaves no lambda with half of its records
+	if err := db.DelIndexedValue(ctx, lambdaSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.DelIndexedValue(ctx, buildSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.DelIndexedValue(ctx, lambdaRuntimeSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.DelIndexedValue(ctx, lambdaImageSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.DelIndexedValue(ctx, lambdaRegistryAuthSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	if err := db.DelIndexedValue(ctx, lambdaBuildParamsSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	return code.DeleteCode(ctx, id)
+}
+
+// DelRuntime removes the runtime along with its versions and image records. Dockerfiles
+// are kept in the artifact store.
+func DelRuntime(ctx context.Context, id string) error {
+	if err := db.DelIndexedValue(ctx, runtimeSchema, id)(store.Client); err != nil {
+		return err
+	}
+
+	if err := delRuntimeVersions(ctx, id); err != nil {
+		return err
+	}
+
+	images, err := GetRuntimeImages(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		if err := db.DelIndexedValue(ctx, runtimeImageSchema, image.Id)(store.Client); err != nil {
+			return err
+		}
+	}
+
+	return db.DelIndexedValue(ctx, builtinRuntimeSchema, id)(store.Client)
 }
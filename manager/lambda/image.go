@@ -0,0 +1,138 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+var ErrPreBuilt = errs.New(errs.Conflict, "lambda runs a pre-built image")
+
+func (s *service) RegisterImage(ctx context.Context, cLambda *api.CreateLambda, source *model.ImageSource) (*api.Lambda, error) {
+	if succ := s.bootstrapping.AddUniq(cLambda.Name); !succ {
+		return nil, errs.New(errs.Conflict, "lambda '%s' is already being bootstrapped", cLambda.Name)
+	}
+	defer s.bootstrapping.Remove(cLambda.Name)
+
+	existing, err := GetLambda(ctx, cLambda.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		return nil, &db.ConflictError{Field: "name", Value: cLambda.Name, ID: existing.Id}
+	}
+
+	// Credentials which can't be stored are rejected before the image is pulled
+	if source.Auth != nil {
+		if _, err := registryAuthCipher(); err != nil {
+			return nil, err
+		}
+	}
+
+	imageID, pinned, err := s.dockerSvc.Pull(ctx, source.Ref, source.Platform, source.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull image %s: %w", source.Ref, err)
+	}
+
+	createdAt := time.Now().UnixMilli()
+
+	lambda := api.Lambda{
+		Id:         cLambda.Name,
+		Name:       cLambda.Name,
+		CreatedAt:  createdAt,
+		UpdatedAt:  createdAt,
+		LambdaType: cLambda.LambdaType,
+	}
+
+	// Credentials are kept to pull the image again if it's removed from the host
+	if source.Auth != nil {
+		if err := SetLambdaRegistryAuth(ctx, lambda.Id, source.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.createImageLambda(ctx, &lambda, &model.LambdaImage{
+		Id:       lambda.Id,
+		Ref:      source.Ref,
+		Pinned:   pinned,
+		ImageId:  imageID,
+		Platform: source.Platform,
+		PulledAt: createdAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &lambda, nil
+}
+
+func (s *service) ImportLambda(ctx context.Context, lambda *api.Lambda, image *model.LambdaImage) error {
+	if succ := s.bootstrapping.AddUniq(lambda.Name); !succ {
+		return errs.New(errs.Conflict, "lambda '%s' is already being bootstrapped", lambda.Name)
+	}
+	defer s.bootstrapping.Remove(lambda.Name)
+
+	return s.createImageLambda(ctx, lambda, image)
+}
+
+func (s *service) createImageLambda(ctx context.Context, lambda *api.Lambda, image *model.LambdaImage) error {
+	if err := SetLambdaImage(ctx, image); err != nil {
+		return err
+	}
+
+	if err := CreateLambda(ctx, lambda); err != nil {
+		return err
+	}
+
+	s.lambdas.Set(lambda.Id, *lambda)
+
+	return nil
+}
+
+// pull pulls the pinned image unless it's present on the host and records it as the lambda build.
+func (s service) pull(ctx context.Context, image *model.LambdaImage) error {
+	_, digest, _ := strings.Cut(image.Pinned, "@")
+	if image.Imported {
+		digest = image.ImageId
+	}
+
+	build := &model.LambdaBuild{
+		Id:      image.Id,
+		Digest:  digest,
+		Image:   image.Pinned,
+		Params:  &model.BuildParams{Platform: image.Platform},
+		BuiltAt: time.Now().UnixMilli(),
+	}
+
+	imageID, err := s.dockerSvc.ImageID(ctx, image.Pinned)
+	if err != nil {
+		return err
+	}
+
+	if imageID != "" {
+		build.Cached = true
+	} else if image.Imported {
+		return errs.New(errs.Conflict, "image %s of the imported lambda is removed from the host, import the bundle again", image.Ref)
+	} else {
+		auth, err := GetLambdaRegistryAuth(ctx, image.Id)
+		if err != nil {
+			return err
+		}
+
+		imageID, _, err = s.dockerSvc.Pull(ctx, image.Pinned, image.Platform, auth)
+		if err != nil {
+			return fmt.Errorf("failed to pull image %s: %w", image.Pinned, err)
+		}
+	}
+
+	build.ImageId = imageID
+
+	return s.setBuild(ctx, build)
+}
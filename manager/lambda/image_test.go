@@ -0,0 +1,93 @@
+package lambda
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/onpremless/go-client"
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+// TestRegisterImage pulls from a local registry and runs only if TEST_REGISTRY points to it
+// and Docker is reachable, e.g.
+//
+//	docker run -d -p 5000:5000 registry:2
+//	docker tag alpine localhost:5000/opless-test:latest && docker push localhost:5000/opless-test:latest
+//	TEST_REGISTRY=localhost:5000 go test ./lambda
+//
+// TEST_REGISTRY_USERNAME and TEST_REGISTRY_PASSWORD are passed as credentials if the registry
+// requires them.
+func TestRegisterImage(t *testing.T) {
+	registry := os.Getenv("TEST_REGISTRY")
+	if registry == "" {
+		t.Skip("TEST_REGISTRY is not set")
+	}
+
+	b, err := db.NewBolt(filepath.Join(t.TempDir(), "store.db"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := store.Client
+	store.Client = b
+	t.Cleanup(func() {
+		store.Client = prev
+		b.Close()
+	})
+
+	ctx := context.Background()
+	if err := Reindex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(registryAuthKeyVar, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	s, err := CreateLambdaService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &model.ImageSource{Ref: registry + "/opless-test:latest"}
+	if username := os.Getenv("TEST_REGISTRY_USERNAME"); username != "" {
+		source.Auth = &model.RegistryAuth{Username: username, Password: os.Getenv("TEST_REGISTRY_PASSWORD")}
+	}
+
+	lambda, err := s.RegisterImage(ctx, &api.CreateLambda{Name: "opless-test", LambdaType: "ENDPOINT"}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := GetLambdaImage(ctx, lambda.Id)
+	if err != nil || image == nil {
+		t.Fatalf("expected the lambda image, got %v, %v", image, err)
+	}
+
+	if !strings.HasPrefix(image.Pinned, registry+"/opless-test@sha256:") || image.ImageId == "" {
+		t.Fatalf("expected the image pinned by digest, got %s (%s)", image.Pinned, image.ImageId)
+	}
+
+	auth, err := GetLambdaRegistryAuth(ctx, lambda.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source.Auth != nil && (auth == nil || *auth != *source.Auth) {
+		t.Fatalf("expected stored credentials %v, got %v", source.Auth, auth)
+	}
+
+	// The pinned image is pulled again once it's gone from the host
+	if err := s.(*service).dockerSvc.RemoveImage(ctx, image.Pinned); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.(*service).pull(ctx, image); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,138 @@
+package lambda
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/logger"
+)
+
+// referencedImages returns references and ids of images lambdas run or are built on.
+// Runtime images aren't kept by their records, they're rebuilt once a lambda needs them.
+func referencedImages(ctx context.Context) (map[string]bool, error) {
+	builds, err := GetLambdaBuilds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := GetLambdaImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+	for _, build := range builds {
+		for _, ref := range []string{build.Image, build.ImageId, build.BaseImage} {
+			referenced[ref] = true
+		}
+	}
+
+	for _, image := range images {
+		referenced[image.Pinned] = true
+		referenced[image.ImageId] = true
+	}
+
+	delete(referenced, "")
+
+	return referenced, nil
+}
+
+// removeImages removes the images unless another lambda refers to them. Failures are only
+// logged, PruneImages removes what's left.
+func (s service) removeImages(ctx context.Context, images ...string) {
+	referenced, err := referencedImages(ctx)
+	if err != nil {
+		logger.L.Warn("Failed to find referenced images", zap.Error(err))
+		return
+	}
+
+	for _, image := range images {
+		if image == "" || referenced[image] {
+			continue
+		}
+
+		err := s.dockerSvc.RemoveImage(ctx, image)
+		if err == nil {
+			continue
+		}
+
+		switch errs.KindOf(err) {
+		case errs.NotFound:
+		case errs.Conflict:
+			logger.L.Info("Image is in use", zap.String("image", image), zap.Error(err))
+		default:
+			logger.L.Warn("Failed to remove image", zap.String("image", image), zap.Error(err))
+		}
+	}
+}
+
+// PruneImages removes images built by this installation which no lambda refers to, like
+// runtime images of old runtime versions. Images younger than grace are kept, they might
+// be built for a lambda being started. It returns the number of removed images.
+func (s service) PruneImages(ctx context.Context, grace time.Duration) (int, error) {
+	images, err := s.dockerSvc.ListImages(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	referenced, err := referencedImages(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(-grace).Unix()
+	removed := 0
+	for _, image := range images {
+		if image.Created > deadline || referenced[image.ID] {
+			continue
+		}
+
+		if lo.SomeBy(image.RepoTags, func(tag string) bool { return referenced[tag] }) {
+			continue
+		}
+
+		refs := lo.Without(image.RepoTags, "<none>:<none>")
+
+		// Removing the last tag removes the image, untagged ones are removed by id
+		if len(refs) == 0 {
+			refs = append(refs, image.ID)
+		}
+
+		err := s.removeRefs(ctx, refs)
+		// Images used by containers or other images are kept
+		if errs.KindOf(err) == errs.Conflict {
+			logger.L.Info("Image is in use", zap.String("image", image.ID), zap.Error(err))
+			continue
+		}
+
+		if err != nil {
+			return removed, err
+		}
+
+		if digest := image.Labels["opless.digest"]; image.Labels["opless.runtime"] != "" && digest != "" {
+			if err := DelRuntimeImage(ctx, digest); err != nil {
+				return removed, err
+			}
+		}
+
+		logger.L.Info("Removed unreferenced image", zap.String("image", image.ID), zap.String("tags", strings.Join(image.RepoTags, ",")))
+		removed++
+	}
+
+	return removed, nil
+}
+
+func (s service) removeRefs(ctx context.Context, refs []string) error {
+	for _, ref := range refs {
+		if err := s.dockerSvc.RemoveImage(ctx, ref); err != nil && errs.KindOf(err) != errs.NotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+func (s *service) CreateRuntimeVersion(ctx context.Context, id string, req *model.CreateRuntimeVersion) (*model.RuntimeVersion, []*dockerfile.Finding, error) {
+	latest, err := GetLatestRuntimeVersion(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if latest == nil {
+		return nil, nil, errs.New(errs.NotFound, "runtime is not found: %s", id)
+	}
+
+	raw, findings, err := ReadDockerfile(ctx, req.Dockerfile, s.policy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Build params are kept unless replaced
+	params := &latest.Params
+	if req.Build != nil {
+		params = req.Build
+	}
+
+	version, err := CreateRuntimeVersion(ctx, id, raw, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, _, err = ModifyRuntime(ctx, id, func(runtime *api.Runtime) error {
+		runtime.UpdatedAt = version.CreatedAt
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return version, findings, nil
+}
+
+func (s *service) RuntimeLambdas(ctx context.Context, id string) ([]*model.RuntimeLambda, error) {
+	latest, err := GetLatestRuntimeVersion(ctx, id)
+	if err != nil || latest == nil {
+		return nil, err
+	}
+
+	lambdas, err := GetRuntimeLambdas(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*model.RuntimeLambda, 0, len(lambdas))
+	for _, lambda := range lambdas {
+		pin, err := GetLambdaRuntime(ctx, lambda.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Lambdas which aren't pinned yet get the latest version on first use
+		version := latest.Version
+		if pin != nil && pin.Runtime == id {
+			version = pin.Version
+		}
+
+		res = append(res, &model.RuntimeLambda{
+			Lambda:   lambda.Id,
+			Version:  version,
+			Outdated: version < latest.Version,
+		})
+	}
+
+	return res, nil
+}
+
+func (s *service) Rollout(ctx context.Context, target *model.RuntimeVersion, rollout *model.Rollout) (*model.RolloutReport, error) {
+	lambdas, err := s.RuntimeLambdas(ctx, target.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &model.RolloutReport{Runtime: target.Runtime, Version: target.Version, Lambdas: []*model.RolloutResult{}}
+	for _, lambda := range lambdas {
+		if lambda.Version == target.Version {
+			continue
+		}
+
+		report.Lambdas = append(report.Lambdas, &model.RolloutResult{
+			Lambda: lambda.Lambda,
+			From:   lambda.Version,
+			To:     target.Version,
+			Status: model.RolloutSkipped,
+		})
+	}
+
+	concurrency := rollout.Concurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	slots := make(chan struct{}, concurrency)
+	failures := atomic.Int32{}
+	wg := sync.WaitGroup{}
+
+	for _, result := range report.Lambdas {
+		slots <- struct{}{}
+
+		// Lambdas left are reported as skipped
+		if ctx.Err() != nil || (rollout.MaxFailures > 0 && int(failures.Load()) >= rollout.MaxFailures) {
+			break
+		}
+
+		wg.Add(1)
+		go func(result *model.RolloutResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := s.roll(ctx, target, result); err != nil {
+				result.Error = err.Error()
+				failures.Add(1)
+			}
+		}(result)
+	}
+
+	wg.Wait()
+
+	return report, nil
+}
+
+// roll pins the lambda to the target version and restarts it if it's running. The lambda
+// is restarted on the previous version if it fails to start on the target one.
+func (s *service) roll(ctx context.Context, target *model.RuntimeVersion, result *model.RolloutResult) error {
+	result.Status = model.RolloutFailed
+
+	if succ := s.starting.AddUniq(result.Lambda); !succ {
+		return errs.New(errs.Conflict, "lambda '%s' is already being processed", result.Lambda)
+	}
+	defer s.starting.Remove(result.Lambda)
+
+	unlock, err := LockLambda(ctx, result.Lambda)
+	if err != nil {
+		return errs.New(errs.Conflict, "lambda '%s' is being processed by another manager: %w", result.Lambda, err)
+	}
+	defer unlock()
+
+	lambda, err := GetLambda(ctx, result.Lambda)
+	if err != nil {
+		return err
+	}
+
+	if lambda == nil || lambda.Runtime != target.Runtime {
+		return errs.New(errs.Conflict, "lambda is removed or moved to another runtime")
+	}
+
+	current, err := lambdaRuntime(ctx, lambda)
+	if err != nil {
+		return err
+	}
+
+	result.From = current.Version
+
+	overrides, err := GetLambdaBuildParams(ctx, lambda.Id)
+	if err != nil {
+		return err
+	}
+
+	if err := model.ValidateBuildOverrides(&target.Params, overrides); err != nil {
+		return err
+	}
+
+	if err := pinRuntime(ctx, lambda, target); err != nil {
+		return err
+	}
+
+	// Stopped lambda is built from the target version on its next start
+	if lambda.Docker.ContainerId == nil {
+		result.Status = model.RolloutSucceeded
+		return nil
+	}
+
+	startErr := s.restart(ctx, lambda)
+	if startErr == nil {
+		result.Status = model.RolloutSucceeded
+		return nil
+	}
+
+	if err := pinRuntime(ctx, lambda, current); err != nil {
+		return fmt.Errorf("%w, failed to pin the previous version back: %v", startErr, err)
+	}
+
+	if err := s.restart(ctx, lambda); err != nil {
+		return fmt.Errorf("%w, failed to start the previous version: %v", startErr, err)
+	}
+
+	result.Status = model.RolloutRolledBack
+	return startErr
+}
+
+// restart replaces the lambda container with one built from the pinned runtime version,
+// the caller holds the lambda lock.
+func (s *service) restart(ctx context.Context, lambda *api.Lambda) error {
+	if lambda.Docker.ContainerId != nil {
+		if err := s.destroyLocked(ctx, lambda); err != nil {
+			return err
+		}
+	}
+
+	lambda.Docker = api.Docker{}
+
+	return s.startLocked(ctx, lambda)
+}
@@ -0,0 +1,285 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+// Runtime bucket layout: Dockerfiles of runtime versions are kept under versions/<runtime id>/,
+// runtimes created before versioning have their only Dockerfile at <runtime id>.
+const runtimeVersionsDir = "versions/"
+
+// Concurrently created versions might get the same number, so digest is a part of the key
+// to never overwrite the Dockerfile of the one which has won.
+func runtimeVersionKey(runtime string, version int64, digest string) string {
+	_, hash, _ := strings.Cut(digest, ":")
+	return runtimeVersionsDir + runtime + "/" + db.NumKey(version) + "-" + hash
+}
+
+const maxRuntimeVersionRetries = 16
+
+// ReadDockerfile reads the uploaded Dockerfile and checks it against the policy, see dockerfile.Lint.
+func ReadDockerfile(ctx context.Context, upload string, policy *dockerfile.Policy) ([]byte, []*dockerfile.Finding, error) {
+	r, err := artifact.Client.Get(ctx, artifact.TmpBucket, upload)
+	if errors.Is(err, artifact.ErrNotFound) {
+		return nil, nil, errs.Field("dockerfile", "refers to missing upload %s", upload)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	raw, err := readDockerfile(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	findings, err := dockerfile.Lint(bytes.NewReader(raw), policy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return raw, findings, nil
+}
+
+func readDockerfile(r io.Reader) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxDockerfileSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) > maxDockerfileSize {
+		return nil, errs.New(errs.Validation, "dockerfile is larger than %d bytes", maxDockerfileSize)
+	}
+
+	return raw, nil
+}
+
+// CreateRuntimeVersion stores the Dockerfile and build params as the next runtime version.
+func CreateRuntimeVersion(ctx context.Context, runtime string, raw []byte, params *model.BuildParams) (*model.RuntimeVersion, error) {
+	hash := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+
+	for i := 0; i < maxRuntimeVersionRetries; i++ {
+		versions, err := GetRuntimeVersions(ctx, runtime)
+		if err != nil {
+			return nil, err
+		}
+
+		version := &model.RuntimeVersion{
+			Runtime:   runtime,
+			Version:   db.FirstVersion,
+			Digest:    digest,
+			Params:    *params,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+
+		if len(versions) > 0 {
+			version.Version = versions[len(versions)-1].Version + 1
+		}
+
+		key := runtimeVersionKey(runtime, version.Version, digest)
+		if err := artifact.Client.Put(ctx, artifact.RuntimeBucket, key, bytes.NewReader(raw), int64(len(raw)), nil); err != nil {
+			return nil, err
+		}
+
+		err = createRuntimeVersionRecord(ctx, version)
+		// Another version was created meanwhile, so the number is taken
+		if errors.Is(err, db.ErrConflict) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return version, nil
+	}
+
+	return nil, db.ErrTooManyRetries
+}
+
+// GetLatestRuntimeVersion returns nil if the runtime has no versions.
+func GetLatestRuntimeVersion(ctx context.Context, runtime string) (*model.RuntimeVersion, error) {
+	versions, err := GetRuntimeVersions(ctx, runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	return lastVersion(versions), nil
+}
+
+// deleteRuntimeVersions removes version records and Dockerfiles of the runtime.
+func deleteRuntimeVersions(ctx context.Context, runtime string) error {
+	if err := delRuntimeVersions(ctx, runtime); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	err := artifact.Client.Walk(ctx, artifact.RuntimeBucket, runtimeVersionsDir+runtime+"/", func(obj *artifact.Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := artifact.Client.Remove(ctx, artifact.RuntimeBucket, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRuntimeDockerfile returns the Dockerfile of the runtime version.
+func GetRuntimeDockerfile(ctx context.Context, version *model.RuntimeVersion) ([]byte, error) {
+	r, err := artifact.Client.Get(ctx, artifact.RuntimeBucket, runtimeVersionKey(version.Runtime, version.Version, version.Digest))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readDockerfile(r)
+}
+
+// MigrateLegacyRuntimes makes the Dockerfile of every runtime created before runtimes were
+// versioned its first version. It runs on start and after restores, so reads of runtime
+// versions have no side effects.
+func MigrateLegacyRuntimes(ctx context.Context) error {
+	runtimes, err := GetRuntimes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, runtime := range runtimes {
+		if err := migrateLegacyRuntime(ctx, runtime.Id); err != nil {
+			return fmt.Errorf("failed to migrate runtime %s: %w", runtime.Id, err)
+		}
+	}
+
+	return nil
+}
+
+func migrateLegacyRuntime(ctx context.Context, runtime string) error {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Managers starting together would create the same version twice
+	unlock, err := store.Client.Lock(lctx, "runtime:"+runtime, time.Minute)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	versions, err := GetRuntimeVersions(ctx, runtime)
+	if err != nil || len(versions) > 0 {
+		return err
+	}
+
+	r, err := artifact.Client.Get(ctx, artifact.RuntimeBucket, runtime)
+	if errors.Is(err, artifact.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	raw, err := readDockerfile(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := CreateRuntimeVersion(ctx, runtime, raw, &model.BuildParams{}); err != nil {
+		return err
+	}
+
+	if err := artifact.Client.Remove(ctx, artifact.RuntimeBucket, runtime); err != nil {
+		logger.L.Error("Failed to remove migrated runtime Dockerfile", zap.Error(err), zap.String("runtime", runtime))
+	}
+
+	logger.L.Info("Migrated runtime to versions", zap.String("runtime", runtime))
+
+	return nil
+}
+
+func lastVersion(versions []*model.RuntimeVersion) *model.RuntimeVersion {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	return versions[len(versions)-1]
+}
+
+// lambdaRuntime returns the runtime version the lambda is pinned to. Lambdas created
+// before runtimes were versioned are pinned to the latest version on first use.
+func lambdaRuntime(ctx context.Context, lambda *api.Lambda) (*model.RuntimeVersion, error) {
+	if lambda.Runtime == "" {
+		return nil, ErrPreBuilt
+	}
+
+	pin, err := GetLambdaRuntime(ctx, lambda.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if pin != nil && pin.Runtime == lambda.Runtime {
+		version, err := GetRuntimeVersion(ctx, pin.Runtime, pin.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		if version == nil {
+			return nil, fmt.Errorf("version %d of runtime %s is not found", pin.Version, pin.Runtime)
+		}
+
+		return version, nil
+	}
+
+	version, err := GetLatestRuntimeVersion(ctx, lambda.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == nil {
+		return nil, fmt.Errorf("runtime %s has no Dockerfile", lambda.Runtime)
+	}
+
+	if err := pinRuntime(ctx, lambda, version); err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+func pinRuntime(ctx context.Context, lambda *api.Lambda, version *model.RuntimeVersion) error {
+	return SetLambdaRuntime(ctx, &model.LambdaRuntime{Id: lambda.Id, Runtime: version.Runtime, Version: version.Version})
+}
+
+// ListRuntimeVersions returns versions of the runtime ordered from the oldest one.
+func ListRuntimeVersions(ctx context.Context, runtime string) ([]*model.RuntimeVersion, error) {
+	return GetRuntimeVersions(ctx, runtime)
+}
@@ -0,0 +1,95 @@
+package lambda
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+// Registry credentials are sealed with AES-256-GCM before they're stored, REGISTRY_AUTH_KEY
+// env var is the base64 encoded 32 byte key. Lambdas can't be given credentials without it.
+const registryAuthKeyVar = "REGISTRY_AUTH_KEY"
+
+var errNoRegistryAuthKey = errs.New(errs.Unsupported, "registry credentials can't be stored, %s is not set", registryAuthKeyVar)
+
+func registryAuthCipher() (cipher.AEAD, error) {
+	encoded := cutil.GetStrVarDefault(registryAuthKeyVar, "")
+	if encoded == "" {
+		return nil, errNoRegistryAuthKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s has to be a base64 encoded 32 byte key", registryAuthKeyVar)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// checkRegistryAuthKey fails if the key is set but malformed, a missing key only fails
+// lambdas given credentials.
+func checkRegistryAuthKey() error {
+	if _, err := registryAuthCipher(); err != nil && !errors.Is(err, errNoRegistryAuthKey) {
+		return err
+	}
+
+	return nil
+}
+
+// sealRegistryAuth encrypts the credentials, the lambda id is authenticated along with them,
+// so sealed credentials can't be moved to another lambda.
+func sealRegistryAuth(id string, auth *model.RegistryAuth) (string, error) {
+	aead, err := registryAuthCipher()
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(id))), nil
+}
+
+func openRegistryAuth(id string, sealed string) (*model.RegistryAuth, error) {
+	aead, err := registryAuthCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, fmt.Errorf("registry credentials of lambda %s are malformed", id)
+	}
+
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("registry credentials of lambda %s can't be decrypted, %s might have changed", id, registryAuthKeyVar)
+	}
+
+	auth := &model.RegistryAuth{}
+	if err := json.Unmarshal(plain, auth); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
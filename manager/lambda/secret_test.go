@@ -0,0 +1,52 @@
+package lambda
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+func TestRegistryAuthSealing(t *testing.T) {
+	auth := &model.RegistryAuth{Username: "user", Password: "secret"}
+
+	t.Setenv(registryAuthKeyVar, "")
+	if _, err := sealRegistryAuth("lambda", auth); errs.KindOf(err) != errs.Unsupported {
+		t.Fatalf("without a key: expected unsupported, got %v", err)
+	}
+
+	t.Setenv(registryAuthKeyVar, "short")
+	if err := checkRegistryAuthKey(); err == nil {
+		t.Fatal("malformed key: expected an error")
+	}
+
+	t.Setenv(registryAuthKeyVar, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	if err := checkRegistryAuthKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := sealRegistryAuth("lambda", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sealed, auth.Password) {
+		t.Fatal("password is stored in plaintext")
+	}
+
+	opened, err := openRegistryAuth("lambda", sealed)
+	if err != nil || *opened != *auth {
+		t.Fatalf("expected %v, got %v, %v", auth, opened, err)
+	}
+
+	if _, err := openRegistryAuth("another", sealed); err == nil {
+		t.Fatal("credentials of another lambda: expected an error")
+	}
+
+	t.Setenv(registryAuthKeyVar, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 32))))
+	if _, err := openRegistryAuth("lambda", sealed); err == nil {
+		t.Fatal("another key: expected an error")
+	}
+}
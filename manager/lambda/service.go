@@ -2,39 +2,90 @@ package lambda
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	api "github.com/onpremless/go-client"
 	"github.com/onpremless/opless/common/data"
+	"github.com/onpremless/opless/common/db"
 	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/archive"
 	"github.com/onpremless/opless/manager/docker"
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/errs"
 	"github.com/onpremless/opless/manager/logger"
-	"github.com/onpremless/opless/manager/redis"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
 	"github.com/samber/lo"
 	"go.uber.org/zap"
 )
 
+var ErrNotRunning = errs.New(errs.Conflict, "lambda is not running")
+
 type service struct {
 	dockerSvc     docker.DockerService
 	bootstrapping data.ConcurrentSet[string]
 	starting      data.ConcurrentSet[string]
 	lambdas       data.ConcurrentMap[string, api.Lambda]
 	inspect       data.ConcurrentMap[string, func()]
+	limits        *archive.Limits
+	policy        *dockerfile.Policy
 }
 
 type LambdaService interface {
+	// Init loads the lambdas, recreates their missing containers and starts them.
 	Init() error
 	Stop(ctx context.Context)
-	BootstrapRuntime(ctx context.Context, runtime *api.CreateRuntime) (*api.Runtime, error)
-	BootstrapLambda(ctx context.Context, lambda *api.CreateLambda) (*api.Lambda, error)
-	Start(ctx context.Context, id string) error
-	Destroy(ctx context.Context, id string) error
+	// BootstrapRuntime creates the runtime, build params declare build args with their defaults.
+	// Dockerfile lint warnings are returned along, dockerfile.LintError is returned if it's rejected.
+	BootstrapRuntime(ctx context.Context, runtime *api.CreateRuntime, build *model.BuildParams) (*api.Runtime, []*dockerfile.Finding, error)
+	// BootstrapLambda creates the lambda, build params override ones of its runtime.
+	BootstrapLambda(ctx context.Context, lambda *api.CreateLambda, build *model.BuildParams) (*api.Lambda, error)
+	// RegisterImage creates the lambda running the pre-built image, the image is pulled and
+	// pinned by digest.
+	RegisterImage(ctx context.Context, lambda *api.CreateLambda, image *model.ImageSource) (*api.Lambda, error)
+	// ImportLambda creates the lambda running the image loaded from a bundle.
+	ImportLambda(ctx context.Context, lambda *api.Lambda, image *model.LambdaImage) error
+	// SetBuildParams replaces build params overrides of the lambda, they apply to the next build.
+	SetBuildParams(ctx context.Context, id string, build *model.BuildParams) error
+	// CreateRuntimeVersion adds the next version of the runtime, build params of the latest
+	// version are kept unless the request has them.
+	CreateRuntimeVersion(ctx context.Context, id string, req *model.CreateRuntimeVersion) (*model.RuntimeVersion, []*dockerfile.Finding, error)
+	// RuntimeLambdas lists lambdas depending on the runtime with versions they're pinned to.
+	RuntimeLambdas(ctx context.Context, id string) ([]*model.RuntimeLambda, error)
+	// PruneImages removes images built by this installation which no lambda refers to and
+	// which are older than grace.
+	PruneImages(ctx context.Context, grace time.Duration) (int, error)
+	// Rollout moves lambdas pinned to other versions of the runtime to the target one.
+	Rollout(ctx context.Context, target *model.RuntimeVersion, rollout *model.Rollout) (*model.RolloutReport, error)
+	// UpdateLambda applies the changes and restarts the lambda if it's running.
+	UpdateLambda(ctx context.Context, id string, req *model.UpdateLambda) (*api.Lambda, error)
+	// DeleteLambda removes the container and records of the lambda.
+	DeleteLambda(ctx context.Context, id string) error
+	// DeleteRuntime removes the runtime unless there are lambdas depending on it.
+	DeleteRuntime(ctx context.Context, id string) error
+	// Start builds and starts the lambda if its resource version is still the given one,
+	// db.AnyVersion skips the check.
+	Start(ctx context.Context, id string, version int64) error
+	// Destroy removes the lambda container if its resource version is still the given one,
+	// db.AnyVersion skips the check.
+	Destroy(ctx context.Context, id string, version int64) error
+	// Logs returns the multiplexed log stream of the lambda container, ErrNotRunning is
+	// returned if it has none. Nil is returned if the lambda is not found.
+	Logs(ctx context.Context, id string, follow bool, tail string) (io.ReadCloser, error)
 }
 
+// CreateLambdaService creates the service without touching containers, Init has to be called
+// before it serves, maintenance commands skip it.
 func CreateLambdaService() (LambdaService, error) {
-	dockerSvc, err := docker.NewDockerService(redis.OPlessID)
+	if err := checkRegistryAuthKey(); err != nil {
+		return nil, err
+	}
+
+	dockerSvc, err := docker.NewDockerService(store.OPlessID)
 
 	if err != nil {
 		return nil, err
@@ -46,10 +97,8 @@ func CreateLambdaService() (LambdaService, error) {
 		starting:      data.CreateConcurrentSet[string](),
 		lambdas:       data.CreateConcurrentMap[string, api.Lambda](),
 		inspect:       data.CreateConcurrentMap[string, func()](),
-	}
-
-	if err := svc.Init(); err != nil {
-		return nil, err
+		limits:        archive.LimitsFromEnv(),
+		policy:        dockerfile.PolicyFromEnv(),
 	}
 
 	return svc, nil
@@ -84,7 +133,10 @@ func (s service) Init() error {
 
 			if id != "" {
 				lambda.Docker.ContainerId = &id
-				s.updateLambda(ctx, lambda)
+				s.updateLambda(ctx, lambda.Id, func(l *api.Lambda) error {
+					l.Docker = lambda.Docker
+					return nil
+				})
 			}
 		} else if err := s.dockerSvc.Start(ctx, &lambda); err != nil {
 			logger.L.Error(
@@ -127,16 +179,35 @@ func (s *service) Stop(ctx context.Context) {
 	})
 }
 
-func (s *service) BootstrapRuntime(ctx context.Context, cRuntime *api.CreateRuntime) (*api.Runtime, error) {
+func (s *service) BootstrapRuntime(ctx context.Context, cRuntime *api.CreateRuntime, build *model.BuildParams) (*api.Runtime, []*dockerfile.Finding, error) {
 	if succ := s.bootstrapping.AddUniq(cRuntime.Dockerfile); !succ {
-		return nil, fmt.Errorf("lambda with '%s' archive is already in progress", cRuntime.Dockerfile)
+		return nil, nil, errs.New(errs.Conflict, "runtime with '%s' Dockerfile is already being bootstrapped", cRuntime.Dockerfile)
 	}
 	defer s.bootstrapping.Remove(cRuntime.Dockerfile)
 
+	existing, err := GetRuntimeByName(ctx, cRuntime.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if existing != nil {
+		return nil, nil, &db.ConflictError{Field: "name", Value: cRuntime.Name, ID: existing.Id}
+	}
+
+	raw, findings, err := ReadDockerfile(ctx, cRuntime.Dockerfile, s.policy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if build == nil {
+		build = &model.BuildParams{}
+	}
+
 	id := cutil.UUID()
 
-	if err := BootstrapRuntime(ctx, id, cRuntime); err != nil {
-		return nil, err
+	// Runtime is created last, so it's never seen without a version
+	if _, err := CreateRuntimeVersion(ctx, id, raw, build); err != nil {
+		return nil, nil, err
 	}
 
 	createdAt := time.Now().UnixMilli()
@@ -148,16 +219,21 @@ func (s *service) BootstrapRuntime(ctx context.Context, cRuntime *api.CreateRunt
 		UpdatedAt: createdAt,
 	}
 
-	if err := SetRuntime(ctx, runtime); err != nil {
-		return nil, err
+	if err := CreateRuntime(ctx, runtime); err != nil {
+		// Another runtime might have taken the name meanwhile, its versions are left alone
+		if err := deleteRuntimeVersions(ctx, id); err != nil {
+			logger.L.Error("Failed to remove versions of runtime which is not created", zap.Error(err), zap.String("runtime", id))
+		}
+
+		return nil, nil, err
 	}
 
-	return runtime, nil
+	return runtime, findings, nil
 }
 
-func (s *service) BootstrapLambda(ctx context.Context, cLambda *api.CreateLambda) (*api.Lambda, error) {
+func (s *service) BootstrapLambda(ctx context.Context, cLambda *api.CreateLambda, build *model.BuildParams) (*api.Lambda, error) {
 	if succ := s.bootstrapping.AddUniq(cLambda.Archive); !succ {
-		return nil, fmt.Errorf("lambda with '%s' archive is already being bootstrapped", cLambda.Archive)
+		return nil, errs.New(errs.Conflict, "lambda with '%s' archive is already being bootstrapped", cLambda.Archive)
 	}
 	defer s.bootstrapping.Remove(cLambda.Archive)
 
@@ -167,16 +243,31 @@ func (s *service) BootstrapLambda(ctx context.Context, cLambda *api.CreateLambda
 	}
 
 	if existing != nil {
-		return nil, errors.New("already exists")
+		return nil, &db.ConflictError{Field: "name", Value: cLambda.Name, ID: existing.Id}
 	}
 
 	if runtime, err := GetRuntime(ctx, cLambda.Runtime); err != nil {
 		return nil, err
 	} else if runtime == nil {
-		return nil, errors.New("not found")
+		return nil, errs.Field("runtime", "refers to missing runtime %s", cLambda.Runtime)
 	}
 
-	if err := BootstrapLambda(ctx, cLambda.Name, cLambda); err != nil {
+	version, err := GetLatestRuntimeVersion(ctx, cLambda.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == nil {
+		return nil, fmt.Errorf("runtime %s has no Dockerfile", cLambda.Runtime)
+	}
+
+	if build != nil {
+		if err := model.ValidateBuildOverrides(&version.Params, build); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := BootstrapLambda(ctx, cLambda.Name, cLambda, s.limits); err != nil {
 		return nil, err
 	}
 
@@ -191,27 +282,76 @@ func (s *service) BootstrapLambda(ctx context.Context, cLambda *api.CreateLambda
 		LambdaType: cLambda.LambdaType,
 	}
 
-	if err := SetLambda(ctx, &lambda); err != nil {
+	// Runtime might have been deleted since it's checked
+	unlock, err := lockRuntime(ctx, cLambda.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// New lambdas are built from the latest runtime version
+	if err := pinRuntime(ctx, &lambda, version); err != nil {
+		return nil, err
+	}
+
+	if err := CreateLambda(ctx, &lambda); err != nil {
 		return nil, err
 	}
 
+	if build != nil {
+		if err := SetLambdaBuildParams(ctx, lambda.Id, build); err != nil {
+			return nil, err
+		}
+	}
+
 	s.lambdas.Set(lambda.Id, lambda)
 
 	return &lambda, nil
 }
 
+func (s *service) SetBuildParams(ctx context.Context, id string, build *model.BuildParams) error {
+	lambda, err := GetLambda(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if lambda == nil {
+		return errs.New(errs.NotFound, "lambda is not found: %s", id)
+	}
+
+	version, err := lambdaRuntime(ctx, lambda)
+	if err != nil {
+		return err
+	}
+
+	if err := model.ValidateBuildOverrides(&version.Params, build); err != nil {
+		return err
+	}
+
+	return SetLambdaBuildParams(ctx, id, build)
+}
+
+// buildParams returns build params of the runtime version with the lambda overrides applied.
+func buildParams(ctx context.Context, lambda *api.Lambda, version *model.RuntimeVersion) (*model.BuildParams, error) {
+	overrides, err := GetLambdaBuildParams(ctx, lambda.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return version.Params.Merge(overrides), nil
+}
+
 func (s service) start(ctx context.Context, lambda *api.Lambda) (string, error) {
-	tar, err := TarLambda(ctx, lambda.Id, lambda.Runtime)
+	image, err := s.image(ctx, lambda)
 	if err != nil {
 		return "", err
 	}
 
-	image := lambda.Name
 	container := "opless-" + lambda.Name
 	lambda.Docker.Image = &image
 	lambda.Docker.Container = &container
 
-	containerID, err := s.dockerSvc.Create(ctx, lambda, tar)
+	containerID, err := s.dockerSvc.CreateContainer(ctx, lambda)
 	if err != nil {
 		return "", err
 	}
@@ -221,26 +361,202 @@ func (s service) start(ctx context.Context, lambda *api.Lambda) (string, error)
 	return containerID, s.dockerSvc.Start(ctx, lambda)
 }
 
-func (s service) Start(ctx context.Context, id string) error {
+// image returns the image the lambda runs, it's pulled or built if it's missing.
+func (s service) image(ctx context.Context, lambda *api.Lambda) (string, error) {
+	pulled, err := GetLambdaImage(ctx, lambda.Id)
+	if err != nil {
+		return "", err
+	}
+
+	if pulled != nil {
+		return pulled.Pinned, s.pull(ctx, pulled)
+	}
+
+	version, err := lambdaRuntime(ctx, lambda)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := buildParams(ctx, lambda, version)
+	if err != nil {
+		return "", err
+	}
+
+	buildCtx, err := GetBuildContext(ctx, lambda.Id, version, params)
+	if err != nil {
+		return "", err
+	}
+
+	// Image is tagged by its content, so an unchanged lambda reuses the image built before
+	_, hash, _ := strings.Cut(buildCtx.Digest(), ":")
+	image := lambda.Name + ":" + hash
+
+	return image, s.build(ctx, lambda.Id, image, version, buildCtx)
+}
+
+// build builds the image unless it already exists and records the build.
+func (s service) build(ctx context.Context, id string, image string, version *model.RuntimeVersion, buildCtx *BuildContext) error {
+	build := &model.LambdaBuild{
+		Id:             id,
+		Digest:         buildCtx.Digest(),
+		Image:          image,
+		CodeVersion:    buildCtx.Manifest.Version,
+		RuntimeVersion: version.Version,
+		Params:         buildCtx.Params,
+		BuiltAt:        time.Now().UnixMilli(),
+	}
+
+	if base := buildCtx.Base; base != nil {
+		build.BaseImage = base.Image
+		build.Params = &model.BuildParams{
+			Args:     base.Params.Args,
+			Target:   base.Params.Target,
+			Platform: base.Params.Platform,
+			Labels:   buildCtx.Params.Labels,
+		}
+
+		if err := s.buildBase(ctx, base); err != nil {
+			return fmt.Errorf("failed to build runtime image: %w", err)
+		}
+	}
+
+	imageID, err := s.dockerSvc.ImageID(ctx, image)
+	if err != nil {
+		return err
+	}
+
+	if imageID != "" {
+		build.Cached = true
+	} else {
+		tar := buildCtx.Tar(ctx)
+		// Stops streaming the context if the build has failed before reading it
+		defer tar.Close()
+
+		imageID, err = s.dockerSvc.Build(ctx, image, buildCtx.Params, map[string]string{"opless.digest": build.Digest}, tar)
+		if err != nil {
+			return err
+		}
+	}
+
+	build.ImageId = imageID
+
+	return s.setBuild(ctx, build)
+}
+
+// setBuild records the build and removes the image of the previous one, which is superseded.
+func (s service) setBuild(ctx context.Context, build *model.LambdaBuild) error {
+	prev, err := GetLambdaBuild(ctx, build.Id)
+	if err != nil {
+		return err
+	}
+
+	if err := SetLambdaBuild(ctx, build); err != nil {
+		return err
+	}
+
+	if prev != nil && prev.Image != build.Image {
+		s.removeImages(ctx, prev.Image)
+	}
+
+	return nil
+}
+
+// buildBase builds the runtime image unless it already exists. Lambdas sharing it wait
+// for the one building it, across managers as well.
+func (s service) buildBase(ctx context.Context, base *BaseImage) error {
+	digest := base.Digest()
+
+	lctx, cancel := context.WithTimeout(ctx, lambdaLockTTL)
+	defer cancel()
+
+	unlock, err := store.Client.Lock(lctx, "runtime-image:"+digest, lambdaLockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	imageID, err := s.dockerSvc.ImageID(ctx, base.Image)
+	if err != nil || imageID != "" {
+		return err
+	}
+
+	tar, err := base.Tar()
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{
+		"opless.digest":          digest,
+		"opless.runtime":         base.Runtime.Runtime,
+		"opless.runtime.version": strconv.FormatInt(base.Runtime.Version, 10),
+	}
+
+	imageID, err = s.dockerSvc.Build(ctx, base.Image, base.Params, labels, tar)
+	if err != nil {
+		return err
+	}
+
+	return SetRuntimeImage(ctx, &model.RuntimeImage{
+		Id:      digest,
+		Runtime: base.Runtime.Runtime,
+		Version: base.Runtime.Version,
+		Image:   base.Image,
+		ImageId: imageID,
+		Params:  base.Params,
+		BuiltAt: time.Now().UnixMilli(),
+	})
+}
+
+func (s service) Start(ctx context.Context, id string, version int64) error {
 	if succ := s.starting.AddUniq(id); !succ {
-		return fmt.Errorf("lambda '%s' is already being processed", id)
+		return errs.New(errs.Conflict, "lambda '%s' is already being processed", id)
 	}
 	defer s.starting.Remove(id)
 
-	lambda, err := GetLambda(ctx, id)
+	unlock, err := LockLambda(ctx, id)
+	if err != nil {
+		return errs.New(errs.Conflict, "lambda '%s' is being processed by another manager: %w", id, err)
+	}
+	defer unlock()
+
+	lambda, err := getLocked(ctx, id, version)
 	if err != nil {
 		return err
 	}
 
+	return s.startLocked(ctx, lambda)
+}
+
+// getLocked returns the lambda if its resource version is the expected one, the caller
+// holds its lock. Starts, destroys, updates and deletes take the lock, so none of them
+// changes the lambda until the caller is done.
+func getLocked(ctx context.Context, id string, version int64) (*api.Lambda, error) {
+	lambda, current, err := GetVersionedLambda(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
 	if lambda == nil {
-		return errors.New("not found")
+		return nil, errs.New(errs.NotFound, "lambda is not found: %s", id)
 	}
 
-	if _, err = s.start(ctx, lambda); err != nil {
+	if version != db.AnyVersion && version != current {
+		return nil, &errs.Error{Kind: errs.PreconditionFailed, Err: &db.VersionError{Expected: version, Actual: current}}
+	}
+
+	return lambda, nil
+}
+
+// startLocked starts the lambda, the caller holds its lock.
+func (s service) startLocked(ctx context.Context, lambda *api.Lambda) error {
+	if _, err := s.start(ctx, lambda); err != nil {
 		return err
 	}
 
-	if err := s.updateLambda(ctx, *lambda); err != nil {
+	if err := s.updateLambda(ctx, lambda.Id, func(l *api.Lambda) error {
+		l.Docker = lambda.Docker
+		return nil
+	}); err != nil {
 		return err
 	}
 
@@ -251,49 +567,80 @@ func (s service) Start(ctx context.Context, id string) error {
 	return nil
 }
 
-func (s service) Destroy(ctx context.Context, id string) error {
+func (s service) Destroy(ctx context.Context, id string, version int64) error {
 	if succ := s.starting.AddUniq(id); !succ {
-		return fmt.Errorf("lambda '%s' is already being processed", id)
+		return errs.New(errs.Conflict, "lambda '%s' is already being processed", id)
 	}
 	defer s.starting.Remove(id)
 
-	lambda, err := GetLambda(ctx, id)
+	unlock, err := LockLambda(ctx, id)
+	if err != nil {
+		return errs.New(errs.Conflict, "lambda '%s' is being processed by another manager: %w", id, err)
+	}
+	defer unlock()
+
+	lambda, err := getLocked(ctx, id, version)
 	if err != nil {
 		return err
 	}
 
-	if lambda == nil {
-		return errors.New("not found")
+	return s.destroyLocked(ctx, lambda)
+}
+
+func (s service) Logs(ctx context.Context, id string, follow bool, tail string) (io.ReadCloser, error) {
+	lambda, err := GetLambda(ctx, id)
+	if err != nil || lambda == nil {
+		return nil, err
 	}
 
-	s.inspect.Get(id, func() {})()
-	s.inspect.Delete(id)
+	if lambda.Docker.ContainerId == nil {
+		return nil, ErrNotRunning
+	}
+
+	return s.dockerSvc.Logs(ctx, lambda, follow, tail)
+}
+
+// destroyLocked removes the lambda container, the caller holds its lock.
+func (s service) destroyLocked(ctx context.Context, lambda *api.Lambda) error {
+	s.inspect.Get(lambda.Id, func() {})()
+	s.inspect.Delete(lambda.Id)
 
 	if err := s.dockerSvc.Remove(ctx, lambda); err != nil {
 		return err
 	}
 
-	lambda.Docker = api.Docker{}
-
-	if err := s.updateLambda(ctx, *lambda); err != nil {
+	if err := s.updateLambda(ctx, lambda.Id, func(l *api.Lambda) error {
+		l.Docker = api.Docker{}
+		return nil
+	}); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (s service) updateLambda(ctx context.Context, lambda api.Lambda) error {
-	var updateErr error
-	s.lambdas.Update(lambda.Id, func(prev api.Lambda) api.Lambda {
-		if err := SetLambda(ctx, &lambda); err != nil {
-			updateErr = err
-			return prev
+// updateLambda applies the mutation to the latest stored lambda, so concurrent updates
+// made by other routines or managers are not overwritten.
+func (s service) updateLambda(ctx context.Context, id string, mutate func(l *api.Lambda) error) error {
+	lambda, _, err := ModifyLambda(ctx, id, func(l *api.Lambda) error {
+		if err := mutate(l); err != nil {
+			return err
 		}
 
-		return lambda
+		l.UpdatedAt = time.Now().UnixMilli()
+		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return updateErr
+	if lambda == nil {
+		return errs.New(errs.NotFound, "lambda is not found: %s", id)
+	}
+
+	s.lambdas.Set(id, *lambda)
+
+	return nil
 }
 
 func (s service) inspectRoutine(ctx context.Context, lambda api.Lambda) {
@@ -301,8 +648,8 @@ func (s service) inspectRoutine(ctx context.Context, lambda api.Lambda) {
 	for {
 		container, err := s.dockerSvc.Inspect(ctx, id)
 		actual, rErr := GetLambda(ctx, lambda.Id)
-		if rErr != nil && actual == nil {
-			rErr = errors.New("not found")
+		if rErr == nil && actual == nil {
+			rErr = errs.New(errs.NotFound, "lambda is not found: %s", lambda.Id)
 		}
 
 		if rErr == nil {
@@ -319,7 +666,14 @@ func (s service) inspectRoutine(ctx context.Context, lambda api.Lambda) {
 			}
 
 			if actual.Docker.Status != lambda.Docker.Status {
-				if err := s.updateLambda(ctx, lambda); err != nil {
+				if err := s.updateLambda(ctx, lambda.Id, func(l *api.Lambda) error {
+					if l.Docker.ContainerId == nil || *l.Docker.ContainerId != id {
+						return fmt.Errorf("container is replaced: %s", id)
+					}
+
+					l.Docker.Status = lambda.Docker.Status
+					return nil
+				}); err != nil {
 					logger.L.Error(
 						"Failed to update lambda",
 						zap.Error(err),
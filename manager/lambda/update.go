@@ -0,0 +1,294 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/onpremless/go-client"
+	"github.com/samber/lo"
+
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/model"
+)
+
+func (s *service) UpdateLambda(ctx context.Context, id string, req *model.UpdateLambda) (*api.Lambda, error) {
+	if succ := s.starting.AddUniq(id); !succ {
+		return nil, errs.New(errs.Conflict, "lambda '%s' is already being processed", id)
+	}
+	defer s.starting.Remove(id)
+
+	unlock, err := LockLambda(ctx, id)
+	if err != nil {
+		return nil, errs.New(errs.Conflict, "lambda '%s' is being processed by another manager: %w", id, err)
+	}
+	defer unlock()
+
+	lambda, err := GetLambda(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if lambda == nil {
+		return nil, errs.New(errs.NotFound, "lambda is not found: %s", id)
+	}
+
+	if lambda.Runtime == "" && (req.Runtime != "" || req.Archive != "" || req.Build != nil) {
+		return nil, errs.New(errs.Conflict, "lambda '%s' runs a pre-built image, recreate it to build it from a runtime", id)
+	}
+
+	if lambda.Runtime != "" && req.Image != nil {
+		return nil, errs.New(errs.Conflict, "lambda '%s' is built from a runtime, recreate it to run a pre-built image", id)
+	}
+
+	// Everything is checked before the first change, so a rejected update changes nothing
+	var target *model.RuntimeVersion
+	if req.Runtime != "" && req.Runtime != lambda.Runtime {
+		if target, err = s.targetRuntime(ctx, req.Runtime); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Build != nil || target != nil {
+		if err := s.checkOverrides(ctx, lambda, target, req.Build); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Archive != "" {
+		if err := BootstrapLambda(ctx, id, &api.CreateLambda{Archive: req.Archive}, s.limits); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Image != nil {
+		if err := s.repull(ctx, id, req.Image); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Build != nil {
+		if err := SetLambdaBuildParams(ctx, id, req.Build); err != nil {
+			return nil, err
+		}
+	}
+
+	unlockRuntime := func() {}
+	if target != nil {
+		// Runtime might have been deleted since it's checked
+		if unlockRuntime, err = lockRuntime(ctx, target.Runtime); err != nil {
+			return nil, err
+		}
+		defer unlockRuntime()
+
+		if err := pinRuntime(ctx, &api.Lambda{Id: id}, target); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.updateLambda(ctx, id, func(l *api.Lambda) error {
+		if target != nil {
+			l.Runtime = target.Runtime
+		}
+
+		if req.LambdaType != "" {
+			l.LambdaType = req.LambdaType
+		}
+
+		return nil
+	})
+	unlockRuntime()
+	if err != nil {
+		return nil, err
+	}
+
+	lambda, err = GetLambda(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Running lambda is replaced by one built from the changes
+	if lambda.Docker.ContainerId != nil {
+		if err := s.restart(ctx, lambda); err != nil {
+			return nil, err
+		}
+	}
+
+	return lambda, nil
+}
+
+// targetRuntime returns the latest version of the runtime the lambda is moved to.
+func (s *service) targetRuntime(ctx context.Context, id string) (*model.RuntimeVersion, error) {
+	if runtime, err := GetRuntime(ctx, id); err != nil {
+		return nil, err
+	} else if runtime == nil {
+		return nil, errs.Field("runtime", "refers to missing runtime %s", id)
+	}
+
+	version, err := GetLatestRuntimeVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == nil {
+		return nil, fmt.Errorf("runtime %s has no Dockerfile", id)
+	}
+
+	return version, nil
+}
+
+// lockRuntime takes the refs lock of the runtime a lambda is attached to, it fails if the
+// runtime is already gone.
+func lockRuntime(ctx context.Context, id string) (func(), error) {
+	unlock, err := LockRefs(ctx, model.KindRuntime, id)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime, err := GetRuntime(ctx, id)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	if runtime == nil {
+		unlock()
+		return nil, errs.Field("runtime", "refers to missing runtime %s", id)
+	}
+
+	return unlock, nil
+}
+
+// checkOverrides validates build params overrides the lambda is going to have against
+// the runtime version it's going to be built from.
+func (s *service) checkOverrides(ctx context.Context, lambda *api.Lambda, target *model.RuntimeVersion, build *model.BuildParams) error {
+	if target == nil {
+		var err error
+		if target, err = lambdaRuntime(ctx, lambda); err != nil {
+			return err
+		}
+	}
+
+	if build == nil {
+		var err error
+		if build, err = GetLambdaBuildParams(ctx, lambda.Id); err != nil {
+			return err
+		}
+	}
+
+	return model.ValidateBuildOverrides(&target.Params, build)
+}
+
+// repull pulls the image the lambda is moved to and records it.
+func (s *service) repull(ctx context.Context, id string, source *model.ImageSource) error {
+	if source.Auth != nil {
+		if _, err := registryAuthCipher(); err != nil {
+			return err
+		}
+	}
+
+	imageID, pinned, err := s.dockerSvc.Pull(ctx, source.Ref, source.Platform, source.Auth)
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", source.Ref, err)
+	}
+
+	if source.Auth != nil {
+		if err := SetLambdaRegistryAuth(ctx, id, source.Auth); err != nil {
+			return err
+		}
+	}
+
+	return SetLambdaImage(ctx, &model.LambdaImage{
+		Id:       id,
+		Ref:      source.Ref,
+		Pinned:   pinned,
+		ImageId:  imageID,
+		Platform: source.Platform,
+		PulledAt: time.Now().UnixMilli(),
+	})
+}
+
+func (s *service) DeleteLambda(ctx context.Context, id string) error {
+	if succ := s.starting.AddUniq(id); !succ {
+		return errs.New(errs.Conflict, "lambda '%s' is already being processed", id)
+	}
+	defer s.starting.Remove(id)
+
+	unlock, err := LockLambda(ctx, id)
+	if err != nil {
+		return errs.New(errs.Conflict, "lambda '%s' is being processed by another manager: %w", id, err)
+	}
+	defer unlock()
+
+	lambda, err := GetLambda(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if lambda == nil {
+		return errs.New(errs.NotFound, "lambda is not found: %s", id)
+	}
+
+	if lambda.Docker.ContainerId != nil {
+		if err := s.destroyLocked(ctx, lambda); err != nil {
+			return err
+		}
+	}
+
+	build, err := GetLambdaBuild(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	image, err := GetLambdaImage(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := DelLambda(ctx, id); err != nil {
+		return err
+	}
+
+	s.lambdas.Delete(id)
+
+	if build != nil {
+		s.removeImages(ctx, build.Image)
+	}
+
+	// Pulled image might be left without a build if the lambda has never started
+	if image != nil {
+		s.removeImages(ctx, image.Pinned)
+	}
+
+	return nil
+}
+
+func (s *service) DeleteRuntime(ctx context.Context, id string) error {
+	unlock, err := LockRefs(ctx, model.KindRuntime, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	runtime, err := GetRuntime(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if runtime == nil {
+		return errs.New(errs.NotFound, "runtime is not found: %s", id)
+	}
+
+	lambdas, err := GetRuntimeLambdas(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if len(lambdas) > 0 {
+		ids := lo.Map(lambdas, func(l *api.Lambda, _ int) string { return l.Id })
+		return errs.New(errs.Conflict, "runtime %s is used by lambdas: %s", runtime.Name, strings.Join(ids, ", "))
+	}
+
+	return DelRuntime(ctx, id)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gin-gonic/gin"
+)
+
+// flushWriter sends every write to the client right away, so followed logs are not buffered.
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+
+	return n, err
+}
+
+// validTail accepts the number of last lines or 'all'.
+func validTail(tail string) bool {
+	if tail == "all" {
+		return true
+	}
+
+	n, err := strconv.Atoi(tail)
+	return err == nil && n >= 0
+}
+
+// writeLogs demultiplexes the container log stream, stderr lines are sent along with stdout ones.
+func writeLogs(c *gin.Context, logs io.Reader) error {
+	w := flushWriter{w: c.Writer}
+	_, err := stdcopy.StdCopy(w, w, logs)
+
+	return err
+}
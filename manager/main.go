@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -12,33 +16,90 @@ import (
 	"go.uber.org/zap"
 
 	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/common/db"
 	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/apply"
+	"github.com/onpremless/opless/manager/archive"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/auth"
+	"github.com/onpremless/opless/manager/backup"
+	"github.com/onpremless/opless/manager/bundle"
+	"github.com/onpremless/opless/manager/dockerfile"
 	"github.com/onpremless/opless/manager/endpoint"
+	"github.com/onpremless/opless/manager/errs"
 	"github.com/onpremless/opless/manager/lambda"
 	"github.com/onpremless/opless/manager/logger"
 	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/openapi"
+	"github.com/onpremless/opless/manager/store"
 	"github.com/onpremless/opless/manager/task"
+	"github.com/onpremless/opless/manager/upload"
 )
 
 type Services struct {
 	taskSvc     task.TaskService
 	lambdaSvc   lambda.LambdaService
 	endpointSvc endpoint.EndpointService
+	bundleSvc   bundle.BundleService
+	backupSvc   backup.BackupService
+	applySvc    apply.ApplyService
+	uploadSvc   upload.UploadService
+	authSvc     auth.AuthService
 }
 
 func makeServices() *Services {
+	ctx := context.Background()
+	if err := lambda.Reindex(ctx); err != nil {
+		panic(err)
+	}
+
+	if err := endpoint.Reindex(ctx); err != nil {
+		panic(err)
+	}
+
+	if err := upload.Reindex(ctx); err != nil {
+		panic(err)
+	}
+
+	if err := apply.Reindex(ctx); err != nil {
+		panic(err)
+	}
+
+	if err := auth.Reindex(ctx); err != nil {
+		panic(err)
+	}
+
+	if err := lambda.MigrateLegacyRuntimes(ctx); err != nil {
+		panic(err)
+	}
+
+	if err := lambda.SeedCatalog(ctx); err != nil {
+		panic(err)
+	}
+
 	lSvc, err := lambda.CreateLambdaService()
 	if err != nil {
 		panic(err)
 	}
 
 	eSvc := endpoint.CreateEndpointService(lSvc)
+	bSvc, err := bundle.CreateBundleService(lSvc, eSvc)
+	if err != nil {
+		panic(err)
+	}
+
 	tSvc := task.CreateTaskService()
+	uSvc := upload.CreateUploadService()
 
 	return &Services{
 		taskSvc:     tSvc,
 		lambdaSvc:   lSvc,
 		endpointSvc: eSvc,
+		bundleSvc:   bSvc,
+		backupSvc:   backup.CreateBackupService(lSvc),
+		applySvc:    apply.CreateApplyService(lSvc, eSvc, uSvc),
+		uploadSvc:   uSvc,
+		authSvc:     auth.CreateAuthService(),
 	}
 }
 
@@ -46,12 +107,44 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	if err := store.Init(); err != nil {
+		panic(err)
+	}
+	defer store.Client.Close()
+
+	if err := artifact.Init(ctx); err != nil {
+		panic(err)
+	}
+
 	svcs := makeServices()
-	srv, err := StartServer(svcs)
+	if len(os.Args) > 1 {
+		err := runCommand(ctx, svcs, os.Args[1:])
+		svcs.uploadSvc.Stop()
+		if err != nil {
+			logger.L.Fatal("Command failed", zap.Error(err), zap.String("command", os.Args[1]))
+		}
+
+		return
+	}
+
+	// Commands leave containers alone, only the server runs lambdas
+	if err := svcs.lambdaSvc.Init(); err != nil {
+		panic(err)
+	}
+
+	bootstrap, err := svcs.authSvc.Bootstrap(ctx)
 	if err != nil {
 		panic(err)
 	}
 
+	// The secret is printed rather than logged, so it isn't shipped along with log records
+	if bootstrap != nil {
+		logger.L.Warn("Created the bootstrap admin token, it's written to stderr", zap.String("id", bootstrap.Id))
+		fmt.Fprintf(os.Stderr, "Bootstrap admin token, it's not shown again: %s\n", bootstrap.Secret)
+	}
+
+	srv := StartServer(svcs)
+
 	<-ctx.Done()
 	stop()
 
@@ -66,227 +159,1055 @@ func main() {
 	svcCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	svcs.lambdaSvc.Stop(svcCtx)
+	svcs.uploadSvc.Stop()
+}
+
+func StartServer(svcs *Services) *http.Server {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cutil.GetIntVar("PORT")),
+		Handler: newRouter(svcs),
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.L.Error("Failed to start server", zap.Error(err))
+		}
+	}()
+
+	return srv
 }
 
-func StartServer(svcs *Services) (*http.Server, error) {
-	r := gin.Default()
+// newRouter registers the routes, every route must be described by the OpenAPI operations,
+// which the contract test and the openapi command check.
+func newRouter(svcs *Services) *gin.Engine {
+	r := gin.New()
+	r.Use(requestID, gin.Logger(), gin.CustomRecovery(recovered), authorize(svcs.authSvc, operations))
+	r.NoRoute(func(c *gin.Context) {
+		writeError(c, errs.New(errs.NotFound, "route is not found: %s %s", c.Request.Method, c.Request.URL.Path))
+	})
 
 	r.POST("/upload", func(c *gin.Context) {
 		fileHeader, err := c.FormFile("file")
 		if err != nil {
-			logger.L.Error("internal server error", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
 		file, err := fileHeader.Open()
 		if err != nil {
-			logger.L.Error("internal server error", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
+			return
+		}
+
+		res, err := svcs.uploadSvc.Upload(c, file)
+		if errors.Is(err, upload.ErrUploadTooLarge) {
+			writeError(c, errs.Default(errs.TooLarge, err))
 			return
 		}
 
-		id, err := lambda.UploadTmp(c, file)
 		if err != nil {
-			logger.L.Error("internal server error", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{"id": id})
+		c.JSON(http.StatusCreated, res)
 	})
 
-	r.GET("/lambda", func(c *gin.Context) {
-		lambdas, err := lambda.GetLambdas(c)
+	r.POST("/upload/presign", func(c *gin.Context) {
+		presigned, err := svcs.uploadSvc.Presign(c)
+		if errors.Is(err, upload.ErrPresignUnsupported) {
+			writeError(c, errs.Default(errs.Unsupported, err))
+			return
+		}
 
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, lambdas)
+		c.JSON(http.StatusCreated, presigned)
 	})
 
-	r.GET("/lambda/:id", func(c *gin.Context) {
-		lambda, err := lambda.GetLambda(c, c.Param("id"))
+	r.GET("/upload/:id", func(c *gin.Context) {
+		upload, err := svcs.uploadSvc.Get(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, lambda)
+		if upload == nil {
+			notFound(c, "upload")
+			return
+		}
+
+		c.JSON(http.StatusOK, upload)
 	})
 
-	r.POST("/lambda", func(c *gin.Context) {
-		cLambda := &api.CreateLambda{}
-		err := c.ShouldBind(cLambda)
+	r.POST("/upload/:id/touch", func(c *gin.Context) {
+		upload, err := svcs.uploadSvc.Touch(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		err = model.ValidateCreateLambda(cLambda)
+		if upload == nil {
+			notFound(c, "upload")
+			return
+		}
+
+		c.JSON(http.StatusOK, upload)
+	})
+
+	r.POST("/upload/session", func(c *gin.Context) {
+		req := &model.CreateUploadSession{}
+		if err := c.ShouldBind(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		if err := model.ValidateCreateUploadSession(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		session, err := svcs.uploadSvc.CreateSession(c, req)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		lambda, err := svcs.lambdaSvc.BootstrapLambda(c, cLambda)
+		c.JSON(http.StatusCreated, session)
+	})
+
+	r.GET("/upload/session/:id", func(c *gin.Context) {
+		session, err := svcs.uploadSvc.GetSession(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusCreated, lambda)
+		if session == nil {
+			notFound(c, "upload session")
+			return
+		}
+
+		c.JSON(http.StatusOK, session)
 	})
 
-	r.POST("/lambda/:id/start", func(c *gin.Context) {
-		id := cutil.UUID()
-		svcs.taskSvc.Add(id)
+	r.PUT("/upload/session/:id", func(c *gin.Context) {
+		offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			writeError(c, errs.Field("offset", "must be a non-negative integer"))
+			return
+		}
 
-		go func() {
-			ctx := context.TODO()
+		session, err := svcs.uploadSvc.PutChunk(c, c.Param("id"), offset, c.Request.Body)
+		var offsetErr *upload.OffsetError
+		if errors.As(err, &offsetErr) {
+			writeError(c, errs.New(errs.Conflict, "%w", err).WithDetail("offset", offsetErr.Expected))
+			return
+		}
 
-			if err := svcs.lambdaSvc.Start(ctx, c.Param("id")); err != nil {
-				svcs.taskSvc.Failed(id, struct {
-					Error string `json:"error"`
-				}{Error: err.Error()})
-				return
-			}
+		if errors.Is(err, upload.ErrTooLarge) || errors.Is(err, upload.ErrTooManyChunks) {
+			writeError(c, errs.Default(errs.TooLarge, err))
+			return
+		}
 
-			svcs.taskSvc.Succeeded(id, nil)
-		}()
+		if err != nil {
+			writeError(c, err)
+			return
+		}
 
-		c.JSON(http.StatusAccepted, gin.H{"task": id})
+		if session == nil {
+			notFound(c, "upload session")
+			return
+		}
+
+		c.JSON(http.StatusOK, session)
 	})
 
-	r.POST("/lambda/:id/destroy", func(c *gin.Context) {
-		id := cutil.UUID()
-		svcs.taskSvc.Add(id)
+	r.POST("/upload/session/:id/finalize", func(c *gin.Context) {
+		req := &model.FinalizeUploadSession{}
+		if err := c.ShouldBind(req); err != nil {
+			invalid(c, err)
+			return
+		}
 
-		go func() {
-			ctx := context.TODO()
+		if err := model.ValidateFinalizeUploadSession(req); err != nil {
+			invalid(c, err)
+			return
+		}
 
-			if err := svcs.lambdaSvc.Destroy(ctx, c.Param("id")); err != nil {
-				svcs.taskSvc.Failed(id, struct {
-					Error string `json:"error"`
-				}{Error: err.Error()})
-				return
-			}
+		result, err := svcs.uploadSvc.FinalizeSession(c, c.Param("id"), req)
+		if errors.Is(err, upload.ErrIncomplete) || errors.Is(err, upload.ErrChecksumMismatch) {
+			writeError(c, errs.Default(errs.Validation, err))
+			return
+		}
 
-			svcs.taskSvc.Succeeded(id, nil)
-		}()
+		if err != nil {
+			writeError(c, err)
+			return
+		}
 
-		c.JSON(http.StatusAccepted, gin.H{"task": id})
+		if result == nil {
+			notFound(c, "upload session")
+			return
+		}
+
+		c.JSON(http.StatusCreated, result)
 	})
 
-	r.GET("/runtime", func(c *gin.Context) {
-		runtimes, err := lambda.GetRuntimes(c)
+	r.DELETE("/upload/session/:id", func(c *gin.Context) {
+		found, err := svcs.uploadSvc.AbortSession(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, runtimes)
+		if !found {
+			notFound(c, "upload session")
+			return
+		}
+
+		c.Status(http.StatusNoContent)
 	})
 
-	r.GET("/runtime/:id", func(c *gin.Context) {
-		runtime, err := lambda.GetRuntime(c, c.Param("id"))
+	r.GET("/lambda", func(c *gin.Context) {
+		params := &model.ListParams{}
+		filter := &model.LambdaFilter{}
+		if err := bindListQuery(c, params, filter); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		query := model.MakeQuery(params, filter.Match)
+		query.Lookup = filter.Lookup()
+
+		page, err := lambda.ListLambdas(c, query)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, runtime)
+		writePage(c, page)
 	})
 
-	r.POST("/runtime", func(c *gin.Context) {
-		cRuntime := &api.CreateRuntime{}
-		err := c.ShouldBind(cRuntime)
+	r.GET("/lambda/:id", func(c *gin.Context) {
+		lambda, version, err := lambda.GetVersionedLambda(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		err = model.ValidateCreateRuntime(cRuntime)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if lambda == nil {
+			notFound(c, "lambda")
 			return
 		}
 
-		runtime, err := svcs.lambdaSvc.BootstrapRuntime(c, cRuntime)
+		setETag(c, version)
+		c.JSON(http.StatusOK, lambda)
+	})
+
+	r.GET("/lambda/:id/image", func(c *gin.Context) {
+		image, err := lambda.GetLambdaImage(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
+			return
+		}
+
+		if image == nil {
+			notFound(c, "image of lambda")
 			return
 		}
 
-		c.JSON(http.StatusCreated, runtime)
+		c.JSON(http.StatusOK, image)
 	})
 
-	r.GET("/endpoint", func(c *gin.Context) {
-		endpoints, err := svcs.endpointSvc.List(c)
+	r.GET("/lambda/:id/export", func(c *gin.Context) {
+		manifest, err := svcs.bundleSvc.Manifest(c, c.Param("id"))
+		if errors.Is(err, bundle.ErrNotBuilt) {
+			writeError(c, errs.Default(errs.Conflict, err))
+			return
+		}
+
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, err)
+			return
+		}
+
+		if manifest == nil {
+			notFound(c, "lambda")
 			return
 		}
 
-		c.JSON(http.StatusOK, endpoints)
+		c.Header("Content-Type", "application/x-tar")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", manifest.Lambda.Name+".opless.tar"))
+		c.Status(http.StatusOK)
+
+		// The status is sent already, so the client gets a truncated bundle on failure
+		if err := svcs.bundleSvc.Export(c, manifest, c.Writer); err != nil {
+			logger.L.Error("Failed to export lambda", zap.Error(err), zap.String("lambda", manifest.Lambda.Id))
+			c.Abort()
+		}
 	})
 
-	r.GET("/endpoint/:id", func(c *gin.Context) {
-		endpoint, err := svcs.endpointSvc.Get(c, c.Param("id"))
+	r.GET("/lambda/:id/logs", func(c *gin.Context) {
+		follow, err := strconv.ParseBool(c.DefaultQuery("follow", "false"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeError(c, errs.Field("follow", "must be a boolean"))
 			return
 		}
 
-		c.JSON(http.StatusOK, endpoint)
+		tail := c.DefaultQuery("tail", "100")
+		if !validTail(tail) {
+			writeError(c, errs.Field("tail", "must be a non-negative integer or 'all'"))
+			return
+		}
+
+		logs, err := svcs.lambdaSvc.Logs(c, c.Param("id"), follow, tail)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if logs == nil {
+			notFound(c, "lambda")
+			return
+		}
+		defer logs.Close()
+
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(http.StatusOK)
+
+		// Following ends once the client disconnects or the container is removed
+		if err := writeLogs(c, logs); err != nil && c.Request.Context().Err() == nil {
+			logger.L.Error("Failed to stream logs", zap.Error(err), zap.String("lambda", c.Param("id")))
+			c.Abort()
+		}
 	})
 
-	r.POST("/endpoint", func(c *gin.Context) {
-		req := &api.CreateEndpoint{}
-		err := c.ShouldBind(req)
+	r.GET("/lambda/:id/build", func(c *gin.Context) {
+		build, err := lambda.GetLambdaBuild(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		err = model.ValidateCreateEndpoint(req)
+		if build == nil {
+			notFound(c, "build of lambda")
+			return
+		}
+
+		c.JSON(http.StatusOK, build)
+	})
+
+	r.GET("/lambda/:id/build-params", func(c *gin.Context) {
+		l, err := lambda.GetLambda(c, c.Param("id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		endpoint, err := svcs.endpointSvc.Create(c, req)
+		if l == nil {
+			notFound(c, "lambda")
+			return
+		}
+
+		params, err := lambda.GetLambdaBuildParams(c, l.Id)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusCreated, endpoint)
+		c.JSON(http.StatusOK, params)
 	})
 
-	r.GET("/task/:id", func(c *gin.Context) {
-		status := svcs.taskSvc.Get(c.Param("id"))
+	r.PUT("/lambda/:id/build-params", func(c *gin.Context) {
+		params := &model.BuildParams{}
+		if err := c.ShouldBindJSON(params); err != nil {
+			invalid(c, err)
+			return
+		}
 
-		if status == nil {
-			c.Status(http.StatusNotFound)
+		if err := svcs.lambdaSvc.SetBuildParams(c, c.Param("id"), params); err != nil {
+			writeError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, task.PrepareStatus(status))
+		c.JSON(http.StatusOK, params)
 	})
 
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cutil.GetIntVar("PORT")),
-		Handler: r,
-	}
+	r.POST("/lambda", func(c *gin.Context) {
+		cLambda := &api.CreateLambda{}
+		build, err := bindCreate(c, cLambda)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.L.Error("Failed to start server", zap.Error(err))
+		image, err := bindImage(c)
+		if err != nil {
+			invalid(c, err)
+			return
 		}
-	}()
 
-	return srv, nil
+		if image != nil {
+			if build != nil {
+				writeError(c, errs.Field("build", "can't be used along with 'image'"))
+				return
+			}
+
+			if err := model.ValidateCreateImageLambda(cLambda, image); err != nil {
+				invalid(c, err)
+				return
+			}
+
+			lambda, err := svcs.lambdaSvc.RegisterImage(c, cLambda, image)
+			if err != nil {
+				writeError(c, err)
+				return
+			}
+
+			setETag(c, db.FirstVersion)
+			c.JSON(http.StatusCreated, lambda)
+			return
+		}
+
+		err = model.ValidateCreateLambda(cLambda)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		lambda, err := svcs.lambdaSvc.BootstrapLambda(c, cLambda, build)
+		var archiveErr *archive.ValidationError
+		if errors.As(err, &archiveErr) {
+			writeError(c, errs.New(errs.Validation, "%w", err).WithDetail("violation", archiveErr))
+			return
+		}
+
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		setETag(c, db.FirstVersion)
+		c.JSON(http.StatusCreated, lambda)
+	})
+
+	r.POST("/lambda/import", func(c *gin.Context) {
+		opts := &model.ImportOptions{Name: c.Query("name"), OnConflict: c.Query("on_conflict")}
+		if err := model.ValidateImportOptions(opts); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		res, err := svcs.bundleSvc.Import(c, c.Request.Body, opts)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, res)
+	})
+
+	r.POST("/lambda/:id/start", func(c *gin.Context) {
+		lambdaID := c.Param("id")
+		version, ok := checkLambdaVersion(c, lambdaID)
+		if !ok {
+			return
+		}
+
+		id := cutil.UUID()
+		svcs.taskSvc.Add(id, model.ScopeLambdaRead)
+
+		go func() {
+			ctx := context.TODO()
+
+			if err := svcs.lambdaSvc.Start(ctx, lambdaID, version); err != nil {
+				svcs.taskSvc.Failed(id, task.ErrorOf(err))
+				return
+			}
+
+			svcs.taskSvc.Succeeded(id, nil)
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"task": id})
+	})
+
+	r.POST("/lambda/:id/destroy", func(c *gin.Context) {
+		lambdaID := c.Param("id")
+		version, ok := checkLambdaVersion(c, lambdaID)
+		if !ok {
+			return
+		}
+
+		id := cutil.UUID()
+		svcs.taskSvc.Add(id, model.ScopeLambdaRead)
+
+		go func() {
+			ctx := context.TODO()
+
+			if err := svcs.lambdaSvc.Destroy(ctx, lambdaID, version); err != nil {
+				svcs.taskSvc.Failed(id, task.ErrorOf(err))
+				return
+			}
+
+			svcs.taskSvc.Succeeded(id, nil)
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"task": id})
+	})
+
+	r.GET("/runtime", func(c *gin.Context) {
+		params := &model.ListParams{}
+		if err := bindListQuery(c, params); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		page, err := lambda.ListRuntimes(c, model.MakeQuery[api.Runtime](params, nil))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		writePage(c, page)
+	})
+
+	r.GET("/runtime/:id", func(c *gin.Context) {
+		runtime, version, err := lambda.GetVersionedRuntime(c, c.Param("id"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if runtime == nil {
+			notFound(c, "runtime")
+			return
+		}
+
+		setETag(c, version)
+		c.JSON(http.StatusOK, runtime)
+	})
+
+	r.GET("/catalog/runtime", func(c *gin.Context) {
+		runtimes, err := lambda.GetBuiltinRuntimes(c)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, runtimes)
+	})
+
+	r.GET("/runtime/:id/build-params", func(c *gin.Context) {
+		runtime, err := lambda.GetRuntime(c, c.Param("id"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if runtime == nil {
+			notFound(c, "runtime")
+			return
+		}
+
+		version, err := lambda.GetLatestRuntimeVersion(c, runtime.Id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if version == nil {
+			notFound(c, "runtime")
+			return
+		}
+
+		c.JSON(http.StatusOK, version.Params)
+	})
+
+	r.GET("/runtime/:id/version", func(c *gin.Context) {
+		versions, err := lambda.ListRuntimeVersions(c, c.Param("id"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if len(versions) == 0 {
+			notFound(c, "runtime")
+			return
+		}
+
+		c.JSON(http.StatusOK, versions)
+	})
+
+	r.GET("/runtime/:id/version/:version", func(c *gin.Context) {
+		number, err := strconv.ParseInt(c.Param("version"), 10, 64)
+		if err != nil {
+			writeError(c, errs.New(errs.Validation, "invalid version: %s", c.Param("version")))
+			return
+		}
+
+		version, err := lambda.GetRuntimeVersion(c, c.Param("id"), number)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if version == nil {
+			writeError(c, errs.New(errs.NotFound, "version %d of runtime %s is not found", number, c.Param("id")))
+			return
+		}
+
+		c.JSON(http.StatusOK, version)
+	})
+
+	r.POST("/runtime/:id/version", func(c *gin.Context) {
+		req := &model.CreateRuntimeVersion{}
+		if err := c.ShouldBindJSON(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		if err := model.ValidateCreateRuntimeVersion(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		version, findings, err := svcs.lambdaSvc.CreateRuntimeVersion(c, c.Param("id"), req)
+		var lintErr *dockerfile.LintError
+		if errors.As(err, &lintErr) {
+			writeError(c, errs.New(errs.Validation, "%w", err).WithDetail("findings", lintErr.Findings))
+			return
+		}
+
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"version": version, "findings": findings})
+	})
+
+	r.GET("/runtime/:id/image", func(c *gin.Context) {
+		runtime, err := lambda.GetRuntime(c, c.Param("id"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if runtime == nil {
+			notFound(c, "runtime")
+			return
+		}
+
+		images, err := lambda.GetRuntimeImages(c, runtime.Id)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, images)
+	})
+
+	r.GET("/runtime/:id/lambdas", func(c *gin.Context) {
+		lambdas, err := svcs.lambdaSvc.RuntimeLambdas(c, c.Param("id"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if lambdas == nil {
+			notFound(c, "runtime")
+			return
+		}
+
+		c.JSON(http.StatusOK, lambdas)
+	})
+
+	r.POST("/runtime/:id/rollout", func(c *gin.Context) {
+		rollout := &model.Rollout{}
+		if err := c.ShouldBindJSON(rollout); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		if err := model.ValidateRollout(rollout); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		target, err := lambda.GetLatestRuntimeVersion(c, c.Param("id"))
+		if err == nil && target != nil && rollout.Version != 0 {
+			target, err = lambda.GetRuntimeVersion(c, c.Param("id"), rollout.Version)
+		}
+
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if target == nil {
+			notFound(c, "runtime")
+			return
+		}
+
+		id := cutil.UUID()
+		svcs.taskSvc.Add(id, model.ScopeRuntimeRead)
+
+		go func() {
+			ctx := context.TODO()
+
+			report, err := svcs.lambdaSvc.Rollout(ctx, target, rollout)
+			if err != nil {
+				svcs.taskSvc.Failed(id, task.ErrorOf(err))
+				return
+			}
+
+			for _, result := range report.Lambdas {
+				if result.Status != model.RolloutSucceeded {
+					svcs.taskSvc.Failed(id, report)
+					return
+				}
+			}
+
+			svcs.taskSvc.Succeeded(id, report)
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"task": id})
+	})
+
+	r.POST("/runtime", func(c *gin.Context) {
+		cRuntime := &api.CreateRuntime{}
+		build, err := bindCreate(c, cRuntime)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		err = model.ValidateCreateRuntime(cRuntime)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		runtime, findings, err := svcs.lambdaSvc.BootstrapRuntime(c, cRuntime, build)
+		var lintErr *dockerfile.LintError
+		if errors.As(err, &lintErr) {
+			writeError(c, errs.New(errs.Validation, "%w", err).WithDetail("findings", lintErr.Findings))
+			return
+		}
+
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		res, err := runtime.ToMap()
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		res["findings"] = findings
+
+		setETag(c, db.FirstVersion)
+		c.JSON(http.StatusCreated, res)
+	})
+
+	r.GET("/endpoint", func(c *gin.Context) {
+		params := &model.ListParams{}
+		filter := &model.EndpointFilter{}
+		if err := bindListQuery(c, params, filter); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		query := model.MakeQuery(params, filter.Match)
+		query.Lookup = filter.Lookup()
+
+		page, err := svcs.endpointSvc.List(c, query)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		writePage(c, page)
+	})
+
+	r.GET("/endpoint/:id", func(c *gin.Context) {
+		endpoint, version, err := svcs.endpointSvc.Get(c, c.Param("id"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if endpoint == nil {
+			notFound(c, "endpoint")
+			return
+		}
+
+		setETag(c, version)
+		c.JSON(http.StatusOK, endpoint)
+	})
+
+	r.POST("/endpoint", func(c *gin.Context) {
+		req := &api.CreateEndpoint{}
+		err := c.ShouldBind(req)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		err = model.ValidateCreateEndpoint(req)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		endpoint, err := svcs.endpointSvc.Create(c, req)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		setETag(c, db.FirstVersion)
+		c.JSON(http.StatusCreated, endpoint)
+	})
+
+	r.PUT("/endpoint/:id", func(c *gin.Context) {
+		version, err := ifMatch(c)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		req := &api.CreateEndpoint{}
+		if err := c.ShouldBind(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		if err := model.ValidateCreateEndpoint(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		endpoint, newVersion, err := svcs.endpointSvc.Update(c, c.Param("id"), req, version)
+		if errors.Is(err, db.ErrStaleVersion) {
+			writeError(c, staleError(version, err))
+			return
+		}
+
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		setETag(c, newVersion)
+		c.JSON(http.StatusOK, endpoint)
+	})
+
+	r.DELETE("/endpoint/:id", func(c *gin.Context) {
+		version, err := ifMatch(c)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		err = svcs.endpointSvc.Delete(c, c.Param("id"), version)
+		if errors.Is(err, db.ErrStaleVersion) {
+			writeError(c, staleError(version, err))
+			return
+		}
+
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	r.POST("/apply", func(c *gin.Context) {
+		dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+		if err != nil {
+			writeError(c, errs.Field("dry_run", "must be a boolean"))
+			return
+		}
+
+		prune, err := strconv.ParseBool(c.DefaultQuery("prune", "false"))
+		if err != nil {
+			writeError(c, errs.Field("prune", "must be a boolean"))
+			return
+		}
+
+		adopt, err := strconv.ParseBool(c.DefaultQuery("adopt", "false"))
+		if err != nil {
+			writeError(c, errs.Field("adopt", "must be a boolean"))
+			return
+		}
+
+		raw, err := io.ReadAll(io.LimitReader(c.Request.Body, model.MaxManifestSize+1))
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		if len(raw) > model.MaxManifestSize {
+			writeError(c, errs.New(errs.TooLarge, "manifest is larger than %d bytes", model.MaxManifestSize))
+			return
+		}
+
+		manifest, err := model.ParseManifest(raw)
+		if err != nil {
+			invalid(c, err)
+			return
+		}
+
+		plan, err := svcs.applySvc.Apply(c, manifest, dryRun, prune, adopt)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, plan)
+	})
+
+	r.GET("/backup", func(c *gin.Context) {
+		name := fmt.Sprintf("opless-backup-%d.tar.gz", time.Now().Unix())
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+		// Nothing is written until the lock is taken and the records are read, so those
+		// failures are answered with an error. Later ones leave the archive truncated.
+		err := svcs.backupSvc.Backup(c, c.Writer)
+		if err != nil && !c.Writer.Written() {
+			c.Header("Content-Type", "")
+			c.Header("Content-Disposition", "")
+			writeError(c, err)
+			return
+		}
+
+		if err != nil {
+			logger.L.Error("Failed to back up", zap.Error(err))
+			c.Abort()
+		}
+	})
+
+	r.POST("/restore", func(c *gin.Context) {
+		start, err := strconv.ParseBool(c.DefaultQuery("start", "false"))
+		if err != nil {
+			writeError(c, errs.Field("start", "must be a boolean"))
+			return
+		}
+
+		report, err := svcs.backupSvc.Restore(c, c.Request.Body)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		if !start {
+			c.JSON(http.StatusOK, gin.H{"restore": report})
+			return
+		}
+
+		id := cutil.UUID()
+		svcs.taskSvc.Add(id, model.ScopeAdmin)
+
+		go func() {
+			results := svcs.backupSvc.Start(context.TODO(), report.Running)
+			for _, result := range results {
+				if result.Error != "" {
+					svcs.taskSvc.Failed(id, results)
+					return
+				}
+			}
+
+			svcs.taskSvc.Succeeded(id, results)
+		}()
+
+		c.JSON(http.StatusAccepted, gin.H{"restore": report, "task": id})
+	})
+
+	r.GET("/token", func(c *gin.Context) {
+		params := &model.ListParams{}
+		if err := bindListQuery(c, params); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		page, err := svcs.authSvc.List(c, model.MakeQuery[model.StoredToken](params, nil))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		writePage(c, page)
+	})
+
+	r.POST("/token", func(c *gin.Context) {
+		req := &model.CreateToken{}
+		if err := c.ShouldBindJSON(req); err != nil {
+			invalid(c, err)
+			return
+		}
+
+		if err := model.ValidateCreateToken(req); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		token, err := svcs.authSvc.Create(c, req)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, token)
+	})
+
+	r.DELETE("/token/:id", func(c *gin.Context) {
+		if err := svcs.authSvc.Revoke(c, c.Param("id")); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	r.GET("/task/:id", func(c *gin.Context) {
+		scope := svcs.taskSvc.Scope(c.Param("id"))
+		if scope == "" {
+			notFound(c, "task")
+			return
+		}
+
+		if !granted(c, scope) {
+			return
+		}
+
+		status := svcs.taskSvc.Get(c.Param("id"))
+
+		if status == nil {
+			notFound(c, "task")
+			return
+		}
+
+		c.JSON(http.StatusOK, task.PrepareStatus(status))
+	})
+
+	doc := openapi.Build(apiInfo, operations)
+
+	r.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	})
+
+	r.GET("/docs", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", openapi.DocsPage)
+	})
+
+	return r
 }
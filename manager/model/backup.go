@@ -0,0 +1,29 @@
+package model
+
+// BackupFormat is the version of the backup archive layout, archives of other versions are rejected.
+const BackupFormat = 1
+
+// Backup is the manifest of a platform backup archive.
+type Backup struct {
+	Format int `json:"format"`
+	// OPlessID is the id of the installation the backup is made of
+	OPlessID  string `json:"opless_id"`
+	CreatedAt int64  `json:"created_at"`
+	// Records are numbers of records per collection prefix
+	Records map[string]int `json:"records"`
+}
+
+// RestoreReport describes the restored state.
+type RestoreReport struct {
+	Records map[string]int `json:"records"`
+	// Objects are numbers of artifacts per bucket
+	Objects map[string]int `json:"objects"`
+	// Running are lambdas which were running when the backup was made
+	Running []string `json:"running"`
+}
+
+// StartResult is the outcome of starting a restored lambda.
+type StartResult struct {
+	Lambda string `json:"lambda"`
+	Error  string `json:"error,omitempty"`
+}
@@ -0,0 +1,141 @@
+package model
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/onpremless/opless/manager/errs"
+)
+
+// BuildParams are passed to the image build. Runtimes declare args with their default values,
+// lambdas override them along with the rest of the params.
+type BuildParams struct {
+	Args map[string]string `json:"args,omitempty"`
+	// Target is the stage of a multi-stage Dockerfile to build
+	Target string `json:"target,omitempty"`
+	// Platform is '<os>/<arch>[/<variant>]' of the image
+	Platform string            `json:"platform,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// LambdaBuildParams keeps build params overrides of the lambda with the same id.
+type LambdaBuildParams struct {
+	Id string `json:"id"`
+	BuildParams
+}
+
+// BuildRequest is an optional part of runtime and lambda creation requests.
+type BuildRequest struct {
+	Build *BuildParams `json:"build"`
+}
+
+// LambdaBuild describes the image the lambda with the same id was last started from.
+type LambdaBuild struct {
+	Id string `json:"id"`
+	// Digest of the runtime Dockerfile, the code manifest and the params the image is built from
+	Digest      string `json:"digest"`
+	Image       string `json:"image"`
+	ImageId     string `json:"image_id"`
+	CodeVersion int64  `json:"code_version"`
+	// RuntimeVersion is the version of the runtime the image is built from
+	RuntimeVersion int64 `json:"runtime_version"`
+	// BaseImage is the runtime image the lambda image is built from, empty if
+	// the runtime Dockerfile is built along with the code
+	BaseImage string `json:"base_image,omitempty"`
+	// Params are the effective build params
+	Params *BuildParams `json:"params"`
+	// Cached is true if the existing image was reused instead of building it
+	Cached  bool  `json:"cached"`
+	BuiltAt int64 `json:"built_at"`
+}
+
+// Merge returns params with overrides applied on top of p.
+func (p *BuildParams) Merge(overrides *BuildParams) *BuildParams {
+	res := &BuildParams{
+		Args:     map[string]string{},
+		Target:   p.Target,
+		Platform: p.Platform,
+		Labels:   map[string]string{},
+	}
+
+	for _, params := range []*BuildParams{p, overrides} {
+		for k, v := range params.Args {
+			res.Args[k] = v
+		}
+
+		for k, v := range params.Labels {
+			res.Labels[k] = v
+		}
+	}
+
+	if overrides.Target != "" {
+		res.Target = overrides.Target
+	}
+
+	if overrides.Platform != "" {
+		res.Platform = overrides.Platform
+	}
+
+	return res
+}
+
+var BuildArgRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+var TargetRegex = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_.-]*$")
+var PlatformRegex = regexp.MustCompile("^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$")
+
+// ReservedLabelPrefix is used by labels set on every image built.
+const ReservedLabelPrefix = "opless"
+
+func ValidateBuildParams(params *BuildParams) error {
+	for name := range params.Args {
+		if !BuildArgRegex.MatchString(name) {
+			return errs.New(errs.Validation, "build arg '%s' doesn't conform regex: %s", name, BuildArgRegex.String())
+		}
+	}
+
+	if params.Target != "" && !TargetRegex.MatchString(params.Target) {
+		return errs.Field("target", "doesn't conform regex: %s", TargetRegex.String())
+	}
+
+	if params.Platform != "" && !PlatformRegex.MatchString(params.Platform) {
+		return errs.Field("platform", "doesn't conform regex: %s", PlatformRegex.String())
+	}
+
+	for name := range params.Labels {
+		if name == "" {
+			return errs.New(errs.Validation, "label name is required")
+		}
+
+		if strings.HasPrefix(name, ReservedLabelPrefix) {
+			return errs.New(errs.Validation, "label '%s' uses reserved prefix '%s'", name, ReservedLabelPrefix)
+		}
+	}
+
+	return nil
+}
+
+// ValidateBuildOverrides checks that overrides set only args declared by the runtime.
+func ValidateBuildOverrides(runtime *BuildParams, overrides *BuildParams) error {
+	if err := ValidateBuildParams(overrides); err != nil {
+		return err
+	}
+
+	for name := range overrides.Args {
+		if _, ok := runtime.Args[name]; !ok {
+			return errs.New(errs.Validation, "build arg '%s' is not declared by the runtime", name)
+		}
+	}
+
+	return nil
+}
+
+// RuntimeImage is a base image built from a runtime version, Id is the base image digest.
+type RuntimeImage struct {
+	Id      string       `json:"id"`
+	Runtime string       `json:"runtime"`
+	Version int64        `json:"version"`
+	Image   string       `json:"image"`
+	ImageId string       `json:"image_id"`
+	Params  *BuildParams `json:"params"`
+	BuiltAt int64        `json:"built_at"`
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/manager/errs"
+)
+
+// BundleFormat is the version of the lambda bundle layout, bundles of other versions are rejected.
+const BundleFormat = 1
+
+// LambdaBundle is the manifest of an exported lambda. The bundle is a tar stream having
+// the manifest first followed by the 'docker save' output of the lambda image.
+// Registry credentials are never exported.
+type LambdaBundle struct {
+	Format int         `json:"format"`
+	Lambda *api.Lambda `json:"lambda"`
+	// Build is the image the lambda was last started from, the one exported
+	Build *LambdaBuild `json:"build"`
+	// Image is set if the lambda runs a pre-built image
+	Image          *LambdaImage    `json:"image,omitempty"`
+	Runtime        *api.Runtime    `json:"runtime,omitempty"`
+	RuntimeVersion *RuntimeVersion `json:"runtime_version,omitempty"`
+	// BuildParams are build params overrides of the lambda
+	BuildParams *BuildParams    `json:"build_params,omitempty"`
+	Endpoints   []*api.Endpoint `json:"endpoints"`
+	ExportedAt  int64           `json:"exported_at"`
+}
+
+func ValidateLambdaBundle(bundle *LambdaBundle) error {
+	if bundle.Format != BundleFormat {
+		return errs.New(errs.Validation, "unsupported bundle format %d, expected %d", bundle.Format, BundleFormat)
+	}
+
+	if bundle.Lambda == nil || bundle.Lambda.Name == "" {
+		return errs.New(errs.Validation, "bundle has no lambda")
+	}
+
+	if bundle.Build == nil || bundle.Build.ImageId == "" {
+		return errs.New(errs.Validation, "bundle has no image")
+	}
+
+	return nil
+}
+
+const (
+	// ConflictFail rejects the import if the lambda name or any endpoint path is taken
+	ConflictFail = "fail"
+	// ConflictRename imports the lambda under the first free '<name>-<n>' name,
+	// endpoints with taken paths are skipped
+	ConflictRename = "rename"
+)
+
+// ImportOptions are query params of the lambda import.
+type ImportOptions struct {
+	// Name replaces the name of the exported lambda
+	Name       string
+	OnConflict string
+}
+
+func ValidateImportOptions(opts *ImportOptions) error {
+	if opts.OnConflict == "" {
+		opts.OnConflict = ConflictFail
+	}
+
+	if opts.OnConflict != ConflictFail && opts.OnConflict != ConflictRename {
+		return errs.Field("on_conflict", "has invalid value %s", opts.OnConflict)
+	}
+
+	return nil
+}
+
+// SkippedEndpoint is an exported endpoint which isn't recreated.
+type SkippedEndpoint struct {
+	Endpoint *api.Endpoint `json:"endpoint"`
+	Reason   string        `json:"reason"`
+}
+
+// ImportResult describes records created by the lambda import.
+type ImportResult struct {
+	Lambda *api.Lambda `json:"lambda"`
+	// Renamed is true if the lambda is imported under another name because of a conflict
+	Renamed   bool               `json:"renamed"`
+	Endpoints []*api.Endpoint    `json:"endpoints"`
+	Skipped   []*SkippedEndpoint `json:"skipped"`
+}
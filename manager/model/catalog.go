@@ -0,0 +1,13 @@
+package model
+
+// BuiltinRuntime marks the runtime with the same id as installed from the catalog
+// embedded into the manager.
+type BuiltinRuntime struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Digest of the catalog Dockerfile and build params the runtime is installed from
+	Digest      string `json:"digest"`
+	InstalledAt int64  `json:"installed_at"`
+	UpgradedAt  int64  `json:"upgraded_at"`
+}
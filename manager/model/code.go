@@ -0,0 +1,30 @@
+package model
+
+// CodeFile is a lambda file stored as a content addressed blob.
+type CodeFile struct {
+	Path string `json:"path"`
+	// Digest is '<algorithm>:<hex digest>' of the file content
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	// Mode is 0755 for executable files and 0644 for the rest, it's 0 for files stored
+	// before modes were kept, they're written as 0644
+	Mode int64 `json:"mode,omitempty"`
+}
+
+// CodeManifest lists files of a lambda code version ordered by path.
+type CodeManifest struct {
+	Lambda  string `json:"lambda"`
+	Version int64  `json:"version"`
+	// Digest identifies the files list, versions with the same files have the same digest
+	Digest    string      `json:"digest"`
+	Files     []*CodeFile `json:"files"`
+	CreatedAt int64       `json:"created_at"`
+}
+
+// LambdaCode points to the current code version of the lambda with the same id.
+type LambdaCode struct {
+	Id        string `json:"id"`
+	Version   int64  `json:"version"`
+	Digest    string `json:"digest"`
+	UpdatedAt int64  `json:"updated_at"`
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/manager/errs"
+)
+
+// RegistryAuth are credentials of a private registry, either username with password
+// or an identity token.
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identity_token,omitempty"`
+}
+
+// ImageSource is a pre-built image a lambda runs instead of one built from its code.
+type ImageSource struct {
+	// Ref is 'registry/repo:tag' or 'registry/repo@sha256:<hex>'
+	Ref      string        `json:"ref"`
+	Platform string        `json:"platform,omitempty"`
+	Auth     *RegistryAuth `json:"auth,omitempty"`
+}
+
+// ImageRequest is an optional part of lambda creation requests.
+type ImageRequest struct {
+	Image *ImageSource `json:"image"`
+}
+
+// LambdaImage describes the image the lambda with the same id runs.
+type LambdaImage struct {
+	Id string `json:"id"`
+	// Ref is the reference the lambda is registered with
+	Ref string `json:"ref"`
+	// Pinned is the reference by digest the image is pulled with, the image id if it's imported
+	Pinned   string `json:"pinned"`
+	ImageId  string `json:"image_id"`
+	Platform string `json:"platform,omitempty"`
+	PulledAt int64  `json:"pulled_at"`
+	// Imported is true if the image is loaded from a lambda bundle, so it can't be pulled again
+	Imported bool `json:"imported,omitempty"`
+}
+
+// LambdaRegistryAuth keeps credentials the image of the lambda with the same id is pulled with.
+type LambdaRegistryAuth struct {
+	Id string `json:"id"`
+	// Sealed is RegistryAuth encrypted with the key of the manager
+	Sealed string `json:"sealed"`
+}
+
+func ValidateImageSource(image *ImageSource) error {
+	if image.Ref == "" {
+		return errs.Field("image.ref", "is required")
+	}
+
+	if image.Platform != "" && !PlatformRegex.MatchString(image.Platform) {
+		return errs.Field("image.platform", "doesn't conform regex: %s", PlatformRegex.String())
+	}
+
+	if auth := image.Auth; auth != nil {
+		if auth.IdentityToken == "" && (auth.Username == "" || auth.Password == "") {
+			return errs.Field("image.auth", "requires either 'username' with 'password' or 'identity_token'")
+		}
+	}
+
+	return nil
+}
+
+// ValidateCreateImageLambda validates the creation request of a lambda running a pre-built image,
+// such a lambda has neither a runtime nor an archive.
+func ValidateCreateImageLambda(lambda *api.CreateLambda, image *ImageSource) error {
+	if lambda.Name == "" {
+		return errs.Field("name", "is required")
+	}
+
+	if lambda.Runtime != "" || lambda.Archive != "" {
+		return errs.New(errs.Validation, "'runtime' and 'archive' can't be used along with 'image'")
+	}
+
+	if lambda.LambdaType != "ENDPOINT" && lambda.LambdaType != "INTERNAL" {
+		return errs.Field("lambda_type", "has invalid value %s", lambda.LambdaType)
+	}
+
+	return ValidateImageSource(image)
+}
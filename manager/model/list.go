@@ -0,0 +1,104 @@
+package model
+
+import (
+	"strings"
+
+	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/errs"
+)
+
+type ListParams struct {
+	Cursor string `form:"cursor"`
+	Limit  int    `form:"limit"`
+	SortBy string `form:"sort_by"`
+	Order  string `form:"order"`
+}
+
+type LambdaFilter struct {
+	Name       string `form:"name"`
+	Runtime    string `form:"runtime"`
+	LambdaType string `form:"lambda_type"`
+	Status     string `form:"status"`
+}
+
+type EndpointFilter struct {
+	Lambda     string `form:"lambda"`
+	PathPrefix string `form:"path_prefix"`
+}
+
+func ValidateListParams(params *ListParams) error {
+	// An omitted limit binds as 0, so 0 is the default one
+	if params.Limit < 0 || params.Limit > db.MaxLimit {
+		return errs.Field("limit", "must be between 1 and %d, or 0 for the default %d", db.MaxLimit, db.DefaultLimit)
+	}
+
+	switch params.SortBy {
+	case "", "created_at", "updated_at", "name":
+	default:
+		return errs.Field("sort_by", "has invalid value %s", params.SortBy)
+	}
+
+	if params.Order != "" && params.Order != "asc" && params.Order != "desc" {
+		return errs.Field("order", "has invalid value %s", params.Order)
+	}
+
+	return nil
+}
+
+func MakeQuery[T any](params *ListParams, filter func(x *T) bool) *db.Query[T] {
+	sortBy := params.SortBy
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+
+	return &db.Query[T]{
+		SortBy: sortBy,
+		Desc:   params.Order == "desc",
+		Cursor: params.Cursor,
+		Limit:  params.Limit,
+		Filter: filter,
+	}
+}
+
+// Lookup returns the filter fields the lambda lookup indexes cover.
+func (f *LambdaFilter) Lookup() map[string]string {
+	return map[string]string{"runtime": f.Runtime}
+}
+
+func (f *LambdaFilter) Match(lambda *api.Lambda) bool {
+	if f.Name != "" && lambda.Name != f.Name {
+		return false
+	}
+
+	if f.Runtime != "" && lambda.Runtime != f.Runtime {
+		return false
+	}
+
+	if f.LambdaType != "" && lambda.LambdaType != f.LambdaType {
+		return false
+	}
+
+	if f.Status != "" && lambda.Docker.Status != f.Status {
+		return false
+	}
+
+	return true
+}
+
+// Lookup returns the filter fields the endpoint lookup indexes cover.
+func (f *EndpointFilter) Lookup() map[string]string {
+	return map[string]string{"lambda": f.Lambda}
+}
+
+func (f *EndpointFilter) Match(endpoint *api.Endpoint) bool {
+	if f.Lambda != "" && endpoint.Lambda != f.Lambda {
+		return false
+	}
+
+	if f.PathPrefix != "" && !strings.HasPrefix(endpoint.Path, f.PathPrefix) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/onpremless/opless/manager/errs"
+)
+
+// Manifest declares the desired runtimes, lambdas and endpoints. Resources created or
+// updated by applying it are owned by the manifest name, so they can be pruned once
+// they disappear from it.
+type Manifest struct {
+	Name      string          `json:"name"`
+	Runtimes  []*RuntimeSpec  `json:"runtimes"`
+	Lambdas   []*LambdaSpec   `json:"lambdas"`
+	Endpoints []*EndpointSpec `json:"endpoints"`
+}
+
+type RuntimeSpec struct {
+	Name string `json:"name"`
+	// Dockerfile is an id of the upload, the CLI accepts a path relative to the manifest
+	Dockerfile string       `json:"dockerfile"`
+	Build      *BuildParams `json:"build,omitempty"`
+}
+
+type LambdaSpec struct {
+	Name string `json:"name"`
+	// Runtime is the runtime name
+	Runtime string `json:"runtime,omitempty"`
+	// Type is ENDPOINT or INTERNAL
+	Type string `json:"type"`
+	// Archive is an id of the upload, the CLI accepts a path relative to the manifest
+	Archive string       `json:"archive,omitempty"`
+	Image   *ImageSource `json:"image,omitempty"`
+	Build   *BuildParams `json:"build,omitempty"`
+}
+
+type EndpointSpec struct {
+	Name string `json:"name"`
+	// Path identifies the endpoint
+	Path string `json:"path"`
+	// Lambda is the lambda name
+	Lambda string `json:"lambda"`
+}
+
+const MaxManifestSize = 4 << 20
+
+// ParseManifest decodes the YAML or JSON manifest and validates it. YAML is converted to JSON
+// first, so both formats share field names and unknown fields are rejected.
+func ParseManifest(raw []byte) (*Manifest, error) {
+	var doc any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	manifest := &Manifest{}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	if err := ValidateManifest(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+const DefaultManifest = "default"
+
+var ManifestNameRegex = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_.-]*$")
+
+func ValidateManifest(manifest *Manifest) error {
+	if manifest.Name == "" {
+		manifest.Name = DefaultManifest
+	}
+
+	if !ManifestNameRegex.MatchString(manifest.Name) {
+		return errs.Field("name", "doesn't conform regex: %s", ManifestNameRegex.String())
+	}
+
+	runtimes := map[string]bool{}
+	for i, runtime := range manifest.Runtimes {
+		if runtime.Name == "" || runtime.Dockerfile == "" {
+			return errs.New(errs.Validation, "runtimes[%d]: 'name' and 'dockerfile' are required", i)
+		}
+
+		if runtimes[runtime.Name] {
+			return errs.New(errs.Validation, "runtimes[%d]: duplicate name %s", i, runtime.Name)
+		}
+		runtimes[runtime.Name] = true
+
+		if runtime.Build != nil {
+			if err := ValidateBuildParams(runtime.Build); err != nil {
+				return fmt.Errorf("runtimes[%d]: %w", i, err)
+			}
+		}
+	}
+
+	lambdas := map[string]*LambdaSpec{}
+	for i, lambda := range manifest.Lambdas {
+		if err := validateLambdaSpec(lambda); err != nil {
+			return fmt.Errorf("lambdas[%d]: %w", i, err)
+		}
+
+		if lambdas[lambda.Name] != nil {
+			return errs.New(errs.Validation, "lambdas[%d]: duplicate name %s", i, lambda.Name)
+		}
+		lambdas[lambda.Name] = lambda
+	}
+
+	paths := map[string]bool{}
+	for i, endpoint := range manifest.Endpoints {
+		if endpoint.Name == "" || endpoint.Lambda == "" {
+			return errs.New(errs.Validation, "endpoints[%d]: 'name' and 'lambda' are required", i)
+		}
+
+		if err := ValidateEndpoint(endpoint.Path); err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+
+		if paths[endpoint.Path] {
+			return errs.New(errs.Validation, "endpoints[%d]: duplicate path %s", i, endpoint.Path)
+		}
+		paths[endpoint.Path] = true
+
+		// Lambdas out of the manifest are checked once it's applied
+		if lambda := lambdas[endpoint.Lambda]; lambda != nil && lambda.Type != "ENDPOINT" {
+			return errs.New(errs.Validation, "endpoints[%d]: lambda %s is not an endpoint", i, endpoint.Lambda)
+		}
+	}
+
+	return nil
+}
+
+func validateLambdaSpec(lambda *LambdaSpec) error {
+	if lambda.Name == "" {
+		return errs.Field("name", "is required")
+	}
+
+	if lambda.Type != "ENDPOINT" && lambda.Type != "INTERNAL" {
+		return errs.Field("type", "has invalid value %s", lambda.Type)
+	}
+
+	if lambda.Image != nil {
+		if lambda.Runtime != "" || lambda.Archive != "" || lambda.Build != nil {
+			return errs.New(errs.Validation, "'runtime', 'archive' and 'build' can't be used along with 'image'")
+		}
+
+		return ValidateImageSource(lambda.Image)
+	}
+
+	if lambda.Runtime == "" || lambda.Archive == "" {
+		return errs.New(errs.Validation, "either 'image' or 'runtime' with 'archive' is required")
+	}
+
+	if lambda.Build != nil {
+		return ValidateBuildParams(lambda.Build)
+	}
+
+	return nil
+}
+
+// UpdateLambda changes the lambda, empty fields are kept as they are. Lambdas running
+// pre-built images can't be moved to runtimes and vice versa.
+type UpdateLambda struct {
+	// Runtime is the runtime id, the lambda is pinned to its latest version
+	Runtime    string
+	LambdaType string
+	// Archive is an id of the upload becoming the next code version
+	Archive string
+	// Build replaces build params overrides if it's not nil
+	Build *BuildParams
+	Image *ImageSource
+}
+
+const (
+	KindRuntime  = "runtime"
+	KindLambda   = "lambda"
+	KindEndpoint = "endpoint"
+)
+
+const (
+	ActionCreate = "CREATE"
+	ActionUpdate = "UPDATE"
+	ActionDelete = "DELETE"
+	ActionNone   = "NONE"
+)
+
+const (
+	ApplyPlanned   = "PLANNED"
+	ApplySucceeded = "SUCCEEDED"
+	ApplyFailed    = "FAILED"
+)
+
+// PlanItem is a change of a single resource, it carries the outcome once applied.
+type PlanItem struct {
+	Kind string `json:"kind"`
+	// Name is the name of runtimes and lambdas, the path of endpoints
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Changes are fields which differ from the last applied spec
+	Changes []string `json:"changes,omitempty"`
+	// Owner is the manifest owning the resource before the apply, if any
+	Owner string `json:"owner,omitempty"`
+	// Adopt is set for existing resources no manifest owns, which the manifest takes over
+	Adopt  bool   `json:"adopt,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Plan is the list of changes bringing the current state to the manifest.
+type Plan struct {
+	Manifest string      `json:"manifest"`
+	DryRun   bool        `json:"dry_run"`
+	Items    []*PlanItem `json:"items"`
+}
+
+// Owned records a resource applied by a manifest along with the spec it's applied with.
+type Owned struct {
+	// Id is '<kind>/<name>'
+	Id       string `json:"id"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Manifest string `json:"manifest"`
+	// Spec is the applied spec with uploads replaced by their checksums
+	Spec      map[string]any `json:"spec"`
+	AppliedAt int64          `json:"applied_at"`
+}
@@ -1,27 +1,27 @@
 package model
 
 import (
-	"fmt"
 	"regexp"
 
 	api "github.com/onpremless/go-client"
+	"github.com/onpremless/opless/manager/errs"
 )
 
 func ValidateCreateLambda(lambda *api.CreateLambda) error {
 	if lambda.Name == "" {
-		return fmt.Errorf("'name' is required")
+		return errs.Field("name", "is required")
 	}
 
 	if lambda.Runtime == "" {
-		return fmt.Errorf("'runtime' is required")
+		return errs.Field("runtime", "is required")
 	}
 
 	if lambda.LambdaType == "" {
-		return fmt.Errorf("'lambda_type' is required")
+		return errs.Field("lambda_type", "is required")
 	}
 
 	if lambda.LambdaType != "ENDPOINT" && lambda.LambdaType != "INTERNAL" {
-		return fmt.Errorf("invalid 'lambda_type' value: %s", lambda.LambdaType)
+		return errs.Field("lambda_type", "has invalid value %s", lambda.LambdaType)
 	}
 
 	return nil
@@ -31,7 +31,7 @@ var EndpointRegex = regexp.MustCompile("^(/[0-9a-zA-Z-_]+)+$")
 
 func ValidateEndpoint(path string) error {
 	if !EndpointRegex.MatchString(path) {
-		return fmt.Errorf("'endpoint' doesn't conform regex: %s", EndpointRegex.String())
+		return errs.Field("endpoint", "doesn't conform regex: %s", EndpointRegex.String())
 	}
 
 	return nil
@@ -39,11 +39,11 @@ func ValidateEndpoint(path string) error {
 
 func ValidateCreateRuntime(req *api.CreateRuntime) error {
 	if req.Name == "" {
-		return fmt.Errorf("'name' is required")
+		return errs.Field("name", "is required")
 	}
 
 	if req.Dockerfile == "" {
-		return fmt.Errorf("'dockerfile' is required")
+		return errs.Field("dockerfile", "is required")
 	}
 
 	return nil
@@ -51,11 +51,11 @@ func ValidateCreateRuntime(req *api.CreateRuntime) error {
 
 func ValidateCreateEndpoint(req *api.CreateEndpoint) error {
 	if req.Name == "" {
-		return fmt.Errorf("'name' is required")
+		return errs.Field("name", "is required")
 	}
 
 	if req.Lambda == "" {
-		return fmt.Errorf("'lambda' is required")
+		return errs.Field("lambda", "is required")
 	}
 
 	if err := ValidateEndpoint(req.Path); err != nil {
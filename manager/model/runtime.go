@@ -0,0 +1,102 @@
+package model
+
+import "github.com/onpremless/opless/manager/errs"
+
+// RuntimeVersion is an immutable revision of the runtime Dockerfile and build params.
+type RuntimeVersion struct {
+	Runtime string `json:"runtime"`
+	Version int64  `json:"version"`
+	// Digest of the Dockerfile
+	Digest    string      `json:"digest"`
+	Params    BuildParams `json:"params"`
+	CreatedAt int64       `json:"created_at"`
+}
+
+// LambdaRuntime pins the lambda with the same id to a runtime version, the lambda is
+// built from it until rolled out to another one.
+type LambdaRuntime struct {
+	Id      string `json:"id"`
+	Runtime string `json:"runtime"`
+	Version int64  `json:"version"`
+}
+
+// CreateRuntimeVersion is a request to add the next version of a runtime.
+type CreateRuntimeVersion struct {
+	// Dockerfile is an id of the upload
+	Dockerfile string       `json:"dockerfile"`
+	Build      *BuildParams `json:"build"`
+}
+
+func ValidateCreateRuntimeVersion(req *CreateRuntimeVersion) error {
+	if req.Dockerfile == "" {
+		return errs.Field("dockerfile", "is required")
+	}
+
+	if req.Build != nil {
+		return ValidateBuildParams(req.Build)
+	}
+
+	return nil
+}
+
+// Rollout moves lambdas pinned to older versions of a runtime to the target one.
+type Rollout struct {
+	// Version is the target version, the latest one if 0
+	Version int64 `json:"version"`
+	// Concurrency is the number of lambdas rolled at once
+	Concurrency int `json:"concurrency"`
+	// MaxFailures stops the rollout once reached, the rest lambdas are skipped. No limit if 0.
+	MaxFailures int `json:"max_failures"`
+}
+
+const MaxRolloutConcurrency = 16
+
+func ValidateRollout(req *Rollout) error {
+	if req.Version < 0 {
+		return errs.Field("version", "must not be negative")
+	}
+
+	if req.Concurrency < 0 || req.Concurrency > MaxRolloutConcurrency {
+		return errs.Field("concurrency", "must be between 1 and %d", MaxRolloutConcurrency)
+	}
+
+	if req.MaxFailures < 0 {
+		return errs.Field("max_failures", "must not be negative")
+	}
+
+	return nil
+}
+
+const (
+	RolloutSucceeded  = "SUCCEEDED"
+	RolloutFailed     = "FAILED"
+	RolloutRolledBack = "ROLLED_BACK"
+	RolloutSkipped    = "SKIPPED"
+)
+
+// RolloutResult is the outcome of a lambda rollout.
+type RolloutResult struct {
+	Lambda string `json:"lambda"`
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	// Status is SUCCEEDED, ROLLED_BACK if the lambda has failed to start on the target version
+	// and runs the previous one again, SKIPPED if the rollout is stopped before reaching it,
+	// or FAILED otherwise
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RolloutReport is the details of a rollout task.
+type RolloutReport struct {
+	Runtime string           `json:"runtime"`
+	Version int64            `json:"version"`
+	Lambdas []*RolloutResult `json:"lambdas"`
+}
+
+// RuntimeLambda is a lambda depending on the runtime.
+type RuntimeLambda struct {
+	Lambda  string `json:"lambda"`
+	Version int64  `json:"version"`
+	// Outdated is true if the lambda is pinned to a version older than the latest one
+	Outdated bool `json:"outdated"`
+}
@@ -0,0 +1,83 @@
+package model
+
+import (
+	"regexp"
+	"slices"
+
+	"github.com/onpremless/opless/manager/errs"
+)
+
+// Scopes of API tokens. A write scope grants reading the same resources and admin grants
+// everything, including tokens, backups and manifests.
+const (
+	ScopeLambdaRead    = "lambda:read"
+	ScopeLambdaWrite   = "lambda:write"
+	ScopeRuntimeRead   = "runtime:read"
+	ScopeRuntimeWrite  = "runtime:write"
+	ScopeEndpointRead  = "endpoint:read"
+	ScopeEndpointWrite = "endpoint:write"
+	ScopeUploadWrite   = "upload:write"
+	ScopeAdmin         = "admin"
+)
+
+var Scopes = []string{
+	ScopeLambdaRead, ScopeLambdaWrite,
+	ScopeRuntimeRead, ScopeRuntimeWrite,
+	ScopeEndpointRead, ScopeEndpointWrite,
+	ScopeUploadWrite,
+	ScopeAdmin,
+}
+
+// Token is an API token, the secret part of it is never stored or shown again after
+// the token is created.
+type Token struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is 0 for tokens which don't expire
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// StoredToken is the token along with the SHA-256 of its secret.
+type StoredToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+type CreateToken struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// TTL is the lifetime in seconds, the token doesn't expire if it's 0
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// CreatedToken carries the bearer token, it's responded once.
+type CreatedToken struct {
+	Token
+	Secret string `json:"token"`
+}
+
+var TokenNameRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]{1,64}$")
+
+func ValidateCreateToken(req *CreateToken) error {
+	if !TokenNameRegex.MatchString(req.Name) {
+		return errs.Field("name", "doesn't conform regex: %s", TokenNameRegex.String())
+	}
+
+	if len(req.Scopes) == 0 {
+		return errs.Field("scopes", "are required")
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			return errs.Field("scopes", "has unknown scope %s", scope)
+		}
+	}
+
+	if req.TTL < 0 {
+		return errs.Field("ttl", "must not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"regexp"
+
+	"github.com/onpremless/opless/manager/errs"
+)
+
+type Upload struct {
+	Id string `json:"id"`
+	// Size of the uploaded file in bytes
+	Size int64 `json:"size"`
+	// Checksum is '<algorithm>:<hex digest>' of the uploaded file,
+	// it's unknown for presigned uploads which don't pass through the manager
+	Checksum string `json:"checksum,omitempty"`
+	// Presigned upload is written directly to the storage by the client
+	Presigned bool  `json:"presigned,omitempty"`
+	CreatedAt int64 `json:"created_at"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+type PresignedUpload struct {
+	Id string `json:"id"`
+	// Url accepts the file with a multipart POST request until UrlExpiresAt, the form
+	// has the Fields followed by the 'file' field
+	Url          string            `json:"url"`
+	Fields       map[string]string `json:"fields"`
+	UrlExpiresAt int64             `json:"url_expires_at"`
+}
+
+// UploadSession collects an upload from sequential chunks, so an interrupted
+// transfer is resumed from Offset instead of being restarted.
+type UploadSession struct {
+	Id string `json:"id"`
+	// Size is the declared size of the whole file in bytes
+	Size int64 `json:"size"`
+	// Offset is the number of bytes received so far, the next chunk starts there
+	Offset    int64          `json:"offset"`
+	Chunks    []*UploadChunk `json:"chunks"`
+	CreatedAt int64          `json:"created_at"`
+	ExpiresAt int64          `json:"expires_at"`
+}
+
+type UploadChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Key    string `json:"key"`
+}
+
+type CreateUploadSession struct {
+	Size int64 `json:"size"`
+}
+
+type FinalizeUploadSession struct {
+	// Checksum is '<algorithm>:<hex digest>' of the whole file, only sha256 is supported
+	Checksum string `json:"checksum"`
+}
+
+var ChecksumRegex = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+func ValidateCreateUploadSession(req *CreateUploadSession) error {
+	if req.Size <= 0 {
+		return errs.Field("size", "must be positive")
+	}
+
+	return nil
+}
+
+func ValidateFinalizeUploadSession(req *FinalizeUploadSession) error {
+	if !ChecksumRegex.MatchString(req.Checksum) {
+		return errs.Field("checksum", "doesn't conform regex: %s", ChecksumRegex.String())
+	}
+
+	return nil
+}
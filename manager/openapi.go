@@ -0,0 +1,360 @@
+package main
+
+import (
+	"net/http"
+
+	api "github.com/onpremless/go-client"
+
+	"github.com/onpremless/opless/manager/dockerfile"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/openapi"
+	"github.com/onpremless/opless/manager/task"
+)
+
+var apiInfo = openapi.Info{Title: "OPless manager", Version: "1.0.0"}
+
+// Bodies the handlers respond with as gin.H.
+type runtimeVersionBody struct {
+	Version  *model.RuntimeVersion `json:"version"`
+	Findings []*dockerfile.Finding `json:"findings"`
+}
+
+type findingsBody struct {
+	Findings []*dockerfile.Finding `json:"findings"`
+}
+
+type restoreBody struct {
+	Restore *model.RestoreReport `json:"restore"`
+	// Task starts lambdas which were running, it's set if 'start' is requested
+	Task string `json:"task,omitempty"`
+}
+
+// Shorthands of common responses.
+func ok(body any) *openapi.Response {
+	return &openapi.Response{Status: http.StatusOK, Body: body}
+}
+
+func created(body any) *openapi.Response {
+	return &openapi.Response{Status: http.StatusCreated, Body: body}
+}
+
+func accepted() *openapi.Response {
+	return &openapi.Response{Status: http.StatusAccepted, Body: api.TaskResponse{}}
+}
+
+func noContent() *openapi.Response {
+	return &openapi.Response{Status: http.StatusNoContent}
+}
+
+func page(body any) *openapi.Response {
+	return &openapi.Response{Status: http.StatusOK, Body: body, Headers: []string{nextCursorHeader}}
+}
+
+func versioned(status int, body any) *openapi.Response {
+	return &openapi.Response{Status: status, Body: body, Headers: []string{"ETag"}}
+}
+
+var ifMatchParam = openapi.HeaderParam("If-Match", "version from the ETag the change requires")
+
+// operations describe every route of the manager, the contract test and the 'openapi'
+// command fail if they drift apart from the registered routes.
+var operations = []*openapi.Operation{
+	{
+		Method: http.MethodPost, Path: "/upload", Summary: "Upload a file",
+		Scope:       model.ScopeUploadWrite,
+		RequestType: openapi.Multipart, Responses: []*openapi.Response{created(model.Upload{})},
+		Errors: []int{http.StatusRequestEntityTooLarge},
+	},
+	{
+		Method: http.MethodPost, Path: "/upload/presign", Summary: "Get a URL to upload a file to the artifact storage",
+		Scope:     model.ScopeUploadWrite,
+		Responses: []*openapi.Response{created(model.PresignedUpload{})},
+		Errors:    []int{http.StatusNotImplemented},
+	},
+	{
+		Method: http.MethodGet, Path: "/upload/:id", Summary: "Get an upload",
+		Scope:     model.ScopeUploadWrite,
+		Responses: []*openapi.Response{ok(model.Upload{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/upload/:id/touch", Summary: "Extend the upload lifetime",
+		Scope:     model.ScopeUploadWrite,
+		Responses: []*openapi.Response{ok(model.Upload{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/upload/session", Summary: "Start a resumable upload",
+		Scope:   model.ScopeUploadWrite,
+		Request: model.CreateUploadSession{}, Responses: []*openapi.Response{created(model.UploadSession{})},
+		Errors: []int{http.StatusBadRequest},
+	},
+	{
+		Method: http.MethodGet, Path: "/upload/session/:id", Summary: "Get a resumable upload",
+		Scope:     model.ScopeUploadWrite,
+		Responses: []*openapi.Response{ok(model.UploadSession{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPut, Path: "/upload/session/:id", Summary: "Upload a chunk",
+		Scope:       model.ScopeUploadWrite,
+		Params:      []*openapi.Param{openapi.QueryParam("offset", "integer", "offset of the chunk")},
+		RequestType: openapi.Binary, Responses: []*openapi.Response{ok(model.UploadSession{})},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge},
+	},
+	{
+		Method: http.MethodPost, Path: "/upload/session/:id/finalize", Summary: "Finish a resumable upload",
+		Scope:   model.ScopeUploadWrite,
+		Request: model.FinalizeUploadSession{}, Responses: []*openapi.Response{created(model.Upload{})},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodDelete, Path: "/upload/session/:id", Summary: "Abort a resumable upload",
+		Scope:     model.ScopeUploadWrite,
+		Responses: []*openapi.Response{noContent()},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda", Summary: "List lambdas",
+		Scope:     model.ScopeLambdaRead,
+		Params:    openapi.Query(model.ListParams{}, model.LambdaFilter{}),
+		Responses: []*openapi.Response{page([]*api.Lambda{})},
+		Errors:    []int{http.StatusBadRequest},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda/:id", Summary: "Get a lambda",
+		Scope:     model.ScopeLambdaRead,
+		Responses: []*openapi.Response{versioned(http.StatusOK, api.Lambda{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda/:id/image", Summary: "Get the pre-built image of a lambda",
+		Scope:     model.ScopeLambdaRead,
+		Responses: []*openapi.Response{ok(model.LambdaImage{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda/:id/export", Summary: "Export a lambda bundle",
+		Scope:     model.ScopeLambdaRead,
+		Responses: []*openapi.Response{{Status: http.StatusOK, Type: openapi.Tar}},
+		Errors:    []int{http.StatusNotFound, http.StatusConflict},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda/:id/logs", Summary: "Get or follow logs of a running lambda",
+		Scope: model.ScopeLambdaRead,
+		Params: []*openapi.Param{
+			openapi.QueryParam("follow", "boolean", "stream new lines until the client disconnects"),
+			openapi.QueryParam("tail", "string", "number of last lines or 'all', 100 by default"),
+		},
+		Responses: []*openapi.Response{{Status: http.StatusOK, Type: openapi.Text}},
+		Errors:    []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda/:id/build", Summary: "Get the last build of a lambda",
+		Scope:     model.ScopeLambdaRead,
+		Responses: []*openapi.Response{ok(model.LambdaBuild{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/lambda/:id/build-params", Summary: "Get build params overrides of a lambda",
+		Scope:     model.ScopeLambdaRead,
+		Responses: []*openapi.Response{ok(model.BuildParams{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPut, Path: "/lambda/:id/build-params", Summary: "Replace build params overrides of a lambda",
+		Scope:   model.ScopeLambdaWrite,
+		Request: model.BuildParams{}, Responses: []*openapi.Response{ok(model.BuildParams{})},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+	},
+	{
+		Method: http.MethodPost, Path: "/lambda", Summary: "Create a lambda from an archive or a pre-built image",
+		Scope:     model.ScopeLambdaWrite,
+		Request:   openapi.AllOf(api.CreateLambda{}, model.BuildRequest{}, model.ImageRequest{}),
+		Responses: []*openapi.Response{versioned(http.StatusCreated, api.Lambda{})},
+		Errors:    []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	{
+		Method: http.MethodPost, Path: "/lambda/import", Summary: "Import a lambda bundle along with its endpoints",
+		Scope: model.ScopeAdmin,
+		Params: []*openapi.Param{
+			openapi.QueryParam("name", "string", "name replacing the exported one"),
+			openapi.QueryParam("on_conflict", "string", "fail or rename"),
+		},
+		RequestType: openapi.Tar, Responses: []*openapi.Response{versioned(http.StatusCreated, model.ImportResult{})},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	{
+		Method: http.MethodPost, Path: "/lambda/:id/start", Summary: "Build and start a lambda",
+		Scope:  model.ScopeLambdaWrite,
+		Params: []*openapi.Param{ifMatchParam}, Responses: []*openapi.Response{accepted()},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusPreconditionFailed},
+	},
+	{
+		Method: http.MethodPost, Path: "/lambda/:id/destroy", Summary: "Stop and remove the lambda container",
+		Scope:  model.ScopeLambdaWrite,
+		Params: []*openapi.Param{ifMatchParam}, Responses: []*openapi.Response{accepted()},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusPreconditionFailed},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime", Summary: "List runtimes",
+		Scope:     model.ScopeRuntimeRead,
+		Params:    openapi.Query(model.ListParams{}),
+		Responses: []*openapi.Response{page([]*api.Runtime{})},
+		Errors:    []int{http.StatusBadRequest},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime/:id", Summary: "Get a runtime",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{versioned(http.StatusOK, api.Runtime{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/catalog/runtime", Summary: "List builtin runtimes",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{ok([]*model.BuiltinRuntime{})},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime/:id/build-params", Summary: "Get build params of the latest runtime version",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{ok(model.BuildParams{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime/:id/version", Summary: "List runtime versions",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{ok([]*model.RuntimeVersion{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime/:id/version/:version", Summary: "Get a runtime version",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{ok(model.RuntimeVersion{})},
+		Errors:    []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/runtime/:id/version", Summary: "Add a runtime version",
+		Scope:   model.ScopeRuntimeWrite,
+		Request: model.CreateRuntimeVersion{}, Responses: []*openapi.Response{created(runtimeVersionBody{})},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime/:id/image", Summary: "List images built from a runtime",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{ok([]*model.RuntimeImage{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/runtime/:id/lambdas", Summary: "List lambdas depending on a runtime",
+		Scope:     model.ScopeRuntimeRead,
+		Responses: []*openapi.Response{ok([]*model.RuntimeLambda{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/runtime/:id/rollout", Summary: "Move lambdas to a runtime version",
+		Scope:   model.ScopeRuntimeWrite,
+		Request: model.Rollout{}, Responses: []*openapi.Response{accepted()},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/runtime", Summary: "Create a runtime",
+		Scope:     model.ScopeRuntimeWrite,
+		Request:   openapi.AllOf(api.CreateRuntime{}, model.BuildRequest{}),
+		Responses: []*openapi.Response{versioned(http.StatusCreated, openapi.AllOf(api.Runtime{}, findingsBody{}))},
+		Errors:    []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	{
+		Method: http.MethodGet, Path: "/endpoint", Summary: "List endpoints",
+		Scope:     model.ScopeEndpointRead,
+		Params:    openapi.Query(model.ListParams{}, model.EndpointFilter{}),
+		Responses: []*openapi.Response{page([]*api.Endpoint{})},
+		Errors:    []int{http.StatusBadRequest},
+	},
+	{
+		Method: http.MethodGet, Path: "/endpoint/:id", Summary: "Get an endpoint",
+		Scope:     model.ScopeEndpointRead,
+		Responses: []*openapi.Response{versioned(http.StatusOK, api.Endpoint{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/endpoint", Summary: "Create an endpoint",
+		Scope:   model.ScopeEndpointWrite,
+		Request: api.CreateEndpoint{}, Responses: []*openapi.Response{versioned(http.StatusCreated, api.Endpoint{})},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	{
+		Method: http.MethodPut, Path: "/endpoint/:id", Summary: "Replace an endpoint",
+		Scope:  model.ScopeEndpointWrite,
+		Params: []*openapi.Param{ifMatchParam}, Request: api.CreateEndpoint{},
+		Responses: []*openapi.Response{versioned(http.StatusOK, api.Endpoint{})},
+		Errors:    []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed},
+	},
+	{
+		Method: http.MethodDelete, Path: "/endpoint/:id", Summary: "Delete an endpoint",
+		Scope:  model.ScopeEndpointWrite,
+		Params: []*openapi.Param{ifMatchParam}, Responses: []*openapi.Response{noContent()},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusPreconditionFailed},
+	},
+	{
+		Method: http.MethodPost, Path: "/apply", Summary: "Apply a manifest",
+		Scope: model.ScopeAdmin,
+		Params: []*openapi.Param{
+			openapi.QueryParam("dry_run", "boolean", "only plan the changes"),
+			openapi.QueryParam("prune", "boolean", "delete resources removed from the manifest"),
+			openapi.QueryParam("adopt", "boolean", "take over existing resources no manifest owns"),
+		},
+		Request: model.Manifest{}, RequestType: openapi.YAML, Responses: []*openapi.Response{ok(model.Plan{})},
+		Errors: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge},
+	},
+	{
+		Method: http.MethodGet, Path: "/backup", Summary: "Download a backup archive",
+		Scope:     model.ScopeAdmin,
+		Responses: []*openapi.Response{{Status: http.StatusOK, Type: openapi.Gzip}},
+	},
+	{
+		Method: http.MethodPost, Path: "/restore", Summary: "Restore a backup archive into an empty installation",
+		Scope:       model.ScopeAdmin,
+		Params:      []*openapi.Param{openapi.QueryParam("start", "boolean", "start lambdas which were running")},
+		RequestType: openapi.Gzip,
+		Responses: []*openapi.Response{
+			ok(restoreBody{}),
+			{Status: http.StatusAccepted, Body: restoreBody{}},
+		},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	{
+		Method: http.MethodGet, Path: "/token", Summary: "List API tokens",
+		Scope:     model.ScopeAdmin,
+		Params:    openapi.Query(model.ListParams{}),
+		Responses: []*openapi.Response{page([]*model.Token{})},
+		Errors:    []int{http.StatusBadRequest},
+	},
+	{
+		Method: http.MethodPost, Path: "/token", Summary: "Create an API token, the token is responded only once",
+		Scope:   model.ScopeAdmin,
+		Request: model.CreateToken{}, Responses: []*openapi.Response{created(model.CreatedToken{})},
+		Errors: []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	{
+		Method: http.MethodDelete, Path: "/token/:id", Summary: "Revoke an API token",
+		Scope:     model.ScopeAdmin,
+		Responses: []*openapi.Response{noContent()},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/task/:id", Summary: "Get a task status",
+		ScopedBy:  "the read scope of the resources the task changes, 'admin' for restores",
+		Responses: []*openapi.Response{ok(task.PreparedStatus{})},
+		Errors:    []int{http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/openapi.json", Summary: "Get this document",
+		Public:    true,
+		Responses: []*openapi.Response{ok(map[string]any{})},
+	},
+	{
+		Method: http.MethodGet, Path: "/docs", Summary: "Browse this document",
+		Public:    true,
+		Responses: []*openapi.Response{{Status: http.StatusOK, Type: openapi.HTML}},
+	},
+}
@@ -0,0 +1,8 @@
+package openapi
+
+import _ "embed"
+
+// DocsPage renders the document served next to it as openapi.json.
+//
+//go:embed docs.html
+var DocsPage []byte
@@ -0,0 +1,328 @@
+// Package openapi describes the manager API as an OpenAPI 3 document. Operations are
+// declared along with the routes, payload schemas are generated from the Go types the
+// handlers bind and respond with, and Check keeps declared operations and registered
+// routes in sync.
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/onpremless/opless/manager/errs"
+)
+
+// Content types of payloads which are not JSON.
+const (
+	JSON      = "application/json"
+	Multipart = "multipart/form-data"
+	Binary    = "application/octet-stream"
+	Tar       = "application/x-tar"
+	Gzip      = "application/gzip"
+	YAML      = "application/yaml"
+	Text      = "text/plain"
+	HTML      = "text/html"
+)
+
+// Operation describes a single route.
+type Operation struct {
+	Method  string
+	Path    string
+	Summary string
+	// Params are query and header params, path params are taken from the path
+	Params []*Param
+	// Request is a value of the request body type, it's sent as RequestType, JSON by default
+	Request     any
+	RequestType string
+	Responses   []*Response
+	// Errors are statuses responded with the error body, besides the ones any operation may fail with
+	Errors []int
+	// Scope is the one the bearer token has to grant, unless the operation is Public
+	Scope  string
+	Public bool
+	// ScopedBy describes what decides the scope if it depends on the resource, the handler
+	// checks it instead of Scope
+	ScopedBy string
+}
+
+type Param struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type Response struct {
+	Status int
+	// Body is a value of the response body type, no body is sent if it's nil and Type is empty
+	Body any
+	// Type is the content type, JSON by default
+	Type    string
+	Headers []string
+}
+
+// allOf is a body combining fields of several types, like the lambda creation request.
+type allOf []any
+
+// AllOf combines fields of the types into a single body.
+func AllOf(values ...any) any {
+	return allOf(values)
+}
+
+// Query returns query params bound from the 'form' tags of the structs.
+func Query(values ...any) []*Param {
+	s := newSchemas()
+	params := []*Param{}
+	for _, v := range values {
+		t := reflect.TypeOf(v)
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("form"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+
+			params = append(params, &Param{Name: name, In: "query", Schema: s.typeOf(t.Field(i).Type)})
+		}
+	}
+
+	return params
+}
+
+// QueryParam is a single query param of the type, like 'string' or 'boolean'.
+func QueryParam(name string, typ string, description string) *Param {
+	return &Param{Name: name, In: "query", Description: description, Schema: &Schema{Type: typ}}
+}
+
+// HeaderParam is an optional string request header.
+func HeaderParam(name string, description string) *Param {
+	return &Param{Name: name, In: "header", Description: description, Schema: &Schema{Type: "string"}}
+}
+
+// Document is the OpenAPI 3 document.
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components components                       `json:"components"`
+	Security   []map[string][]string            `json:"security"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*securityScheme `json:"securitySchemes"`
+}
+
+type securityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+// bearerAuth is the name of the scheme API tokens are sent with.
+const bearerAuth = "bearerAuth"
+
+type operation struct {
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	OperationID string               `json:"operationId"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Param             `json:"parameters,omitempty"`
+	RequestBody *body                `json:"requestBody,omitempty"`
+	Responses   map[string]*response `json:"responses"`
+	// Security is empty for public operations, others require the token the document does
+	Security *[]map[string][]string `json:"security,omitempty"`
+}
+
+type body struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*mediaType `json:"content"`
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type response struct {
+	Description string                `json:"description"`
+	Headers     map[string]*header    `json:"headers,omitempty"`
+	Content     map[string]*mediaType `json:"content,omitempty"`
+}
+
+type header struct {
+	Schema *Schema `json:"schema"`
+}
+
+// commonErrors are the statuses any operation may respond with, when it fails unexpectedly
+// or a service it depends on, like the store or Docker, is unreachable.
+var commonErrors = []int{http.StatusInternalServerError, http.StatusServiceUnavailable}
+
+// authErrors are the statuses of operations requiring a token.
+var authErrors = []int{http.StatusUnauthorized, http.StatusForbidden}
+
+var pathParam = regexp.MustCompile(`:([^/]+)`)
+
+// Build generates the document of the operations.
+func Build(info Info, ops []*Operation) *Document {
+	s := newSchemas()
+	doc := &Document{
+		OpenAPI:  "3.0.3",
+		Info:     info,
+		Paths:    map[string]map[string]*operation{},
+		Security: []map[string][]string{{bearerAuth: {}}},
+	}
+
+	errorRef := s.of(errs.Body{})
+	for _, op := range ops {
+		path := pathParam.ReplaceAllString(op.Path, "{$1}")
+		o := &operation{
+			Summary:     op.Summary,
+			OperationID: operationID(op),
+			Tags:        []string{strings.Split(strings.TrimPrefix(op.Path, "/"), "/")[0]},
+			Responses:   map[string]*response{},
+		}
+
+		statuses := append(op.Errors, commonErrors...)
+		if op.Public {
+			o.Security = &[]map[string][]string{}
+		} else if op.ScopedBy != "" {
+			o.Description = "Requires " + op.ScopedBy + "."
+			statuses = append(statuses, authErrors...)
+		} else {
+			o.Description = "Requires the '" + op.Scope + "' scope."
+			statuses = append(statuses, authErrors...)
+		}
+
+		for _, match := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+			o.Parameters = append(o.Parameters, &Param{Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+		o.Parameters = append(o.Parameters, op.Params...)
+
+		if op.Request != nil || op.RequestType != "" {
+			o.RequestBody = &body{Required: true, Content: content(s, op.Request, op.RequestType)}
+		}
+
+		for _, res := range op.Responses {
+			r := &response{Description: http.StatusText(res.Status)}
+			if res.Body != nil || res.Type != "" {
+				r.Content = content(s, res.Body, res.Type)
+			}
+
+			for _, name := range res.Headers {
+				if r.Headers == nil {
+					r.Headers = map[string]*header{}
+				}
+
+				r.Headers[name] = &header{Schema: &Schema{Type: "string"}}
+			}
+
+			o.Responses[fmt.Sprint(res.Status)] = r
+		}
+
+		for _, status := range statuses {
+			o.Responses[fmt.Sprint(status)] = &response{
+				Description: http.StatusText(status),
+				Content:     map[string]*mediaType{JSON: {Schema: errorRef}},
+			}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*operation{}
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = o
+	}
+
+	doc.Components.Schemas = s.components
+	doc.Components.SecuritySchemes = map[string]*securityScheme{bearerAuth: {Type: "http", Scheme: "bearer"}}
+
+	return doc
+}
+
+// content describes the body, non-JSON bodies without a type are binary strings.
+func content(s *schemas, v any, typ string) map[string]*mediaType {
+	if typ == "" {
+		typ = JSON
+	}
+
+	schema := &Schema{Type: "string", Format: "binary"}
+	switch {
+	case v != nil:
+		schema = s.of(v)
+	case typ == Text || typ == HTML:
+		schema = &Schema{Type: "string"}
+	}
+
+	return map[string]*mediaType{typ: {Schema: schema}}
+}
+
+// operationID is the method followed by the path segments, like 'getLambdaIdBuild'.
+func operationID(op *Operation) string {
+	id := strings.ToLower(op.Method)
+	for _, segment := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '-' || r == '.' || r == ':' }) {
+		id += strings.ToUpper(segment[:1]) + segment[1:]
+	}
+
+	return id
+}
+
+// Check reports routes which are not described by the operations and operations which
+// have no route, so the document can't drift apart from the handlers.
+func Check(ops []*Operation, routes gin.RoutesInfo) error {
+	described := map[string]bool{}
+	for _, op := range ops {
+		key := op.Method + " " + op.Path
+		if described[key] {
+			return fmt.Errorf("operation %s is described twice", key)
+		}
+		described[key] = true
+
+		// Otherwise the route would be left open by a forgotten scope
+		decided := 0
+		for _, set := range []bool{op.Public, op.Scope != "", op.ScopedBy != ""} {
+			if set {
+				decided++
+			}
+		}
+
+		if decided != 1 {
+			return fmt.Errorf("operation %s has to be either public, require a scope or be scoped by its handler", key)
+		}
+	}
+
+	var problems []string
+	registered := map[string]bool{}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		if !described[key] {
+			problems = append(problems, "route "+key+" is not described")
+		}
+	}
+
+	for key := range described {
+		if !registered[key] {
+			problems = append(problems, "operation "+key+" has no route")
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	return errors.New("openapi document drifted from routes: " + strings.Join(problems, "; "))
+}
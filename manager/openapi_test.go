@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/onpremless/opless/manager/openapi"
+)
+
+// TestOpenAPIContract keeps the OpenAPI operations in line with the registered routes.
+// Handlers aren't called, so the router is built with stub services.
+func TestOpenAPIContract(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := newRouter(&Services{})
+	if err := openapi.Check(operations, r.Routes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var pathParam = regexp.MustCompile(`:([^/]+)`)
+
+// TestOpenAPIPayloads round-trips a sample of every JSON body type through its generated
+// schema, so the schemas can't drift from what encoding/json makes of the types.
+func TestOpenAPIPayloads(t *testing.T) {
+	doc := openapi.Build(openapi.Info{}, operations)
+
+	for _, op := range operations {
+		o := doc.Paths[pathParam.ReplaceAllString(op.Path, "{$1}")][strings.ToLower(op.Method)]
+		if typ, ok := jsonType(op.RequestType); ok && op.Request != nil {
+			name := fmt.Sprintf("%s %s request", op.Method, op.Path)
+			roundTrip(t, doc.Components.Schemas, name, op.Request, o.RequestBody.Content[typ].Schema)
+		}
+
+		for _, res := range op.Responses {
+			if typ, ok := jsonType(res.Type); ok && res.Body != nil {
+				name := fmt.Sprintf("%s %s %d response", op.Method, op.Path, res.Status)
+				roundTrip(t, doc.Components.Schemas, name, res.Body, o.Responses[fmt.Sprint(res.Status)].Content[typ].Schema)
+			}
+		}
+	}
+}
+
+// jsonType returns the content type of bodies decoded as JSON, YAML manifests are converted
+// to JSON before they're decoded.
+func jsonType(typ string) (string, bool) {
+	switch typ {
+	case "":
+		return openapi.JSON, true
+	case openapi.JSON, openapi.YAML:
+		return typ, true
+	default:
+		return "", false
+	}
+}
+
+func roundTrip(t *testing.T, schemas map[string]*openapi.Schema, name string, v any, schema *openapi.Schema) {
+	// Parts of combined bodies are checked against their own schemas
+	if len(schema.AllOf) > 0 {
+		parts := reflect.ValueOf(v)
+		for i, part := range schema.AllOf {
+			roundTrip(t, schemas, name, parts.Index(i).Interface(), part)
+		}
+
+		return
+	}
+
+	typ := reflect.TypeOf(v)
+	value := sample(typ, 0)
+	raw, err := json.Marshal(value.Interface())
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+
+	var decoded any
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+
+	if err := validate(schemas, schema, decoded, typ.String()); err != nil {
+		t.Errorf("%s: %v in %s", name, err, raw)
+	}
+
+	back := reflect.New(typ)
+	if err := json.Unmarshal(raw, back.Interface()); err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+
+	if !reflect.DeepEqual(back.Elem().Interface(), value.Interface()) {
+		t.Errorf("%s: %s doesn't decode to the value it's encoded from", name, raw)
+	}
+}
+
+var rawMessage = reflect.TypeOf(json.RawMessage{})
+
+// sample returns a value of the type with every field set, so none is omitted when it's
+// encoded. Recursive types stop at a few levels.
+func sample(t reflect.Type, depth int) reflect.Value {
+	v := reflect.New(t).Elem()
+	if depth > 4 {
+		return v
+	}
+
+	switch {
+	case t == rawMessage:
+		v.Set(reflect.ValueOf(json.RawMessage(`{}`)))
+		return v
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte("x"))
+		return v
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		v.Set(sample(t.Elem(), depth+1).Addr())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				v.Field(i).Set(sample(t.Field(i).Type, depth+1))
+			}
+		}
+	case reflect.Slice:
+		v.Set(reflect.Append(reflect.MakeSlice(t, 0, 1), sample(t.Elem(), depth+1)))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		v.SetMapIndex(sample(t.Key(), depth+1), sample(t.Elem(), depth+1))
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	}
+
+	return v
+}
+
+// validate checks the decoded JSON value against the schema, properties missing from the
+// schema are reported as well. Nulls are left by interfaces and cut recursion.
+func validate(schemas map[string]*openapi.Schema, schema *openapi.Schema, v any, at string) error {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		if schema = schemas[name]; schema == nil {
+			return fmt.Errorf("%s refers to missing schema %s", at, name)
+		}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	ok := true
+	switch schema.Type {
+	case "object":
+		obj, isObj := v.(map[string]any)
+		if !isObj {
+			ok = false
+			break
+		}
+
+		for _, name := range schema.Required {
+			if _, present := obj[name]; !present {
+				return fmt.Errorf("%s.%s is required but missing", at, name)
+			}
+		}
+
+		for name, field := range obj {
+			prop := schema.Properties[name]
+			if prop == nil {
+				prop = schema.AdditionalProperties
+			}
+
+			if prop == nil {
+				return fmt.Errorf("%s.%s is not in the schema", at, name)
+			}
+
+			if err := validate(schemas, prop, field, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, isArray := v.([]any)
+		if !isArray {
+			ok = false
+			break
+		}
+
+		for i, item := range items {
+			if err := validate(schemas, schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		_, ok = v.(string)
+	case "boolean":
+		_, ok = v.(bool)
+	case "number":
+		_, ok = v.(float64)
+	case "integer":
+		n, isNum := v.(float64)
+		ok = isNum && n == math.Trunc(n)
+	}
+
+	if !ok {
+		return fmt.Errorf("%s is %T, the schema type is %s", at, v, schema.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/model"
+)
+
+const nextCursorHeader = "X-Next-Cursor"
+
+func bindListQuery(c *gin.Context, params *model.ListParams, filters ...interface{}) error {
+	if err := c.ShouldBindQuery(params); err != nil {
+		return err
+	}
+
+	if err := model.ValidateListParams(params); err != nil {
+		return err
+	}
+
+	for _, filter := range filters {
+		if err := c.ShouldBindQuery(filter); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writePage keeps list responses plain arrays, the cursor of the next page is passed in a header.
+func writePage[T any](c *gin.Context, page *db.Page[T]) {
+	if page.Next != "" {
+		c.Header(nextCursorHeader, page.Next)
+	}
+
+	c.JSON(http.StatusOK, page.Items)
+}
@@ -0,0 +1,25 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/logger"
+)
+
+var Client db.Store
+var OPlessID = ""
+
+func Init() error {
+	var err error
+	Client, err = db.Open(logger.L)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+
+	OPlessID, err = Client.Meta(context.Background(), "opless-id", util.UUID())
+
+	return err
+}
@@ -9,29 +9,37 @@ import (
 type service struct {
 	lock     *sync.RWMutex
 	statuses map[string]Status
+	scopes   map[string]string
 	cleanup  map[string]func()
 }
 
 type TaskService interface {
-	Add(id string)
+	// Add registers the pending task, its status is read with the scope, which depends on
+	// the kind of the task, like runtime:read for rollouts.
+	Add(id string, scope string)
 	Failed(id string, details interface{})
 	Succeeded(id string, details interface{})
 	Get(id string) Status
+	// Scope returns the scope the status of the task is read with, an empty string is
+	// returned if there is no such task.
+	Scope(id string) string
 }
 
 func CreateTaskService() TaskService {
 	return &service{
 		lock:     &sync.RWMutex{},
 		statuses: map[string]Status{},
+		scopes:   map[string]string{},
 		cleanup:  map[string]func(){},
 	}
 }
 
-func (s *service) Add(id string) {
+func (s *service) Add(id string, scope string) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	s.statuses[id] = Pending{StartedAt_: time.Now().UnixMicro()}
+	s.scopes[id] = scope
 }
 
 func (s *service) Failed(id string, details interface{}) {
@@ -78,6 +86,13 @@ func (s *service) Get(id string) Status {
 	return status
 }
 
+func (s *service) Scope(id string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.scopes[id]
+}
+
 func (s *service) poke(id string) {
 	cancel := s.cleanup[id]
 	if cancel != nil {
@@ -94,6 +109,7 @@ func (s *service) poke(id string) {
 
 			delete(s.cleanup, id)
 			delete(s.statuses, id)
+			delete(s.scopes, id)
 		case <-ctx.Done():
 			return
 		}
@@ -1,5 +1,7 @@
 package task
 
+import "github.com/onpremless/opless/manager/errs"
+
 const (
 	PENDING  = "PENDING"
 	SUCCEDED = "SUCCEDED"
@@ -77,3 +79,15 @@ func PrepareStatus(status Status) *PreparedStatus {
 
 	return nil
 }
+
+// ErrorDetails are the details of a task failed with an error, the code is the same error
+// responses of the API carry.
+type ErrorDetails struct {
+	Error string    `json:"error"`
+	Code  errs.Kind `json:"code"`
+}
+
+// ErrorOf returns the details of the task failed with the error.
+func ErrorOf(err error) ErrorDetails {
+	return ErrorDetails{Error: err.Error(), Code: errs.KindOf(err)}
+}
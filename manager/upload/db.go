@@ -0,0 +1,105 @@
+package upload
+
+import (
+	"context"
+	"time"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/manager/model"
+	"github.com/onpremless/opless/manager/store"
+)
+
+var uploadSchema = &db.Schema[model.Upload]{
+	Prefix: "upload",
+	ID:     func(x *model.Upload) string { return x.Id },
+	Sort: map[string]db.SortKey[model.Upload]{
+		"expires_at": func(x *model.Upload) string { return db.NumKey(x.ExpiresAt) },
+	},
+}
+
+var sessionSchema = &db.Schema[model.UploadSession]{
+	Prefix: "upload-session",
+	ID:     func(x *model.UploadSession) string { return x.Id },
+	Sort: map[string]db.SortKey[model.UploadSession]{
+		"expires_at": func(x *model.UploadSession) string { return db.NumKey(x.ExpiresAt) },
+	},
+}
+
+// Assembling an upload can take a while, lock expires only if a manager has gone.
+const sessionLockTTL = 10 * time.Minute
+
+// LockSession serializes finalization and removal of the upload session across managers.
+func LockSession(ctx context.Context, id string) (func(), error) {
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return store.Client.Lock(lctx, "upload-session:"+id, sessionLockTTL)
+}
+
+func Reindex(ctx context.Context) error {
+	if err := db.Reindex(ctx, uploadSchema)(store.Client); err != nil {
+		return err
+	}
+
+	return db.Reindex(ctx, sessionSchema)(store.Client)
+}
+
+func GetUpload(ctx context.Context, id string) (*model.Upload, error) {
+	return db.GetValue[model.Upload](ctx, "upload", id)(store.Client)
+}
+
+func CreateUpload(ctx context.Context, upload *model.Upload) error {
+	return db.CreateIndexedValue(ctx, uploadSchema, upload)(store.Client)
+}
+
+func ModifyUpload(ctx context.Context, id string, mutate func(upload *model.Upload) error) (*model.Upload, error) {
+	upload, _, err := db.ModifyIndexedValue(ctx, uploadSchema, id, mutate)(store.Client)
+	return upload, err
+}
+
+func DelUpload(ctx context.Context, id string) error {
+	return db.DelIndexedValue(ctx, uploadSchema, id)(store.Client)
+}
+
+// ListExpiring returns uploads which expire first.
+func ListExpiring(ctx context.Context, limit int) ([]*model.Upload, error) {
+	page, err := db.ListValues(ctx, uploadSchema, &db.Query[model.Upload]{
+		SortBy: "expires_at",
+		Limit:  limit,
+	})(store.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Items, nil
+}
+
+func GetSession(ctx context.Context, id string) (*model.UploadSession, error) {
+	return db.GetValue[model.UploadSession](ctx, "upload-session", id)(store.Client)
+}
+
+func CreateSession(ctx context.Context, session *model.UploadSession) error {
+	return db.CreateIndexedValue(ctx, sessionSchema, session)(store.Client)
+}
+
+func ModifySession(ctx context.Context, id string, mutate func(session *model.UploadSession) error) (*model.UploadSession, error) {
+	session, _, err := db.ModifyIndexedValue(ctx, sessionSchema, id, mutate)(store.Client)
+	return session, err
+}
+
+func DelSession(ctx context.Context, id string) error {
+	return db.DelIndexedValue(ctx, sessionSchema, id)(store.Client)
+}
+
+// ListExpiringSessions returns upload sessions which expire first.
+func ListExpiringSessions(ctx context.Context, limit int) ([]*model.UploadSession, error) {
+	page, err := db.ListValues(ctx, sessionSchema, &db.Query[model.UploadSession]{
+		SortBy: "expires_at",
+		Limit:  limit,
+	})(store.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Items, nil
+}
@@ -0,0 +1,362 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+)
+
+const (
+	sweepInterval = time.Minute
+	sweepBatch    = 100
+
+	// presignExpiry is capped by TMP_TTL, the upload is removed once it expires anyway
+	presignExpiry = 15 * time.Minute
+)
+
+var errExpired = errors.New("upload is expired")
+var ErrUploadTooLarge = errors.New("upload exceeds the maximum size")
+var ErrPresignUnsupported = errors.New("artifact store doesn't support presigned uploads")
+
+type UploadService interface {
+	Upload(ctx context.Context, file io.Reader) (*model.Upload, error)
+	// Presign reserves an upload id the file can be uploaded with directly to the artifact
+	// store, which rejects files larger than the upload limit.
+	Presign(ctx context.Context) (*model.PresignedUpload, error)
+	// Get returns nil if the upload doesn't exist or is expired.
+	Get(ctx context.Context, id string) (*model.Upload, error)
+	// Touch postpones upload expiration by TTL, it returns nil if the upload doesn't exist or is expired.
+	Touch(ctx context.Context, id string) (*model.Upload, error)
+
+	CreateSession(ctx context.Context, req *model.CreateUploadSession) (*model.UploadSession, error)
+	// GetSession returns nil if the session doesn't exist or is expired.
+	GetSession(ctx context.Context, id string) (*model.UploadSession, error)
+	// PutChunk appends the chunk starting at offset, which has to be equal to the session offset.
+	// It returns nil if the session doesn't exist or is expired.
+	PutChunk(ctx context.Context, id string, offset int64, r io.Reader) (*model.UploadSession, error)
+	// FinalizeSession assembles received chunks into an upload with the same id,
+	// it returns nil if the session doesn't exist or is expired.
+	FinalizeSession(ctx context.Context, id string, req *model.FinalizeUploadSession) (*model.Upload, error)
+	AbortSession(ctx context.Context, id string) (bool, error)
+	Stop()
+}
+
+type service struct {
+	ttl time.Duration
+	// maxSize caps uploads and sessions, maxChunks caps chunks of a session, so its record
+	// stays small
+	maxSize   int64
+	maxChunks int
+	stop      func()
+	// done is closed once the sweeper has stopped
+	done chan struct{}
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func CreateUploadService() UploadService {
+	ctx, stop := context.WithCancel(context.Background())
+	s := &service{
+		ttl:       time.Duration(cutil.GetIntVar("TMP_TTL")) * time.Second,
+		maxSize:   int64(cutil.GetIntVarDefault("UPLOAD_MAX_SIZE", 1<<30)),
+		maxChunks: cutil.GetIntVarDefault("UPLOAD_MAX_CHUNKS", 1024),
+		stop:      stop,
+		done:      make(chan struct{}),
+	}
+
+	go s.sweepRoutine(ctx)
+
+	return s
+}
+
+// Stop waits for the sweeper to finish, so the store can be closed right after.
+func (s *service) Stop() {
+	s.stop()
+	<-s.done
+}
+
+func (s *service) Upload(ctx context.Context, file io.Reader) (*model.Upload, error) {
+	id := cutil.UUID()
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	file = io.LimitReader(file, s.maxSize+1)
+	err := artifact.Client.Put(ctx, artifact.TmpBucket, id, io.TeeReader(file, io.MultiWriter(hash, counter)), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if counter.n > s.maxSize {
+		s.removeObject(id)
+		return nil, fmt.Errorf("%w of %d bytes", ErrUploadTooLarge, s.maxSize)
+	}
+
+	now := time.Now()
+	upload := &model.Upload{
+		Id:        id,
+		Size:      counter.n,
+		Checksum:  "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt: now.UnixMilli(),
+		ExpiresAt: now.Add(s.ttl).UnixMilli(),
+	}
+
+	if err := CreateUpload(ctx, upload); err != nil {
+		artifact.Client.Remove(context.Background(), artifact.TmpBucket, id)
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (s *service) Presign(ctx context.Context) (*model.PresignedUpload, error) {
+	presigner, ok := artifact.Client.(artifact.Presigner)
+	if !ok {
+		return nil, ErrPresignUnsupported
+	}
+
+	expiry := presignExpiry
+	if s.ttl < expiry {
+		expiry = s.ttl
+	}
+
+	now := time.Now()
+	upload := &model.Upload{
+		Id:        cutil.UUID(),
+		Presigned: true,
+		CreatedAt: now.UnixMilli(),
+		ExpiresAt: now.Add(s.ttl).UnixMilli(),
+	}
+
+	url, fields, err := presigner.PresignPost(ctx, artifact.TmpBucket, upload.Id, s.maxSize, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CreateUpload(ctx, upload); err != nil {
+		return nil, err
+	}
+
+	return &model.PresignedUpload{
+		Id:           upload.Id,
+		Url:          url,
+		Fields:       fields,
+		UrlExpiresAt: now.Add(expiry).UnixMilli(),
+	}, nil
+}
+
+func (s *service) Get(ctx context.Context, id string) (*model.Upload, error) {
+	upload, err := GetUpload(ctx, id)
+	if err != nil || upload == nil {
+		return nil, err
+	}
+
+	if upload.ExpiresAt <= time.Now().UnixMilli() {
+		return nil, nil
+	}
+
+	// Size of a presigned upload is zero until the client puts the file
+	if upload.Presigned {
+		obj, err := artifact.Client.Stat(ctx, artifact.TmpBucket, upload.Id)
+		if err != nil && !errors.Is(err, artifact.ErrNotFound) {
+			return nil, err
+		}
+
+		if obj != nil {
+			upload.Size = obj.Size
+		}
+	}
+
+	return upload, nil
+}
+
+func (s *service) Touch(ctx context.Context, id string) (*model.Upload, error) {
+	upload, err := ModifyUpload(ctx, id, func(upload *model.Upload) error {
+		now := time.Now()
+		// Sweeper might be removing it already
+		if upload.ExpiresAt <= now.UnixMilli() {
+			return errExpired
+		}
+
+		upload.ExpiresAt = now.Add(s.ttl).UnixMilli()
+		return nil
+	})
+
+	if errors.Is(err, errExpired) {
+		return nil, nil
+	}
+
+	return upload, err
+}
+
+func (s *service) sweepRoutine(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		s.sweep(ctx)
+
+		select {
+		case <-time.After(sweepInterval):
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *service) sweep(ctx context.Context) {
+	now := time.Now()
+
+	for {
+		uploads, err := ListExpiring(ctx, sweepBatch)
+		if err != nil {
+			logger.L.Error("Failed to list expiring uploads", zap.Error(err))
+			return
+		}
+
+		failed := false
+		expired := 0
+		for _, upload := range uploads {
+			if upload.ExpiresAt > now.UnixMilli() {
+				break
+			}
+
+			expired++
+			if err := s.remove(ctx, upload.Id); err != nil {
+				logger.L.Error(
+					"Failed to remove expired upload",
+					zap.Error(err),
+					zap.String("id", upload.Id),
+				)
+				failed = true
+			}
+		}
+
+		// Failed uploads would be listed again, so give up until the next sweep
+		if failed || expired < sweepBatch {
+			break
+		}
+	}
+
+	s.sweepSessions(ctx, now)
+	s.sweepOrphans(ctx, now)
+}
+
+func (s *service) sweepSessions(ctx context.Context, now time.Time) {
+	for {
+		sessions, err := ListExpiringSessions(ctx, sweepBatch)
+		if err != nil {
+			logger.L.Error("Failed to list expiring upload sessions", zap.Error(err))
+			return
+		}
+
+		failed := false
+		expired := 0
+		for _, session := range sessions {
+			if session.ExpiresAt > now.UnixMilli() {
+				break
+			}
+
+			expired++
+			if err := s.removeExpiredSession(ctx, session.Id); err != nil {
+				logger.L.Error(
+					"Failed to remove expired upload session",
+					zap.Error(err),
+					zap.String("id", session.Id),
+				)
+				failed = true
+			}
+		}
+
+		if failed || expired < sweepBatch {
+			break
+		}
+	}
+}
+
+func (s *service) removeExpiredSession(ctx context.Context, id string) error {
+	// Session which is being finalized is removed by the next sweep if it's still there
+	unlock, err := LockSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	session, err := GetSession(ctx, id)
+	if err != nil || session == nil {
+		return err
+	}
+
+	return s.removeSession(ctx, session)
+}
+
+func (s *service) remove(ctx context.Context, id string) error {
+	if err := artifact.Client.Remove(ctx, artifact.TmpBucket, id); err != nil {
+		return err
+	}
+
+	return DelUpload(ctx, id)
+}
+
+// sweepOrphans removes tmp objects without an upload or session record, e.g. ones uploaded
+// before records were introduced or left by a crashed manager.
+func (s *service) sweepOrphans(ctx context.Context, now time.Time) {
+	orphans := []string{}
+
+	err := artifact.Client.Walk(ctx, artifact.TmpBucket, "", func(obj *artifact.Object) error {
+		if obj.ModTime.Add(s.ttl).After(now) {
+			return nil
+		}
+
+		id := owner(obj.Key)
+
+		upload, err := GetUpload(ctx, id)
+		if err != nil || upload != nil {
+			return err
+		}
+
+		session, err := GetSession(ctx, id)
+		if err != nil || session != nil {
+			return err
+		}
+
+		orphans = append(orphans, obj.Key)
+		return nil
+	})
+
+	// Sweeper is stopped meanwhile
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if err != nil {
+		logger.L.Error("Failed to walk tmp uploads", zap.Error(err))
+	}
+
+	for _, key := range orphans {
+		if err := artifact.Client.Remove(ctx, artifact.TmpBucket, key); err != nil {
+			logger.L.Error(
+				"Failed to remove orphan upload",
+				zap.Error(err),
+				zap.String("key", key),
+			)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	cutil "github.com/onpremless/opless/common/util"
+	"github.com/onpremless/opless/manager/artifact"
+	"github.com/onpremless/opless/manager/errs"
+	"github.com/onpremless/opless/manager/logger"
+	"github.com/onpremless/opless/manager/model"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+var ErrIncomplete = errors.New("upload session is incomplete")
+var ErrTooLarge = errors.New("chunk exceeds declared upload size")
+var ErrTooManyChunks = errors.New("upload session has too many chunks")
+var ErrOffsetMismatch = errors.New("chunk offset mismatch")
+
+type OffsetError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("chunk offset %d is expected, got %d", e.Expected, e.Actual)
+}
+
+func (e *OffsetError) Unwrap() error {
+	return ErrOffsetMismatch
+}
+
+const chunksDir = "chunks/"
+
+// Chunks of the session are kept in the tmp bucket under 'chunks/<session id>/' prefix,
+// the assembled file is stored under the session id itself.
+func chunkPrefix(id string) string {
+	return chunksDir + id + "/"
+}
+
+// owner returns id of the upload or session the tmp object belongs to.
+func owner(key string) string {
+	id, _, _ := strings.Cut(strings.TrimPrefix(key, chunksDir), "/")
+	return id
+}
+
+func (s *service) CreateSession(ctx context.Context, req *model.CreateUploadSession) (*model.UploadSession, error) {
+	if req.Size > s.maxSize {
+		return nil, errs.Field("size", "must not exceed %d bytes", s.maxSize)
+	}
+
+	now := time.Now()
+	session := &model.UploadSession{
+		Id:        cutil.UUID(),
+		Size:      req.Size,
+		Chunks:    []*model.UploadChunk{},
+		CreatedAt: now.UnixMilli(),
+		ExpiresAt: now.Add(s.ttl).UnixMilli(),
+	}
+
+	if err := CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (s *service) GetSession(ctx context.Context, id string) (*model.UploadSession, error) {
+	session, err := GetSession(ctx, id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	if session.ExpiresAt <= time.Now().UnixMilli() {
+		return nil, nil
+	}
+
+	return session, nil
+}
+
+func (s *service) PutChunk(ctx context.Context, id string, offset int64, r io.Reader) (*model.UploadSession, error) {
+	session, err := s.GetSession(ctx, id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	if session.Offset != offset {
+		return nil, &OffsetError{Expected: session.Offset, Actual: offset}
+	}
+
+	if len(session.Chunks) >= s.maxChunks {
+		return nil, fmt.Errorf("%w, %d are allowed", ErrTooManyChunks, s.maxChunks)
+	}
+
+	// Keys are unique, so a chunk written by a concurrent request never overwrites an accepted one
+	key := chunkPrefix(id) + cutil.UUID()
+	left := session.Size - offset
+	counter := &countingWriter{}
+
+	err = artifact.Client.Put(ctx, artifact.TmpBucket, key, io.TeeReader(io.LimitReader(r, left+1), counter), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	removeChunk := func() {
+		if err := artifact.Client.Remove(context.Background(), artifact.TmpBucket, key); err != nil {
+			logger.L.Error("Failed to remove rejected chunk", zap.Error(err), zap.String("key", key))
+		}
+	}
+
+	if counter.n > left {
+		removeChunk()
+		return nil, ErrTooLarge
+	}
+
+	if counter.n == 0 {
+		removeChunk()
+		return session, nil
+	}
+
+	session, err = ModifySession(ctx, id, func(session *model.UploadSession) error {
+		now := time.Now()
+		if session.ExpiresAt <= now.UnixMilli() {
+			return errExpired
+		}
+
+		if session.Offset != offset {
+			return &OffsetError{Expected: session.Offset, Actual: offset}
+		}
+
+		if len(session.Chunks) >= s.maxChunks {
+			return fmt.Errorf("%w, %d are allowed", ErrTooManyChunks, s.maxChunks)
+		}
+
+		session.Chunks = append(session.Chunks, &model.UploadChunk{
+			Offset: offset,
+			Size:   counter.n,
+			Key:    key,
+		})
+		session.Offset += counter.n
+		session.ExpiresAt = now.Add(s.ttl).UnixMilli()
+
+		return nil
+	})
+
+	if err != nil || session == nil {
+		removeChunk()
+	}
+
+	if errors.Is(err, errExpired) {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+func (s *service) FinalizeSession(ctx context.Context, id string, req *model.FinalizeUploadSession) (*model.Upload, error) {
+	unlock, err := LockSession(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("upload session '%s' is being processed by another manager: %w", id, err)
+	}
+	defer unlock()
+
+	session, err := s.GetSession(ctx, id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	if session.Offset != session.Size {
+		return nil, fmt.Errorf("%w: %d of %d bytes are received", ErrIncomplete, session.Offset, session.Size)
+	}
+
+	hash := sha256.New()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(copyChunks(ctx, session.Chunks, pw))
+	}()
+
+	err = artifact.Client.Put(ctx, artifact.TmpBucket, id, io.TeeReader(pr, hash), session.Size, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if checksum != req.Checksum {
+		s.removeObject(id)
+		return nil, fmt.Errorf("%w: file checksum is %s", ErrChecksumMismatch, checksum)
+	}
+
+	now := time.Now()
+	upload := &model.Upload{
+		Id:        id,
+		Size:      session.Size,
+		Checksum:  checksum,
+		CreatedAt: now.UnixMilli(),
+		ExpiresAt: now.Add(s.ttl).UnixMilli(),
+	}
+
+	if err := CreateUpload(ctx, upload); err != nil {
+		s.removeObject(id)
+		return nil, err
+	}
+
+	if err := s.removeSession(ctx, session); err != nil {
+		logger.L.Error("Failed to remove finalized upload session", zap.Error(err), zap.String("id", id))
+	}
+
+	return upload, nil
+}
+
+// AbortSession removes the session and its chunks, false is returned if there is no such session.
+func (s *service) AbortSession(ctx context.Context, id string) (bool, error) {
+	unlock, err := LockSession(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("upload session '%s' is being processed by another manager: %w", id, err)
+	}
+	defer unlock()
+
+	session, err := GetSession(ctx, id)
+	if err != nil || session == nil {
+		return false, err
+	}
+
+	return true, s.removeSession(ctx, session)
+}
+
+func copyChunks(ctx context.Context, chunks []*model.UploadChunk, w io.Writer) error {
+	for _, chunk := range chunks {
+		r, err := artifact.Client.Get(ctx, artifact.TmpBucket, chunk.Key)
+		if err != nil {
+			return err
+		}
+
+		n, err := io.Copy(w, r)
+		r.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if n != chunk.Size {
+			return fmt.Errorf("chunk %s is %d bytes, %d are expected", chunk.Key, n, chunk.Size)
+		}
+	}
+
+	return nil
+}
+
+func (s *service) removeObject(key string) {
+	if err := artifact.Client.Remove(context.Background(), artifact.TmpBucket, key); err != nil {
+		logger.L.Error("Failed to remove upload object", zap.Error(err), zap.String("key", key))
+	}
+}
+
+// removeSession removes every object under the session prefix, not only accepted chunks,
+// to clean up chunks rejected by a crashed manager.
+func (s *service) removeSession(ctx context.Context, session *model.UploadSession) error {
+	keys := []string{}
+
+	err := artifact.Client.Walk(ctx, artifact.TmpBucket, chunkPrefix(session.Id), func(obj *artifact.Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := artifact.Client.Remove(ctx, artifact.TmpBucket, key); err != nil {
+			return err
+		}
+	}
+
+	return DelSession(ctx, session.Id)
+}
@@ -10,10 +10,16 @@ import (
 	"github.com/onpremless/opless/common/util"
 	"github.com/onpremless/opless/router/logger"
 	"github.com/onpremless/opless/router/service"
+	"github.com/onpremless/opless/router/store"
 	"go.uber.org/zap"
 )
 
 func main() {
+	if err := store.Init(); err != nil {
+		panic(err)
+	}
+	defer store.Client.Close()
+
 	svc, err := service.NewService(context.TODO())
 	if err != nil {
 		panic(err)
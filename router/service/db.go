@@ -2,32 +2,83 @@ package service
 
 import (
 	"context"
+	"time"
 
 	api "github.com/onpremless/go-client"
 	"github.com/onpremless/opless/common/db"
-	"github.com/onpremless/opless/router/redis"
+	"github.com/onpremless/opless/router/logger"
+	"github.com/onpremless/opless/router/store"
+	"go.uber.org/zap"
 )
 
+const resubscribeDelay = time.Second
+
 func GetEndpoints(ctx context.Context) ([]*api.Endpoint, error) {
-	return db.GetValues[api.Endpoint](ctx, "endpoint")(redis.Client)
+	return db.GetValues[api.Endpoint](ctx, "endpoint")(store.Client)
 }
 
 type NotificationHandler interface {
 	HandleDel(key string)
 	HandleSet(value *api.Endpoint)
+	// HandleReset replaces all endpoints, changes might have been missed before it
+	HandleReset(values []*api.Endpoint)
 }
 
-func SubEndpointChanges(ctx context.Context, handler NotificationHandler) {
-	notificationsC := db.Subscribe[api.Endpoint](ctx, "endpoint")(redis.Client)
+// SubEndpointChanges streams changes to the handler until ctx is done. The store closes the
+// stream if changes are missed, endpoints are listed again then.
+func SubEndpointChanges(ctx context.Context, handler NotificationHandler) error {
+	notificationsC, err := db.Subscribe[api.Endpoint](ctx, "endpoint")(store.Client)
+	if err != nil {
+		return err
+	}
 
 	go func() {
-		for notification := range notificationsC {
-			switch n := notification.(type) {
-			case *db.SetNotification[api.Endpoint]:
-				handler.HandleSet(n.Value)
-			case *db.DelNotification:
-				handler.HandleDel(n.Key)
+		for {
+			for notification := range notificationsC {
+				switch n := notification.(type) {
+				case *db.SetNotification[api.Endpoint]:
+					handler.HandleSet(n.Value)
+				case *db.DelNotification:
+					handler.HandleDel(n.Key)
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger.L.Warn("Endpoint changes stream is closed, resubscribing")
+			notificationsC = resubscribe(ctx, handler)
+			if notificationsC == nil {
+				return
 			}
 		}
 	}()
+
+	return nil
+}
+
+// resubscribe retries until endpoints are listed, it returns nil once ctx is done.
+func resubscribe(ctx context.Context, handler NotificationHandler) <-chan interface{} {
+	for {
+		// Subscribed before listing, so changes made in between aren't missed
+		notificationsC, err := db.Subscribe[api.Endpoint](ctx, "endpoint")(store.Client)
+		if err == nil {
+			endpoints, lerr := GetEndpoints(ctx)
+			if lerr == nil {
+				handler.HandleReset(endpoints)
+				return notificationsC
+			}
+
+			err = lerr
+		}
+
+		logger.L.Error("Failed to resubscribe to endpoint changes", zap.Error(err))
+
+		select {
+		case <-time.After(resubscribeDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
@@ -47,7 +47,10 @@ func (s *service) init(ctx context.Context) error {
 	cancelCtx, stop := context.WithCancel(context.Background())
 	s.stop = stop
 
-	SubEndpointChanges(cancelCtx, s)
+	if err := SubEndpointChanges(cancelCtx, s); err != nil {
+		stop()
+		return err
+	}
 
 	return nil
 }
@@ -70,11 +73,33 @@ func (s service) HandleSet(endpoint *api.Endpoint) {
 	s.router.Add(endpoint.Path, endpoint.Lambda)
 }
 
+func (s service) HandleReset(endpoints []*api.Endpoint) {
+	current := map[string]bool{}
+	for _, endpoint := range endpoints {
+		current[endpoint.Id] = true
+
+		// Routes of unchanged endpoints are kept, so they're served all along
+		prev := s.endpoints.Get(endpoint.Id, nil)
+		if prev != nil && prev.Path == endpoint.Path && prev.Lambda == endpoint.Lambda {
+			continue
+		}
+
+		s.HandleSet(endpoint)
+	}
+
+	for _, endpoint := range s.endpoints.Values() {
+		if !current[endpoint.Id] {
+			s.HandleDel(endpoint.Id)
+		}
+	}
+}
+
 func (s service) HandleDel(key string) {
 	endpoint := s.endpoints.Get(key, nil)
 	if endpoint == nil {
 		return
 	}
 
+	s.endpoints.Delete(key)
 	s.router.Remove(endpoint.Path)
 }
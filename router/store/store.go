@@ -0,0 +1,25 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/onpremless/opless/common/db"
+	"github.com/onpremless/opless/router/logger"
+)
+
+var Client db.Store
+
+func Init() error {
+	// The manager locks the bolt file and bolt events don't leave its process
+	if backend := db.Backend(); backend != db.BackendRedis {
+		return fmt.Errorf("store backend %s can't be shared with the manager, the router requires %s", backend, db.BackendRedis)
+	}
+
+	var err error
+	Client, err = db.Open(logger.L)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+
+	return nil
+}